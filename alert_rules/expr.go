@@ -0,0 +1,803 @@
+package alert_rules
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Limits keep rules cheap to evaluate on every ingested row. The language has
+// no loops, assignments or user functions, so evaluation time is bounded by
+// the size of the expression.
+const (
+	maxSourceLen = 2048
+	maxNodes     = 512
+	maxDepth     = 64
+)
+
+// Env holds the variables a rule can read, e.g. payload, value, is_on, target.
+type Env map[string]interface{}
+
+// variables are the names a rule can read, see NewEnv; any other name is a
+// syntax error rather than a silent null.
+var variables = map[string]bool{"payload": true, "value": true, "is_on": true, "target": true}
+
+// Program is a compiled rule, safe for concurrent use.
+type Program struct {
+	src  string
+	root node
+}
+
+// String returns the rule source.
+func (p *Program) String() string {
+	return p.src
+}
+
+// Compile parses a rule such as
+//
+//	payload.precip_mm > 10 && payload.temp_c < 2
+//	target.country in ["Canada", "Norway"] and not has(payload.cleared)
+//
+// and reports syntax errors with their position.
+func Compile(src string) (*Program, error) {
+	if len(src) > maxSourceLen {
+		return nil, fmt.Errorf("rule is longer than %d characters", maxSourceLen)
+	}
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, syntaxError(t.pos, "unexpected %s", t)
+	}
+	return &Program{src: src, root: root}, nil
+}
+
+// Eval runs the rule against env. A rule that does not produce a boolean,
+// or fails on mismatched types, returns an error.
+func (p *Program) Eval(env Env) (bool, error) {
+	v, err := p.root.eval(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("rule %q evaluates to %s, not a boolean", p.src, typeName(v))
+	}
+	return b, nil
+}
+
+func syntaxError(pos int, format string, args ...interface{}) error {
+	return fmt.Errorf("syntax error at position %d: %s", pos+1, fmt.Sprintf(format, args...))
+}
+
+// =============
+// Lexer
+// =============
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+)
+
+type token struct {
+	kind tokKind
+	text string
+	pos  int
+	num  float64
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of rule"
+	case tokString:
+		return strconv.Quote(t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "%", "(", ")", "[", "]", ".", ","}
+
+func lex(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.' || src[i] == 'e' || src[i] == 'E' ||
+				(src[i] == '-' || src[i] == '+') && (src[i-1] == 'e' || src[i-1] == 'E')) {
+				i++
+			}
+			n, err := strconv.ParseFloat(src[start:i], 64)
+			if err != nil {
+				return nil, syntaxError(start, "invalid number %q", src[start:i])
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: src[start:i], pos: start, num: n})
+		case c == '"' || c == '\'':
+			start := i
+			var sb strings.Builder
+			i++
+			for {
+				if i >= len(src) {
+					return nil, syntaxError(start, "unterminated string")
+				}
+				if src[i] == c {
+					i++
+					break
+				}
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+					switch src[i] {
+					case 'n':
+						sb.WriteByte('\n')
+					case 't':
+						sb.WriteByte('\t')
+					default:
+						sb.WriteByte(src[i])
+					}
+					i++
+					continue
+				}
+				sb.WriteByte(src[i])
+				i++
+			}
+			tokens = append(tokens, token{kind: tokString, text: sb.String(), pos: start})
+		case c == '_' || unicode.IsLetter(rune(c)):
+			start := i
+			for i < len(src) && (src[i] == '_' || unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: src[start:i], pos: start})
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(src[i:], op) {
+					tokens = append(tokens, token{kind: tokOp, text: op, pos: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, syntaxError(i, "unexpected character %q", c)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(src)}), nil
+}
+
+// =============
+// Parser
+// =============
+
+type parser struct {
+	tokens []token
+	pos    int
+	nodes  int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(op string) error {
+	if t := p.next(); t.kind != tokOp || t.text != op {
+		return syntaxError(t.pos, "expected %q, got %s", op, t)
+	}
+	return nil
+}
+
+func (p *parser) newNode(pos int) error {
+	p.nodes++
+	if p.nodes > maxNodes {
+		return syntaxError(pos, "rule is too complex (more than %d nodes)", maxNodes)
+	}
+	return nil
+}
+
+// binary operator precedence, higher binds tighter; keywords are aliases
+var precedence = map[string]int{
+	"||": 1, "or": 1,
+	"&&": 2, "and": 2,
+	"==": 4, "!=": 4, "<": 4, "<=": 4, ">": 4, ">=": 4, "in": 4,
+	"+": 5, "-": 5,
+	"*": 6, "/": 6, "%": 6,
+}
+
+var aliases = map[string]string{"or": "||", "and": "&&", "not": "!"}
+
+func binaryOp(t token) (string, int, bool) {
+	if t.kind != tokOp && t.kind != tokIdent {
+		return "", 0, false
+	}
+	prec, ok := precedence[t.text]
+	if !ok {
+		return "", 0, false
+	}
+	op := t.text
+	if alias, ok := aliases[op]; ok {
+		op = alias
+	}
+	return op, prec, true
+}
+
+func (p *parser) parseExpr(depth int) (node, error) {
+	return p.parseBinary(1, depth)
+}
+
+func (p *parser) parseBinary(minPrec, depth int) (node, error) {
+	if depth > maxDepth {
+		return nil, syntaxError(p.peek().pos, "rule is nested too deeply")
+	}
+	left, err := p.parseUnary(depth + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		op, prec, ok := binaryOp(t)
+		if !ok || prec < minPrec {
+			return left, nil
+		}
+		p.next()
+		if err := p.newNode(t.pos); err != nil {
+			return nil, err
+		}
+		right, err := p.parseBinary(prec+1, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *parser) parseUnary(depth int) (node, error) {
+	if depth > maxDepth {
+		return nil, syntaxError(p.peek().pos, "rule is nested too deeply")
+	}
+	t := p.peek()
+	if t.kind == tokOp && (t.text == "!" || t.text == "-") || t.kind == tokIdent && t.text == "not" {
+		p.next()
+		if err := p.newNode(t.pos); err != nil {
+			return nil, err
+		}
+		op := t.text
+		if alias, ok := aliases[op]; ok {
+			op = alias
+		}
+		var operand node
+		var err error
+		if op == "!" {
+			// `not a > b` negates the comparison, like `!(a > b)`
+			operand, err = p.parseBinary(precedence["=="], depth+1)
+		} else {
+			operand, err = p.parseUnary(depth + 1)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: op, operand: operand}, nil
+	}
+	return p.parsePostfix(depth + 1)
+}
+
+func (p *parser) parsePostfix(depth int) (node, error) {
+	n, err := p.parsePrimary(depth)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokOp || t.text != "." && t.text != "[" {
+			return n, nil
+		}
+		p.next()
+		if err := p.newNode(t.pos); err != nil {
+			return nil, err
+		}
+		if t.text == "." {
+			name := p.next()
+			if name.kind != tokIdent {
+				return nil, syntaxError(name.pos, "expected field name after '.', got %s", name)
+			}
+			n = &fieldNode{object: n, key: &literalNode{value: name.text}}
+			continue
+		}
+		key, err := p.parseExpr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		n = &fieldNode{object: n, key: key}
+	}
+}
+
+func (p *parser) parsePrimary(depth int) (node, error) {
+	t := p.next()
+	if err := p.newNode(t.pos); err != nil {
+		return nil, err
+	}
+	switch t.kind {
+	case tokNumber:
+		return &literalNode{value: t.num}, nil
+	case tokString:
+		return &literalNode{value: t.text}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		case "null":
+			return &literalNode{value: nil}, nil
+		}
+		if _, reserved := precedence[t.text]; reserved {
+			return nil, syntaxError(t.pos, "unexpected %s", t)
+		}
+		if next := p.peek(); next.kind == tokOp && next.text == "(" {
+			return p.parseCall(t, depth)
+		}
+		if !variables[t.text] {
+			return nil, syntaxError(t.pos, "unknown variable %q", t.text)
+		}
+		return &varNode{name: t.text}, nil
+	case tokOp:
+		switch t.text {
+		case "(":
+			n, err := p.parseExpr(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(")")
+		case "[":
+			list := &listNode{}
+			if next := p.peek(); next.kind == tokOp && next.text == "]" {
+				p.next()
+				return list, nil
+			}
+			for {
+				item, err := p.parseExpr(depth + 1)
+				if err != nil {
+					return nil, err
+				}
+				list.items = append(list.items, item)
+				sep := p.next()
+				if sep.kind == tokOp && sep.text == "]" {
+					return list, nil
+				}
+				if sep.kind != tokOp || sep.text != "," {
+					return nil, syntaxError(sep.pos, "expected ',' or ']', got %s", sep)
+				}
+			}
+		}
+	}
+	return nil, syntaxError(t.pos, "unexpected %s", t)
+}
+
+func (p *parser) parseCall(name token, depth int) (node, error) {
+	fn, ok := functions[name.text]
+	if !ok {
+		return nil, syntaxError(name.pos, "unknown function %q", name.text)
+	}
+	p.next() // (
+	call := &callNode{name: name.text, fn: fn}
+	if next := p.peek(); next.kind == tokOp && next.text == ")" {
+		p.next()
+	} else {
+		for {
+			arg, err := p.parseExpr(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			sep := p.next()
+			if sep.kind == tokOp && sep.text == ")" {
+				break
+			}
+			if sep.kind != tokOp || sep.text != "," {
+				return nil, syntaxError(sep.pos, "expected ',' or ')', got %s", sep)
+			}
+		}
+	}
+	if len(call.args) != fn.arity {
+		return nil, syntaxError(name.pos, "%s() takes %d argument(s), got %d", name.text, fn.arity, len(call.args))
+	}
+	return call, nil
+}
+
+// =============
+// Evaluation
+// =============
+
+type node interface {
+	eval(env Env) (interface{}, error)
+}
+
+type literalNode struct{ value interface{} }
+
+func (n *literalNode) eval(Env) (interface{}, error) { return n.value, nil }
+
+// varNode reads a variable, unknown variables are null
+type varNode struct{ name string }
+
+func (n *varNode) eval(env Env) (interface{}, error) { return normalize(env[n.name]), nil }
+
+// fieldNode reads a map key or list index, missing fields are null
+type fieldNode struct {
+	object node
+	key    node
+}
+
+func (n *fieldNode) eval(env Env) (interface{}, error) {
+	obj, err := n.object.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	key, err := n.key.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch o := obj.(type) {
+	case map[string]interface{}:
+		k, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("map key must be a string, got %s", typeName(key))
+		}
+		return normalize(o[k]), nil
+	case []interface{}:
+		i, ok := key.(float64)
+		if !ok || i != math.Trunc(i) {
+			return nil, fmt.Errorf("list index must be an integer, got %s", typeName(key))
+		}
+		if i < 0 || int(i) >= len(o) {
+			return nil, nil
+		}
+		return normalize(o[int(i)]), nil
+	case nil:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("cannot read field of %s", typeName(obj))
+}
+
+type listNode struct{ items []node }
+
+func (n *listNode) eval(env Env) (interface{}, error) {
+	list := make([]interface{}, 0, len(n.items))
+	for _, item := range n.items {
+		v, err := item.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+type unaryNode struct {
+	op      string
+	operand node
+}
+
+func (n *unaryNode) eval(env Env) (interface{}, error) {
+	v, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "!":
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("cannot negate %s", typeName(v))
+		}
+		return !b, nil
+	default: // "-"
+		f, ok := v.(float64)
+		if !ok {
+			return nil, fmt.Errorf("cannot negate %s", typeName(v))
+		}
+		return -f, nil
+	}
+}
+
+type binaryNode struct {
+	op          string
+	left, right node
+}
+
+func (n *binaryNode) eval(env Env) (interface{}, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// logical operators short-circuit
+	if n.op == "&&" || n.op == "||" {
+		l, ok := left.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s needs booleans, got %s", n.op, typeName(left))
+		}
+		if n.op == "&&" && !l || n.op == "||" && l {
+			return l, nil
+		}
+		right, err := n.right.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		r, ok := right.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s needs booleans, got %s", n.op, typeName(right))
+		}
+		return r, nil
+	}
+
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "<", "<=", ">", ">=":
+		// comparisons with a missing (null) field are false, so rules over
+		// optional payload fields do not fail
+		if left == nil || right == nil {
+			return false, nil
+		}
+		c, err := compare(left, right)
+		if err != nil {
+			return nil, err
+		}
+		switch n.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	case "in":
+		switch r := right.(type) {
+		case []interface{}:
+			for _, item := range r {
+				if equal(left, item) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case map[string]interface{}:
+			k, ok := left.(string)
+			_, found := r[k]
+			return ok && found, nil
+		case string:
+			l, ok := left.(string)
+			return ok && strings.Contains(r, l), nil
+		case nil:
+			return false, nil
+		}
+		return nil, fmt.Errorf("cannot look up in %s", typeName(right))
+	case "+":
+		if l, ok := left.(string); ok {
+			if r, ok := right.(string); ok {
+				return l + r, nil
+			}
+		}
+	}
+
+	l, lok := left.(float64)
+	r, rok := right.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("%s needs numbers, got %s and %s", n.op, typeName(left), typeName(right))
+	}
+	switch n.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return l / r, nil
+	default: // "%"
+		if r == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return math.Mod(l, r), nil
+	}
+}
+
+type function struct {
+	arity int
+	call  func(args []interface{}) (interface{}, error)
+}
+
+type callNode struct {
+	name string
+	fn   function
+	args []node
+}
+
+func (n *callNode) eval(env Env) (interface{}, error) {
+	args := make([]interface{}, 0, len(n.args))
+	for _, arg := range n.args {
+		v, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+	v, err := n.fn.call(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s(): %w", n.name, err)
+	}
+	return v, nil
+}
+
+func stringArgs(args []interface{}) ([]string, error) {
+	strs := make([]string, 0, len(args))
+	for _, a := range args {
+		s, ok := a.(string)
+		if !ok {
+			return nil, fmt.Errorf("needs strings, got %s", typeName(a))
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
+
+func stringFunction(arity int, f func(s []string) interface{}) function {
+	return function{arity: arity, call: func(args []interface{}) (interface{}, error) {
+		s, err := stringArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		return f(s), nil
+	}}
+}
+
+// functions is the whole standard library, rules cannot define their own
+var functions = map[string]function{
+	"has": {arity: 1, call: func(args []interface{}) (interface{}, error) {
+		return args[0] != nil, nil
+	}},
+	"size": {arity: 1, call: func(args []interface{}) (interface{}, error) {
+		switch v := args[0].(type) {
+		case string:
+			return float64(len(v)), nil
+		case []interface{}:
+			return float64(len(v)), nil
+		case map[string]interface{}:
+			return float64(len(v)), nil
+		case nil:
+			return float64(0), nil
+		}
+		return nil, fmt.Errorf("needs a string, list or map, got %s", typeName(args[0]))
+	}},
+	"abs": {arity: 1, call: func(args []interface{}) (interface{}, error) {
+		f, ok := args[0].(float64)
+		if !ok {
+			return nil, fmt.Errorf("needs a number, got %s", typeName(args[0]))
+		}
+		return math.Abs(f), nil
+	}},
+	"lower":      stringFunction(1, func(s []string) interface{} { return strings.ToLower(s[0]) }),
+	"upper":      stringFunction(1, func(s []string) interface{} { return strings.ToUpper(s[0]) }),
+	"contains":   stringFunction(2, func(s []string) interface{} { return strings.Contains(s[0], s[1]) }),
+	"startsWith": stringFunction(2, func(s []string) interface{} { return strings.HasPrefix(s[0], s[1]) }),
+	"endsWith":   stringFunction(2, func(s []string) interface{} { return strings.HasSuffix(s[0], s[1]) }),
+}
+
+// normalize maps Go values from payloads and target attributes onto the
+// value types of the language: float64, string, bool, nil, lists and maps.
+func normalize(v interface{}) interface{} {
+	switch x := v.(type) {
+	case int:
+		return float64(x)
+	case int32:
+		return float64(x)
+	case int64:
+		return float64(x)
+	case float32:
+		return float64(x)
+	case map[string]string:
+		m := make(map[string]interface{}, len(x))
+		for k, s := range x {
+			m[k] = s
+		}
+		return m
+	}
+	return v
+}
+
+func equal(a, b interface{}) bool {
+	switch x := a.(type) {
+	case nil:
+		return b == nil
+	case float64, string, bool:
+		return a == b
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equal(x[i], normalize(y[i])) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func compare(a, b interface{}) (int, error) {
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			switch {
+			case x < y:
+				return -1, nil
+			case x > y:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), nil
+		}
+	}
+	return 0, fmt.Errorf("cannot compare %s with %s", typeName(a), typeName(b))
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "map"
+	}
+	return fmt.Sprintf("%T", v)
+}
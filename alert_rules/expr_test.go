@@ -0,0 +1,163 @@
+package alert_rules
+
+import (
+	"strings"
+	"testing"
+)
+
+func testEnv() Env {
+	return NewEnv(`{"precip_mm": 12, "temp_c": -3, "tags": ["ice", "wind"], "gate": "B12"}`,
+		42.5, true, map[string]interface{}{"country": "Canada", "status": "scheduled"})
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		rule string
+		want bool
+	}{
+		{`1 + 2 * 3 == 7`, true},
+		{`(1 + 2) * 3 == 9`, true},
+		{`10 - 4 - 3 == 3`, true}, // left associative
+		{`12 / 3 / 2 == 2`, true},
+		{`7 % 4 + 1 == 4`, true},
+		{`-2 * 3 == -6`, true},
+		{`true || false && false`, true}, // && binds tighter than ||
+		{`(true || false) && false`, false},
+		{`false and true or true`, true},
+		{`not false && false`, false},
+		{`not 1 > 2`, true}, // not negates the comparison
+		{`!(value > 40) || is_on`, true},
+		{`value > 40 && payload.precip_mm > 10`, true},
+		{`payload.precip_mm > 10 && payload.temp_c < 2`, true},
+		{`target.country in ["Canada", "Norway"] and not has(payload.cleared)`, true},
+		{`"ice" in payload.tags && size(payload.tags) == 2`, true},
+		{`payload["gate"] == "B12" && startsWith(lower(payload.gate), "b")`, true},
+		{`1 + 1 in [2, 3]`, true}, // arithmetic before in
+		{`abs(payload.temp_c) - 3 == 0`, true},
+		{`payload.missing > 1 || payload.missing <= 1`, false}, // comparisons with null are false
+		{`payload.missing == null`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			p, err := Compile(tt.rule)
+			if err != nil {
+				t.Fatalf("Compile: %v", err)
+			}
+			got, err := p.Eval(testEnv())
+			if err != nil {
+				t.Fatalf("Eval: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalShortCircuit(t *testing.T) {
+	// the right operand would fail if it were evaluated
+	tests := []struct {
+		rule string
+		want bool
+	}{
+		{`false && 1 / 0 > 1`, false},
+		{`true || 1 / 0 > 1`, true},
+		{`false and payload.missing.field > 1`, false},
+		{`is_on or "a" < 1`, true},
+		{`has(payload.cleared) && payload.cleared.at > 0`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			p, err := Compile(tt.rule)
+			if err != nil {
+				t.Fatalf("Compile: %v", err)
+			}
+			got, err := p.Eval(testEnv())
+			if err != nil {
+				t.Fatalf("Eval: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalTypeErrors(t *testing.T) {
+	tests := []struct {
+		rule string
+		err  string
+	}{
+		{`1 && true`, "&& needs booleans, got number"},
+		{`false || "yes"`, "|| needs booleans, got string"},
+		{`"a" < 1`, "cannot compare string with number"},
+		{`payload.tags < 1`, "cannot compare list with number"},
+		{`"a" + 1 == 2`, "+ needs numbers, got string and number"},
+		{`-"a" == 1`, "cannot negate string"},
+		{`!1`, "cannot negate number"},
+		{`1 / 0 > 1`, "division by zero"},
+		{`1 in 2`, "cannot look up in number"},
+		{`abs("a") > 1`, "abs(): needs a number, got string"},
+		{`contains(1, "a")`, "contains(): needs strings, got number"},
+		{`value.x == 1`, "cannot read field of number"},
+		{`value + 1`, "evaluates to number, not a boolean"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			p, err := Compile(tt.rule)
+			if err != nil {
+				t.Fatalf("Compile: %v", err)
+			}
+			_, err = p.Eval(testEnv())
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		rule string
+		err  string
+	}{
+		{`paylod.precip_mm > 10`, `position 1: unknown variable "paylod"`},
+		{`value > threshold`, `position 9: unknown variable "threshold"`},
+		{`payload.x > 1 && flight.status == "x"`, `unknown variable "flight"`},
+		{`matches(payload.gate, "B")`, `unknown function "matches"`},
+		{`lower("a", "b") == "a"`, "lower() takes 1 argument(s), got 2"},
+		{`value >`, "syntax error at position"},
+		{`(value > 1`, "syntax error at position"},
+		{`[1, 2`, "expected ',' or ']'"},
+		{`value > 1 value`, "unexpected"},
+		{`payload. > 1`, "expected field name after '.'"},
+		{`and`, "unexpected"},
+		{strings.Repeat("(", maxDepth+1) + "true" + strings.Repeat(")", maxDepth+1), "nested too deeply"},
+		{strings.Repeat("x", maxSourceLen+1), "longer than"},
+	}
+	for _, tt := range tests {
+		name := tt.rule
+		if len(name) > 40 {
+			name = name[:40]
+		}
+		t.Run(name, func(t *testing.T) {
+			_, err := Compile(tt.rule)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRecompile(t *testing.T) {
+	p, err := recompile(nil, `is_on`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q, _ := recompile(p, `is_on`); q != p {
+		t.Error("unchanged rule was recompiled")
+	}
+	if q, _ := recompile(p, `!is_on`); q == p || q.String() != `!is_on` {
+		t.Errorf("changed rule was not recompiled, got %q", q)
+	}
+}
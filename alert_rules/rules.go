@@ -0,0 +1,491 @@
+package alert_rules
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/okharch/yal/ingest_alerts"
+	"github.com/okharch/yal/model"
+)
+
+const refreshInterval = time.Minute
+
+// NewEnv builds the variables of a rule evaluated on one alert:
+//
+//	payload  the alert payload (JSON object), e.g. payload.precip_mm
+//	value    the measured value, null when not reported
+//	is_on    the state decided by the producer (or previous evaluator)
+//	target   the target attributes, see Targets
+func NewEnv(payload interface{}, value interface{}, isOn bool, target map[string]interface{}) Env {
+	var fields interface{}
+	switch p := payload.(type) {
+	case string:
+		if err := json.Unmarshal([]byte(p), &fields); err != nil {
+			fields = p
+		}
+	default:
+		fields = p
+	}
+	return Env{
+		"payload": fields,
+		"value":   value,
+		"is_on":   isOn,
+		"target":  target,
+	}
+}
+
+// Targets caches the attributes rules can read from target, e.g.
+// target.country of an airport or target.airline and target.status of a
+// flight. Targets of other registered types (see target_types) have
+// target.name. Every target also has target.id and target.type.
+type Targets struct {
+	airports map[int]map[string]interface{}
+	flights  map[int]map[string]interface{}
+	entities map[string]string                         // entity by target type
+	others   map[string]map[int]map[string]interface{} // by entity
+	lock     sync.RWMutex
+}
+
+// Attributes returns the attributes of a target, nil fields when unknown.
+func (t *Targets) Attributes(target model.Target) map[string]interface{} {
+	t.lock.RLock()
+	var attrs map[string]interface{}
+	switch entity := t.entities[target.Type]; entity {
+	case "flight":
+		attrs = t.flights[target.ID]
+	case "airport":
+		attrs = t.airports[target.ID]
+	default:
+		attrs = t.others[entity][target.ID]
+	}
+	t.lock.RUnlock()
+
+	m := make(map[string]interface{}, len(attrs)+2)
+	for k, v := range attrs {
+		m[k] = v
+	}
+	m["id"] = float64(target.ID)
+	m["type"] = target.Type
+	return m
+}
+
+// LoadTargets reads the target attributes rules read, see Load.
+func LoadTargets(ctx context.Context, db *pgxpool.Pool) (*Targets, error) {
+	t := &Targets{}
+	if err := t.Load(ctx, db); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// KeepFresh reloads the target attributes (e.g. flight status) every minute
+// until ctx is done.
+func (t *Targets) KeepFresh(ctx context.Context, db *pgxpool.Pool) {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := t.Load(ctx, db); err != nil {
+				log.Printf("failed to reload rule targets: %v", err)
+			}
+		}
+	}
+}
+
+// Load (re)reads airport and flight attributes, and the names of targets of
+// the other registered types.
+func (t *Targets) Load(ctx context.Context, db *pgxpool.Pool) error {
+	entities, others, err := loadOtherTargets(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	airports := make(map[int]map[string]interface{})
+	rows, err := db.Query(ctx, `
+		SELECT id, COALESCE(name, ''), COALESCE(city, ''), COALESCE(country, ''), COALESCE(iata, ''), COALESCE(icao, '')
+		FROM airports`)
+	if err != nil {
+		return fmt.Errorf("failed to load airports: %w", err)
+	}
+	for rows.Next() {
+		var id int
+		var name, city, country, iata, icao string
+		if err := rows.Scan(&id, &name, &city, &country, &iata, &icao); err != nil {
+			rows.Close()
+			return err
+		}
+		airports[id] = map[string]interface{}{
+			"name": name, "city": city, "country": country, "iata": iata, "icao": icao,
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	flights := make(map[int]map[string]interface{})
+	rows, err = db.Query(ctx, `
+		SELECT f.id, f.flight_number, f.status::text, COALESCE(al.name, ''), COALESCE(al.iata, ''), COALESCE(al.country, ''),
+		       f.source_airport_id, f.destination_airport_id
+		FROM flights f
+		LEFT JOIN airlines al ON al.id = f.airline_id`)
+	if err != nil {
+		return fmt.Errorf("failed to load flights: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, source, destination int
+		var number, status, airline, airlineIATA, airlineCountry string
+		if err := rows.Scan(&id, &number, &status, &airline, &airlineIATA, &airlineCountry, &source, &destination); err != nil {
+			return err
+		}
+		flights[id] = map[string]interface{}{
+			"flight_number":       number,
+			"status":              status,
+			"airline":             airline,
+			"airline_iata":        airlineIATA,
+			"airline_country":     airlineCountry,
+			"source_country":      airports[source]["country"],
+			"destination_country": airports[destination]["country"],
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	t.airports, t.flights = airports, flights
+	t.entities, t.others = entities, others
+	t.lock.Unlock()
+	return nil
+}
+
+// loadOtherTargets reads the target registry and the names (label_format
+// over label_columns) of targets that are neither airports nor flights.
+func loadOtherTargets(ctx context.Context, db *pgxpool.Pool) (map[string]string, map[string]map[int]map[string]interface{}, error) {
+	type source struct {
+		entity, table, format string
+		columns               []string
+	}
+	rows, err := db.Query(ctx, `SELECT name, entity, source_table, label_format, label_columns FROM target_types`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load target types: %w", err)
+	}
+	entities := make(map[string]string)
+	sources := make(map[string]source)
+	for rows.Next() {
+		var name string
+		var src source
+		if err := rows.Scan(&name, &src.entity, &src.table, &src.format, &src.columns); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		entities[name] = src.entity
+		if src.entity != "airport" && src.entity != "flight" {
+			sources[src.entity] = src
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	others := make(map[string]map[int]map[string]interface{}, len(sources))
+	for entity, src := range sources {
+		columns := make([]string, len(src.columns))
+		for i, c := range src.columns {
+			columns[i] = pgx.Identifier{c}.Sanitize() + "::text"
+		}
+		rows, err := db.Query(ctx, fmt.Sprintf(`SELECT id, COALESCE(format($1, VARIADIC ARRAY[%s]), '') FROM %s`,
+			strings.Join(columns, ", "), pgx.Identifier{src.table}.Sanitize()), src.format)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load %s targets: %w", entity, err)
+		}
+		names := make(map[int]map[string]interface{})
+		for rows.Next() {
+			var id int
+			var name string
+			if err := rows.Scan(&id, &name); err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+			names[id] = map[string]interface{}{"name": name}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, nil, err
+		}
+		others[entity] = names
+	}
+	return entities, others, nil
+}
+
+// recompile returns the program of a rule, reusing the one compiled before
+// unless its source changed.
+func recompile(before *Program, src string) (*Program, error) {
+	if before != nil && before.src == src {
+		return before, nil
+	}
+	return Compile(src)
+}
+
+// ConditionEvaluator decides is_on of conditions with a rule
+// (conditions.rule) at ingestion. The rule replaces the producer's decision,
+// which it can still read as is_on, e.g. `is_on && payload.temp_c < 2`.
+type ConditionEvaluator struct {
+	targets *Targets
+	rules   map[int]conditionRule // by condition id
+	lock    sync.RWMutex
+}
+
+type conditionRule struct {
+	program    *Program
+	targetType string // rows do not carry it, it is the template's
+}
+
+// LoadConditionEvaluator loads condition rules and target attributes and
+// registers the evaluator with the ingestion pipeline. Load it after the
+// baseline evaluator, so rules of baseline conditions see the score as value.
+func LoadConditionEvaluator(ctx context.Context, db *pgxpool.Pool) (*ConditionEvaluator, error) {
+	targets, err := LoadTargets(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	e := &ConditionEvaluator{targets: targets}
+	if err := e.loadRules(ctx, db); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *ConditionEvaluator) loadRules(ctx context.Context, db *pgxpool.Pool) error {
+	rows, err := db.Query(ctx, `
+		SELECT c.id, c.rule, ct.target_type::text
+		FROM conditions c
+		JOIN condition_templates ct ON ct.id = c.template_id
+		WHERE c.rule IS NOT NULL`)
+	if err != nil {
+		return fmt.Errorf("failed to load condition rules: %w", err)
+	}
+	defer rows.Close()
+	// rules are recompiled when changed, and dropped with their condition
+	e.lock.RLock()
+	before := e.rules
+	e.lock.RUnlock()
+	rules := make(map[int]conditionRule)
+	for rows.Next() {
+		var id int
+		var src, targetType string
+		if err := rows.Scan(&id, &src, &targetType); err != nil {
+			return err
+		}
+		p, err := recompile(before[id].program, src)
+		if err != nil {
+			// only possible when the rule was not set through SetConditionRule
+			log.Printf("ignoring invalid rule of condition %d: %v", id, err)
+			continue
+		}
+		rules[id] = conditionRule{program: p, targetType: targetType}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	e.rules = rules
+	e.lock.Unlock()
+	for id := range rules {
+		ingest_alerts.RegisterEvaluator(id, e)
+	}
+	return nil
+}
+
+// KeepFresh reloads condition rules and target attributes (e.g. flight
+// status) every minute until ctx is done.
+func (e *ConditionEvaluator) KeepFresh(ctx context.Context, db *pgxpool.Pool) {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.targets.Load(ctx, db); err != nil {
+				log.Printf("failed to reload rule targets: %v", err)
+			}
+			if err := e.loadRules(ctx, db); err != nil {
+				log.Printf("failed to reload condition rules: %v", err)
+			}
+		}
+	}
+}
+
+// Targets returns the target attributes the evaluator reads.
+func (e *ConditionEvaluator) Targets() *Targets {
+	return e.targets
+}
+
+// Evaluate implements ingest_alerts.Evaluator.
+func (e *ConditionEvaluator) Evaluate(row []interface{}) {
+	conditionID, _ := row[ingest_alerts.ColConditionID].(int)
+	e.lock.RLock()
+	r, ok := e.rules[conditionID]
+	e.lock.RUnlock()
+	if !ok {
+		return
+	}
+	targetID, _ := row[ingest_alerts.ColTargetID].(int)
+	isOn, _ := row[ingest_alerts.ColIsOn].(bool)
+	target := e.targets.Attributes(model.Target{ID: targetID, Type: r.targetType})
+	on, err := r.program.Eval(NewEnv(row[ingest_alerts.ColPayload], row[ingest_alerts.ColValue], isOn, target))
+	if err != nil {
+		log.Printf("rule of condition %d failed on target %d: %v", conditionID, targetID, err)
+		return
+	}
+	row[ingest_alerts.ColIsOn] = on
+}
+
+// SubscriptionRules applies user subscription condition rules
+// (user_subscription_conditions.rule) at delivery: an alert that is on is
+// delivered as off to users whose rule does not match it.
+type SubscriptionRules struct {
+	targets *Targets
+	rules   map[int]*Program // by user subscription condition id
+	lock    sync.RWMutex
+}
+
+// NewSubscriptionRules returns rules evaluated against targets.
+func NewSubscriptionRules(targets *Targets) *SubscriptionRules {
+	return &SubscriptionRules{targets: targets, rules: make(map[int]*Program)}
+}
+
+// Refresh reloads the rules, recompiling only changed ones.
+func (r *SubscriptionRules) Refresh(ctx context.Context, db *pgxpool.Pool) error {
+	rows, err := db.Query(ctx, `SELECT id, rule FROM user_subscription_conditions WHERE rule IS NOT NULL`)
+	if err != nil {
+		return fmt.Errorf("failed to load user subscription condition rules: %w", err)
+	}
+	defer rows.Close()
+	rules := make(map[int]*Program)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for rows.Next() {
+		var id int
+		var src string
+		if err := rows.Scan(&id, &src); err != nil {
+			return err
+		}
+		p, err := recompile(r.rules[id], src)
+		if err != nil {
+			log.Printf("ignoring invalid rule of user subscription condition %d: %v", id, err)
+			continue
+		}
+		rules[id] = p
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	r.rules = rules
+	return nil
+}
+
+// Apply evaluates the rules on alerts as returned by get_alerts_json and
+// turns off the alerts their user's rule does not match. Incidents (see
+// get_incidents_json) have their alerts evaluated.
+func (r *SubscriptionRules) Apply(alertsJSON string) (string, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if len(r.rules) == 0 {
+		return alertsJSON, nil
+	}
+
+	var alerts []map[string]interface{}
+	if err := json.Unmarshal([]byte(alertsJSON), &alerts); err != nil {
+		return "", fmt.Errorf("failed to parse alerts: %w", err)
+	}
+	if !r.apply(alerts) {
+		return alertsJSON, nil
+	}
+	b, err := json.Marshal(alerts)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (r *SubscriptionRules) apply(alerts []map[string]interface{}) bool {
+	changed := false
+	for _, a := range alerts {
+		if members, ok := a["alerts"].([]interface{}); ok {
+			incidentAlerts := make([]map[string]interface{}, 0, len(members))
+			for _, m := range members {
+				if alert, ok := m.(map[string]interface{}); ok {
+					incidentAlerts = append(incidentAlerts, alert)
+				}
+			}
+			if r.apply(incidentAlerts) {
+				changed = true
+			}
+			continue
+		}
+		uscID, _ := a["user_subscription_condition_id"].(float64)
+		p, ok := r.rules[int(uscID)]
+		isOn, _ := a["is_on"].(bool)
+		if !ok || !isOn {
+			continue
+		}
+		targetID, _ := a["target_id"].(float64)
+		targetType, _ := a["target_type"].(string)
+		target := r.targets.Attributes(model.Target{ID: int(targetID), Type: targetType})
+		on, err := p.Eval(NewEnv(a["payload"], a["value"], isOn, target))
+		if err != nil {
+			log.Printf("rule of user subscription condition %d failed on alert %v: %v", int(uscID), a["alert_id"], err)
+			on = false
+		}
+		if !on {
+			a["is_on"] = false
+			changed = true
+		}
+	}
+	return changed
+}
+
+// SetConditionRule validates and stores the rule of a condition, an empty
+// rule removes it. Syntax errors are returned and nothing is stored.
+func SetConditionRule(ctx context.Context, db *pgxpool.Pool, conditionID int, src string) error {
+	return setRule(ctx, db, `UPDATE conditions SET rule = $2 WHERE id = $1`, conditionID, src)
+}
+
+// SetSubscriptionConditionRule validates and stores the rule of a user
+// subscription condition, an empty rule removes it.
+func SetSubscriptionConditionRule(ctx context.Context, db *pgxpool.Pool, uscID int, src string) error {
+	return setRule(ctx, db, `UPDATE user_subscription_conditions SET rule = $2 WHERE id = $1`, uscID, src)
+}
+
+func setRule(ctx context.Context, db *pgxpool.Pool, sql string, id int, src string) error {
+	var rule *string
+	if src != "" {
+		if _, err := Compile(src); err != nil {
+			return err
+		}
+		rule = &src
+	}
+	tag, err := db.Exec(ctx, sql, id, rule)
+	if err != nil {
+		return fmt.Errorf("failed to store rule: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("no row with id %d", id)
+	}
+	return nil
+}
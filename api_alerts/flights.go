@@ -0,0 +1,102 @@
+package api_alerts
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/okharch/yal/subscription_alerts"
+)
+
+// FlightSubscription is a traveller following one flight, see
+// subscription_alerts.FlightSubscription.
+type FlightSubscription struct {
+	SubscriptionID     int       `json:"subscription_id"`
+	UserSubscriptionID int       `json:"user_subscription_id"`
+	FlightID           int       `json:"flight_id"`
+	FlightNumber       string    `json:"flight_number"`
+	DepartureTime      time.Time `json:"departure_time"`
+	ArrivalTime        time.Time `json:"arrival_time"`
+	ExpiresAt          time.Time `json:"expires_at"`
+}
+
+func newFlightSubscription(fs subscription_alerts.FlightSubscription) FlightSubscription {
+	return FlightSubscription{
+		SubscriptionID:     fs.ID,
+		UserSubscriptionID: fs.UserSubscriptionID,
+		FlightID:           fs.FlightID,
+		FlightNumber:       fs.FlightNumber,
+		DepartureTime:      fs.DepartureTime,
+		ArrivalTime:        fs.ArrivalTime,
+		ExpiresAt:          fs.ExpiresAt(),
+	}
+}
+
+// POST /users/{id}/flights {"flight_number": "AA0042", "date": "2025-06-01", "expires_after": "6h"}
+//
+// Follows one flight for a trip: date picks the day it departs (default its
+// next flight), expires_after how long after arrival the subscription is
+// deleted (default subscription_alerts.DefaultFlightExpiry). Following a
+// flight the user already follows returns that subscription with 200.
+func (s *Server) followFlight(w http.ResponseWriter, r *http.Request) error {
+	userID, err := ownUser(r)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		FlightNumber string `json:"flight_number"`
+		Date         string `json:"date"`
+		ExpiresAfter string `json:"expires_after"`
+	}
+	if err := decode(w, r, &req); err != nil {
+		return err
+	}
+	if req.FlightNumber == "" {
+		return invalid("flight_number is required")
+	}
+	var departsOn time.Time
+	if req.Date != "" {
+		if departsOn, err = time.Parse(time.DateOnly, req.Date); err != nil {
+			return invalid("date must be YYYY-MM-DD")
+		}
+	}
+	var expiresAfter time.Duration
+	if req.ExpiresAfter != "" {
+		if expiresAfter, err = time.ParseDuration(req.ExpiresAfter); err != nil || expiresAfter <= 0 {
+			return invalid("expires_after must be a positive duration like 6h")
+		}
+	}
+	fs, err := subscription_alerts.SubscribeToFlight(r.Context(), s.db, userID, req.FlightNumber, departsOn, expiresAfter)
+	if errors.Is(err, subscription_alerts.ErrNoFlight) {
+		return invalid("%v", err)
+	}
+	if errors.Is(err, subscription_alerts.ErrFollowing) {
+		writeJSON(w, http.StatusOK, newFlightSubscription(fs))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusCreated, newFlightSubscription(fs))
+	return nil
+}
+
+// GET /users/{id}/flights
+//
+// Not paginated: a traveller follows a handful of flights at a time.
+func (s *Server) listFlights(w http.ResponseWriter, r *http.Request) error {
+	userID, err := ownUser(r)
+	if err != nil {
+		return err
+	}
+	subs, err := subscription_alerts.FlightSubscriptions(r.Context(), s.db, userID)
+	if err != nil {
+		return err
+	}
+	items := make([]FlightSubscription, 0, len(subs))
+	for _, fs := range subs {
+		items = append(items, newFlightSubscription(fs))
+	}
+	writeJSON(w, http.StatusOK, Page[FlightSubscription]{Items: items})
+	return nil
+}
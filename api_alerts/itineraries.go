@@ -0,0 +1,118 @@
+package api_alerts
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/okharch/yal/subscription_alerts"
+)
+
+// Itinerary is a traveller following connecting flights, see
+// subscription_alerts.Itinerary.
+type Itinerary struct {
+	ID                 int            `json:"id"`
+	SubscriptionID     int            `json:"subscription_id"`
+	UserSubscriptionID int            `json:"user_subscription_id"`
+	Legs               []ItineraryLeg `json:"legs"`
+	ExpiresAt          time.Time      `json:"expires_at"`
+}
+
+// ItineraryLeg is a flight of an itinerary; connection_id is the target id
+// of connection_at_risk alerts on the connection to the next leg.
+type ItineraryLeg struct {
+	ConnectionID  *int      `json:"connection_id,omitempty"`
+	FlightID      int       `json:"flight_id"`
+	FlightNumber  string    `json:"flight_number"`
+	DepartureTime time.Time `json:"departure_time"`
+	ArrivalTime   time.Time `json:"arrival_time"`
+}
+
+func newItinerary(it subscription_alerts.Itinerary) Itinerary {
+	out := Itinerary{
+		ID:                 it.ID,
+		SubscriptionID:     it.SubscriptionID,
+		UserSubscriptionID: it.UserSubscriptionID,
+		ExpiresAt:          it.ExpiresAt(),
+	}
+	for i, leg := range it.Legs {
+		l := ItineraryLeg{FlightID: leg.FlightID, FlightNumber: leg.FlightNumber,
+			DepartureTime: leg.DepartureTime, ArrivalTime: leg.ArrivalTime}
+		if i < len(it.Legs)-1 {
+			l.ConnectionID = &leg.ID
+		}
+		out.Legs = append(out.Legs, l)
+	}
+	return out
+}
+
+// POST /users/{id}/itineraries {"legs": [{"flight_number": "AA0042", "date": "2025-06-01"}, {"flight_number": "BA0117"}], "expires_after": "6h"}
+//
+// Follows connecting flights. A leg without date is its first flight
+// departing after the previous leg arrives.
+func (s *Server) followItinerary(w http.ResponseWriter, r *http.Request) error {
+	userID, err := ownUser(r)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Legs []struct {
+			FlightNumber string `json:"flight_number"`
+			Date         string `json:"date"`
+		} `json:"legs"`
+		ExpiresAfter string `json:"expires_after"`
+	}
+	if err := decode(w, r, &req); err != nil {
+		return err
+	}
+	if len(req.Legs) < 2 {
+		return invalid("legs: an itinerary needs at least 2 legs")
+	}
+	legs := make([]subscription_alerts.Leg, len(req.Legs))
+	for i, leg := range req.Legs {
+		if leg.FlightNumber == "" {
+			return invalid("legs[%d]: flight_number is required", i)
+		}
+		legs[i].FlightNumber = leg.FlightNumber
+		if leg.Date != "" {
+			if legs[i].DepartsOn, err = time.Parse(time.DateOnly, leg.Date); err != nil {
+				return invalid("legs[%d]: date must be YYYY-MM-DD", i)
+			}
+		}
+	}
+	var expiresAfter time.Duration
+	if req.ExpiresAfter != "" {
+		if expiresAfter, err = time.ParseDuration(req.ExpiresAfter); err != nil || expiresAfter <= 0 {
+			return invalid("expires_after must be a positive duration like 6h")
+		}
+	}
+	it, err := subscription_alerts.SubscribeToItinerary(r.Context(), s.db, userID, legs, expiresAfter)
+	if errors.Is(err, subscription_alerts.ErrNoFlight) || errors.Is(err, subscription_alerts.ErrInvalidItinerary) {
+		return invalid("%v", err)
+	}
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusCreated, newItinerary(it))
+	return nil
+}
+
+// GET /users/{id}/itineraries
+//
+// Not paginated, like /users/{id}/flights.
+func (s *Server) listItineraries(w http.ResponseWriter, r *http.Request) error {
+	userID, err := ownUser(r)
+	if err != nil {
+		return err
+	}
+	itineraries, err := subscription_alerts.Itineraries(r.Context(), s.db, userID)
+	if err != nil {
+		return err
+	}
+	items := make([]Itinerary, 0, len(itineraries))
+	for _, it := range itineraries {
+		items = append(items, newItinerary(it))
+	}
+	writeJSON(w, http.StatusOK, Page[Itinerary]{Items: items})
+	return nil
+}
@@ -0,0 +1,123 @@
+package api_alerts
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/okharch/yal/model"
+	"github.com/okharch/yal/mute_alerts"
+)
+
+// Mute is a target muted for a user subscription, see mute_alerts.Mute.
+type Mute struct {
+	ID         int        `json:"id"`
+	TargetID   int        `json:"target_id"`
+	TargetType string     `json:"target_type"`
+	Until      *time.Time `json:"until"` // null: until unmuted
+	Reason     string     `json:"reason,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func newMute(m mute_alerts.Mute) Mute {
+	return Mute{ID: m.ID, TargetID: m.Target.ID, TargetType: m.Target.Type, Until: m.Until, Reason: m.Reason,
+		CreatedAt: m.CreatedAt}
+}
+
+// POST /user-subscriptions/{id}/mutes {"target_type": "flight", "target_id": 1234, "for": "24h", "reason": "..."}
+//
+// Mutes a target until `until` (RFC 3339), for a duration, or until unmuted
+// when neither is set. Muting a muted target replaces the mute and
+// answers 200 instead of 201.
+func (s *Server) mute(w http.ResponseWriter, r *http.Request) error {
+	usID, err := s.ownUserSubscription(r)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		TargetType string     `json:"target_type"`
+		TargetID   int        `json:"target_id"`
+		Until      *time.Time `json:"until"`
+		For        string     `json:"for"`
+		Reason     string     `json:"reason"`
+	}
+	if err := decode(w, r, &req); err != nil {
+		return err
+	}
+	if req.TargetType == "" || req.TargetID <= 0 {
+		return invalid("target_type and target_id are required")
+	}
+	m := mute_alerts.Mute{
+		UserSubscriptionID: usID,
+		Target:             model.Target{ID: req.TargetID, Type: req.TargetType},
+		Until:              req.Until,
+		Reason:             req.Reason,
+	}
+	if req.For != "" {
+		if req.Until != nil {
+			return invalid("set until or for, not both")
+		}
+		d, err := time.ParseDuration(req.For)
+		if err != nil || d <= 0 {
+			return invalid("for must be a positive duration like 24h")
+		}
+		until := time.Now().Add(d)
+		m.Until = &until
+	}
+	if m.Until != nil && !m.Until.After(time.Now()) {
+		return invalid("until must be in the future")
+	}
+	added, replaced, err := mute_alerts.Add(r.Context(), s.db, m)
+	if err != nil {
+		return err
+	}
+	status := http.StatusCreated
+	if replaced {
+		status = http.StatusOK
+	}
+	writeJSON(w, status, newMute(added))
+	return nil
+}
+
+// GET /user-subscriptions/{id}/mutes
+//
+// The mutes in force, not paginated: a user mutes a handful of targets.
+func (s *Server) listMutes(w http.ResponseWriter, r *http.Request) error {
+	usID, err := s.ownUserSubscription(r)
+	if err != nil {
+		return err
+	}
+	mutes, err := mute_alerts.List(r.Context(), s.db, usID)
+	if err != nil {
+		return err
+	}
+	items := make([]Mute, 0, len(mutes))
+	for _, m := range mutes {
+		items = append(items, newMute(m))
+	}
+	writeJSON(w, http.StatusOK, Page[Mute]{Items: items})
+	return nil
+}
+
+// DELETE /user-subscriptions/{id}/mutes/{mute_id}
+//
+// Unmutes; what the mute held back is pushed right away.
+func (s *Server) unmute(w http.ResponseWriter, r *http.Request) error {
+	usID, err := s.ownUserSubscription(r)
+	if err != nil {
+		return err
+	}
+	muteID, err := pathID(r, "mute_id")
+	if err != nil {
+		return err
+	}
+	err = mute_alerts.End(r.Context(), s.db, usID, muteID)
+	if errors.Is(err, mute_alerts.ErrNoMute) {
+		return notFound("%v", err)
+	}
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,131 @@
+package api_alerts
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/okharch/yal/subscription_alerts"
+)
+
+// Pack is a condition pack, see subscription_alerts.Pack.
+type Pack struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	Description  string `json:"description"`
+	ConditionIDs []int  `json:"condition_ids"`
+}
+
+// Preferences are the preferences of a user subscription, see
+// subscription_alerts.Preferences.
+type Preferences struct {
+	MinSeverity int `json:"min_severity"`
+}
+
+// GET /condition-packs
+//
+// Not paginated: there are a handful of packs.
+func (s *Server) listPacks(w http.ResponseWriter, r *http.Request) error {
+	packs, err := subscription_alerts.Packs(r.Context(), s.db)
+	if err != nil {
+		return err
+	}
+	items := make([]Pack, 0, len(packs))
+	for _, p := range packs {
+		items = append(items, Pack{ID: p.ID, Name: p.Name, Description: p.Description, ConditionIDs: p.ConditionIDs})
+	}
+	writeJSON(w, http.StatusOK, Page[Pack]{Items: items})
+	return nil
+}
+
+// GET /user-subscriptions/{id}/preferences
+func (s *Server) getPreferences(w http.ResponseWriter, r *http.Request) error {
+	usID, err := s.ownUserSubscription(r)
+	if err != nil {
+		return err
+	}
+	return s.writePreferences(w, r, usID)
+}
+
+// PUT /user-subscriptions/{id}/preferences {"min_severity": 2}
+//
+// Sets the fields given and leaves the others as they are. A change pushes
+// the user a snapshot.
+func (s *Server) setPreferences(w http.ResponseWriter, r *http.Request) error {
+	usID, err := s.ownUserSubscription(r)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		MinSeverity *int `json:"min_severity"`
+	}
+	if err := decode(w, r, &req); err != nil {
+		return err
+	}
+	if req.MinSeverity != nil && *req.MinSeverity < 0 {
+		return invalid("min_severity must not be negative")
+	}
+	if req.MinSeverity != nil {
+		if err := subscription_alerts.SetMinSeverity(r.Context(), s.db, usID, *req.MinSeverity); err != nil {
+			return err
+		}
+	}
+	return s.writePreferences(w, r, usID)
+}
+
+func (s *Server) writePreferences(w http.ResponseWriter, r *http.Request, usID int) error {
+	p, err := subscription_alerts.LoadPreferences(r.Context(), s.db, usID)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, Preferences{MinSeverity: p.MinSeverity})
+	return nil
+}
+
+// POST /user-subscriptions/{id}/packs {"packs": ["weather", "safety"]}
+//
+// Turns on every condition of the packs, leaving the others as they are, and
+// returns the conditions of the packs. Each condition turned on pushes its
+// alerts like PUT .../conditions/{condition_id}.
+func (s *Server) enablePacks(w http.ResponseWriter, r *http.Request) error {
+	usID, err := s.ownUserSubscription(r)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Packs []string `json:"packs"`
+	}
+	if err := decode(w, r, &req); err != nil {
+		return err
+	}
+	if len(req.Packs) == 0 {
+		return invalid("packs is required")
+	}
+	err = subscription_alerts.EnablePacks(r.Context(), s.db, usID, req.Packs)
+	if errors.Is(err, subscription_alerts.ErrUnknownPack) {
+		return invalid("%v", err)
+	}
+	if err != nil {
+		return err
+	}
+	rows, err := s.db.Query(r.Context(), `
+		SELECT `+conditionColumns+`
+		FROM user_subscription_conditions usc
+		JOIN conditions c ON c.id = usc.condition_id
+		JOIN condition_templates ct ON ct.id = c.template_id
+		WHERE usc.user_subscription_id = $1
+		  AND c.id IN (SELECT m.condition_id FROM condition_pack_members m JOIN condition_packs p ON p.id = m.pack_id
+		               WHERE p.name = ANY($2))
+		ORDER BY c.id`, usID, req.Packs)
+	if err != nil {
+		return err
+	}
+	conditions, err := collect(rows, scanCondition)
+	if err != nil {
+		return err
+	}
+	if conditions == nil {
+		conditions = []Condition{}
+	}
+	writeJSON(w, http.StatusOK, Page[Condition]{Items: conditions})
+	return nil
+}
@@ -0,0 +1,144 @@
+package api_alerts
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/okharch/yal/model"
+	"github.com/okharch/yal/preview_alerts"
+	"github.com/okharch/yal/subscription_alerts"
+)
+
+const (
+	defaultPreviewPeriod = 7 * 24 * time.Hour
+	maxPreviewPeriod     = 30 * 24 * time.Hour // alert history retention
+	defaultPreviewSample = 3
+	maxPreviewSamples    = 20
+)
+
+// Preview is the estimated delivery of a subscription, see
+// preview_alerts.Result.
+type Preview struct {
+	From          time.Time         `json:"from"`
+	To            time.Time         `json:"to"`
+	Targets       int               `json:"targets"`
+	Notifications int               `json:"notifications"`
+	AlertChanges  int               `json:"alert_changes"`
+	PerDay        float64           `json:"per_day"`
+	PeakPush      Burst             `json:"peak_push"`
+	PeakHour      Burst             `json:"peak_hour"`
+	ByCondition   map[int]int       `json:"by_condition"`
+	Samples       []json.RawMessage `json:"samples"`
+	Approximation []string          `json:"approximation,omitempty"` // why the estimate may be off
+}
+
+// Burst is a peak of a preview.
+type Burst struct {
+	At    *time.Time `json:"at"` // null without notifications
+	Count int        `json:"count"`
+}
+
+func newBurst(b preview_alerts.Burst) Burst {
+	if b.Count == 0 {
+		return Burst{}
+	}
+	return Burst{At: &b.At, Count: b.Count}
+}
+
+// POST /subscriptions/preview
+//
+//	{"spec": {...}, "targets": [{"type": "flight", "id": 1234}], "view_name": "...",
+//	 "conditions": [{"id": 5, "threshold": 25}], "since": "168h", "samples": 3}
+//
+// Estimates what a subscription would have been pushed over the last
+// `since` by replaying alert history; nothing is created.
+func (s *Server) previewSubscription(w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		Spec     json.RawMessage `json:"spec"`
+		ViewName string          `json:"view_name"`
+		Targets  []struct {
+			Type string `json:"type"`
+			ID   int    `json:"id"`
+		} `json:"targets"`
+		Conditions []struct {
+			ID        int      `json:"id"`
+			Threshold *float64 `json:"threshold"`
+		} `json:"conditions"`
+		Since   string `json:"since"`
+		Samples *int   `json:"samples"`
+	}
+	if err := decode(w, r, &req); err != nil {
+		return err
+	}
+
+	since := defaultPreviewPeriod
+	if req.Since != "" {
+		d, err := time.ParseDuration(req.Since)
+		if err != nil || d <= 0 || d > maxPreviewPeriod {
+			return invalid("since must be a positive duration up to %s", maxPreviewPeriod)
+		}
+		since = d
+	}
+	preq := preview_alerts.Request{
+		ViewName: req.ViewName,
+		To:       time.Now(),
+		Samples:  defaultPreviewSample,
+	}
+	preq.From = preq.To.Add(-since)
+	if req.Samples != nil {
+		if *req.Samples < 0 || *req.Samples > maxPreviewSamples {
+			return invalid("samples must be between 0 and %d", maxPreviewSamples)
+		}
+		preq.Samples = *req.Samples
+	}
+	if len(req.Spec) > 0 {
+		spec, err := subscription_alerts.Parse(req.Spec)
+		if err != nil {
+			return invalid("%v", err)
+		}
+		preq.Spec = spec
+	}
+	for _, t := range req.Targets {
+		if t.Type == "" || t.ID <= 0 {
+			return invalid("targets need a type and an id")
+		}
+		preq.Targets = append(preq.Targets, model.Target{ID: t.ID, Type: t.Type})
+	}
+	if len(req.Conditions) == 0 {
+		return invalid("at least one condition is required")
+	}
+	for _, c := range req.Conditions {
+		preq.Conditions = append(preq.Conditions, preview_alerts.ConditionFilter{ID: c.ID, Threshold: c.Threshold})
+	}
+	if preq.Spec == nil && preq.ViewName == "" && len(preq.Targets) == 0 {
+		return invalid("spec, view_name or targets is required")
+	}
+
+	res, err := preview_alerts.Preview(r.Context(), s.db, preq)
+	if errors.Is(err, preview_alerts.ErrInvalid) {
+		return invalid("%v", err)
+	}
+	if err != nil {
+		return err
+	}
+	samples := res.Samples
+	if samples == nil {
+		samples = []json.RawMessage{}
+	}
+	writeJSON(w, http.StatusOK, Preview{
+		From:          res.From,
+		To:            res.To,
+		Targets:       res.Targets,
+		Notifications: res.Notifications,
+		AlertChanges:  res.AlertChanges,
+		PerDay:        res.PerDay,
+		PeakPush:      newBurst(res.PeakPush),
+		PeakHour:      newBurst(res.PeakHour),
+		ByCondition:   res.ByCondition,
+		Samples:       samples,
+		Approximation: res.Caveats,
+	})
+	return nil
+}
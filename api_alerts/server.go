@@ -0,0 +1,301 @@
+package api_alerts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+	maxBodyBytes    = 1 << 20
+)
+
+// Server is the self-service subscription management API: users,
+// subscriptions, user subscriptions and their conditions.
+type Server struct {
+	db  *pgxpool.Pool
+	mux *http.ServeMux
+}
+
+// NewServer routes the API, see the README for the endpoints. Every endpoint
+// but POST /users needs the token of a user, see authenticated.
+func NewServer(db *pgxpool.Pool) *Server {
+	s := &Server{db: db, mux: http.NewServeMux()}
+	s.mux.Handle("POST /users", handler(s.createUser))
+	s.mux.Handle("GET /users/{id}", s.authenticated(s.getUser))
+	s.mux.Handle("POST /users/{id}/subscriptions", s.authenticated(s.subscribe))
+	s.mux.Handle("GET /users/{id}/subscriptions", s.authenticated(s.listUserSubscriptions))
+	s.mux.Handle("POST /users/{id}/flights", s.authenticated(s.followFlight))
+	s.mux.Handle("GET /users/{id}/flights", s.authenticated(s.listFlights))
+	s.mux.Handle("POST /users/{id}/itineraries", s.authenticated(s.followItinerary))
+	s.mux.Handle("GET /users/{id}/itineraries", s.authenticated(s.listItineraries))
+	s.mux.Handle("POST /subscriptions", s.authenticated(s.createSubscription))
+	s.mux.Handle("POST /subscriptions/preview", s.authenticated(s.previewSubscription))
+	s.mux.Handle("GET /subscriptions", s.authenticated(s.listSubscriptions))
+	s.mux.Handle("GET /subscriptions/{id}", s.authenticated(s.getSubscription))
+	s.mux.Handle("GET /user-subscriptions/{id}/conditions", s.authenticated(s.listConditions))
+	s.mux.Handle("PUT /user-subscriptions/{id}/conditions/{condition_id}", s.authenticated(s.setCondition))
+	s.mux.Handle("POST /user-subscriptions/{id}/mutes", s.authenticated(s.mute))
+	s.mux.Handle("GET /user-subscriptions/{id}/mutes", s.authenticated(s.listMutes))
+	s.mux.Handle("DELETE /user-subscriptions/{id}/mutes/{mute_id}", s.authenticated(s.unmute))
+	s.mux.Handle("GET /user-subscriptions/{id}/preferences", s.authenticated(s.getPreferences))
+	s.mux.Handle("PUT /user-subscriptions/{id}/preferences", s.authenticated(s.setPreferences))
+	s.mux.Handle("POST /user-subscriptions/{id}/packs", s.authenticated(s.enablePacks))
+	s.mux.Handle("GET /condition-packs", s.authenticated(s.listPacks))
+	return s
+}
+
+// ServeHTTP answers requests that match no route like the others, with a
+// JSON error: 404, or 405 with the Allow header when only the method is wrong.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, pattern := s.mux.Handler(r); pattern == "" {
+		w = &errorWriter{ResponseWriter: w, r: r}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// errorWriter replaces the plain text errors of http.ServeMux.
+type errorWriter struct {
+	http.ResponseWriter
+	r      *http.Request
+	failed bool
+}
+
+func (w *errorWriter) WriteHeader(status int) {
+	var ae *apiError
+	switch status {
+	case http.StatusNotFound:
+		ae = notFound("no endpoint %s %s", w.r.Method, w.r.URL.Path)
+	case http.StatusMethodNotAllowed:
+		ae = &apiError{Status: status, Code: "method_not_allowed",
+			Message: fmt.Sprintf("%s is not allowed on %s", w.r.Method, w.r.URL.Path)}
+	default: // redirects to the clean path
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.failed = true
+	writeJSON(w.ResponseWriter, status, map[string]*apiError{"error": ae})
+}
+
+func (w *errorWriter) Write(b []byte) (int, error) {
+	if w.failed {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+type userKey struct{}
+
+// authenticated runs h for the user whose token is given as
+// "Authorization: Bearer <token>", see authUser.
+func (s *Server) authenticated(h func(w http.ResponseWriter, r *http.Request) error) http.Handler {
+	return handler(func(w http.ResponseWriter, r *http.Request) error {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			return unauthorized("a bearer token is required")
+		}
+		var userID int
+		err := s.db.QueryRow(r.Context(), `SELECT id FROM users WHERE token = $1`, token).Scan(&userID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return unauthorized("invalid token")
+		}
+		if err != nil {
+			return err
+		}
+		return h(w, r.WithContext(context.WithValue(r.Context(), userKey{}, userID)))
+	})
+}
+
+// authUser is the id of the user a request is authenticated as.
+func authUser(r *http.Request) int {
+	id, _ := r.Context().Value(userKey{}).(int)
+	return id
+}
+
+// ownUser returns the {id} path parameter of /users/{id}/... routes, which
+// must be the authenticated user; other users are not found.
+func ownUser(r *http.Request) (int, error) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		return 0, err
+	}
+	if id != authUser(r) {
+		return 0, notFound("user %d not found", id)
+	}
+	return id, nil
+}
+
+// ownUserSubscription returns the {id} path parameter of
+// /user-subscriptions/{id}/... routes, which must be a user subscription of
+// the authenticated user; those of other users are not found.
+func (s *Server) ownUserSubscription(r *http.Request) (int, error) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		return 0, err
+	}
+	var found bool
+	err = s.db.QueryRow(r.Context(), `
+		SELECT EXISTS (SELECT 1 FROM user_subscriptions WHERE id = $1 AND user_id = $2)`, id, authUser(r)).Scan(&found)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, notFound("user subscription %d not found", id)
+	}
+	return id, nil
+}
+
+// apiError is every error response: {"error": {"code": ..., "message": ...}}.
+type apiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string { return e.Message }
+
+func badRequest(format string, args ...any) *apiError {
+	return &apiError{Status: http.StatusBadRequest, Code: "bad_request", Message: fmt.Sprintf(format, args...)}
+}
+
+func invalid(format string, args ...any) *apiError {
+	return &apiError{Status: http.StatusUnprocessableEntity, Code: "invalid", Message: fmt.Sprintf(format, args...)}
+}
+
+func unauthorized(format string, args ...any) *apiError {
+	return &apiError{Status: http.StatusUnauthorized, Code: "unauthorized", Message: fmt.Sprintf(format, args...)}
+}
+
+func notFound(format string, args ...any) *apiError {
+	return &apiError{Status: http.StatusNotFound, Code: "not_found", Message: fmt.Sprintf(format, args...)}
+}
+
+func conflict(format string, args ...any) *apiError {
+	return &apiError{Status: http.StatusConflict, Code: "conflict", Message: fmt.Sprintf(format, args...)}
+}
+
+// handler turns the error of h into an error response: API errors as they
+// are, constraint violations as conflicts or invalid requests, anything
+// else as an internal error that is logged but not exposed.
+func handler(h func(w http.ResponseWriter, r *http.Request) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := h(w, r)
+		if err == nil {
+			return
+		}
+		var ae *apiError
+		var pgErr *pgconn.PgError
+		switch {
+		case errors.As(err, &ae):
+		case errors.Is(err, pgx.ErrNoRows):
+			ae = notFound("not found")
+		case errors.As(err, &pgErr) && pgErr.Code == "23505":
+			ae = conflict("already exists: %s", pgErr.Detail)
+		case errors.As(err, &pgErr) && (pgErr.Code == "23503" || pgErr.Code == "23514"):
+			ae = invalid("%s", pgErr.Message)
+		default:
+			log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+			ae = &apiError{Status: http.StatusInternalServerError, Code: "internal", Message: "internal error"}
+		}
+		writeJSON(w, ae.Status, map[string]*apiError{"error": ae})
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// decode reads a JSON request body into v, rejecting unknown fields.
+func decode(w http.ResponseWriter, r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return badRequest("invalid request body: %v", err)
+	}
+	return nil
+}
+
+// pathID parses a positive integer path parameter.
+func pathID(r *http.Request, name string) (int, error) {
+	id, err := strconv.Atoi(r.PathValue(name))
+	if err != nil || id <= 0 {
+		return 0, badRequest("%s must be a positive integer", name)
+	}
+	return id, nil
+}
+
+// page is keyset pagination: up to Limit items with an id after After.
+type page struct {
+	Limit int
+	After int
+}
+
+// Page is a paginated list; NextAfter is the `after` of the next page,
+// absent on the last one.
+type Page[T any] struct {
+	Items     []T  `json:"items"`
+	NextAfter *int `json:"next_after,omitempty"`
+}
+
+func parsePage(r *http.Request) (page, error) {
+	p := page{Limit: defaultPageSize}
+	q := r.URL.Query()
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxPageSize {
+			return p, badRequest("limit must be between 1 and %d", maxPageSize)
+		}
+		p.Limit = n
+	}
+	if v := q.Get("after"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return p, badRequest("after must be a non-negative integer")
+		}
+		p.After = n
+	}
+	return p, nil
+}
+
+// newPage trims items fetched with limit+1 to the page and sets NextAfter
+// from the id of its last item.
+func newPage[T any](items []T, p page, id func(T) int) Page[T] {
+	if items == nil {
+		items = []T{}
+	}
+	if len(items) <= p.Limit {
+		return Page[T]{Items: items}
+	}
+	items = items[:p.Limit]
+	next := id(items[len(items)-1])
+	return Page[T]{Items: items, NextAfter: &next}
+}
+
+// collect scans every row with scan.
+func collect[T any](rows pgx.Rows, scan func(pgx.Rows) (T, error)) ([]T, error) {
+	defer rows.Close()
+	var items []T
+	for rows.Next() {
+		item, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
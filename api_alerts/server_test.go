@@ -0,0 +1,264 @@
+package api_alerts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/okharch/yal/testdb"
+)
+
+// call serves one request and decodes the response into out unless it is nil.
+func call(t *testing.T, srv http.Handler, method, path, token, body string, out any) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: %v in %s", method, path, err, w.Body)
+		}
+	}
+	return w
+}
+
+// Requests no route matches get JSON errors, and a missing token is refused
+// before the database is used.
+func TestUnmatched(t *testing.T) {
+	srv := NewServer(nil)
+	tests := []struct {
+		name, method, path string
+		status             int
+		code               string
+	}{
+		{"no route", "GET", "/nope", http.StatusNotFound, "not_found"},
+		{"wrong method", "DELETE", "/users", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"no token", "GET", "/users/1", http.StatusUnauthorized, "unauthorized"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp struct {
+				Error apiError `json:"error"`
+			}
+			w := call(t, srv, tt.method, tt.path, "", "", &resp)
+			if w.Code != tt.status || resp.Error.Code != tt.code {
+				t.Errorf("got %d %q, want %d %q", w.Code, resp.Error.Code, tt.status, tt.code)
+			}
+		})
+	}
+	w := call(t, srv, "DELETE", "/users", "", "", nil)
+	if allow := w.Header().Get("Allow"); !strings.Contains(allow, "POST") {
+		t.Errorf("Allow is %q, want POST", allow)
+	}
+}
+
+// TestRoutes calls every route as the owner and, where it is scoped to a
+// user, as another user. The server commits, so what it creates is deleted
+// when the test ends.
+func TestRoutes(t *testing.T) {
+	db := testdb.Connect(t)
+	ctx := context.Background()
+	srv := NewServer(db)
+
+	var flights [2]struct {
+		id     int
+		number string
+		date   string
+	}
+	err := db.QueryRow(ctx, `
+		WITH legs AS (
+			SELECT r1.id AS r1, r1.airline_id AS a1, r1.source_airport_id AS src, r1.destination_airport_id AS via,
+			       r2.id AS r2, r2.airline_id AS a2, r2.destination_airport_id AS dst
+			FROM routes r1
+			JOIN routes r2 ON r2.source_airport_id = r1.destination_airport_id
+			JOIN airlines al1 ON al1.id = r1.airline_id
+			JOIN airlines al2 ON al2.id = r2.airline_id
+			ORDER BY r1.id, r2.id LIMIT 1),
+		f1 AS (
+			INSERT INTO flights (route_id, airline_id, flight_number, source_airport_id, destination_airport_id,
+			                     departure_time, arrival_time, status)
+			SELECT r1, a1, 'APITEST1', src, via, now() + interval '1 hour', now() + interval '3 hours', 'scheduled'
+			FROM legs RETURNING id, departure_time),
+		f2 AS (
+			INSERT INTO flights (route_id, airline_id, flight_number, source_airport_id, destination_airport_id,
+			                     departure_time, arrival_time, status)
+			SELECT r2, a2, 'APITEST2', via, dst, now() + interval '5 hours', now() + interval '7 hours', 'scheduled'
+			FROM legs RETURNING id, departure_time)
+		SELECT f1.id, to_char(f1.departure_time AT TIME ZONE 'UTC', 'YYYY-MM-DD'),
+		       f2.id, to_char(f2.departure_time AT TIME ZONE 'UTC', 'YYYY-MM-DD')
+		FROM f1, f2`).Scan(&flights[0].id, &flights[0].date, &flights[1].id, &flights[1].date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flights[0].number, flights[1].number = "APITEST1", "APITEST2"
+
+	var users [2]User
+	for i := range users {
+		if w := call(t, srv, "POST", "/users", "", fmt.Sprintf(`{"name": "api test %d"}`, i), &users[i]); w.Code != http.StatusCreated {
+			t.Fatalf("POST /users: %d %s", w.Code, w.Body)
+		}
+	}
+	t.Cleanup(func() { cleanup(t, db, []int{users[0].ID, users[1].ID}, []int{flights[0].id, flights[1].id}) })
+	me, other := users[0], users[1]
+
+	var sub Subscription
+	if w := call(t, srv, "POST", "/subscriptions", me.Token,
+		`{"name": "api test", "spec": {"flight_numbers": ["APITEST1"]}}`, &sub); w.Code != http.StatusCreated {
+		t.Fatalf("POST /subscriptions: %d %s", w.Code, w.Body)
+	}
+	t.Cleanup(func() { deleteSubscriptions(t, db, []int{sub.ID}) })
+	var condition int
+	if err := db.QueryRow(ctx, `SELECT min(id) FROM conditions`).Scan(&condition); err != nil {
+		t.Fatal(err)
+	}
+	var us UserSubscription
+	if w := call(t, srv, "POST", fmt.Sprintf("/users/%d/subscriptions", me.ID), me.Token,
+		fmt.Sprintf(`{"subscription_id": %d, "conditions": [%d]}`, sub.ID, condition), &us); w.Code != http.StatusCreated {
+		t.Fatalf("POST /users/{id}/subscriptions: %d %s", w.Code, w.Body)
+	}
+	var mute Mute
+	if w := call(t, srv, "POST", fmt.Sprintf("/user-subscriptions/%d/mutes", us.ID), me.Token,
+		fmt.Sprintf(`{"target_type": "flight", "target_id": %d, "for": "1h"}`, flights[0].id), &mute); w.Code != http.StatusCreated {
+		t.Fatalf("POST /user-subscriptions/{id}/mutes: %d %s", w.Code, w.Body)
+	}
+
+	user := fmt.Sprintf("/users/%d", me.ID)
+	userSub := fmt.Sprintf("/user-subscriptions/%d", us.ID)
+	tests := []struct {
+		method, path, body string
+		status             int
+		scoped             bool // another user gets not found
+	}{
+		{"GET", user, "", http.StatusOK, true},
+		{"GET", user + "/subscriptions", "", http.StatusOK, true},
+		{"POST", user + "/subscriptions", fmt.Sprintf(`{"subscription_id": %d}`, sub.ID), http.StatusConflict, true},
+		{"POST", user + "/flights", fmt.Sprintf(`{"flight_number": %q, "date": %q}`, flights[0].number, flights[0].date),
+			http.StatusCreated, true},
+		{"GET", user + "/flights", "", http.StatusOK, true},
+		{"POST", user + "/itineraries", fmt.Sprintf(`{"legs": [{"flight_number": %q, "date": %q}, {"flight_number": %q}]}`,
+			flights[0].number, flights[0].date, flights[1].number), http.StatusCreated, true},
+		{"GET", user + "/itineraries", "", http.StatusOK, true},
+		{"POST", "/subscriptions", `{"name": "api test", "spec": {"airports": ["QQQ"]}}`, http.StatusUnprocessableEntity, false},
+		{"POST", "/subscriptions/preview", fmt.Sprintf(`{"spec": {"flight_numbers": ["APITEST1"]}, "conditions": [{"id": %d}]}`,
+			condition), http.StatusOK, false},
+		{"GET", "/subscriptions", "", http.StatusOK, false},
+		{"GET", fmt.Sprintf("/subscriptions/%d", sub.ID), "", http.StatusOK, false},
+		{"GET", userSub + "/conditions", "", http.StatusOK, true},
+		{"PUT", fmt.Sprintf("%s/conditions/%d", userSub, condition), `{"is_on": false}`, http.StatusOK, true},
+		{"GET", userSub + "/mutes", "", http.StatusOK, true},
+		{"GET", userSub + "/preferences", "", http.StatusOK, true},
+		{"PUT", userSub + "/preferences", `{"min_severity": 1}`, http.StatusOK, true},
+		{"GET", "/condition-packs", "", http.StatusOK, false},
+		{"POST", userSub + "/packs", `{"packs": ["weather"]}`, http.StatusOK, true},
+		{"POST", userSub + "/packs", `{"packs": ["nope"]}`, http.StatusUnprocessableEntity, true},
+		{"DELETE", fmt.Sprintf("%s/mutes/%d", userSub, mute.ID), "", http.StatusNoContent, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			if tt.scoped {
+				if w := call(t, srv, tt.method, tt.path, other.Token, tt.body, nil); w.Code != http.StatusNotFound {
+					t.Errorf("another user got %d %s, want 404", w.Code, w.Body)
+				}
+			}
+			if w := call(t, srv, tt.method, tt.path, "not a token", tt.body, nil); w.Code != http.StatusUnauthorized {
+				t.Errorf("an unknown token got %d, want 401", w.Code)
+			}
+			if w := call(t, srv, tt.method, tt.path, me.Token, tt.body, nil); w.Code != tt.status {
+				t.Errorf("got %d %s, want %d", w.Code, w.Body, tt.status)
+			}
+		})
+	}
+
+	// a flight is followed once, and its subscription stays private
+	var fs FlightSubscription
+	body := fmt.Sprintf(`{"flight_number": %q, "date": %q}`, flights[0].number, flights[0].date)
+	if w := call(t, srv, "POST", user+"/flights", me.Token, body, &fs); w.Code != http.StatusOK {
+		t.Errorf("following the flight again got %d %s, want 200", w.Code, w.Body)
+	}
+	if w := call(t, srv, "GET", fmt.Sprintf("/subscriptions/%d", fs.SubscriptionID), me.Token, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET a flight subscription got %d, want 404", w.Code)
+	}
+	body = fmt.Sprintf(`{"subscription_id": %d}`, fs.SubscriptionID)
+	if w := call(t, srv, "POST", fmt.Sprintf("/users/%d/subscriptions", other.ID), other.Token, body, nil); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("subscribing to a flight subscription got %d, want 422", w.Code)
+	}
+
+	// a pack turns its conditions on
+	var enabled Page[Condition]
+	if w := call(t, srv, "POST", userSub+"/packs", me.Token, `{"packs": ["safety"]}`, &enabled); w.Code != http.StatusOK {
+		t.Errorf("enabling a pack got %d %s", w.Code, w.Body)
+	}
+	if len(enabled.Items) == 0 {
+		t.Error("the pack has no conditions")
+	}
+	for _, c := range enabled.Items {
+		if !c.IsOn {
+			t.Errorf("condition %d of the pack is off", c.ConditionID)
+		}
+	}
+
+	// muting a muted target replaces the mute
+	body = fmt.Sprintf(`{"target_type": "flight", "target_id": %d}`, flights[1].id)
+	for _, want := range []int{http.StatusCreated, http.StatusOK} {
+		if w := call(t, srv, "POST", userSub+"/mutes", me.Token, body, nil); w.Code != want {
+			t.Errorf("muting got %d %s, want %d", w.Code, w.Body, want)
+		}
+	}
+}
+
+// cleanup deletes the users, their subscriptions and the flights a test created.
+func cleanup(t *testing.T, db *pgxpool.Pool, users, flights []int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var subs, itineraries []int
+	err := db.QueryRow(ctx, `
+		SELECT COALESCE(array_agg(s.id), '{}'), COALESCE(array_agg(s.itinerary_id) FILTER (WHERE s.itinerary_id IS NOT NULL), '{}')
+		FROM subscriptions s
+		WHERE s.expires_after IS NOT NULL
+		  AND s.id IN (SELECT subscription_id FROM user_subscriptions WHERE user_id = ANY($1))`, users).Scan(&subs, &itineraries)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, q := range []string{
+		`DELETE FROM user_subscription_conditions WHERE user_subscription_id IN
+			(SELECT id FROM user_subscriptions WHERE user_id = ANY($1))`,
+		`DELETE FROM user_subscriptions WHERE user_id = ANY($1)`,
+		`DELETE FROM users WHERE id = ANY($1)`,
+	} {
+		if _, err := db.Exec(ctx, q, users); err != nil {
+			t.Error(err)
+		}
+	}
+	deleteSubscriptions(t, db, subs)
+	if _, err := db.Exec(ctx, `DELETE FROM itineraries WHERE id = ANY($1)`, itineraries); err != nil {
+		t.Error(err)
+	}
+	if _, err := db.Exec(ctx, `DELETE FROM flights WHERE id = ANY($1)`, flights); err != nil {
+		t.Error(err)
+	}
+}
+
+func deleteSubscriptions(t *testing.T, db *pgxpool.Pool, ids []int) {
+	ctx := context.Background()
+	for _, q := range []string{
+		`DELETE FROM user_subscription_conditions WHERE user_subscription_id IN
+			(SELECT id FROM user_subscriptions WHERE subscription_id = ANY($1))`,
+		`DELETE FROM user_subscriptions WHERE subscription_id = ANY($1)`,
+		`DELETE FROM subscription_targets WHERE subscription_id = ANY($1)`,
+		`DELETE FROM subscriptions WHERE id = ANY($1)`,
+	} {
+		if _, err := db.Exec(ctx, q, ids); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package api_alerts
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/okharch/yal/subscription_alerts"
+)
+
+// Subscription is a row of subscriptions with the number of targets it
+// currently resolves to.
+type Subscription struct {
+	ID       int                       `json:"id"`
+	Name     string                    `json:"name"`
+	Spec     *subscription_alerts.Spec `json:"spec,omitempty"`
+	ViewName string                    `json:"view_name,omitempty"` // legacy subscriptions
+	Targets  int                       `json:"targets"`
+}
+
+const subscriptionColumns = `
+	s.id, s.name, s.spec, COALESCE(s.view_name, ''),
+	(SELECT count(*) FROM subscription_targets st WHERE st.subscription_id = s.id)`
+
+func scanSubscription(rows pgx.Rows) (Subscription, error) {
+	var sub Subscription
+	var spec []byte
+	if err := rows.Scan(&sub.ID, &sub.Name, &spec, &sub.ViewName, &sub.Targets); err != nil {
+		return sub, err
+	}
+	if spec != nil {
+		sub.Spec = new(subscription_alerts.Spec)
+		if err := json.Unmarshal(spec, sub.Spec); err != nil {
+			return sub, err
+		}
+	}
+	return sub, nil
+}
+
+// POST /subscriptions {"name": "...", "spec": {...}}
+//
+// Subscriptions are created from a declarative spec only; its targets are
+// resolved before the response.
+func (s *Server) createSubscription(w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		Name string          `json:"name"`
+		Spec json.RawMessage `json:"spec"`
+	}
+	if err := decode(w, r, &req); err != nil {
+		return err
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		return invalid("name is required")
+	}
+	if len(req.Spec) == 0 {
+		return invalid("spec is required")
+	}
+	spec, err := subscription_alerts.Parse(req.Spec)
+	if err != nil {
+		return invalid("%v", err)
+	}
+	id, err := subscription_alerts.Create(r.Context(), s.db, name, spec)
+	if errors.Is(err, subscription_alerts.ErrInvalidSpec) {
+		return invalid("%v", err)
+	}
+	if err != nil {
+		return err
+	}
+	sub, err := s.subscription(r, id)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusCreated, sub)
+	return nil
+}
+
+// GET /subscriptions?limit=&after=
+func (s *Server) listSubscriptions(w http.ResponseWriter, r *http.Request) error {
+	p, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+	rows, err := s.db.Query(r.Context(), `
+		SELECT `+subscriptionColumns+`
+		FROM subscriptions s
+		WHERE s.id > $1 AND s.expires_after IS NULL -- travellers' flights and itineraries are private
+		ORDER BY s.id LIMIT $2`, p.After, p.Limit+1)
+	if err != nil {
+		return err
+	}
+	subs, err := collect(rows, scanSubscription)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, newPage(subs, p, func(sub Subscription) int { return sub.ID }))
+	return nil
+}
+
+// GET /subscriptions/{id}
+//
+// Private subscriptions are not found, see listSubscriptions.
+func (s *Server) getSubscription(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "id")
+	if err != nil {
+		return err
+	}
+	sub, err := s.subscription(r, id)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, sub)
+	return nil
+}
+
+// subscription loads a public subscription with its target count.
+func (s *Server) subscription(r *http.Request, id int) (Subscription, error) {
+	rows, err := s.db.Query(r.Context(), `
+		SELECT `+subscriptionColumns+` FROM subscriptions s
+		WHERE s.id = $1 AND s.expires_after IS NULL`, id)
+	if err != nil {
+		return Subscription{}, err
+	}
+	subs, err := collect(rows, scanSubscription)
+	if err != nil {
+		return Subscription{}, err
+	}
+	if len(subs) == 0 {
+		return Subscription{}, notFound("subscription %d not found", id)
+	}
+	return subs[0], nil
+}
+
+// exists reports a not found error unless the row with id exists in table.
+func (s *Server) exists(r *http.Request, table, what string, id int) error {
+	var found bool
+	err := s.db.QueryRow(r.Context(), `SELECT EXISTS (SELECT 1 FROM `+table+` WHERE id = $1)`, id).Scan(&found)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return notFound("%s %d not found", what, id)
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package api_alerts
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Delivery modes of a user subscription, see delivery_mode.
+const (
+	deliverAlerts    = "alerts"
+	deliverIncidents = "incidents"
+)
+
+// UserSubscription is a user attached to a subscription.
+type UserSubscription struct {
+	ID               int        `json:"id"`
+	UserID           int        `json:"user_id"`
+	SubscriptionID   int        `json:"subscription_id"`
+	SubscriptionName string     `json:"subscription_name"`
+	Delivery         string     `json:"delivery"` // "alerts" or "incidents", see delivery_mode
+	MinSeverity      int        `json:"min_severity"`
+	PushedAt         *time.Time `json:"pushed_at"`
+}
+
+func scanUserSubscription(rows pgx.Rows) (UserSubscription, error) {
+	var us UserSubscription
+	err := rows.Scan(&us.ID, &us.UserID, &us.SubscriptionID, &us.SubscriptionName, &us.Delivery, &us.MinSeverity,
+		&us.PushedAt)
+	return us, err
+}
+
+const userSubscriptionColumns = `us.id, us.user_id, us.subscription_id, s.name, us.delivery, us.min_severity, us.pushed_at`
+
+// Condition is a condition of a user subscription as the user set it.
+type Condition struct {
+	ID            int        `json:"id"` // user_subscription_conditions.id
+	ConditionID   int        `json:"condition_id"`
+	Name          string     `json:"name"`
+	TargetType    string     `json:"target_type"`
+	IsOn          bool       `json:"is_on"`
+	Severity      int        `json:"severity"`                 // see min_severity in preferences
+	Threshold     float64    `json:"threshold"`                // the global one
+	UserThreshold *float64   `json:"user_threshold,omitempty"` // per-user override
+	LastChangedAt *time.Time `json:"last_changed_at"`
+}
+
+func scanCondition(rows pgx.Rows) (Condition, error) {
+	var c Condition
+	err := rows.Scan(&c.ID, &c.ConditionID, &c.Name, &c.TargetType, &c.IsOn, &c.Severity, &c.Threshold, &c.UserThreshold,
+		&c.LastChangedAt)
+	return c, err
+}
+
+const conditionColumns = `usc.id, c.id, ct.name, ct.target_type, usc.is_on, c.severity, c.threshold, usc.threshold,
+	usc.last_changed_at`
+
+// POST /users/{id}/subscriptions {"subscription_id": 3797, "delivery": "alerts", "conditions": [4, 5]}
+//
+// Attaches the user to a subscription with every condition listed turned on
+// (all of them when none are listed) and the others off. The insert pushes
+// the user a snapshot of the alerts already on, see ListenForSnapshots.
+func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) error {
+	userID, err := ownUser(r)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		SubscriptionID int    `json:"subscription_id"`
+		Delivery       string `json:"delivery"`
+		Conditions     []int  `json:"conditions"`
+	}
+	if err := decode(w, r, &req); err != nil {
+		return err
+	}
+	switch req.Delivery {
+	case "":
+		req.Delivery = deliverAlerts
+	case deliverAlerts, deliverIncidents:
+	default:
+		return invalid("delivery must be %q or %q", deliverAlerts, deliverIncidents)
+	}
+	// an unknown or private subscription is a bad body, not a missing resource
+	if _, err := s.subscription(r, req.SubscriptionID); err != nil {
+		var ae *apiError
+		if errors.As(err, &ae) {
+			return invalid("%s", ae.Message)
+		}
+		return err
+	}
+	if req.Conditions == nil {
+		req.Conditions = []int{}
+	}
+	var unknown []int
+	err = s.db.QueryRow(r.Context(), `
+		SELECT COALESCE(array_agg(u.id), '{}') FROM unnest($1::int[]) u(id)
+		WHERE NOT EXISTS (SELECT 1 FROM conditions c WHERE c.id = u.id)`, req.Conditions).Scan(&unknown)
+	if err != nil {
+		return err
+	}
+	if len(unknown) > 0 {
+		return invalid("unknown conditions %v", unknown)
+	}
+
+	ctx := r.Context()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	var id int
+	err = tx.QueryRow(ctx, `
+		INSERT INTO user_subscriptions (user_id, subscription_id, delivery) VALUES ($1, $2, $3)
+		RETURNING id`, userID, req.SubscriptionID, req.Delivery).Scan(&id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO user_subscription_conditions (user_subscription_id, condition_id, is_on, last_changed_at)
+		SELECT $1, c.id, cardinality($2::int[]) = 0 OR c.id = ANY($2), now()
+		FROM conditions c`, id, req.Conditions)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	rows, err := s.db.Query(ctx, `
+		SELECT `+userSubscriptionColumns+`
+		FROM user_subscriptions us JOIN subscriptions s ON s.id = us.subscription_id
+		WHERE us.id = $1`, id)
+	if err != nil {
+		return err
+	}
+	subs, err := collect(rows, scanUserSubscription)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusCreated, subs[0])
+	return nil
+}
+
+// GET /users/{id}/subscriptions?limit=&after=
+func (s *Server) listUserSubscriptions(w http.ResponseWriter, r *http.Request) error {
+	userID, err := ownUser(r)
+	if err != nil {
+		return err
+	}
+	p, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+	rows, err := s.db.Query(r.Context(), `
+		SELECT `+userSubscriptionColumns+`
+		FROM user_subscriptions us JOIN subscriptions s ON s.id = us.subscription_id
+		WHERE us.user_id = $1 AND us.id > $2
+		ORDER BY us.id LIMIT $3`, userID, p.After, p.Limit+1)
+	if err != nil {
+		return err
+	}
+	subs, err := collect(rows, scanUserSubscription)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, newPage(subs, p, func(us UserSubscription) int { return us.ID }))
+	return nil
+}
+
+// GET /user-subscriptions/{id}/conditions?limit=&after=
+//
+// Pages by condition_id.
+func (s *Server) listConditions(w http.ResponseWriter, r *http.Request) error {
+	usID, err := s.ownUserSubscription(r)
+	if err != nil {
+		return err
+	}
+	p, err := parsePage(r)
+	if err != nil {
+		return err
+	}
+	rows, err := s.db.Query(r.Context(), `
+		SELECT `+conditionColumns+`
+		FROM user_subscription_conditions usc
+		JOIN conditions c ON c.id = usc.condition_id
+		JOIN condition_templates ct ON ct.id = c.template_id
+		WHERE usc.user_subscription_id = $1 AND c.id > $2
+		ORDER BY c.id LIMIT $3`, usID, p.After, p.Limit+1)
+	if err != nil {
+		return err
+	}
+	conditions, err := collect(rows, scanCondition)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, newPage(conditions, p, func(c Condition) int { return c.ConditionID }))
+	return nil
+}
+
+// PUT /user-subscriptions/{id}/conditions/{condition_id} {"is_on": true}
+//
+// Turns a condition on or off. A change fires
+// trg_notify_subscription_condition_change, which pushes the condition's
+// alerts to the user (condition_enabled / condition_disabled); a condition
+// added after the user subscribed is inserted, which pushes a snapshot.
+func (s *Server) setCondition(w http.ResponseWriter, r *http.Request) error {
+	usID, err := s.ownUserSubscription(r)
+	if err != nil {
+		return err
+	}
+	conditionID, err := pathID(r, "condition_id")
+	if err != nil {
+		return err
+	}
+	var req struct {
+		IsOn *bool `json:"is_on"`
+	}
+	if err := decode(w, r, &req); err != nil {
+		return err
+	}
+	if req.IsOn == nil {
+		return invalid("is_on is required")
+	}
+	if err := s.exists(r, "conditions", "condition", conditionID); err != nil {
+		return err
+	}
+	_, err = s.db.Exec(r.Context(), `
+		INSERT INTO user_subscription_conditions AS usc (user_subscription_id, condition_id, is_on, last_changed_at)
+		VALUES ($1, $2, $3, now())
+		ON CONFLICT (user_subscription_id, condition_id) DO UPDATE
+		SET is_on = EXCLUDED.is_on,
+		    last_changed_at = CASE WHEN usc.is_on IS DISTINCT FROM EXCLUDED.is_on
+		                           THEN EXCLUDED.last_changed_at ELSE usc.last_changed_at END`,
+		usID, conditionID, *req.IsOn)
+	if err != nil {
+		return err
+	}
+	rows, err := s.db.Query(r.Context(), `
+		SELECT `+conditionColumns+`
+		FROM user_subscription_conditions usc
+		JOIN conditions c ON c.id = usc.condition_id
+		JOIN condition_templates ct ON ct.id = c.template_id
+		WHERE usc.user_subscription_id = $1 AND c.id = $2`, usID, conditionID)
+	if err != nil {
+		return err
+	}
+	conditions, err := collect(rows, scanCondition)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, conditions[0])
+	return nil
+}
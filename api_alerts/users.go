@@ -0,0 +1,62 @@
+package api_alerts
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// User is a row of users.
+type User struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Token     string    `json:"token,omitempty"` // returned once, when the user is created
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// POST /users {"name": "..."}
+//
+// The only endpoint without a token: it returns the token of the new user.
+func (s *Server) createUser(w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := decode(w, r, &req); err != nil {
+		return err
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		return invalid("name is required")
+	}
+	var u User
+	err := s.db.QueryRow(r.Context(), `
+		INSERT INTO users (name) VALUES ($1)
+		RETURNING id, name, token, created_at`, name).Scan(&u.ID, &u.Name, &u.Token, &u.CreatedAt)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusCreated, u)
+	return nil
+}
+
+// GET /users/{id}
+func (s *Server) getUser(w http.ResponseWriter, r *http.Request) error {
+	id, err := ownUser(r)
+	if err != nil {
+		return err
+	}
+	var u User
+	err = s.db.QueryRow(r.Context(), `SELECT id, name, created_at FROM users WHERE id = $1`, id).
+		Scan(&u.ID, &u.Name, &u.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return notFound("user %d not found", id)
+	}
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, u)
+	return nil
+}
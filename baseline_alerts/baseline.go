@@ -0,0 +1,281 @@
+package baseline_alerts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/okharch/yal/ingest_alerts"
+)
+
+const persistInterval = 10 * time.Second
+
+type statsKey struct {
+	templateID int
+	targetID   int
+}
+
+// stats is an exponentially weighted rolling mean and variance.
+type stats struct {
+	samples    int64
+	mean       float64
+	variance   float64
+	measuredAt time.Time // latest measurement folded in
+}
+
+// add folds x into the rolling baseline spanning about window measurements.
+func (s *stats) add(x float64, window int) {
+	s.samples++
+	if s.samples == 1 {
+		s.mean, s.variance = x, 0
+		return
+	}
+	alpha := 2 / (float64(window) + 1)
+	diff := x - s.mean
+	incr := alpha * diff
+	s.mean += incr
+	s.variance = (1 - alpha) * (s.variance + diff*incr)
+}
+
+// condition is a 'zscore' or 'percentile' condition.
+type condition struct {
+	id         int
+	templateID int
+	kind       string
+	threshold  float64
+	direction  string
+	window     int
+	minSamples int
+}
+
+// Evaluator fires baseline conditions on deviations of a measurement from the
+// rolling baseline of its (template, target). The ingested row must carry the
+// raw measurement as its value; the evaluator replaces it with the score
+// (z-score or percentile) and sets is_on by comparing the score with the
+// condition threshold in the template direction.
+//
+// A measurement is folded into the baseline once, however many conditions of
+// the template score it and however often it is re-sent: only measurements
+// newer than the latest one folded in are. The time of a measurement is the
+// payload's "measured_at" (RFC 3339), or received_at without one.
+type Evaluator struct {
+	conditions map[int]condition
+	baselines  map[statsKey]*stats
+	dirty      map[statsKey]struct{}
+	lock       sync.Mutex
+}
+
+// LoadEvaluator loads baseline conditions and their persisted baselines and
+// registers the evaluator with the ingestion pipeline.
+func LoadEvaluator(ctx context.Context, db *pgxpool.Pool) (*Evaluator, error) {
+	e := &Evaluator{
+		conditions: make(map[int]condition),
+		baselines:  make(map[statsKey]*stats),
+		dirty:      make(map[statsKey]struct{}),
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT c.id, c.template_id, c.kind, c.threshold, t.direction, t.baseline_window, t.baseline_min_samples
+		FROM conditions c
+		JOIN condition_templates t ON t.id = c.template_id
+		WHERE c.kind <> 'threshold'`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load baseline conditions: %w", err)
+	}
+	for rows.Next() {
+		var c condition
+		if err := rows.Scan(&c.id, &c.templateID, &c.kind, &c.threshold, &c.direction, &c.window, &c.minSamples); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		e.conditions[c.id] = c
+	}
+	rows.Close()
+
+	rows, err = db.Query(ctx, `
+		SELECT template_id, target_id, samples, mean, variance, measured_at
+		FROM baseline_stats
+		WHERE template_id IN (SELECT template_id FROM conditions WHERE kind <> 'threshold')`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load baseline stats: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k statsKey
+		var s stats
+		var measuredAt *time.Time
+		if err := rows.Scan(&k.templateID, &k.targetID, &s.samples, &s.mean, &s.variance, &measuredAt); err != nil {
+			return nil, err
+		}
+		if measuredAt != nil {
+			s.measuredAt = *measuredAt
+		}
+		e.baselines[k] = &s
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for id := range e.conditions {
+		ingest_alerts.RegisterEvaluator(id, e)
+	}
+	log.Printf("loaded %d baseline conditions with %d baselines", len(e.conditions), len(e.baselines))
+	return e, nil
+}
+
+// Evaluate implements ingest_alerts.Evaluator.
+func (e *Evaluator) Evaluate(row []interface{}) {
+	conditionID, _ := row[ingest_alerts.ColConditionID].(int)
+	c, ok := e.conditions[conditionID]
+	if !ok {
+		return
+	}
+	x, ok := row[ingest_alerts.ColValue].(float64)
+	if !ok {
+		return
+	}
+	targetID, _ := row[ingest_alerts.ColTargetID].(int)
+	measuredAt := measurementTime(row)
+	key := statsKey{templateID: c.templateID, targetID: targetID}
+
+	e.lock.Lock()
+	s, ok := e.baselines[key]
+	if !ok {
+		s = &stats{}
+		e.baselines[key] = s
+	}
+	// score against the baseline before this measurement is part of it
+	before := *s
+	if measuredAt.IsZero() || measuredAt.After(s.measuredAt) {
+		s.add(x, c.window)
+		s.measuredAt = measuredAt
+		e.dirty[key] = struct{}{}
+	}
+	e.lock.Unlock()
+
+	row[ingest_alerts.ColIsOn] = false
+	row[ingest_alerts.ColValue] = nil
+	if before.samples < int64(c.minSamples) {
+		return // still warming up
+	}
+
+	sd := math.Sqrt(before.variance)
+	z := 0.0
+	if sd > 0 {
+		z = (x - before.mean) / sd
+	}
+	score := z
+	if c.kind == "percentile" {
+		score = 50 * (1 + math.Erf(z/math.Sqrt2)) // percentile under a normal baseline
+	}
+	isOn := score > c.threshold
+	if c.direction == "below" {
+		isOn = score < c.threshold
+	}
+
+	row[ingest_alerts.ColIsOn] = isOn
+	row[ingest_alerts.ColValue] = score
+	row[ingest_alerts.ColPayload] = withBaseline(row[ingest_alerts.ColPayload], x, before, z)
+}
+
+// measurementTime is when the measurement of row was taken: the payload's
+// measured_at, or received_at.
+func measurementTime(row []interface{}) time.Time {
+	if p, ok := row[ingest_alerts.ColPayload].(string); ok && strings.Contains(p, `"measured_at"`) {
+		var payload struct {
+			MeasuredAt time.Time `json:"measured_at"`
+		}
+		if err := json.Unmarshal([]byte(p), &payload); err == nil && !payload.MeasuredAt.IsZero() {
+			return payload.MeasuredAt
+		}
+	}
+	receivedAt, _ := row[ingest_alerts.ColReceivedAt].(time.Time)
+	return receivedAt
+}
+
+// withBaseline adds the measurement and its baseline to the evaluator payload.
+func withBaseline(payload interface{}, x float64, s stats, z float64) string {
+	fields := make(map[string]interface{})
+	if p, ok := payload.(string); ok && p != "" {
+		if err := json.Unmarshal([]byte(p), &fields); err != nil {
+			fields = map[string]interface{}{"payload": p}
+		}
+	}
+	fields["measurement"] = x
+	fields["baseline"] = map[string]interface{}{
+		"mean":    s.mean,
+		"stddev":  math.Sqrt(s.variance),
+		"samples": s.samples,
+		"zscore":  z,
+	}
+	b, _ := json.Marshal(fields)
+	return string(b)
+}
+
+// PersistStats periodically saves updated baselines to baseline_stats, so
+// they survive restarts. It returns when ctx is done, after a final save.
+func (e *Evaluator) PersistStats(ctx context.Context, db *pgxpool.Pool) {
+	ticker := time.NewTicker(persistInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// ctx is done, use a fresh one for the final save
+			if err := e.persist(context.Background(), db); err != nil {
+				log.Printf("failed to persist baseline stats: %v", err)
+			}
+			return
+		case <-ticker.C:
+			if err := e.persist(ctx, db); err != nil {
+				log.Printf("failed to persist baseline stats: %v", err)
+			}
+		}
+	}
+}
+
+func (e *Evaluator) persist(ctx context.Context, db *pgxpool.Pool) error {
+	e.lock.Lock()
+	n := len(e.dirty)
+	templateIDs := make([]int, 0, n)
+	targetIDs := make([]int, 0, n)
+	samples := make([]int64, 0, n)
+	means := make([]float64, 0, n)
+	variances := make([]float64, 0, n)
+	measuredAts := make([]*time.Time, 0, n)
+	for k := range e.dirty {
+		s := e.baselines[k]
+		templateIDs = append(templateIDs, k.templateID)
+		targetIDs = append(targetIDs, k.targetID)
+		samples = append(samples, s.samples)
+		means = append(means, s.mean)
+		variances = append(variances, s.variance)
+		var measuredAt *time.Time
+		if !s.measuredAt.IsZero() {
+			measuredAt = &s.measuredAt
+		}
+		measuredAts = append(measuredAts, measuredAt)
+	}
+	e.dirty = make(map[statsKey]struct{}, n)
+	e.lock.Unlock()
+
+	if n == 0 {
+		return nil
+	}
+	_, err := db.Exec(ctx, `
+		INSERT INTO baseline_stats (template_id, target_id, samples, mean, variance, measured_at, updated_at)
+		SELECT *, now() FROM unnest($1::int[], $2::int[], $3::bigint[], $4::float8[], $5::float8[], $6::timestamptz[])
+		ON CONFLICT (template_id, target_id) DO UPDATE
+			SET samples = EXCLUDED.samples,
+			    mean = EXCLUDED.mean,
+			    variance = EXCLUDED.variance,
+			    measured_at = EXCLUDED.measured_at,
+			    updated_at = EXCLUDED.updated_at`,
+		templateIDs, targetIDs, samples, means, variances, measuredAts)
+	return err
+}
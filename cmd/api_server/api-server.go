@@ -0,0 +1,66 @@
+// File: cmd/api_server/api-server.go
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/okharch/yal/api_alerts"
+)
+
+const dbConnStr = "postgresql://postgres@localhost:5433/postgres?sslmode=disable"
+
+// api-server serves the self-service subscription management API, e.g.
+//
+//	go run ./cmd/api_server -addr :8080
+//
+// Run cmd/listen_changes next to it so condition toggles and new
+// subscriptions are pushed to users.
+func main() {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	flag.Parse()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool, err := pgxpool.New(ctx, dbConnStr)
+	if err != nil {
+		log.Fatalf("failed to connect to database: %v", err)
+	}
+	defer pool.Close()
+
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           api_alerts.NewServer(pool),
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       15 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       time.Minute,
+	}
+
+	// Handle Ctrl-C
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		log.Println("Stopping API server...")
+		shutdownCtx, stop := context.WithTimeout(ctx, 10*time.Second)
+		defer stop()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("failed to shut down: %v", err)
+		}
+	}()
+
+	log.Printf("API listening on %s", *addr)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("%v", err)
+	}
+	log.Println("Exiting...")
+}
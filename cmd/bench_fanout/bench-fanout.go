@@ -0,0 +1,62 @@
+// File: cmd/bench_fanout/bench-fanout.go
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/okharch/yal/ingest_alerts"
+)
+
+const dbConnStr = "postgresql://postgres@localhost:5433/postgres?sslmode=disable"
+
+// bench-fanout measures merge and fan-out throughput of process_alert_staging
+// when part of the subscribers evaluate alerts against their own thresholds,
+// see ingest_alerts.RunFanoutRound. It needs the mock subscriptions (make
+// rebuild) and must not run alongside make alerts; everything it changes is
+// rolled back.
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds) // Include milliseconds
+
+	rounds := flag.Int("rounds", 5, "number of staged batches to merge")
+	overrides := flag.Float64("overrides", 0.5, "share of user_subscription_conditions with a threshold override")
+	spread := flag.Float64("spread", 0.3, "overrides and staged values deviate up to this share of the global threshold")
+	flag.Parse()
+
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, dbConnStr)
+	if err != nil {
+		log.Fatalf("failed to connect to database: %v", err)
+	}
+	defer pool.Close()
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		log.Fatalf("failed to begin: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `CALL recreate_subscription_targets()`); err != nil {
+		log.Fatalf("failed to recreate subscription_targets: %v", err)
+	}
+	updated, err := ingest_alerts.SpreadOverrides(ctx, tx, *overrides, *spread)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("set threshold overrides on %.0f%% of %d user_subscription_conditions", *overrides*100, updated)
+
+	var subscriptions int
+	_ = tx.QueryRow(ctx, `SELECT count(*) FROM user_subscriptions`).Scan(&subscriptions)
+
+	for round := 1; round <= *rounds; round++ {
+		r, err := ingest_alerts.RunFanoutRound(ctx, tx, *spread)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("round %d: staged %d alerts in %s, merged in %s, fetched %d of %d user_subscriptions in %s. %.1f subscriptions per sec",
+			round, r.Staged, r.Stage, r.Merge, r.Notified, subscriptions, r.Fetch,
+			float64(r.Notified)/r.Fetch.Seconds())
+	}
+}
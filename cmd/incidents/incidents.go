@@ -0,0 +1,84 @@
+// File: cmd/incidents/incidents.go
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/okharch/yal/incident_alerts"
+)
+
+const dbConnStr = "postgresql://postgres@localhost:5433/postgres?sslmode=disable"
+
+// incidents lists incidents, moves them through their lifecycle and switches
+// user subscriptions to incident delivery, e.g.
+//
+//	go run ./cmd/incidents
+//	go run ./cmd/incidents -ack 17 -by 'ops desk'
+//	go run ./cmd/incidents -delivery incidents -user-subscription 42
+func main() {
+	all := flag.Bool("all", false, "list resolved incidents too")
+	limit := flag.Int("limit", 50, "number of incidents to list")
+	ack := flag.Int("ack", 0, "acknowledge the incident with this id")
+	by := flag.String("by", "", "who acknowledges, with -ack")
+	resolve := flag.Int("resolve", 0, "resolve the incident with this id")
+	reopen := flag.Int("reopen", 0, "reopen the incident with this id")
+	delivery := flag.String("delivery", "", "set delivery of -user-subscription to 'alerts' or 'incidents'")
+	usID := flag.Int("user-subscription", 0, "user subscription id, with -delivery")
+	flag.Parse()
+
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, dbConnStr)
+	if err != nil {
+		log.Fatalf("failed to connect to database: %v", err)
+	}
+	defer pool.Close()
+
+	switch {
+	case *ack != 0:
+		if err := incident_alerts.Acknowledge(ctx, pool, *ack, *by); err != nil {
+			log.Fatalf("%v", err)
+		}
+		fmt.Printf("incident %d acknowledged by %s\n", *ack, *by)
+
+	case *resolve != 0:
+		if err := incident_alerts.Resolve(ctx, pool, *resolve); err != nil {
+			log.Fatalf("%v", err)
+		}
+		fmt.Printf("incident %d resolved\n", *resolve)
+
+	case *reopen != 0:
+		if err := incident_alerts.Reopen(ctx, pool, *reopen); err != nil {
+			log.Fatalf("%v", err)
+		}
+		fmt.Printf("incident %d reopened\n", *reopen)
+
+	case *delivery != "":
+		if *usID == 0 {
+			log.Fatalf("-delivery needs -user-subscription")
+		}
+		if err := incident_alerts.SetDelivery(ctx, pool, *usID, *delivery); err != nil {
+			log.Fatalf("%v", err)
+		}
+		fmt.Printf("user subscription %d is delivered %s\n", *usID, *delivery)
+
+	default:
+		incidents, err := incident_alerts.List(ctx, pool, *all, *limit)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		for _, i := range incidents {
+			handled := ""
+			if i.AcknowledgedBy != nil {
+				handled = " by " + *i.AcknowledgedBy
+			}
+			fmt.Printf("%d\t%s:%d\t%s%s\tseverity %d\t%d alerts on\topened %s\tupdated %s\n",
+				i.ID, i.Target.Type, i.Target.ID, i.Status, handled, i.Severity, i.Alerts,
+				i.OpenedAt.Format(time.RFC3339), i.UpdatedAt.Format(time.RFC3339))
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/jackc/pgx/v5/pgxpool"
 	_ "github.com/lib/pq"
+	"github.com/okharch/yal/alert_rules"
 	"github.com/okharch/yal/process_alerts"
 	"log"
 	"os"
@@ -24,6 +25,15 @@ func main() {
 	}
 	defer pool.Close()
 
+	// user rules read target attributes, kept fresh
+	targets, err := alert_rules.LoadTargets(ctx, pool)
+	if err != nil {
+		log.Fatalf("failed to load rule targets: %v", err)
+	}
+	go targets.KeepFresh(ctx, pool)
+	process_alerts.SubscriptionRules = alert_rules.NewSubscriptionRules(targets)
+	go process_alerts.PrunePushes(ctx, pool)
+
 	// lsiten for subscription updates when new alerts conditions are created
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -45,6 +55,16 @@ func main() {
 		}
 	}()
 
+	// push the alerts already on to new subscribers and newly enabled conditions
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := process_alerts.ListenForSnapshots(ctx, dbConnStr, pool)
+		if err != nil {
+			log.Printf("error processing user_subscription_snapshots notifications: %s", err)
+		}
+	}()
+
 	// Handle Ctrl-C
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
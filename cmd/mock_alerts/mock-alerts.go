@@ -4,8 +4,11 @@ import (
 	"context"
 	"github.com/jackc/pgx/v5/pgxpool"
 	_ "github.com/lib/pq"
+	"github.com/okharch/yal/alert_rules"
+	"github.com/okharch/yal/baseline_alerts"
 	"github.com/okharch/yal/ingest_alerts"
 	"github.com/okharch/yal/mock_alerts"
+	"github.com/okharch/yal/plugin_alerts"
 	"github.com/okharch/yal/process_alerts"
 	"log"
 	"os"
@@ -25,6 +28,25 @@ func main() {
 	}
 	defer pool.Close()
 
+	baselines, err := baseline_alerts.LoadEvaluator(ctx, pool)
+	if err != nil {
+		log.Fatalf("failed to load baseline evaluator: %v", err)
+	}
+	go baselines.PersistStats(ctx, pool)
+
+	plugins, err := plugin_alerts.LoadEvaluator(ctx, pool)
+	if err != nil {
+		log.Fatalf("failed to load condition plugins: %v", err)
+	}
+	defer plugins.Close(context.Background())
+
+	rules, err := alert_rules.LoadConditionEvaluator(ctx, pool)
+	if err != nil {
+		log.Fatalf("failed to load condition rules: %v", err)
+	}
+	go rules.KeepFresh(ctx, pool)
+	process_alerts.SubscriptionRules = alert_rules.NewSubscriptionRules(rules.Targets())
+
 	go ingest_alerts.IngestAlertData(ctx, pool)
 	go func() {
 		err := process_alerts.ListenForSubscriptionUpdates(ctx, dbConnStr, pool)
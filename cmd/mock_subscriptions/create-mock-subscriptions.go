@@ -10,6 +10,7 @@ import (
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/okharch/yal/subscription_alerts"
 )
 
 const (
@@ -28,13 +29,13 @@ func main() {
 
 	var subscriptionIDs []int
 
-	// 1. Get top 30 destination airports in the U.S.
+	// 1. Get top 30 destination airports in the U.S. that have a code
 	routes, err := dbpool.Query(ctx, `
-		SELECT a.id, a.name
+		SELECT a.id, a.name, COALESCE(NULLIF(a.iata, ''), a.icao)
 		FROM routes r
 		JOIN airports a ON r.destination_airport_id = a.id
-		WHERE a.country = 'United States'
-		GROUP BY a.id, a.name
+		WHERE a.country = 'United States' AND COALESCE(NULLIF(a.iata, ''), NULLIF(a.icao, '')) IS NOT NULL
+		GROUP BY a.id, a.name, a.iata, a.icao
 		ORDER BY count(*) DESC
 		LIMIT 30
 	`)
@@ -45,35 +46,31 @@ func main() {
 
 	for routes.Next() {
 		var id int
-		var name string
-		if err := routes.Scan(&id, &name); err != nil {
+		var name, code string
+		if err := routes.Scan(&id, &name, &code); err != nil {
 			log.Fatal(err)
 		}
 
-		viewName := fmt.Sprintf("subscription_%d", id)
-		viewSQL := fmt.Sprintf(`
-			CREATE OR REPLACE VIEW %s AS
-			SELECT id AS flight_id, source_airport_id, destination_airport_id
-			FROM active_flights
-			WHERE destination_airport_id = %d;
-		`, viewName, id)
+		subscriptionIDs = append(subscriptionIDs, id)
 
-		if _, err := dbpool.Exec(ctx, viewSQL); err != nil {
-			log.Fatalf("Error creating view %s: %v", viewName, err)
+		// keep a subscription that already exists, e.g. edited since the last run
+		var exists bool
+		if err := dbpool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM subscriptions WHERE id = $1)`, id).Scan(&exists); err != nil {
+			log.Fatal(err)
 		}
-
-		if _, err := dbpool.Exec(ctx, `
-			INSERT INTO subscriptions (id, name, view_name)
-			VALUES ($1, $2, $3) ON CONFLICT (id) DO NOTHING
-		`, id, name, viewName); err != nil {
-			log.Fatalf("Error inserting subscription %d: %v", id, err)
+		if exists {
+			continue
+		}
+		spec := &subscription_alerts.Spec{
+			DestinationAirports: []string{code},
+			Targets:             []string{"flight", "source_airport", "destination_airport", "airline"},
+		}
+		if err := subscription_alerts.Save(ctx, dbpool, id, name, spec); err != nil {
+			log.Fatalf("Error saving subscription %d: %v", id, err)
 		}
-
-		subscriptionIDs = append(subscriptionIDs, id)
-
 	}
 
-	log.Println("✅ Subscriptions, views, and subscription_targets_view created.")
+	log.Println("✅ Subscriptions created.")
 
 	// 2. Collect mock users
 	log.Println("Preparing users...")
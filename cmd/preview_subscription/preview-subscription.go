@@ -0,0 +1,144 @@
+// File: cmd/preview_subscription/preview-subscription.go
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/okharch/yal/model"
+	"github.com/okharch/yal/preview_alerts"
+	"github.com/okharch/yal/subscription_alerts"
+)
+
+const dbConnStr = "postgresql://postgres@localhost:5433/postgres?sslmode=disable"
+
+// preview-subscription estimates how many pushes a subscription would produce
+// before a user enables it, by replaying recorded alert history.
+//
+// Example:
+//
+//	go run ./cmd/preview_subscription -spec jfk.yaml -conditions 4,5:25 -since 168h
+//	go run ./cmd/preview_subscription -view subscription_3797 -conditions 4,5:25
+//	go run ./cmd/preview_subscription -targets destination_airport:3797,flight:1234 -conditions 5
+func main() {
+	specFile := flag.String("spec", "", "subscription spec (YAML or JSON) to resolve targets from")
+	viewName := flag.String("view", "", "legacy subscription view to resolve targets from")
+	targets := flag.String("targets", "", "comma separated target_type:target_id list")
+	conditions := flag.String("conditions", "", "comma separated condition_id[:threshold] list")
+	since := flag.Duration("since", 7*24*time.Hour, "replay period ending now")
+	samples := flag.Int("samples", 3, "number of sample payloads to show")
+	flag.Parse()
+
+	req := preview_alerts.Request{
+		ViewName: *viewName,
+		To:       time.Now(),
+		Samples:  *samples,
+	}
+	req.From = req.To.Add(-*since)
+
+	var err error
+	if *specFile != "" {
+		data, err := os.ReadFile(*specFile)
+		if err != nil {
+			log.Fatalf("failed to read -spec: %v", err)
+		}
+		if req.Spec, err = subscription_alerts.Parse(data); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	if req.Targets, err = parseTargets(*targets); err != nil {
+		log.Fatalf("invalid -targets: %v", err)
+	}
+	if req.Conditions, err = parseConditions(*conditions); err != nil {
+		log.Fatalf("invalid -conditions: %v", err)
+	}
+
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, dbConnStr)
+	if err != nil {
+		log.Fatalf("failed to connect to database: %v", err)
+	}
+	defer pool.Close()
+
+	res, err := preview_alerts.Preview(ctx, pool, req)
+	if err != nil {
+		log.Fatalf("preview failed: %v", err)
+	}
+
+	fmt.Printf("Replayed %s .. %s over %d targets\n", res.From.Format(time.RFC3339), res.To.Format(time.RFC3339), res.Targets)
+	fmt.Printf("  notifications:   %d (%.1f per day)\n", res.Notifications, res.PerDay)
+	fmt.Printf("  alert changes:   %d\n", res.AlertChanges)
+	if res.Notifications > 0 {
+		fmt.Printf("  peak push:       %d alerts at %s\n", res.PeakPush.Count, res.PeakPush.At.Format(time.RFC3339))
+		fmt.Printf("  peak hour:       %d notifications from %s\n", res.PeakHour.Count, res.PeakHour.At.Format(time.RFC3339))
+	}
+	conditionIDs := make([]int, 0, len(res.ByCondition))
+	for id := range res.ByCondition {
+		conditionIDs = append(conditionIDs, id)
+	}
+	sort.Ints(conditionIDs)
+	for _, id := range conditionIDs {
+		fmt.Printf("  condition %-5d  %d alert changes\n", id, res.ByCondition[id])
+	}
+	for _, payload := range res.Samples {
+		fmt.Printf("sample: %s\n", payload)
+	}
+	for _, caveat := range res.Caveats {
+		fmt.Printf("approximation: %s\n", caveat)
+	}
+}
+
+func parseTargets(s string) ([]model.Target, error) {
+	var targets []model.Target
+	for _, item := range splitList(s) {
+		kind, id, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("%q is not target_type:target_id", item)
+		}
+		targetID, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", item, err)
+		}
+		targets = append(targets, model.Target{ID: targetID, Type: kind})
+	}
+	return targets, nil
+}
+
+func parseConditions(s string) ([]preview_alerts.ConditionFilter, error) {
+	var conditions []preview_alerts.ConditionFilter
+	for _, item := range splitList(s) {
+		id, threshold, hasThreshold := strings.Cut(item, ":")
+		conditionID, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", item, err)
+		}
+		c := preview_alerts.ConditionFilter{ID: conditionID}
+		if hasThreshold {
+			t, err := strconv.ParseFloat(threshold, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%q: %w", item, err)
+			}
+			c.Threshold = &t
+		}
+		conditions = append(conditions, c)
+	}
+	return conditions, nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,62 @@
+// File: cmd/register_plugin/register-plugin.go
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/okharch/yal/plugin_alerts"
+)
+
+const dbConnStr = "postgresql://postgres@localhost:5433/postgres?sslmode=disable"
+
+// register-plugin stores a WebAssembly condition plugin against a condition
+// template, after checking that it instantiates within its limits, e.g.
+//
+//	go run ./cmd/register_plugin -template wind -wasm plugins/hysteresis.wasm
+func main() {
+	template := flag.String("template", "", "condition template name")
+	wasmPath := flag.String("wasm", "", "plugin module (.wasm)")
+	name := flag.String("name", "", "plugin name, defaults to the file name")
+	fuel := flag.Uint64("fuel", plugin_alerts.DefaultLimits.Fuel, "function calls one evaluation may make")
+	timeout := flag.Duration("timeout", plugin_alerts.DefaultLimits.Timeout, "wall-clock limit of one evaluation")
+	memoryPages := flag.Uint("memory-pages", uint(plugin_alerts.DefaultLimits.MemoryPages), "memory limit in 64 KiB pages")
+	flag.Parse()
+
+	if *template == "" || *wasmPath == "" {
+		log.Fatalf("-template and -wasm are required")
+	}
+	if *fuel == 0 {
+		log.Fatalf("-fuel must be positive")
+	}
+	if *timeout < time.Millisecond {
+		log.Fatalf("-timeout must be at least 1ms")
+	}
+	if *name == "" {
+		*name = strings.TrimSuffix(filepath.Base(*wasmPath), ".wasm")
+	}
+	wasm, err := os.ReadFile(*wasmPath)
+	if err != nil {
+		log.Fatalf("failed to read plugin: %v", err)
+	}
+
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, dbConnStr)
+	if err != nil {
+		log.Fatalf("failed to connect to database: %v", err)
+	}
+	defer pool.Close()
+
+	limits := plugin_alerts.Limits{Fuel: *fuel, Timeout: *timeout, MemoryPages: uint32(*memoryPages)}
+	if err := plugin_alerts.Register(ctx, pool, *template, *name, wasm, limits); err != nil {
+		log.Fatalf("failed to register plugin: %v", err)
+	}
+	fmt.Printf("plugin %s registered for %s, restart ingestion to load it\n", *name, *template)
+}
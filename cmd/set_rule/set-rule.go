@@ -0,0 +1,63 @@
+// File: cmd/set_rule/set-rule.go
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/okharch/yal/alert_rules"
+)
+
+const dbConnStr = "postgresql://postgres@localhost:5433/postgres?sslmode=disable"
+
+// set-rule validates an expression rule and stores it on a condition or a
+// user subscription condition. Syntax errors are reported and nothing is
+// stored. With -payload the rule is only tried on a sample payload, e.g.
+//
+//	go run ./cmd/set_rule -rule 'payload.precip_mm > 10 && payload.temp_c < 2' -payload '{"precip_mm": 12, "temp_c": 0}'
+func main() {
+	conditionID := flag.Int("condition", 0, "condition id to set the rule on")
+	uscID := flag.Int("subscription-condition", 0, "user subscription condition id to set the rule on")
+	rule := flag.String("rule", "", "rule expression, empty removes the rule")
+	payload := flag.String("payload", "", "try the rule on this JSON payload instead of storing it")
+	value := flag.Float64("value", 0, "value to try the rule with")
+	flag.Parse()
+
+	if *rule != "" {
+		p, err := alert_rules.Compile(*rule)
+		if err != nil {
+			log.Fatalf("invalid rule: %v", err)
+		}
+		if *payload != "" {
+			on, err := p.Eval(alert_rules.NewEnv(*payload, *value, true, map[string]interface{}{}))
+			if err != nil {
+				log.Fatalf("rule failed: %v", err)
+			}
+			fmt.Printf("rule is valid and evaluates to %v\n", on)
+			return
+		}
+	}
+	if (*conditionID == 0) == (*uscID == 0) {
+		log.Fatalf("set exactly one of -condition and -subscription-condition")
+	}
+
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, dbConnStr)
+	if err != nil {
+		log.Fatalf("failed to connect to database: %v", err)
+	}
+	defer pool.Close()
+
+	if *conditionID != 0 {
+		err = alert_rules.SetConditionRule(ctx, pool, *conditionID, *rule)
+	} else {
+		err = alert_rules.SetSubscriptionConditionRule(ctx, pool, *uscID, *rule)
+	}
+	if err != nil {
+		log.Fatalf("failed to set rule: %v", err)
+	}
+	fmt.Println("rule stored")
+}
@@ -0,0 +1,103 @@
+// File: cmd/shadow_report/shadow-report.go
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const dbConnStr = "postgresql://postgres@localhost:5433/postgres?sslmode=disable"
+
+// shadow-report compares shadow conditions with the live conditions they
+// shadow: how many transitions and affected user subscriptions each
+// threshold produced over the chosen period.
+func main() {
+	shadowID := flag.Int("shadow", 0, "shadow condition id, 0 reports every active shadow condition")
+	since := flag.Duration("since", 24*time.Hour, "report period ending now, ignored when -from is set")
+	from := flag.String("from", "", "period start (RFC3339)")
+	to := flag.String("to", "", "period end (RFC3339), defaults to now")
+	flag.Parse()
+
+	periodTo := time.Now()
+	if *to != "" {
+		t, err := time.Parse(time.RFC3339, *to)
+		if err != nil {
+			log.Fatalf("invalid -to: %v", err)
+		}
+		periodTo = t
+	}
+	periodFrom := periodTo.Add(-*since)
+	if *from != "" {
+		t, err := time.Parse(time.RFC3339, *from)
+		if err != nil {
+			log.Fatalf("invalid -from: %v", err)
+		}
+		periodFrom = t
+	}
+
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, dbConnStr)
+	if err != nil {
+		log.Fatalf("failed to connect to database: %v", err)
+	}
+	defer pool.Close()
+
+	rows, err := pool.Query(ctx, `
+		SELECT s.id, ct.name, s.description
+		FROM shadow_conditions s
+		JOIN conditions c ON c.id = s.condition_id
+		JOIN condition_templates ct ON ct.id = c.template_id
+		WHERE ($1 = 0 AND s.is_active) OR s.id = $1
+		ORDER BY s.id`, *shadowID)
+	if err != nil {
+		log.Fatalf("failed to fetch shadow conditions: %v", err)
+	}
+	type shadow struct {
+		id          int
+		name        string
+		description *string
+	}
+	var shadows []shadow
+	for rows.Next() {
+		var s shadow
+		if err := rows.Scan(&s.id, &s.name, &s.description); err != nil {
+			log.Fatal(err)
+		}
+		shadows = append(shadows, s)
+	}
+	rows.Close()
+	if len(shadows) == 0 {
+		log.Fatalf("no shadow conditions to report")
+	}
+
+	fmt.Printf("Shadow report %s .. %s\n", periodFrom.Format(time.RFC3339), periodTo.Format(time.RFC3339))
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "\nSHADOW\tCONDITION\tSOURCE\tTHRESHOLD\tTRANSITIONS\tTURNED ON\tTARGETS\tUSER SUBSCRIPTIONS")
+	for _, s := range shadows {
+		rows, err := pool.Query(ctx, `SELECT * FROM shadow_report($1, $2, $3)`, s.id, periodFrom, periodTo)
+		if err != nil {
+			log.Fatalf("failed to build report for shadow condition %d: %v", s.id, err)
+		}
+		for rows.Next() {
+			var source string
+			var threshold float64
+			var transitions, turnedOn, targets, userSubs int64
+			if err := rows.Scan(&source, &threshold, &transitions, &turnedOn, &targets, &userSubs); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%g\t%d\t%d\t%d\t%d\n", s.id, s.name, source, threshold, transitions, turnedOn, targets, userSubs)
+		}
+		rows.Close()
+		if s.description != nil {
+			fmt.Fprintf(w, "\t%s\n", *s.description)
+		}
+	}
+	_ = w.Flush()
+}
@@ -0,0 +1,107 @@
+// File: cmd/subscription_spec/subscription-spec.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/okharch/yal/subscription_alerts"
+)
+
+const dbConnStr = "postgresql://postgres@localhost:5433/postgres?sslmode=disable"
+
+// subscription-spec validates and saves declarative subscriptions, e.g.
+//
+//	go run ./cmd/subscription_spec -file jfk.yaml -check
+//	go run ./cmd/subscription_spec -id 3797 -name 'JFK arrivals' -file jfk.yaml
+//	go run ./cmd/subscription_spec -show 3797
+//
+// with jfk.yaml like
+//
+//	destination_airports: [JFK]
+//	airlines: [AA, DL]
+//	targets: [flight, destination_airport, airline]
+//
+// or, for everything arriving within 200 km of Chicago,
+//
+//	areas:
+//	  - {lat: 41.88, lon: -87.63, radius_km: 200, end: destination}
+func main() {
+	file := flag.String("file", "", "spec file, YAML or JSON")
+	check := flag.Bool("check", false, "validate the spec and list the targets it resolves to, without saving")
+	id := flag.Int("id", 0, "subscription id to save the spec as")
+	name := flag.String("name", "", "subscription name")
+	show := flag.Int("show", 0, "print the spec of this subscription")
+	flag.Parse()
+
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, dbConnStr)
+	if err != nil {
+		log.Fatalf("failed to connect to database: %v", err)
+	}
+	defer pool.Close()
+
+	if *show != 0 {
+		spec, err := subscription_alerts.Load(ctx, pool, *show)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if spec == nil {
+			log.Fatalf("subscription %d is not defined by a spec", *show)
+		}
+		out, _ := json.MarshalIndent(spec, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+
+	if *file == "" {
+		log.Fatalf("-file is required")
+	}
+	data, err := os.ReadFile(*file)
+	if err != nil {
+		log.Fatalf("failed to read %s: %v", *file, err)
+	}
+	spec, err := subscription_alerts.Parse(data)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	if *check {
+		if err := spec.Validate(ctx, pool); err != nil {
+			log.Fatalf("%v", err)
+		}
+		targets, err := spec.Resolve(ctx, pool)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		counts := make(map[string]int)
+		for _, t := range targets {
+			counts[t.Type]++
+		}
+		fmt.Printf("spec is valid, %d targets right now\n", len(targets))
+		if len(spec.Areas) > 0 {
+			within, err := subscription_alerts.AirportsWithin(ctx, pool, spec.Areas)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			fmt.Printf("  %d airports inside the areas\n", len(within))
+		}
+		for kind, n := range counts {
+			fmt.Printf("  %-20s %d\n", kind, n)
+		}
+		return
+	}
+
+	if *id == 0 || *name == "" {
+		log.Fatalf("-id and -name are required to save a spec")
+	}
+	if err := subscription_alerts.Save(ctx, pool, *id, *name, spec); err != nil {
+		log.Fatalf("%v", err)
+	}
+	fmt.Printf("subscription %d saved and its targets resolved\n", *id)
+}
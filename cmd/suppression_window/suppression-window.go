@@ -0,0 +1,119 @@
+// File: cmd/suppression_window/suppression-window.go
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/okharch/yal/model"
+	"github.com/okharch/yal/window_alerts"
+)
+
+const dbConnStr = "postgresql://postgres@localhost:5433/postgres?sslmode=disable"
+
+// suppression-window schedules, lists and ends suppression windows, e.g.
+//
+//	go run ./cmd/suppression_window -target destination_airport:3797 -from 2025-06-01T22:00:00Z -for 6h -reason 'runway 09L works'
+//	go run ./cmd/suppression_window -list
+//	go run ./cmd/suppression_window -end 12
+func main() {
+	targetFlag := flag.String("target", "", "target as type:id, e.g. destination_airport:3797 or flight:1234")
+	conditionID := flag.Int("condition", 0, "suppress only this condition, 0 suppresses all")
+	from := flag.String("from", "", "start as RFC3339, defaults to now")
+	until := flag.String("until", "", "end as RFC3339")
+	duration := flag.Duration("for", 0, "length of the window, instead of -until")
+	reason := flag.String("reason", "", "why alerts are suppressed")
+	list := flag.Bool("list", false, "list windows that have not ended")
+	all := flag.Bool("all", false, "with -list, include ended windows")
+	end := flag.Int("end", 0, "end (or cancel a scheduled) window with this id now")
+	flag.Parse()
+
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, dbConnStr)
+	if err != nil {
+		log.Fatalf("failed to connect to database: %v", err)
+	}
+	defer pool.Close()
+
+	switch {
+	case *list:
+		windows, err := window_alerts.List(ctx, pool, *all)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		now := time.Now()
+		for _, w := range windows {
+			condition := "all conditions"
+			if w.ConditionID != nil {
+				condition = fmt.Sprintf("condition %d", *w.ConditionID)
+			}
+			state := "scheduled"
+			if w.Active(now) {
+				state = "active"
+			} else if !now.Before(w.EndsAt) {
+				state = "ended"
+			}
+			fmt.Printf("%d\t%s:%d\t%s\t%s - %s\t%s\t%s\n", w.ID, w.Target.Type, w.Target.ID, condition,
+				w.StartsAt.Format(time.RFC3339), w.EndsAt.Format(time.RFC3339), state, w.Reason)
+		}
+
+	case *end != 0:
+		if err := window_alerts.End(ctx, pool, *end); err != nil {
+			log.Fatalf("%v", err)
+		}
+		fmt.Printf("suppression window %d ended, alerts still on are delivered within seconds\n", *end)
+
+	default:
+		var w window_alerts.Window
+		if *targetFlag == "" {
+			log.Fatalf("-target is required")
+		}
+		if w.Target, err = parseTarget(*targetFlag); err != nil {
+			log.Fatalf("%v", err)
+		}
+		if *conditionID != 0 {
+			w.ConditionID = conditionID
+		}
+		w.StartsAt = time.Now()
+		if *from != "" {
+			if w.StartsAt, err = time.Parse(time.RFC3339, *from); err != nil {
+				log.Fatalf("invalid -from: %v", err)
+			}
+		}
+		switch {
+		case *until != "":
+			if w.EndsAt, err = time.Parse(time.RFC3339, *until); err != nil {
+				log.Fatalf("invalid -until: %v", err)
+			}
+		case *duration > 0:
+			w.EndsAt = w.StartsAt.Add(*duration)
+		default:
+			log.Fatalf("set -until or -for")
+		}
+		w.Reason = *reason
+		id, err := window_alerts.Add(ctx, pool, w)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		fmt.Printf("suppression window %d scheduled from %s until %s\n", id,
+			w.StartsAt.Format(time.RFC3339), w.EndsAt.Format(time.RFC3339))
+	}
+}
+
+func parseTarget(s string) (model.Target, error) {
+	kind, id, ok := strings.Cut(s, ":")
+	if !ok {
+		return model.Target{}, fmt.Errorf("%q is not target_type:target_id", s)
+	}
+	targetID, err := strconv.Atoi(id)
+	if err != nil {
+		return model.Target{}, fmt.Errorf("%q: %w", s, err)
+	}
+	return model.Target{ID: targetID, Type: kind}, nil
+}
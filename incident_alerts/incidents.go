@@ -0,0 +1,109 @@
+package incident_alerts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/okharch/yal/model"
+)
+
+// Incident statuses, see incident_status.
+const (
+	Open         = "open"
+	Acknowledged = "acknowledged"
+	Resolved     = "resolved"
+)
+
+// Incident groups related alerts of a target and its flights, see incidents.
+type Incident struct {
+	ID             int
+	Target         model.Target
+	Status         string
+	Severity       int
+	OpenedAt       time.Time
+	AcknowledgedAt *time.Time
+	AcknowledgedBy *string
+	ResolvedAt     *time.Time
+	UpdatedAt      time.Time
+	Alerts         int // alerts of the incident that are on
+}
+
+// List returns the incidents that are not resolved, or all of them, most
+// recently updated first.
+func List(ctx context.Context, db *pgxpool.Pool, all bool, limit int) ([]Incident, error) {
+	rows, err := db.Query(ctx, `
+		SELECT i.id, i.target_id, i.target_type::text, i.status::text, i.severity, i.opened_at,
+		       i.acknowledged_at, i.acknowledged_by, i.resolved_at, i.updated_at,
+		       (SELECT count(*) FROM alerts a WHERE a.incident_id = i.id AND a.is_on AND NOT a.suppressed)
+		FROM incidents i
+		WHERE $1 OR i.status <> 'resolved'
+		ORDER BY i.updated_at DESC, i.id DESC
+		LIMIT $2`, all, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list incidents: %w", err)
+	}
+	defer rows.Close()
+	var incidents []Incident
+	for rows.Next() {
+		var i Incident
+		if err := rows.Scan(&i.ID, &i.Target.ID, &i.Target.Type, &i.Status, &i.Severity, &i.OpenedAt,
+			&i.AcknowledgedAt, &i.AcknowledgedBy, &i.ResolvedAt, &i.UpdatedAt, &i.Alerts); err != nil {
+			return nil, err
+		}
+		incidents = append(incidents, i)
+	}
+	return incidents, rows.Err()
+}
+
+// Acknowledge marks an incident as being handled by `by`.
+func Acknowledge(ctx context.Context, db *pgxpool.Pool, id int, by string) error {
+	if by == "" {
+		return errors.New("acknowledging needs who handles the incident")
+	}
+	return setStatus(ctx, db, id, Acknowledged, by)
+}
+
+// Resolve closes an incident. It is reopened when one of its alerts changes
+// while on.
+func Resolve(ctx context.Context, db *pgxpool.Pool, id int) error {
+	return setStatus(ctx, db, id, Resolved, "")
+}
+
+// Reopen opens an acknowledged or resolved incident again.
+func Reopen(ctx context.Context, db *pgxpool.Pool, id int) error {
+	return setStatus(ctx, db, id, Open, "")
+}
+
+func setStatus(ctx context.Context, db *pgxpool.Pool, id int, status, by string) error {
+	var byArg *string
+	if by != "" {
+		byArg = &by
+	}
+	_, err := db.Exec(ctx, `CALL set_incident_status($1, $2::incident_status, $3)`, id, status, byArg)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "P0002" { // no_data_found
+		return fmt.Errorf("no incident %d", id)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set incident %d %s: %w", id, status, err)
+	}
+	return nil
+}
+
+// SetDelivery switches a user subscription between being pushed every alert
+// ("alerts") and incident updates ("incidents").
+func SetDelivery(ctx context.Context, db *pgxpool.Pool, userSubscriptionID int, mode string) error {
+	tag, err := db.Exec(ctx, `UPDATE user_subscriptions SET delivery = $2::delivery_mode WHERE id = $1`,
+		userSubscriptionID, mode)
+	if err != nil {
+		return fmt.Errorf("failed to set delivery: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("no user subscription %d", userSubscriptionID)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package ingest_alerts
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// connectionsInterval is how late a connection is found at risk after the
+// delay of its inbound leg changed.
+const connectionsInterval = 30 * time.Second
+
+// DelayedStatusMinutes is the delay assumed for a flight whose status is
+// 'delayed' when no delay alert says better.
+var DelayedStatusMinutes = 30.0
+
+// MinimumConnectionMinutes is the minimum connection time of airports
+// without one in minimum_connection_times.
+var MinimumConnectionMinutes = 60
+
+// connectionRisks returns a row of the connection_at_risk measurement of
+// every tracked itinerary connection, see connection_risks. The rows are
+// staged like any other, so the alert follows inhibition, suppression and
+// per-user thresholds.
+func connectionRisks(ctx context.Context, pgxPool *pgxpool.Pool) [][]interface{} {
+	rows, err := pgxPool.Query(ctx, `
+		SELECT condition_id, connection_id, is_on, payload, value FROM connection_risks($1, $2)`,
+		DelayedStatusMinutes, MinimumConnectionMinutes)
+	if err != nil {
+		log.Printf("failed to estimate connection risks: %v", err)
+		return nil
+	}
+	defer rows.Close()
+	now := time.Now()
+	var risks [][]interface{}
+	for rows.Next() {
+		var conditionID, connectionID int
+		var isOn bool
+		var payload string
+		var value float64
+		if err := rows.Scan(&conditionID, &connectionID, &isOn, &payload, &value); err != nil {
+			log.Printf("failed to read connection risk: %v", err)
+			return nil
+		}
+		risks = append(risks, []interface{}{conditionID, connectionID, isOn, payload, now, value})
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("failed to estimate connection risks: %v", err)
+		return nil
+	}
+	return risks
+}
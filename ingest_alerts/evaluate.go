@@ -0,0 +1,85 @@
+package ingest_alerts
+
+import "sync"
+
+// Positions of the fields in an AlertData row.
+const (
+	ColConditionID = iota
+	ColTargetID
+	ColIsOn
+	ColPayload
+	ColReceivedAt
+	ColValue
+)
+
+// Evaluator decides is_on for the rows of the conditions it is registered
+// for. It is called by IngestAlertData before a row is staged and may
+// rewrite any field of the row in place.
+type Evaluator interface {
+	Evaluate(row []interface{})
+}
+
+// Deferrer is an Evaluator too slow to run in the ingest loop, e.g. a
+// WebAssembly plugin. The loop offers it the row with Defer instead of
+// calling Evaluate. Once it has taken the row, it evaluates it off the loop
+// and calls resume, which runs the evaluators after it and stages the row.
+// A Deferrer that is behind returns false and the row goes on without it.
+type Deferrer interface {
+	Evaluator
+	Defer(row []interface{}, resume func()) bool
+}
+
+// resumed are the deferred rows ready to be staged.
+var resumed = make(chan []interface{}, bufferSize)
+
+var (
+	evaluators     = make(map[int][]Evaluator)
+	evaluatorsLock sync.RWMutex
+)
+
+// RegisterEvaluator makes e evaluate every ingested row of conditionID.
+// Evaluators of a condition run in registration order, each seeing the row as
+// rewritten by the previous one. Registering e again has no effect.
+func RegisterEvaluator(conditionID int, e Evaluator) {
+	evaluatorsLock.Lock()
+	defer evaluatorsLock.Unlock()
+	for _, registered := range evaluators[conditionID] {
+		if registered == e {
+			return
+		}
+	}
+	evaluators[conditionID] = append(evaluators[conditionID], e)
+}
+
+// evaluate runs the evaluators of row and reports whether it is ready to be
+// staged; otherwise a Deferrer took it over and it arrives on resumed.
+func evaluate(row []interface{}) bool {
+	conditionID, ok := row[ColConditionID].(int)
+	if !ok {
+		return true
+	}
+	evaluatorsLock.RLock()
+	registered := evaluators[conditionID]
+	evaluatorsLock.RUnlock()
+	return evaluateWith(row, registered)
+}
+
+func evaluateWith(row []interface{}, registered []Evaluator) bool {
+	for i, e := range registered {
+		d, ok := e.(Deferrer)
+		if !ok {
+			e.Evaluate(row)
+			continue
+		}
+		rest := registered[i+1:]
+		resume := func() {
+			if evaluateWith(row, rest) {
+				resumed <- row
+			}
+		}
+		if d.Defer(row, resume) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,62 @@
+package ingest_alerts
+
+import (
+	"testing"
+	"time"
+)
+
+// appendValue appends its name to the value of a row.
+type appendValue string
+
+func (e appendValue) Evaluate(row []interface{}) {
+	row[ColValue] = row[ColValue].(string) + string(e)
+}
+
+// deferValue is an appendValue evaluated on a goroutine, unless behind.
+type deferValue struct {
+	appendValue
+	behind bool
+}
+
+func (e deferValue) Defer(row []interface{}, resume func()) bool {
+	if e.behind {
+		return false
+	}
+	go func() {
+		e.Evaluate(row)
+		resume()
+	}()
+	return true
+}
+
+func TestEvaluateDeferred(t *testing.T) {
+	tests := []struct {
+		name       string
+		evaluators []Evaluator
+		deferred   bool
+		want       string
+	}{
+		{"in place", []Evaluator{appendValue("a"), appendValue("b")}, false, "ab"},
+		{"deferred", []Evaluator{appendValue("a"), deferValue{appendValue: "p"}, appendValue("b")}, true, "apb"},
+		{"deferred twice", []Evaluator{deferValue{appendValue: "p"}, deferValue{appendValue: "q"}, appendValue("b")}, true, "pqb"},
+		{"behind", []Evaluator{appendValue("a"), deferValue{appendValue: "p", behind: true}, appendValue("b")}, false, "ab"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			row := []interface{}{1, 2, true, "{}", time.Now(), ""}
+			if ready := evaluateWith(row, tt.evaluators); ready == tt.deferred {
+				t.Fatalf("evaluateWith returned %v, want %v", ready, !tt.deferred)
+			}
+			if tt.deferred {
+				select {
+				case row = <-resumed:
+				case <-time.After(time.Second):
+					t.Fatal("deferred row was not resumed")
+				}
+			}
+			if got := row[ColValue]; got != tt.want {
+				t.Errorf("got value %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
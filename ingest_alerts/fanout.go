@@ -0,0 +1,91 @@
+package ingest_alerts
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// FanoutRound is what one merge of a batch took, see RunFanoutRound.
+type FanoutRound struct {
+	Staged   int64 // alerts staged
+	Notified int   // user subscriptions notified, and fetched
+	Stage    time.Duration
+	Merge    time.Duration
+	Fetch    time.Duration
+}
+
+// SpreadOverrides overrides the threshold of the share overrides of
+// user_subscription_conditions (and removes the others) with a value up to
+// spread away from the global one, e.g. 25 and 40 knots around 30. It
+// returns the number of rows updated.
+func SpreadOverrides(ctx context.Context, tx pgx.Tx, overrides, spread float64) (int64, error) {
+	tag, err := tx.Exec(ctx, `
+		UPDATE user_subscription_conditions usc
+		SET threshold = CASE WHEN random() < $1
+			THEN round(c.threshold * (1 + (random() * 2 - 1) * $2))::int END
+		FROM conditions c
+		WHERE c.id = usc.condition_id`, overrides, spread)
+	if err != nil {
+		return 0, fmt.Errorf("failed to set threshold overrides: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// RunFanoutRound stages a value up to spread away from the global threshold
+// for every condition of every subscribed target, merges the batch and
+// fetches the pushes of every user subscription it notified. The round runs
+// in a savepoint of tx that is rolled back, so rounds start from the same
+// alerts and the caller rolls tx back to leave the database as it was.
+// Pushes are fetched one after another on tx's connection.
+func RunFanoutRound(ctx context.Context, tx pgx.Tx, spread float64) (FanoutRound, error) {
+	var r FanoutRound
+	sp, err := tx.Begin(ctx)
+	if err != nil {
+		return r, err
+	}
+	defer sp.Rollback(ctx)
+
+	start := time.Now()
+	tag, err := sp.Exec(ctx, `
+		INSERT INTO alerts_staging (condition_id, target_id, is_on, payload, received_at, value)
+		SELECT v.condition_id, v.target_id, threshold_crossed(v.direction, v.value, v.threshold),
+		       '{"helper": "bench"}', now(), v.value
+		FROM (
+			SELECT DISTINCT c.id AS condition_id, st.target_id, ct.direction, c.threshold,
+			       c.threshold * (1 + (random() * 2 - 1) * $1) AS value
+			FROM subscription_targets st
+			JOIN condition_templates ct ON ct.target_type = st.target_type
+			JOIN conditions c ON c.template_id = ct.id
+		) v`, spread)
+	if err != nil {
+		return r, fmt.Errorf("failed to stage alerts: %w", err)
+	}
+	r.Staged, r.Stage = tag.RowsAffected(), time.Since(start)
+
+	start = time.Now()
+	if _, err := sp.Exec(ctx, `CALL process_alert_staging()`); err != nil {
+		return r, fmt.Errorf("failed to process alert staging: %w", err)
+	}
+	r.Merge = time.Since(start)
+
+	// alerts_triggered_at is set to the transaction's now(), the same in
+	// every round: the savepoint clears it again
+	var ids []int32
+	err = sp.QueryRow(ctx, `
+		SELECT COALESCE(array_agg(id), '{}') FROM user_subscriptions WHERE alerts_triggered_at = now()`).Scan(&ids)
+	if err != nil {
+		return r, fmt.Errorf("failed to fetch notified subscriptions: %w", err)
+	}
+	start = time.Now()
+	for _, id := range ids {
+		var alertsJSON string
+		if err := sp.QueryRow(ctx, `SELECT get_alerts_json($1)`, id).Scan(&alertsJSON); err != nil {
+			return r, fmt.Errorf("failed to fetch alerts JSON for subscription %d: %w", id, err)
+		}
+	}
+	r.Notified, r.Fetch = len(ids), time.Since(start)
+	return r, nil
+}
@@ -0,0 +1,66 @@
+package ingest_alerts
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/okharch/yal/testdb"
+)
+
+// minFanoutSubscriptions is the fan-out the pipeline is sized for.
+const minFanoutSubscriptions = 1000
+
+// BenchmarkFanout merges batches that flip alerts around the global
+// thresholds, without overrides and with overrides on half of the
+// subscribers, and fetches the pushes of every notified user subscription,
+// like cmd/bench_fanout. It fails when a merge notifies fewer than
+// minFanoutSubscriptions or the overrides halve the throughput. Needs the
+// mock subscriptions (make rebuild); everything is rolled back:
+//
+//	YAL_TEST_DB=... go test ./ingest_alerts -run '^$' -bench Fanout -benchtime 5x
+func BenchmarkFanout(b *testing.B) {
+	db := testdb.Connect(b)
+	var subscriptions int
+	if err := db.QueryRow(context.Background(), `SELECT count(*) FROM user_subscriptions`).Scan(&subscriptions); err != nil {
+		b.Fatal(err)
+	}
+	if subscriptions < minFanoutSubscriptions {
+		b.Skipf("%d user subscriptions, need %d: run make rebuild", subscriptions, minFanoutSubscriptions)
+	}
+
+	throughput := map[float64]float64{}
+	for _, overrides := range []float64{0, 0.5} {
+		b.Run(fmt.Sprintf("overrides=%.0f%%", overrides*100), func(b *testing.B) {
+			testdb.Tx(b, db, func(ctx context.Context, tx pgx.Tx) {
+				if _, err := tx.Exec(ctx, `CALL recreate_subscription_targets()`); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := SpreadOverrides(ctx, tx, overrides, 0.3); err != nil {
+					b.Fatal(err)
+				}
+				notified, minNotified := 0, subscriptions
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					r, err := RunFanoutRound(ctx, tx, 0.3)
+					if err != nil {
+						b.Fatal(err)
+					}
+					notified += r.Notified
+					minNotified = min(minNotified, r.Notified)
+				}
+				b.StopTimer()
+				if minNotified < minFanoutSubscriptions {
+					b.Errorf("a merge notified %d user subscriptions, want at least %d", minNotified, minFanoutSubscriptions)
+				}
+				throughput[overrides] = float64(notified) / b.Elapsed().Seconds()
+				b.ReportMetric(throughput[overrides], "subscriptions/s")
+				b.ReportMetric(float64(notified)/float64(b.N), "subscriptions/op")
+			})
+		})
+	}
+	if without, with := throughput[0], throughput[0.5]; without > 0 && with > 0 && with < without/2 {
+		b.Errorf("overrides cut fan-out from %.0f to %.0f subscriptions/s", without, with)
+	}
+}
@@ -0,0 +1,36 @@
+package ingest_alerts
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const historyMaintenanceInterval = time.Hour
+
+// HistoryRetentionDays is how long alert_transitions and
+// subscription_target_events are kept.
+var HistoryRetentionDays = 30
+
+// maintainHistory creates upcoming alert_transitions partitions and drops
+// expired ones, see maintain_alert_transitions, and forgets expired target
+// events.
+func maintainHistory(ctx context.Context, pgxPool *pgxpool.Pool) {
+	ticker := time.NewTicker(historyMaintenanceInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := pgxPool.Exec(ctx, `CALL maintain_alert_transitions(2, $1)`, HistoryRetentionDays); err != nil {
+			log.Printf("failed to maintain alert_transitions: %v", err)
+		}
+		if _, err := pgxPool.Exec(ctx, `DELETE FROM subscription_target_events WHERE recorded_at < now() - make_interval(days => $1)`, HistoryRetentionDays); err != nil {
+			log.Printf("failed to prune subscription_target_events: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
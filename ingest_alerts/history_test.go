@@ -0,0 +1,160 @@
+package ingest_alerts
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/okharch/yal/testdb"
+)
+
+// Two merges are two batches: alerts_as_of between them returns the state
+// the first one left, and the transitions land in the day's partition.
+func TestAlertsAsOf(t *testing.T) {
+	db := testdb.Connect(t)
+	testdb.Tx(t, db, func(ctx context.Context, tx pgx.Tx) {
+		if _, err := tx.Exec(ctx, `CALL maintain_alert_transitions()`); err != nil {
+			t.Fatal(err)
+		}
+		var conditionID, airportID int
+		var targetType string
+		err := tx.QueryRow(ctx, `
+			SELECT c.id, ct.target_type::text, (SELECT min(id) FROM airports)
+			FROM conditions c JOIN condition_templates ct ON ct.id = c.template_id
+			WHERE ct.name = 'temperature'
+			ORDER BY c.id LIMIT 1`).Scan(&conditionID, &targetType, &airportID)
+		if err != nil {
+			t.Fatalf("no temperature condition: %v", err)
+		}
+		merge := func(isOn bool, value float64) {
+			t.Helper()
+			if _, err := tx.Exec(ctx, `
+				INSERT INTO alerts_staging (condition_id, target_id, is_on, payload, received_at, value)
+				VALUES ($1, $2, $3, '{}', clock_timestamp(), $4)`, conditionID, airportID, isOn, value); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tx.Exec(ctx, `CALL process_alert_staging()`); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// off first, whatever the feed left on the airport
+		merge(false, 20)
+		var logged int64
+		if err := tx.QueryRow(ctx, `SELECT COALESCE(max(id), 0) FROM alert_transitions`).Scan(&logged); err != nil {
+			t.Fatal(err)
+		}
+		merge(true, 40)
+		merge(false, 20)
+
+		type transition struct {
+			batch     int64
+			isOn      bool
+			partition string
+		}
+		rows, err := tx.Query(ctx, `
+			SELECT t.batch_id, t.is_on,
+			       (SELECT tableoid::regclass::text FROM alert_transitions WHERE id = t.id AND recorded_at = t.recorded_at)
+			FROM target_transitions($1, $2::target_type) t
+			WHERE t.id > $3 AND t.condition_id = $4`, airportID, targetType, logged, conditionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		transitions, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (transition, error) {
+			var tr transition
+			err := row.Scan(&tr.batch, &tr.isOn, &tr.partition)
+			return tr, err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(transitions) != 2 || !transitions[0].isOn || transitions[1].isOn {
+			t.Fatalf("got transitions %+v, want on then off", transitions)
+		}
+		first, second := transitions[0].batch, transitions[1].batch
+		if first >= second {
+			t.Errorf("batch ids %d then %d, want increasing", first, second)
+		}
+		var today string
+		if err := tx.QueryRow(ctx, `SELECT 'alert_transitions_' || to_char(current_date, 'YYYYMMDD')`).Scan(&today); err != nil {
+			t.Fatal(err)
+		}
+		for _, tr := range transitions {
+			if tr.partition != today {
+				t.Errorf("batch %d landed in %s, want %s", tr.batch, tr.partition, today)
+			}
+		}
+
+		// now() is the same for the whole transaction: move the first batch an
+		// hour back to look between the two
+		if _, err := tx.Exec(ctx, `
+			UPDATE alert_transitions SET recorded_at = now() - interval '1 hour'
+			WHERE batch_id = $1 AND condition_id = $2`, first, conditionID); err != nil {
+			t.Fatal(err)
+		}
+		tests := []struct {
+			name      string
+			at        string
+			wantOn    bool
+			wantBatch int64
+		}{
+			{"between the batches", "30 minutes", true, first},
+			{"after the second batch", "0 minutes", false, second},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				var isOn bool
+				var batch int64
+				err := tx.QueryRow(ctx, `
+					SELECT is_on, batch_id
+					FROM alerts_as_of($1, $2::target_type, now() - $3::interval)
+					WHERE condition_id = $4`, airportID, targetType, tt.at, conditionID).Scan(&isOn, &batch)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if isOn != tt.wantOn || batch != tt.wantBatch {
+					t.Errorf("got is_on %v in batch %d, want %v in batch %d", isOn, batch, tt.wantOn, tt.wantBatch)
+				}
+			})
+		}
+	})
+}
+
+// Rows that landed in the default partition move into the partition
+// maintain_alert_transitions creates for their day.
+func TestMaintainAlertTransitionsMovesDefault(t *testing.T) {
+	db := testdb.Connect(t)
+	testdb.Tx(t, db, func(ctx context.Context, tx pgx.Tx) {
+		var id int64
+		err := tx.QueryRow(ctx, `
+			INSERT INTO alert_transitions (batch_id, alert_id, condition_id, target_id, target_type, is_on,
+			                               old_suppressed, suppressed, payload, received_at, recorded_at)
+			VALUES (nextval('alert_batch_seq'), 0, 0, 0, 'flight', true, false, false, '{}', now(),
+			        current_date + 10)
+			RETURNING id`).Scan(&id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		partition := func() string {
+			t.Helper()
+			var name string
+			if err := tx.QueryRow(ctx, `SELECT tableoid::regclass::text FROM alert_transitions WHERE id = $1`, id).Scan(&name); err != nil {
+				t.Fatal(err)
+			}
+			return name
+		}
+		if got := partition(); got != "alert_transitions_default" {
+			t.Fatalf("row 10 days ahead landed in %s, want the default partition", got)
+		}
+		if _, err := tx.Exec(ctx, `CALL maintain_alert_transitions(10, 30)`); err != nil {
+			t.Fatal(err)
+		}
+		var want string
+		if err := tx.QueryRow(ctx, `SELECT 'alert_transitions_' || to_char(current_date + 10, 'YYYYMMDD')`).Scan(&want); err != nil {
+			t.Fatal(err)
+		}
+		if got := partition(); got != want {
+			t.Errorf("row moved to %s, want %s", got, want)
+		}
+	})
+}
@@ -11,7 +11,9 @@ import (
 const flushInterval = 500 * time.Millisecond
 const bufferSize = 50000
 
-// AlertData is a buffered channel for alert data ingestion
+// AlertData is a buffered channel for alert data ingestion.
+// Each row is condition_id, target_id, is_on, payload, received_at, value;
+// value is the raw measurement (float64 or nil) used for per-user thresholds.
 var AlertData = make(chan []interface{}, bufferSize*3)
 var AlertsFlushed = make(chan struct{})
 
@@ -23,9 +25,16 @@ func IngestAlertData(ctx context.Context, pgxPool *pgxpool.Pool) {
 		log.Fatalf("failed to create temp staging table: %v", err)
 	}
 	log.Printf("created subscription_targets table in %s", time.Since(started))
+	go maintainHistory(ctx, pgxPool)
+
+	stale := newStaleSweeper()
+	if err := stale.reload(ctx, pgxPool); err != nil {
+		log.Printf("stale alert expiry disabled until next reload: %v", err)
+	}
 
 	rows := make([][]interface{}, 0, bufferSize)
 	toMerge := 0
+	deferred := 0 // rows taken over by a Deferrer, not back on resumed yet
 
 	flush := func() {
 		if len(rows) == 0 {
@@ -38,7 +47,7 @@ func IngestAlertData(ctx context.Context, pgxPool *pgxpool.Pool) {
 		_, err := pgxPool.CopyFrom(
 			ctx,
 			pgx.Identifier{"alerts_staging"},
-			[]string{"condition_id", "target_id", "is_on", "payload", "received_at"},
+			[]string{"condition_id", "target_id", "is_on", "payload", "received_at", "value"},
 			pgx.CopyFromRows(rows),
 		)
 		if err != nil {
@@ -54,6 +63,13 @@ func IngestAlertData(ctx context.Context, pgxPool *pgxpool.Pool) {
 
 		rows = rows[:0]
 	}
+	stage := func(values []interface{}) {
+		stale.observe(values)
+		rows = append(rows, values)
+		if len(rows) >= bufferSize {
+			flush()
+		}
+	}
 	merge := func() {
 		if toMerge == 0 {
 			// fetch true from AlertDataDirty
@@ -77,6 +93,13 @@ func IngestAlertData(ctx context.Context, pgxPool *pgxpool.Pool) {
 	}
 
 	flushTicker := time.NewTicker(flushInterval)
+	sweepTicker := time.NewTicker(staleSweepInterval)
+	reloadTicker := time.NewTicker(staleReloadInterval)
+	lifecycleTicker := time.NewTicker(lifecycleInterval)
+	reconcileTicker := time.NewTicker(reconcileInterval)
+	windowTicker := time.NewTicker(windowInterval)
+	targetsTicker := time.NewTicker(targetsInterval)
+	connectionsTicker := time.NewTicker(connectionsInterval)
 
 	for {
 		select {
@@ -90,20 +113,66 @@ func IngestAlertData(ctx context.Context, pgxPool *pgxpool.Pool) {
 				return
 			}
 			if values == nil {
+				// the deferred rows were received before EOF
+				for ; deferred > 0; deferred-- {
+					stage(<-resumed)
+				}
 				flush()
 				merge()
 				AlertsFlushed <- struct{}{} // flushed after receiving EOF
 				continue
 			}
-			rows = append(rows, values)
-
-			if len(rows) >= bufferSize {
-				flush()
+			if !evaluate(values) {
+				deferred++
+				continue
 			}
+			stage(values)
+
+		case values := <-resumed:
+			deferred--
+			stage(values)
 
 		case <-flushTicker.C:
 			flush()
 			merge()
+
+		case now := <-sweepTicker.C:
+			// expired rows are not evaluated, they are the pipeline's own decision
+			if expired := stale.sweep(now); len(expired) > 0 {
+				log.Printf("turning off %d stale alerts", len(expired))
+				rows = append(rows, expired...)
+			}
+
+		case <-reloadTicker.C:
+			if err := stale.reload(ctx, pgxPool); err != nil {
+				log.Printf("failed to reload stale_after: %v", err)
+			}
+
+		case <-lifecycleTicker.C:
+			// between merges, so staged alerts never race the refresh
+			flush()
+			merge()
+			archiveUntracked(ctx, pgxPool)
+
+		case <-reconcileTicker.C:
+			flush()
+			merge()
+			reconcileTargets(ctx, pgxPool)
+
+		case <-windowTicker.C:
+			flush()
+			merge()
+			applyWindows(ctx, pgxPool)
+			releaseMutes(ctx, pgxPool)
+
+		case <-targetsTicker.C:
+			flush()
+			merge()
+			refreshTargets(ctx, pgxPool)
+
+		case <-connectionsTicker.C:
+			// derived from alerts, so like expired rows not evaluated
+			rows = append(rows, connectionRisks(ctx, pgxPool)...)
 		}
 	}
 }
@@ -0,0 +1,49 @@
+package ingest_alerts
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const lifecycleInterval = 5 * time.Minute
+
+// reconcileInterval is how often subscription_targets is rebuilt in full.
+// refresh_subscription_targets keeps it current in between; the rebuild only
+// catches what its queue can not see, e.g. flights removed by TRUNCATE.
+const reconcileInterval = time.Hour
+
+// ArchiveGrace is how long a target must be untracked before its alerts are
+// archived, so that a target coming back shortly keeps them.
+var ArchiveGrace = 10 * time.Minute
+
+// archiveUntracked deletes expired flight subscriptions of travellers, then
+// archives the alerts of targets no longer tracked and sends closing events,
+// see archive_untracked_alerts.
+func archiveUntracked(ctx context.Context, pgxPool *pgxpool.Pool) {
+	start := time.Now()
+	var expired int
+	if err := pgxPool.QueryRow(ctx, `SELECT expire_flight_subscriptions()`).Scan(&expired); err != nil {
+		log.Printf("failed to expire flight subscriptions: %v", err)
+	} else if expired > 0 {
+		log.Printf("deleted %d expired flight subscriptions", expired)
+	}
+	if _, err := pgxPool.Exec(ctx, `CALL archive_untracked_alerts(make_interval(secs => $1))`, ArchiveGrace.Seconds()); err != nil {
+		log.Printf("failed to archive untracked alerts: %v", err)
+		return
+	}
+	log.Printf("archived untracked alerts in %s", time.Since(start))
+}
+
+// reconcileTargets rebuilds subscription_targets from every subscription,
+// see recreate_subscription_targets.
+func reconcileTargets(ctx context.Context, pgxPool *pgxpool.Pool) {
+	start := time.Now()
+	if _, err := pgxPool.Exec(ctx, `CALL recreate_subscription_targets()`); err != nil {
+		log.Printf("failed to recreate subscription_targets: %v", err)
+		return
+	}
+	log.Printf("reconciled subscription_targets in %s", time.Since(start))
+}
@@ -0,0 +1,225 @@
+package ingest_alerts
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/okharch/yal/testdb"
+)
+
+// Archiving a blocked runway, whether still on or gone off, must not leave
+// the low altitude alert of an inbound flight inhibited by an alert that no
+// longer exists.
+func TestArchiveReleasesInhibitedAlerts(t *testing.T) {
+	db := testdb.Connect(t)
+	tests := []struct {
+		name      string
+		sourceOff bool
+	}{
+		{"source on when archived", false},
+		{"source off when archived", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testdb.Tx(t, db, func(ctx context.Context, tx pgx.Tx) {
+				var flightID, airportID, runway, altitude int
+				err := tx.QueryRow(ctx, `
+					INSERT INTO flights (route_id, airline_id, flight_number, source_airport_id, destination_airport_id,
+					                     departure_time, arrival_time, status)
+					SELECT r.id, r.airline_id, 'TEST1', r.source_airport_id, r.destination_airport_id,
+					       now() - interval '1 hour', now() + interval '1 hour', 'departed'
+					FROM routes r
+					JOIN airports src ON src.id = r.source_airport_id
+					JOIN airports dst ON dst.id = r.destination_airport_id
+					JOIN airlines al ON al.id = r.airline_id
+					ORDER BY r.id LIMIT 1
+					RETURNING id, destination_airport_id`).Scan(&flightID, &airportID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = tx.QueryRow(ctx, `
+					SELECT r.source_condition_id, r.target_condition_id
+					FROM inhibition_rules r JOIN conditions c ON c.id = r.target_condition_id
+					JOIN condition_templates ct ON ct.id = c.template_id
+					WHERE r.scope = 'inbound_flights' AND r.is_active AND ct.name = 'low_altitude'
+					ORDER BY r.id LIMIT 1`).Scan(&runway, &altitude)
+				if err != nil {
+					t.Fatalf("no inbound flights inhibition rule: %v", err)
+				}
+				// the airport is no longer tracked, the flight still is
+				if _, err := tx.Exec(ctx, `
+					DELETE FROM subscription_targets WHERE target_id = $1 AND target_type = 'destination_airport';
+					DELETE FROM retired_subscription_targets WHERE target_id = $1 AND target_type = 'destination_airport';
+					INSERT INTO subscription_targets (subscription_id, target_id, target_type)
+					SELECT min(id), $2, 'flight' FROM subscriptions
+					ON CONFLICT DO NOTHING`, airportID, flightID); err != nil {
+					t.Fatal(err)
+				}
+				merge := func(conditionID, targetID int, isOn bool, value float64) {
+					t.Helper()
+					if _, err := tx.Exec(ctx, `
+						INSERT INTO alerts_staging (condition_id, target_id, is_on, payload, received_at, value)
+						VALUES ($1, $2, $3, '{}', clock_timestamp(), $4)`, conditionID, targetID, isOn, value); err != nil {
+						t.Fatal(err)
+					}
+					if _, err := tx.Exec(ctx, `CALL process_alert_staging()`); err != nil {
+						t.Fatal(err)
+					}
+				}
+				symptom := func() (alertID int, inhibitedBy *int, suppressed bool) {
+					t.Helper()
+					err := tx.QueryRow(ctx, `
+						SELECT id, inhibited_by, suppressed FROM alerts WHERE condition_id = $1 AND target_id = $2`,
+						altitude, flightID).Scan(&alertID, &inhibitedBy, &suppressed)
+					if err != nil {
+						t.Fatal(err)
+					}
+					return alertID, inhibitedBy, suppressed
+				}
+
+				merge(runway, airportID, true, 1)
+				merge(altitude, flightID, true, -5000)
+				alertID, inhibitedBy, _ := symptom()
+				if inhibitedBy == nil {
+					t.Fatal("low altitude alert of an inbound flight is not inhibited by the blocked runway")
+				}
+				if tt.sourceOff {
+					merge(runway, airportID, false, 0)
+				}
+				if _, err := tx.Exec(ctx, `CALL archive_untracked_alerts()`); err != nil {
+					t.Fatal(err)
+				}
+
+				var archived bool
+				if err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM alerts_archive WHERE id = $1)`, *inhibitedBy).Scan(&archived); err != nil {
+					t.Fatal(err)
+				}
+				if !archived {
+					t.Fatalf("runway alert %d was not archived", *inhibitedBy)
+				}
+				if _, inhibitedBy, suppressed := symptom(); inhibitedBy != nil || suppressed {
+					t.Errorf("after archiving the runway alert: inhibited by %v, suppressed %v, want released", inhibitedBy != nil, suppressed)
+				}
+				var released bool
+				err = tx.QueryRow(ctx, `
+					SELECT EXISTS (SELECT 1 FROM alert_transitions WHERE alert_id = $1 AND old_suppressed AND NOT suppressed)`,
+					alertID).Scan(&released)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !released {
+					t.Error("release of the low altitude alert was not logged")
+				}
+			})
+		})
+	}
+}
+
+// An incident opened by an alert going on is acknowledged by hand and
+// resolved when archiving takes the alert away, and its incident-mode
+// subscriber is told, with the archived alert closed.
+func TestIncidentLifecycle(t *testing.T) {
+	db := testdb.Connect(t)
+	testdb.Tx(t, db, func(ctx context.Context, tx pgx.Tx) {
+		d := findDelivery(ctx, t, tx)
+		// nothing to join: earlier incidents of the target are resolved long ago
+		if _, err := tx.Exec(ctx, `
+			UPDATE user_subscriptions SET delivery = 'incidents' WHERE id = $1;
+			UPDATE incidents SET status = 'resolved', resolved_at = now() - interval '1 day'
+			WHERE target_id = $2`, d.userSubscriptionID, d.targetID); err != nil {
+			t.Fatal(err)
+		}
+		// off first, whatever the feed left on the target
+		for _, value := range []float64{d.threshold - 1, d.threshold + 1} {
+			if _, err := tx.Exec(ctx, `
+				INSERT INTO alerts_staging (condition_id, target_id, is_on, payload, received_at, value)
+				VALUES ($1, $2, $3 > $4, '{}', clock_timestamp(), $3)`, d.conditionID, d.targetID, value, d.threshold); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tx.Exec(ctx, `CALL process_alert_staging()`); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var alertID int
+		var incidentID *int
+		err := tx.QueryRow(ctx, `SELECT id, incident_id FROM alerts WHERE condition_id = $1 AND target_id = $2`,
+			d.conditionID, d.targetID).Scan(&alertID, &incidentID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if incidentID == nil {
+			t.Fatal("alert going on did not open an incident")
+		}
+		status := func() string {
+			t.Helper()
+			var s string
+			if err := tx.QueryRow(ctx, `SELECT status::text FROM incidents WHERE id = $1`, *incidentID).Scan(&s); err != nil {
+				t.Fatal(err)
+			}
+			return s
+		}
+		if s := status(); s != "open" {
+			t.Errorf("new incident is %s, want open", s)
+		}
+
+		if _, err := tx.Exec(ctx, `CALL set_incident_status($1, 'acknowledged', 'ops desk')`, *incidentID); err != nil {
+			t.Fatal(err)
+		}
+		if s := status(); s != "acknowledged" {
+			t.Errorf("acknowledged incident is %s", s)
+		}
+
+		// the target dropped out of the subscription long enough ago
+		if _, err := tx.Exec(ctx, `
+			DELETE FROM subscription_targets WHERE target_id = $2 AND target_type = $3::target_type;
+			INSERT INTO retired_subscription_targets (subscription_id, target_id, target_type, retired_at)
+			SELECT subscription_id, $2, $3::target_type, now() - interval '1 hour' FROM user_subscriptions WHERE id = $1
+			ON CONFLICT (subscription_id, target_id, target_type) DO UPDATE SET retired_at = EXCLUDED.retired_at;
+			UPDATE user_subscriptions SET alerts_triggered_at = NULL, pushed_at = now() - interval '1 minute'
+			WHERE id = $1`, d.userSubscriptionID, d.targetID, d.targetType); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.Exec(ctx, `CALL archive_untracked_alerts()`); err != nil {
+			t.Fatal(err)
+		}
+		if s := status(); s != "resolved" {
+			t.Errorf("incident of the archived alert is %s, want resolved", s)
+		}
+		var notified bool
+		err = tx.QueryRow(ctx, `SELECT alerts_triggered_at = now() FROM user_subscriptions WHERE id = $1`,
+			d.userSubscriptionID).Scan(&notified)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !notified {
+			t.Error("incident-mode subscriber was not notified of the resolved incident")
+		}
+
+		var pushJSON []byte
+		if err := tx.QueryRow(ctx, `SELECT get_alerts_json($1)`, d.userSubscriptionID).Scan(&pushJSON); err != nil {
+			t.Fatal(err)
+		}
+		var incidents []struct {
+			IncidentID int    `json:"incident_id"`
+			Status     string `json:"status"`
+			Alerts     []struct {
+				AlertID int  `json:"alert_id"`
+				Closed  bool `json:"closed"`
+			} `json:"alerts"`
+		}
+		if err := json.Unmarshal(pushJSON, &incidents); err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, i := range incidents {
+			for _, a := range i.Alerts {
+				found = found || i.IncidentID == *incidentID && i.Status == "resolved" && a.AlertID == alertID && a.Closed
+			}
+		}
+		if !found {
+			t.Errorf("push %s does not carry incident %d resolved with alert %d closed", pushJSON, *incidentID, alertID)
+		}
+	})
+}
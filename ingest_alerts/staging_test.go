@@ -0,0 +1,118 @@
+package ingest_alerts
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/okharch/yal/testdb"
+)
+
+func TestSignificantChangePayload(t *testing.T) {
+	db := testdb.Connect(t)
+	tests := []struct {
+		name       string
+		old, new   string
+		wantReason *string
+	}{
+		{"same key", `{"runway": "09L", "wind": 5}`, `{"runway": "09L", "wind": 7}`, nil},
+		{"changed key", `{"runway": "09L"}`, `{"runway": "27R"}`, strp("payload")},
+		{"old not JSON", `runway 09L closed`, `{"runway": "09L"}`, strp("payload")},
+		{"new not JSON", `{"runway": "09L"}`, `runway 09L closed`, strp("payload")},
+		{"same text", `runway 09L closed`, `runway 09L closed`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reason *string
+			err := db.QueryRow(context.Background(), `
+				SELECT significant_change(NULL, NULL, '{runway}', 1, 1, $1, $2)::text`, tt.old, tt.new).Scan(&reason)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (reason == nil) != (tt.wantReason == nil) || reason != nil && *reason != *tt.wantReason {
+				t.Errorf("got %v, want %v", deref(reason), deref(tt.wantReason))
+			}
+		})
+	}
+}
+
+// A payload that is not JSON used to fail process_alert_staging before it
+// truncated alerts_staging, so every later merge failed on the same row.
+func TestProcessStagingNonJSONPayload(t *testing.T) {
+	db := testdb.Connect(t)
+	testdb.Tx(t, db, func(ctx context.Context, tx pgx.Tx) {
+		var conditionID, targetID int
+		err := tx.QueryRow(ctx, `
+			SELECT c.id, (SELECT min(id) FROM airports)
+			FROM conditions c JOIN condition_templates ct ON ct.id = c.template_id
+			WHERE ct.change_keys IS NOT NULL
+			ORDER BY c.id LIMIT 1`).Scan(&conditionID, &targetID)
+		if err != nil {
+			t.Fatalf("no condition compares payload keys: %v", err)
+		}
+		for _, payload := range []string{`{"runway": "09L"}`, `runway 09L closed`} {
+			if _, err := tx.Exec(ctx, `
+				INSERT INTO alerts_staging (condition_id, target_id, is_on, payload, received_at, value)
+				VALUES ($1, $2, true, $3, clock_timestamp(), 1)`, conditionID, targetID, payload); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tx.Exec(ctx, `CALL process_alert_staging()`); err != nil {
+				t.Fatalf("merging payload %q: %v", payload, err)
+			}
+		}
+		var staged int
+		var payload string
+		err = tx.QueryRow(ctx, `
+			SELECT (SELECT count(*) FROM alerts_staging), payload
+			FROM alerts WHERE condition_id = $1 AND target_id = $2`, conditionID, targetID).Scan(&staged, &payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if staged != 0 || payload != `runway 09L closed` {
+			t.Errorf("got %d staged rows and payload %q, want the text payload merged", staged, payload)
+		}
+	})
+}
+
+// delivery is a threshold condition of a target a user subscription listens
+// to without an override, and an alert of it goes out to the subscriber as
+// merged: no tier, inhibition rule or mute in the way.
+type delivery struct {
+	userSubscriptionID int
+	conditionID        int
+	targetID           int
+	targetType         string
+	threshold          float64 // global threshold, crossed above it
+}
+
+func findDelivery(ctx context.Context, t *testing.T, tx pgx.Tx) delivery {
+	t.Helper()
+	var d delivery
+	err := tx.QueryRow(ctx, `
+		SELECT us.id, c.id, st.target_id, st.target_type::text, c.threshold
+		FROM user_subscriptions us
+		JOIN user_subscription_conditions usc ON usc.user_subscription_id = us.id AND usc.is_on
+		                                      AND usc.threshold IS NULL
+		JOIN conditions c ON c.id = usc.condition_id AND c.kind = 'threshold' AND c.tier_group_id IS NULL
+		                 AND c.severity >= us.min_severity
+		JOIN condition_templates ct ON ct.id = c.template_id AND ct.direction = 'above'
+		JOIN subscription_targets st ON st.subscription_id = us.subscription_id AND st.target_type = ct.target_type
+		WHERE us.delivery <> 'incidents'
+		  AND NOT EXISTS (SELECT 1 FROM inhibition_rules r WHERE r.target_condition_id = c.id)
+		  AND NOT EXISTS (SELECT 1 FROM target_mutes m WHERE m.user_subscription_id = us.id)
+		ORDER BY us.id, c.id, st.target_id LIMIT 1`).
+		Scan(&d.userSubscriptionID, &d.conditionID, &d.targetID, &d.targetType, &d.threshold)
+	if err != nil {
+		t.Skipf("no user subscription to deliver a threshold alert to: %v", err)
+	}
+	return d
+}
+
+func strp(s string) *string { return &s }
+
+func deref(s *string) string {
+	if s == nil {
+		return "NULL"
+	}
+	return *s
+}
@@ -0,0 +1,131 @@
+package ingest_alerts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	staleSweepInterval  = 10 * time.Second
+	staleReloadInterval = time.Minute
+)
+
+// StaleReason is the payload reason of alerts turned off because their
+// producer stopped reporting them.
+const StaleReason = "stale"
+
+type alertKey struct {
+	conditionID int
+	targetID    int
+}
+
+// staleSweeper turns off alerts of templates with stale_after when no row of
+// them was ingested for that long, e.g. because their evaluator died. It is
+// only used by the IngestAlertData goroutine.
+type staleSweeper struct {
+	ttl  map[int]time.Duration  // stale_after by condition id
+	seen map[alertKey]time.Time // when alerts that are on were last ingested
+}
+
+func newStaleSweeper() *staleSweeper {
+	return &staleSweeper{ttl: make(map[int]time.Duration), seen: make(map[alertKey]time.Time)}
+}
+
+// reload reads stale_after of every condition. Alerts that are on but were
+// not ingested by this process yet are considered seen now, so after a
+// restart their producers get a full TTL to report again.
+func (s *staleSweeper) reload(ctx context.Context, pgxPool *pgxpool.Pool) error {
+	rows, err := pgxPool.Query(ctx, `
+		SELECT c.id, (extract(epoch FROM ct.stale_after) * 1000)::bigint
+		FROM conditions c
+		JOIN condition_templates ct ON ct.id = c.template_id
+		WHERE ct.stale_after IS NOT NULL`)
+	if err != nil {
+		return fmt.Errorf("failed to load stale_after: %w", err)
+	}
+	ttl := make(map[int]time.Duration)
+	for rows.Next() {
+		var conditionID int
+		var ms int64
+		if err := rows.Scan(&conditionID, &ms); err != nil {
+			rows.Close()
+			return err
+		}
+		ttl[conditionID] = time.Duration(ms) * time.Millisecond
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	s.ttl = ttl
+	if len(ttl) == 0 {
+		return nil
+	}
+
+	rows, err = pgxPool.Query(ctx, `
+		SELECT a.condition_id, a.target_id
+		FROM alerts a
+		JOIN conditions c ON c.id = a.condition_id
+		JOIN condition_templates ct ON ct.id = c.template_id
+		WHERE a.is_on AND ct.stale_after IS NOT NULL`)
+	if err != nil {
+		return fmt.Errorf("failed to load alerts that can go stale: %w", err)
+	}
+	defer rows.Close()
+	now := time.Now()
+	for rows.Next() {
+		var k alertKey
+		if err := rows.Scan(&k.conditionID, &k.targetID); err != nil {
+			return err
+		}
+		if _, ok := s.seen[k]; !ok {
+			s.seen[k] = now
+		}
+	}
+	return rows.Err()
+}
+
+// observe records an ingested (evaluated) row. Only alerts that are on can
+// go stale, so an off row forgets its alert.
+func (s *staleSweeper) observe(row []interface{}) {
+	conditionID, _ := row[ColConditionID].(int)
+	if _, ok := s.ttl[conditionID]; !ok {
+		return
+	}
+	targetID, _ := row[ColTargetID].(int)
+	k := alertKey{conditionID: conditionID, targetID: targetID}
+	if isOn, _ := row[ColIsOn].(bool); isOn {
+		s.seen[k] = time.Now()
+	} else {
+		delete(s.seen, k)
+	}
+}
+
+// sweep returns off rows for the alerts that went stale and forgets them.
+// The rows are staged like any other, so the change is merged and fanned out
+// as usual, with StaleReason in the payload.
+func (s *staleSweeper) sweep(now time.Time) [][]interface{} {
+	var expired [][]interface{}
+	for k, seenAt := range s.seen {
+		ttl, ok := s.ttl[k.conditionID]
+		if !ok {
+			delete(s.seen, k) // stale_after was removed
+			continue
+		}
+		if now.Sub(seenAt) <= ttl {
+			continue
+		}
+		payload, _ := json.Marshal(map[string]interface{}{
+			"reason":       StaleReason,
+			"last_seen_at": seenAt.Format(time.RFC3339),
+			"stale_after":  ttl.String(),
+		})
+		expired = append(expired, []interface{}{k.conditionID, k.targetID, false, string(payload), now, nil})
+		delete(s.seen, k)
+	}
+	return expired
+}
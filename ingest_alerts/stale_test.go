@@ -0,0 +1,40 @@
+package ingest_alerts
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStaleSweeper(t *testing.T) {
+	s := newStaleSweeper()
+	s.ttl[1] = time.Minute
+	row := func(conditionID, targetID int, isOn bool) []interface{} {
+		return []interface{}{conditionID, targetID, isOn, "{}", time.Now(), nil}
+	}
+
+	s.observe(row(1, 10, true))
+	s.observe(row(1, 11, true))
+	s.observe(row(1, 12, false))
+	s.observe(row(2, 10, true)) // no stale_after
+	if len(s.seen) != 2 {
+		t.Fatalf("tracking %d alerts, want the 2 that are on", len(s.seen))
+	}
+	s.observe(row(1, 11, false))
+	if len(s.seen) != 1 {
+		t.Fatalf("tracking %d alerts after one went off, want 1", len(s.seen))
+	}
+
+	if expired := s.sweep(time.Now()); len(expired) != 0 {
+		t.Fatalf("swept %d alerts within their TTL", len(expired))
+	}
+	expired := s.sweep(time.Now().Add(2 * time.Minute))
+	if len(expired) != 1 || expired[0][ColTargetID] != 10 || expired[0][ColIsOn] != false {
+		t.Fatalf("got %v, want target 10 turned off", expired)
+	}
+	if len(s.seen) != 0 {
+		t.Errorf("still tracking %d alerts after the sweep", len(s.seen))
+	}
+	if expired := s.sweep(time.Now().Add(4 * time.Minute)); len(expired) != 0 {
+		t.Errorf("swept %d alerts again", len(expired))
+	}
+}
@@ -0,0 +1,22 @@
+package ingest_alerts
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// targetsInterval is how late a flight that became active (or left
+// active_flights) is matched against subscriptions.
+const targetsInterval = 5 * time.Second
+
+// refreshTargets recomputes the subscription targets of flights that changed
+// since the last refresh, see refresh_subscription_targets. It returns right
+// away when nothing is queued and no tracked flight landed.
+func refreshTargets(ctx context.Context, pgxPool *pgxpool.Pool) {
+	if _, err := pgxPool.Exec(ctx, `CALL refresh_subscription_targets()`); err != nil {
+		log.Printf("failed to refresh subscription_targets: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package ingest_alerts
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/okharch/yal/testdb"
+)
+
+// A flight diverted to another airport, or deleted, must queue the targets
+// it led to before, or the subscriptions of the old ones never drop it.
+func TestQueueFlightChangeOldTargets(t *testing.T) {
+	db := testdb.Connect(t)
+	testdb.Tx(t, db, func(ctx context.Context, tx pgx.Tx) {
+		var flightID, from, to int
+		err := tx.QueryRow(ctx, `
+			INSERT INTO flights (route_id, airline_id, flight_number, source_airport_id, destination_airport_id,
+			                     departure_time, arrival_time, status)
+			SELECT r.id, r.airline_id, 'TEST1', r.source_airport_id, r.destination_airport_id,
+			       now() + interval '1 hour', now() + interval '3 hours', 'scheduled'
+			FROM routes r
+			JOIN airports src ON src.id = r.source_airport_id
+			JOIN airports dst ON dst.id = r.destination_airport_id
+			JOIN airlines al ON al.id = r.airline_id
+			ORDER BY r.id LIMIT 1
+			RETURNING id, destination_airport_id, (SELECT min(id) FROM airports WHERE id <> destination_airport_id)`).
+			Scan(&flightID, &from, &to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		queued := func(targetID int, targetType string) bool {
+			var found bool
+			err := tx.QueryRow(ctx, `
+				SELECT EXISTS (SELECT 1 FROM subscription_target_queue WHERE target_id = $1 AND target_type = $2)`,
+				targetID, targetType).Scan(&found)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return found
+		}
+		drain := func() {
+			if _, err := tx.Exec(ctx, `DELETE FROM subscription_target_queue`); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if !queued(flightID, "flight") || !queued(from, "destination_airport") {
+			t.Error("inserted flight was not queued")
+		}
+		drain()
+		if _, err := tx.Exec(ctx, `UPDATE flights SET destination_airport_id = $2 WHERE id = $1`, flightID, to); err != nil {
+			t.Fatal(err)
+		}
+		if !queued(from, "destination_airport") || !queued(to, "destination_airport") {
+			t.Errorf("diverting from %d to %d did not queue both airports", from, to)
+		}
+		drain()
+		if _, err := tx.Exec(ctx, `DELETE FROM flights WHERE id = $1`, flightID); err != nil {
+			t.Fatal(err)
+		}
+		if !queued(flightID, "flight") || !queued(to, "destination_airport") {
+			t.Error("deleted flight did not queue its targets")
+		}
+	})
+}
@@ -0,0 +1,116 @@
+package ingest_alerts
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/okharch/yal/testdb"
+)
+
+// A 55kt wind turns on both the 30kt and the 50kt tier of the wind group:
+// only the 50kt alert is delivered, and moving between the tiers is logged.
+func TestTierSupersession(t *testing.T) {
+	db := testdb.Connect(t)
+	testdb.Tx(t, db, func(ctx context.Context, tx pgx.Tx) {
+		var strong, gale, airportID int
+		err := tx.QueryRow(ctx, `
+			SELECT min(c.id) FILTER (WHERE c.threshold = 30), min(c.id) FILTER (WHERE c.threshold = 50),
+			       (SELECT min(id) FROM airports)
+			FROM conditions c JOIN condition_tier_groups g ON g.id = c.tier_group_id
+			WHERE g.name = 'wind'`).Scan(&strong, &gale, &airportID)
+		if err != nil {
+			t.Fatalf("no wind tier group: %v", err)
+		}
+		wind := func(knots float64) {
+			t.Helper()
+			if _, err := tx.Exec(ctx, `
+				INSERT INTO alerts_staging (condition_id, target_id, is_on, payload, received_at, value)
+				SELECT c.id, $2, threshold_crossed(ct.direction, $3, c.threshold), '{}', clock_timestamp(), $3
+				FROM conditions c JOIN condition_templates ct ON ct.id = c.template_id
+				WHERE c.id = ANY($1)`, []int{strong, gale}, airportID, knots); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tx.Exec(ctx, `CALL process_alert_staging()`); err != nil {
+				t.Fatal(err)
+			}
+		}
+		type tierState struct {
+			superseded *int
+			transition *string
+			suppressed bool
+		}
+		state := func(conditionID int) tierState {
+			t.Helper()
+			var s tierState
+			err := tx.QueryRow(ctx, `
+				SELECT superseded_by, tier_transition::text, suppressed
+				FROM alerts WHERE condition_id = $1 AND target_id = $2`, conditionID, airportID).
+				Scan(&s.superseded, &s.transition, &s.suppressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		}
+		active := func() *int {
+			t.Helper()
+			var conditionID *int
+			err := tx.QueryRow(ctx, `
+				SELECT t.condition_id
+				FROM alert_tiers t JOIN condition_tier_groups g ON g.id = t.tier_group_id
+				WHERE g.name = 'wind' AND t.target_id = $1`, airportID).Scan(&conditionID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return conditionID
+		}
+
+		// calm first, whatever the feed left on the airport
+		wind(0)
+		var logged int64
+		if err := tx.QueryRow(ctx, `SELECT COALESCE(max(id), 0) FROM alert_tier_transitions`).Scan(&logged); err != nil {
+			t.Fatal(err)
+		}
+
+		wind(55)
+		if s := state(gale); s.suppressed || deref(s.transition) != "raised" {
+			t.Errorf("gale tier at 55kt: suppressed %v, transition %s, want delivered and raised", s.suppressed, deref(s.transition))
+		}
+		if s := state(strong); !s.suppressed || s.superseded == nil || *s.superseded != gale {
+			t.Errorf("30kt tier at 55kt: suppressed %v, superseded by %v, want superseded by %d", s.suppressed, s.superseded, gale)
+		}
+		if c := active(); c == nil || *c != gale {
+			t.Errorf("active tier at 55kt is %v, want %d", c, gale)
+		}
+
+		wind(40)
+		if s := state(strong); s.suppressed || s.superseded != nil || deref(s.transition) != "de-escalated" {
+			t.Errorf("30kt tier at 40kt: suppressed %v, transition %s, want delivered and de-escalated", s.suppressed, deref(s.transition))
+		}
+		if c := active(); c == nil || *c != strong {
+			t.Errorf("active tier at 40kt is %v, want %d", c, strong)
+		}
+
+		wind(55)
+		if s := state(gale); s.suppressed || deref(s.transition) != "escalated" {
+			t.Errorf("gale tier back at 55kt: suppressed %v, transition %s, want delivered and escalated", s.suppressed, deref(s.transition))
+		}
+		if s := state(strong); !s.suppressed {
+			t.Error("30kt tier back at 55kt is delivered, want superseded")
+		}
+
+		var transitions []string
+		err = tx.QueryRow(ctx, `
+			SELECT array_agg(transition::text ORDER BY id)
+			FROM alert_tier_transitions
+			WHERE id > $1 AND target_id = $2 AND $3 IN (from_condition_id, to_condition_id)`,
+			logged, airportID, gale).Scan(&transitions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"raised", "de-escalated", "escalated"}; !slices.Equal(transitions, want) {
+			t.Errorf("logged tier transitions %v, want %v", transitions, want)
+		}
+	})
+}
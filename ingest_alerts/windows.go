@@ -0,0 +1,29 @@
+package ingest_alerts
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// windowInterval is how late a suppression window may start or end, and a
+// target mute expire.
+const windowInterval = 15 * time.Second
+
+// applyWindows suppresses the alerts of suppression windows that started and
+// delivers those still on when a window ended, see apply_suppression_windows.
+func applyWindows(ctx context.Context, pgxPool *pgxpool.Pool) {
+	if _, err := pgxPool.Exec(ctx, `CALL apply_suppression_windows()`); err != nil {
+		log.Printf("failed to apply suppression windows: %v", err)
+	}
+}
+
+// releaseMutes ends target mutes whose until passed, delivering the alerts
+// they held back, see release_target_mutes.
+func releaseMutes(ctx context.Context, pgxPool *pgxpool.Pool) {
+	if _, err := pgxPool.Exec(ctx, `CALL release_target_mutes()`); err != nil {
+		log.Printf("failed to release target mutes: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package ingest_alerts
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/okharch/yal/testdb"
+)
+
+// An alert that is still on when its suppression window ends is delivered:
+// apply_suppression_windows releases it, logs the release and notifies the
+// subscriber.
+func TestSuppressionWindowEndDeliversAlert(t *testing.T) {
+	db := testdb.Connect(t)
+	testdb.Tx(t, db, func(ctx context.Context, tx pgx.Tx) {
+		d := findDelivery(ctx, t, tx)
+		userSubscriptionID, conditionID, targetID, targetType := d.userSubscriptionID, d.conditionID, d.targetID, d.targetType
+		var windowID int
+		err := tx.QueryRow(ctx, `
+			INSERT INTO suppression_windows (target_id, target_type, condition_id, starts_at, ends_at, reason)
+			VALUES ($1, $2::target_type, $3, now() - interval '1 hour', now() + interval '1 hour', 'runway works')
+			RETURNING id`, targetID, targetType, conditionID).Scan(&windowID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO alerts_staging (condition_id, target_id, is_on, payload, received_at, value)
+			VALUES ($1, $2, true, '{}', clock_timestamp(), $3)`, conditionID, targetID, d.threshold+1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.Exec(ctx, `CALL process_alert_staging()`); err != nil {
+			t.Fatal(err)
+		}
+		delivered := func() (alertID int, windowID *int, isOn bool) {
+			t.Helper()
+			err := tx.QueryRow(ctx, `
+				SELECT alert_id, suppression_window_id, is_on
+				FROM user_subscription_alerts
+				WHERE user_subscription_id = $1 AND condition_id = $2 AND target_id = $3 AND target_type = $4::target_type`,
+				userSubscriptionID, conditionID, targetID, targetType).Scan(&alertID, &windowID, &isOn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return alertID, windowID, isOn
+		}
+		alertID, inWindow, isOn := delivered()
+		if inWindow == nil || *inWindow != windowID || isOn {
+			t.Fatalf("alert merged during window %d is delivered %v, want held by the window", windowID, isOn)
+		}
+
+		// end the window like window_alerts.End, after the last push
+		if _, err := tx.Exec(ctx, `
+			UPDATE suppression_windows SET ends_at = now() WHERE id = $1;
+			UPDATE user_subscriptions SET alerts_triggered_at = NULL, pushed_at = now() - interval '1 minute' WHERE id = $2`,
+			windowID, userSubscriptionID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.Exec(ctx, `CALL apply_suppression_windows()`); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, inWindow, isOn := delivered(); inWindow != nil || !isOn {
+			t.Errorf("alert still on after its window ended is delivered %v, want on", isOn)
+		}
+		var notified, logged bool
+		err = tx.QueryRow(ctx, `
+			SELECT (SELECT alerts_triggered_at = now() FROM user_subscriptions WHERE id = $1),
+			       EXISTS (SELECT 1 FROM alert_transitions WHERE alert_id = $2 AND old_suppressed AND NOT suppressed)`,
+			userSubscriptionID, alertID).Scan(&notified, &logged)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !notified {
+			t.Error("subscriber was not notified of the released alert")
+		}
+		if !logged {
+			t.Error("release was not logged to alert_transitions")
+		}
+
+		var alertsJSON []byte
+		if err := tx.QueryRow(ctx, `SELECT get_alerts_json($1)`, userSubscriptionID).Scan(&alertsJSON); err != nil {
+			t.Fatal(err)
+		}
+		var pushed []struct {
+			AlertID int  `json:"alert_id"`
+			IsOn    bool `json:"is_on"`
+		}
+		if err := json.Unmarshal(alertsJSON, &pushed); err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, a := range pushed {
+			found = found || a.AlertID == alertID && a.IsOn
+		}
+		if !found {
+			t.Errorf("push %s does not deliver alert %d on", alertsJSON, alertID)
+		}
+	})
+}
@@ -58,9 +58,10 @@ func GenerateMockAlerts(ctx context.Context, dbConnStr string) {
 
 func LoadConditionTemplates() error {
 	rows, err := db.Query(`
-		SELECT c.id, t.target_type, c.threshold, t.name
+		SELECT c.id, t.target_type, c.threshold, t.name, t.direction, c.kind
 		FROM conditions c
 		JOIN condition_templates t ON c.template_id = t.id
+		WHERE t.target_type <> 'connection' -- derived by the pipeline, see connection_risks
 	`)
 	if err != nil {
 		return err
@@ -69,7 +70,7 @@ func LoadConditionTemplates() error {
 
 	for rows.Next() {
 		var ct model.ConditionTemplate
-		if err := rows.Scan(&ct.ID, &ct.TargetType, &ct.Threshold, &ct.Name); err != nil {
+		if err := rows.Scan(&ct.ID, &ct.TargetType, &ct.Threshold, &ct.Name, &ct.Direction, &ct.Kind); err != nil {
 			return err
 		}
 		conditionTemplates = append(conditionTemplates, ct)
@@ -96,11 +97,11 @@ func runIngestionCycle(ctx context.Context) {
 	wg.Wait()
 	ingest_alerts.AlertData <- nil // EOF
 	<-ingest_alerts.AlertsFlushed  // wait until it flushed
-	log.Printf("Processed %d flights in %s", counter.Load(), time.Since(start))
+	log.Printf("Processed %d targets in %s", counter.Load(), time.Since(start))
 }
 
 func fetchSubscriptions() ([]model.Subscription, error) {
-	rows, err := db.Query(`SELECT id, name, view_name FROM subscriptions`)
+	rows, err := db.Query(`SELECT id, name, COALESCE(view_name, '') FROM subscriptions`)
 	if err != nil {
 		return nil, err
 	}
@@ -121,57 +122,45 @@ func processSubscription(ctx context.Context, sub model.Subscription) int {
 	//start := time.Now()
 	_, _ = db.Exec(`UPDATE subscriptions SET start_update = now() WHERE id = $1`, sub.ID)
 
-	flights, err := fetchFlights(sub.ViewName)
+	targets, err := fetchTargets(sub.ID)
 	if err != nil {
-		log.Printf("failed to fetch flights for %s: %v", sub.ViewName, err)
+		log.Printf("failed to fetch targets for subscription %d: %v", sub.ID, err)
 		return 0
 	}
 	var wg sync.WaitGroup
-	for _, flight := range flights {
+	for _, target := range targets {
 		wg.Add(1)
-		go func(f model.FlightTarget) {
+		go func(t model.Target) {
 			defer wg.Done()
-			processTargets(ctx, flight)
-		}(flight)
+			generateAlertCondition(ctx, t.ID, t.Type)
+		}(target)
 	}
 	wg.Wait()
 
 	finish := time.Now()
 	_, _ = db.Exec(`UPDATE subscriptions SET finish_update = $1 WHERE id = $2`, finish, sub.ID)
-	//log.Printf("Processed %d flights for subscription %d(%s) in %s", len(flights), sub.ID, sub.Name, finish.Sub(start))
-	return len(flights)
+	//log.Printf("Processed %d targets for subscription %d(%s) in %s", len(targets), sub.ID, sub.Name, finish.Sub(start))
+	return len(targets)
 }
 
-func fetchFlights(viewName string) ([]model.FlightTarget, error) {
-	rows, err := db.Query(fmt.Sprintf(`SELECT flight_id, source_airport_id, destination_airport_id FROM %s`, viewName))
+// fetchTargets resolves a subscription's spec, or its legacy view, to
+// targets, see resolve_subscription_targets.
+func fetchTargets(subscriptionID int) ([]model.Target, error) {
+	rows, err := db.Query(`SELECT target_id, target_type FROM resolve_subscription_targets($1)`, subscriptionID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var flights []model.FlightTarget
+	var targets []model.Target
 	for rows.Next() {
-		var f model.FlightTarget
-		if err := rows.Scan(&f.FlightID, &f.SourceAirport, &f.DestAirport); err != nil {
+		var t model.Target
+		if err := rows.Scan(&t.ID, &t.Type); err != nil {
 			return nil, err
 		}
-		flights = append(flights, f)
-	}
-	return flights, nil
-}
-
-func processTargets(ctx context.Context, f model.FlightTarget) {
-	targets := []struct {
-		id   int
-		kind string
-	}{
-		{f.FlightID, "flight"},
-		{f.SourceAirport, "source_airport"},
-		{f.DestAirport, "destination_airport"},
-	}
-	for _, t := range targets {
-		generateAlertCondition(ctx, t.id, t.kind)
+		targets = append(targets, t)
 	}
+	return targets, rows.Err()
 }
 
 func generateAlertCondition(ctx context.Context, targetID int, targetType string) {
@@ -184,12 +173,12 @@ func generateAlertCondition(ctx context.Context, targetID int, targetType string
 			continue
 		}
 		val := generateStickyMockValue(targetID, targetType, ct)
-		// []string{"condition_id", "target_id", "is_on", "payload", "received_at"},
-		ingest_alerts.AlertData <- []interface{}{ct.ID, targetID, val > ct.Threshold, `{"helper": "mock"}`, time.Now()}
+		// []string{"condition_id", "target_id", "is_on", "payload", "received_at", "value"},
+		ingest_alerts.AlertData <- []interface{}{ct.ID, targetID, thresholdCrossed(ct, val), `{"helper": "mock"}`, time.Now(), val}
 	}
 }
 
-func generateStickyMockValue(targetID int, targetType string, ct model.ConditionTemplate) int {
+func generateStickyMockValue(targetID int, targetType string, ct model.ConditionTemplate) float64 {
 	key := fmt.Sprintf("%s:%d:%d", targetType, targetID, ct.ID)
 	now := time.Now()
 	alertStatusLock.Lock()
@@ -197,7 +186,7 @@ func generateStickyMockValue(targetID int, targetType string, ct model.Condition
 	alertStatusLock.Unlock()
 	if ok && state.isOn {
 		if now.Before(state.expiresAt) {
-			return generateValue(ct.Threshold, ct.Name, true)
+			return generateValue(targetID, ct, true)
 		}
 		alertStatusLock.Lock()
 		delete(alertStatus, key)
@@ -212,23 +201,41 @@ func generateStickyMockValue(targetID int, targetType string, ct model.Condition
 			expiresAt: now.Add(time.Duration(minutes) * time.Minute),
 		}
 		alertStatusLock.Unlock()
-		return generateValue(ct.Threshold, ct.Name, true)
+		return generateValue(targetID, ct, true)
 	}
 
-	return generateValue(ct.Threshold, ct.Name, false)
+	return generateValue(targetID, ct, false)
+}
+
+// thresholdCrossed mirrors the SQL threshold_crossed function.
+func thresholdCrossed(ct model.ConditionTemplate, val float64) bool {
+	if ct.Direction == "below" {
+		return val < ct.Threshold
+	}
+	return val > ct.Threshold
 }
 
-func generateValue(threshold int, conditionName string, alertOn bool) int {
-	switch conditionName {
-	case "fog", "low_altitude", "low_fuel":
+func generateValue(targetID int, ct model.ConditionTemplate, alertOn bool) float64 {
+	if ct.Kind != "threshold" {
+		// baseline conditions get a raw measurement around a per-target
+		// norm, e.g. 15 minutes of delay being routine at some hubs only
+		norm := 5 + targetID%40
+		if alertOn {
+			return float64(norm + 20 + rand.Intn(30))
+		}
+		return float64(norm - 3 + rand.Intn(7))
+	}
+	offset := float64(rand.Intn(50) + 1)
+	switch ct.Direction {
+	case "below":
 		if alertOn {
-			return threshold - rand.Intn(50) - 1
+			return ct.Threshold - offset
 		}
-		return threshold + rand.Intn(50) + 1
+		return ct.Threshold + offset
 	default:
 		if alertOn {
-			return threshold + rand.Intn(50) + 1
+			return ct.Threshold + offset
 		}
-		return threshold - rand.Intn(50) - 1
+		return ct.Threshold - offset
 	}
 }
@@ -3,18 +3,20 @@ package model
 type Subscription struct {
 	ID       int
 	Name     string
-	ViewName string
-}
-
-type FlightTarget struct {
-	FlightID      int
-	SourceAirport int
-	DestAirport   int
+	ViewName string // legacy hand-written view, empty for subscriptions defined by a spec
 }
 
 type ConditionTemplate struct {
 	ID         int
 	TargetType string
-	Threshold  int
+	Threshold  float64
 	Name       string
+	Direction  string // "above" or "below", see threshold_direction
+	Kind       string // "threshold", "zscore" or "percentile", see condition_kind
+}
+
+// Target is anything alerts are raised on, e.g. a flight or a destination airport.
+type Target struct {
+	ID   int
+	Type string // target_type, one of target_types, e.g. "flight", "destination_airport" or "airline"
 }
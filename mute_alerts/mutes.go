@@ -0,0 +1,104 @@
+package mute_alerts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/okharch/yal/model"
+)
+
+// ErrNoMute is returned by End for a mute that is not in force.
+var ErrNoMute = errors.New("no mute in force")
+
+// Mute silences the alerts of one target for one user subscription, e.g.
+// flight 1234 until tomorrow, see target_mutes. Unlike suppression windows
+// it is per user and matches the target type exactly: muting source airport
+// 3797 still delivers its alerts as destination airport.
+type Mute struct {
+	ID                 int
+	UserSubscriptionID int
+	Target             model.Target
+	Until              *time.Time // nil mutes until End
+	Reason             string
+	CreatedAt          time.Time
+}
+
+// Add mutes a target and returns the mute as stored. Muting a target that is
+// already muted replaces its until and reason and reports replaced; a mute
+// whose until passed is ended and a new one added instead.
+func Add(ctx context.Context, db *pgxpool.Pool, m Mute) (added Mute, replaced bool, err error) {
+	switch {
+	case m.UserSubscriptionID == 0:
+		return m, false, errors.New("mute needs a user subscription")
+	case m.Target.ID == 0 || m.Target.Type == "":
+		return m, false, errors.New("mute needs a target")
+	case m.Until != nil && !m.Until.After(time.Now()):
+		return m, false, errors.New("mute must end in the future")
+	}
+	// a mute whose until passed is ended first, like release_target_mutes
+	// would, so it is not replaced; xmax is 0 for an inserted row, the
+	// locking transaction for an updated one
+	err = db.QueryRow(ctx, `
+		WITH lapsed AS (
+			UPDATE target_mutes SET ended_at = now()
+			WHERE user_subscription_id = $1 AND target_id = $2 AND target_type = $3::target_type
+			  AND ended_at IS NULL AND until <= now()
+			RETURNING id
+		)
+		INSERT INTO target_mutes (user_subscription_id, target_id, target_type, until, reason)
+		SELECT $1, $2, $3::target_type, $4::timestamptz, NULLIF($5, '')
+		FROM (SELECT count(*) FROM lapsed) l -- reading it ends the lapsed mute before the insert
+		ON CONFLICT (user_subscription_id, target_id, target_type) WHERE ended_at IS NULL
+		DO UPDATE SET until = EXCLUDED.until, reason = EXCLUDED.reason
+		RETURNING id, user_subscription_id, target_id, target_type::text, until, COALESCE(reason, ''), created_at,
+		          xmax <> 0`,
+		m.UserSubscriptionID, m.Target.ID, m.Target.Type, m.Until, m.Reason).
+		Scan(&added.ID, &added.UserSubscriptionID, &added.Target.ID, &added.Target.Type, &added.Until, &added.Reason,
+			&added.CreatedAt, &replaced)
+	if err != nil {
+		return m, false, fmt.Errorf("failed to mute %s %d: %w", m.Target.Type, m.Target.ID, err)
+	}
+	return added, replaced, nil
+}
+
+// List returns the mutes of a user subscription in force, by id: not ended,
+// and with an until still ahead.
+func List(ctx context.Context, db *pgxpool.Pool, userSubscriptionID int) ([]Mute, error) {
+	rows, err := db.Query(ctx, `
+		SELECT id, user_subscription_id, target_id, target_type::text, until, COALESCE(reason, ''), created_at
+		FROM target_mutes
+		WHERE user_subscription_id = $1 AND ended_at IS NULL AND (until IS NULL OR until > now())
+		ORDER BY id`, userSubscriptionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list mutes: %w", err)
+	}
+	defer rows.Close()
+	var mutes []Mute
+	for rows.Next() {
+		var m Mute
+		if err := rows.Scan(&m.ID, &m.UserSubscriptionID, &m.Target.ID, &m.Target.Type, &m.Until, &m.Reason,
+			&m.CreatedAt); err != nil {
+			return nil, err
+		}
+		mutes = append(mutes, m)
+	}
+	return mutes, rows.Err()
+}
+
+// End unmutes now. The target's alerts that are on or changed while it was
+// muted are pushed right away, see trg_notify_target_unmute.
+func End(ctx context.Context, db *pgxpool.Pool, userSubscriptionID, id int) error {
+	tag, err := db.Exec(ctx, `
+		UPDATE target_mutes SET ended_at = now()
+		WHERE id = $1 AND user_subscription_id = $2 AND ended_at IS NULL`, id, userSubscriptionID)
+	if err != nil {
+		return fmt.Errorf("failed to unmute: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %d", ErrNoMute, id)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package mute_alerts
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/okharch/yal/model"
+	"github.com/okharch/yal/testdb"
+)
+
+// Muting a muted target replaces the mute, muting one whose mute lapsed
+// adds a new one. The mutes are of an airport id past the last airport and
+// deleted when the test ends.
+func TestAddReplacesOnlyMutesInForce(t *testing.T) {
+	db := testdb.Connect(t)
+	ctx := context.Background()
+	m := Mute{Target: model.Target{Type: "destination_airport"}, Reason: "test"}
+	err := db.QueryRow(ctx, `SELECT (SELECT min(id) FROM user_subscriptions), (SELECT max(id) + 1 FROM airports)`).
+		Scan(&m.UserSubscriptionID, &m.Target.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.UserSubscriptionID == 0 {
+		t.Skip("no user subscription to mute for")
+	}
+	t.Cleanup(func() {
+		if _, err := db.Exec(context.Background(), `DELETE FROM target_mutes WHERE target_id = $1`, m.Target.ID); err != nil {
+			t.Error(err)
+		}
+	})
+	add := func(until time.Time) (Mute, bool) {
+		t.Helper()
+		m.Until = &until
+		added, replaced, err := Add(ctx, db, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return added, replaced
+	}
+
+	first, replaced := add(time.Now().Add(time.Hour))
+	if replaced {
+		t.Error("first mute of the target replaced one")
+	}
+	again, replaced := add(time.Now().Add(2 * time.Hour))
+	if !replaced || again.ID != first.ID {
+		t.Errorf("muting again: got mute %d replaced %v, want mute %d replaced", again.ID, replaced, first.ID)
+	}
+
+	if _, err := db.Exec(ctx, `UPDATE target_mutes SET until = now() - interval '1 minute' WHERE id = $1`, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	renewed, replaced := add(time.Now().Add(time.Hour))
+	if replaced || renewed.ID == first.ID {
+		t.Errorf("muting after the mute lapsed: got mute %d replaced %v, want a new mute", renewed.ID, replaced)
+	}
+	var ended bool
+	if err := db.QueryRow(ctx, `SELECT ended_at IS NOT NULL FROM target_mutes WHERE id = $1`, first.ID).Scan(&ended); err != nil {
+		t.Fatal(err)
+	}
+	if !ended {
+		t.Errorf("lapsed mute %d was not ended", first.ID)
+	}
+}
@@ -0,0 +1,234 @@
+package plugin_alerts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/okharch/yal/ingest_alerts"
+)
+
+type condition struct {
+	templateID int
+	threshold  float64
+	direction  string
+	targetType string
+}
+
+// queueSize bounds the rows waiting for a plugin.
+const queueSize = 10000
+
+// worker runs one plugin on its queue of deferred rows.
+type worker struct {
+	plugin  *Plugin
+	queue   chan deferredRow
+	skipped atomic.Int64 // rows that went on without the plugin, it was behind
+}
+
+type deferredRow struct {
+	row    []interface{}
+	resume func()
+}
+
+// Evaluator runs the plugins registered against condition templates
+// (condition_plugins) on the rows of their conditions before they are staged.
+// It is an ingest_alerts.Deferrer: each plugin runs on a goroutine of its
+// own, so a slow plugin delays the rows of its conditions only.
+type Evaluator struct {
+	workers    map[int]*worker // by template id
+	conditions map[int]condition
+}
+
+// LoadEvaluator instantiates the active plugins, starts them until ctx is
+// done and registers the evaluator with the ingestion pipeline.
+func LoadEvaluator(ctx context.Context, db *pgxpool.Pool) (*Evaluator, error) {
+	e := &Evaluator{workers: make(map[int]*worker), conditions: make(map[int]condition)}
+
+	rows, err := db.Query(ctx, `
+		SELECT template_id, name, wasm, fuel, timeout_ms, memory_pages
+		FROM condition_plugins
+		WHERE is_active`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load condition plugins: %w", err)
+	}
+	for rows.Next() {
+		var templateID, timeoutMs, memoryPages int
+		var fuel int64
+		var name string
+		var wasm []byte
+		if err := rows.Scan(&templateID, &name, &wasm, &fuel, &timeoutMs, &memoryPages); err != nil {
+			rows.Close()
+			e.Close(ctx)
+			return nil, err
+		}
+		p, err := Load(ctx, name, wasm, Limits{
+			Fuel:        uint64(fuel),
+			Timeout:     time.Duration(timeoutMs) * time.Millisecond,
+			MemoryPages: uint32(memoryPages),
+		})
+		if err != nil {
+			log.Printf("skipping plugin of template %d: %v", templateID, err)
+			continue
+		}
+		e.workers[templateID] = &worker{plugin: p, queue: make(chan deferredRow, queueSize)}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		e.Close(ctx)
+		return nil, err
+	}
+
+	rows, err = db.Query(ctx, `
+		SELECT c.id, c.template_id, c.threshold, ct.direction::text, ct.target_type::text
+		FROM conditions c
+		JOIN condition_templates ct ON ct.id = c.template_id
+		JOIN condition_plugins p ON p.template_id = c.template_id AND p.is_active`)
+	if err != nil {
+		e.Close(ctx)
+		return nil, fmt.Errorf("failed to load plugin conditions: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var c condition
+		if err := rows.Scan(&id, &c.templateID, &c.threshold, &c.direction, &c.targetType); err != nil {
+			e.Close(ctx)
+			return nil, err
+		}
+		if _, ok := e.workers[c.templateID]; ok {
+			e.conditions[id] = c
+		}
+	}
+	if err := rows.Err(); err != nil {
+		e.Close(ctx)
+		return nil, err
+	}
+
+	for _, w := range e.workers {
+		go e.run(ctx, w)
+	}
+	for id := range e.conditions {
+		ingest_alerts.RegisterEvaluator(id, e)
+	}
+	log.Printf("loaded %d condition plugins for %d conditions", len(e.workers), len(e.conditions))
+	return e, nil
+}
+
+func (e *Evaluator) run(ctx context.Context, w *worker) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case d := <-w.queue:
+			e.evaluate(ctx, d.row)
+			d.resume()
+			if n := w.skipped.Swap(0); n > 0 {
+				log.Printf("plugin %s was behind, %d rows kept the producer's is_on", w.plugin.Name, n)
+			}
+		}
+	}
+}
+
+// Defer implements ingest_alerts.Deferrer, queueing the row for its plugin.
+func (e *Evaluator) Defer(row []interface{}, resume func()) bool {
+	conditionID, _ := row[ingest_alerts.ColConditionID].(int)
+	c, ok := e.conditions[conditionID]
+	if !ok {
+		return false
+	}
+	w := e.workers[c.templateID]
+	select {
+	case w.queue <- deferredRow{row: row, resume: resume}:
+		return true
+	default:
+		w.skipped.Add(1)
+		return false
+	}
+}
+
+// Evaluate implements ingest_alerts.Evaluator, running the plugin in place.
+// When a plugin fails, the row keeps the producer's is_on.
+func (e *Evaluator) Evaluate(row []interface{}) {
+	e.evaluate(context.Background(), row)
+}
+
+func (e *Evaluator) evaluate(ctx context.Context, row []interface{}) {
+	conditionID, _ := row[ingest_alerts.ColConditionID].(int)
+	c, ok := e.conditions[conditionID]
+	if !ok {
+		return
+	}
+	in := Input{
+		ConditionID: conditionID,
+		TargetType:  c.targetType,
+		Threshold:   c.threshold,
+		Direction:   c.direction,
+	}
+	in.TargetID, _ = row[ingest_alerts.ColTargetID].(int)
+	in.IsOn, _ = row[ingest_alerts.ColIsOn].(bool)
+	if v, ok := row[ingest_alerts.ColValue].(float64); ok {
+		in.Value = &v
+	}
+	if p, ok := row[ingest_alerts.ColPayload].(string); ok && p != "" {
+		if json.Valid([]byte(p)) {
+			in.Payload = json.RawMessage(p)
+		} else {
+			in.Payload, _ = json.Marshal(p)
+		}
+	}
+
+	out, err := e.workers[c.templateID].plugin.Evaluate(ctx, in)
+	if err != nil {
+		log.Printf("condition %d target %d: %v", conditionID, in.TargetID, err)
+		return
+	}
+	row[ingest_alerts.ColIsOn] = out.IsOn
+	if out.Value != nil {
+		row[ingest_alerts.ColValue] = *out.Value
+	}
+	if len(out.Payload) > 0 {
+		row[ingest_alerts.ColPayload] = string(out.Payload)
+	}
+}
+
+// Close releases the plugins.
+func (e *Evaluator) Close(ctx context.Context) {
+	for _, w := range e.workers {
+		_ = w.plugin.Close(ctx)
+	}
+}
+
+// Register validates a plugin by instantiating it and stores it against a
+// condition template, replacing the template's previous plugin. Running
+// pipelines pick it up on restart.
+func Register(ctx context.Context, db *pgxpool.Pool, templateName, name string, wasm []byte, limits Limits) error {
+	p, err := Load(ctx, name, wasm, limits)
+	if err != nil {
+		return err
+	}
+	_ = p.Close(ctx)
+
+	tag, err := db.Exec(ctx, `
+		INSERT INTO condition_plugins (template_id, name, wasm, fuel, timeout_ms, memory_pages)
+		SELECT id, $2, $3, $4, $5, $6 FROM condition_templates WHERE name = $1
+		ON CONFLICT (template_id) DO UPDATE
+			SET name = EXCLUDED.name,
+			    wasm = EXCLUDED.wasm,
+			    fuel = EXCLUDED.fuel,
+			    timeout_ms = EXCLUDED.timeout_ms,
+			    memory_pages = EXCLUDED.memory_pages,
+			    is_active = true,
+			    created_at = now()`,
+		templateName, name, wasm, int64(limits.Fuel), limits.Timeout.Milliseconds(), limits.MemoryPages)
+	if err != nil {
+		return fmt.Errorf("failed to store plugin: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("condition template %s does not exist", templateName)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package plugin_alerts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// A plugin is a WebAssembly module (wasip1 reactor, e.g. built with
+// GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared) exporting:
+//
+//	memory
+//	alloc(size u32) -> ptr u32               buffer for the input
+//	evaluate(ptr u32, size u32) -> u64       evaluates the Input JSON written at ptr
+//
+// evaluate returns the Output JSON location packed as ptr<<32 | size. Both
+// buffers belong to the plugin and need only stay valid until the next call.
+// Plugins have no file system, network, clock or environment access.
+
+// Input is the JSON a plugin evaluates for every ingested row.
+type Input struct {
+	ConditionID int             `json:"condition_id"`
+	TargetID    int             `json:"target_id"`
+	TargetType  string          `json:"target_type"`
+	Threshold   float64         `json:"threshold"`
+	Direction   string          `json:"direction"`
+	IsOn        bool            `json:"is_on"`
+	Value       *float64        `json:"value"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+}
+
+// Output is the JSON a plugin returns. Value and Payload replace the row's
+// ones when present.
+type Output struct {
+	IsOn    bool            `json:"is_on"`
+	Value   *float64        `json:"value,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Limits bound what a single plugin may use. Fuel meters the work of a
+// call whatever the load of the host; Timeout is a wall-clock backstop for
+// work that makes no calls.
+type Limits struct {
+	Fuel        uint64        // function calls of one evaluate call, 0 is unmetered
+	Timeout     time.Duration // wall-clock time of one evaluate call
+	MemoryPages uint32        // linear memory in 64 KiB pages
+}
+
+// DefaultLimits fit a small Go (wasip1) plugin.
+var DefaultLimits = Limits{Fuel: 100_000, Timeout: 10 * time.Millisecond, MemoryPages: 512}
+
+// meter is the fuel left to an evaluate call.
+type meter struct {
+	left  uint64
+	spent bool
+}
+
+type meterKey struct{}
+
+var errOutOfFuel = errors.New("out of fuel")
+
+// fuel charges every function call to the meter of its call context and
+// aborts the call once the fuel is spent: wazero recovers the panic and
+// returns it as the call's error. Calls run on the caller's goroutine, so
+// the meter needs no lock.
+var fuel = experimental.FunctionListenerFactoryFunc(func(api.FunctionDefinition) experimental.FunctionListener {
+	return experimental.FunctionListenerFunc(func(ctx context.Context, _ api.Module, _ api.FunctionDefinition, _ []uint64, _ experimental.StackIterator) {
+		m, ok := ctx.Value(meterKey{}).(*meter)
+		if !ok {
+			return
+		}
+		if m.left == 0 {
+			m.spent = true
+			panic(errOutOfFuel)
+		}
+		m.left--
+	})
+})
+
+// Plugin is an instantiated plugin. Calls are serialized.
+type Plugin struct {
+	Name     string
+	limits   Limits
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	module   api.Module
+	lock     sync.Mutex
+}
+
+// Load compiles and instantiates a plugin, checking its exports.
+func Load(ctx context.Context, name string, wasm []byte, limits Limits) (*Plugin, error) {
+	// a call running past its timeout is interrupted by closing its module
+	config := wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(limits.MemoryPages).
+		WithCloseOnContextDone(true)
+	r := wazero.NewRuntimeWithConfig(ctx, config)
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+		_ = r.Close(ctx)
+		return nil, err
+	}
+	compiled, err := r.CompileModule(experimental.WithFunctionListenerFactory(ctx, fuel), wasm)
+	if err != nil {
+		_ = r.Close(ctx)
+		return nil, fmt.Errorf("plugin %s: %w", name, err)
+	}
+	exports := compiled.ExportedFunctions()
+	for _, fn := range []string{"alloc", "evaluate"} {
+		if _, ok := exports[fn]; !ok {
+			_ = r.Close(ctx)
+			return nil, fmt.Errorf("plugin %s does not export %s", name, fn)
+		}
+	}
+
+	p := &Plugin{Name: name, limits: limits, runtime: r, compiled: compiled}
+	if err := p.instantiate(ctx); err != nil {
+		_ = r.Close(ctx)
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Plugin) instantiate(ctx context.Context) error {
+	// anonymous, so that a module closed by a timeout can be replaced
+	config := wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize")
+	m, err := p.runtime.InstantiateModule(ctx, p.compiled, config)
+	if err != nil {
+		return fmt.Errorf("failed to instantiate plugin %s: %w", p.Name, err)
+	}
+	if m.Memory() == nil {
+		_ = m.Close(ctx)
+		return fmt.Errorf("plugin %s does not export memory", p.Name)
+	}
+	p.module = m
+	return nil
+}
+
+// Evaluate calls the plugin within its limits. After a failed call the
+// plugin is reinstantiated, losing the state it kept in memory.
+func (p *Plugin) Evaluate(ctx context.Context, in Input) (Output, error) {
+	var out Output
+	b, err := json.Marshal(in)
+	if err != nil {
+		return out, err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.module == nil || p.module.IsClosed() {
+		if err := p.instantiate(ctx); err != nil {
+			return out, err
+		}
+	}
+	result, err := p.call(ctx, b)
+	if err != nil {
+		_ = p.module.Close(ctx)
+		return out, fmt.Errorf("plugin %s: %w", p.Name, err)
+	}
+	if err := json.Unmarshal(result, &out); err != nil {
+		return out, fmt.Errorf("plugin %s returned invalid output: %w", p.Name, err)
+	}
+	return out, nil
+}
+
+func (p *Plugin) call(ctx context.Context, in []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.limits.Timeout)
+	defer cancel()
+	m := &meter{left: p.limits.Fuel}
+	if p.limits.Fuel == 0 {
+		m.left = math.MaxUint64 // unmetered
+	}
+	ctx = context.WithValue(ctx, meterKey{}, m)
+
+	res, err := p.module.ExportedFunction("alloc").Call(ctx, uint64(len(in)))
+	if err != nil {
+		return nil, p.limitError(ctx, m, err)
+	}
+	ptr := uint32(res[0])
+	if !p.module.Memory().Write(ptr, in) {
+		return nil, errors.New("alloc returned a buffer out of memory range")
+	}
+	res, err = p.module.ExportedFunction("evaluate").Call(ctx, uint64(ptr), uint64(len(in)))
+	if err != nil {
+		return nil, p.limitError(ctx, m, err)
+	}
+	out, ok := p.module.Memory().Read(uint32(res[0]>>32), uint32(res[0]))
+	if !ok {
+		return nil, errors.New("output out of memory range")
+	}
+	// copy, the plugin reuses its buffer
+	return append([]byte(nil), out...), nil
+}
+
+// limitError names the limit that interrupted a call, if any.
+func (p *Plugin) limitError(ctx context.Context, m *meter, err error) error {
+	switch {
+	case m.spent:
+		return fmt.Errorf("ran out of fuel (%d calls)", p.limits.Fuel)
+	case ctx.Err() != nil:
+		return fmt.Errorf("exceeded %s", p.limits.Timeout)
+	}
+	return err
+}
+
+// Close releases the plugin runtime.
+func (p *Plugin) Close(ctx context.Context) error {
+	return p.runtime.Close(ctx)
+}
@@ -0,0 +1,136 @@
+package plugin_alerts
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Hand-assembled plugins: alloc returns offset 0, evaluate runs body, and
+// the memory holds output at offset 1024.
+const outputOffset = 1024
+
+func leb(v int64) []byte {
+	var b []byte
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 && c&0x40 == 0 || v == -1 && c&0x40 != 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func section(id byte, content ...byte) []byte {
+	return append(append([]byte{id}, leb(int64(len(content)))...), content...)
+}
+
+func name(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func join(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func testPlugin(evaluate []byte, output string) []byte {
+	code := func(body ...byte) []byte {
+		body = append([]byte{0}, body...) // no locals
+		return append(leb(int64(len(body))), body...)
+	}
+	return join(
+		[]byte{0, 'a', 's', 'm', 1, 0, 0, 0},
+		section(1, join([]byte{3},
+			[]byte{0x60, 1, 0x7f, 1, 0x7f},       // alloc(i32) i32
+			[]byte{0x60, 2, 0x7f, 0x7f, 1, 0x7e}, // evaluate(i32, i32) i64
+			[]byte{0x60, 0, 0},                   // spend()
+		)...),
+		section(3, 3, 0, 1, 2),
+		section(5, 1, 0, 1),
+		section(7, join([]byte{3},
+			name("memory"), []byte{2, 0},
+			name("alloc"), []byte{0, 0},
+			name("evaluate"), []byte{0, 1},
+		)...),
+		section(10, join([]byte{3},
+			code(0x41, 0, 0x0b), // i32.const 0
+			code(evaluate...),
+			code(0x0b),
+		)...),
+		section(11, join([]byte{1, 0, 0x41}, leb(outputOffset), []byte{0x0b},
+			leb(int64(len(output))), []byte(output))...),
+	)
+}
+
+func TestPluginLimits(t *testing.T) {
+	output := `{"is_on": true}`
+	tests := []struct {
+		name     string
+		evaluate []byte
+		limits   Limits
+		err      string
+	}{
+		{
+			name:     "returns output",
+			evaluate: join([]byte{0x42}, leb(outputOffset<<32|int64(len(output))), []byte{0x0b}),
+			limits:   DefaultLimits,
+		},
+		{
+			// loop { spend() }
+			name:     "runs out of fuel",
+			evaluate: []byte{0x03, 0x40, 0x10, 0x02, 0x0c, 0x00, 0x0b, 0x00, 0x0b},
+			limits:   Limits{Fuel: 1000, Timeout: time.Minute, MemoryPages: 1},
+			err:      "ran out of fuel (1000 calls)",
+		},
+		{
+			// loop {}, no calls to meter
+			name:     "times out",
+			evaluate: []byte{0x03, 0x40, 0x0c, 0x00, 0x0b, 0x00, 0x0b},
+			limits:   Limits{Fuel: 1000, Timeout: 20 * time.Millisecond, MemoryPages: 1},
+			err:      "exceeded 20ms",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			p, err := Load(ctx, "test", testPlugin(tt.evaluate, output), tt.limits)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			defer p.Close(ctx)
+			// twice: a plugin that failed is reinstantiated
+			for i := 0; i < 2; i++ {
+				out, err := p.Evaluate(ctx, Input{ConditionID: 1, TargetID: 2, Threshold: 25, Direction: "above"})
+				if tt.err != "" {
+					if err == nil || !strings.Contains(err.Error(), tt.err) {
+						t.Fatalf("got error %v, want %q", err, tt.err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("Evaluate: %v", err)
+				}
+				if !out.IsOn {
+					t.Errorf("got %+v, want is_on", out)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadChecksExports(t *testing.T) {
+	wasm := testPlugin([]byte{0x42, 0, 0x0b}, "")
+	// rename the evaluate export
+	i := strings.Index(string(wasm), "evaluate")
+	copy(wasm[i:], "evaluatx")
+	_, err := Load(context.Background(), "test", wasm, DefaultLimits)
+	if err == nil || !strings.Contains(err.Error(), "does not export evaluate") {
+		t.Errorf("got error %v, want a missing export", err)
+	}
+}
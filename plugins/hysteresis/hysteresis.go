@@ -0,0 +1,87 @@
+//go:build wasip1
+
+// File: plugins/hysteresis/hysteresis.go
+//
+// hysteresis is an example condition plugin (see plugin_alerts). It turns an
+// alert on when the value crosses the threshold, but off only once the value
+// is back by more than 10% of the threshold, so values hovering around the
+// threshold do not flap. State is kept per target in plugin memory.
+//
+//	GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared -o plugins/hysteresis.wasm ./plugins/hysteresis
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"unsafe"
+)
+
+type input struct {
+	ConditionID int      `json:"condition_id"`
+	TargetID    int      `json:"target_id"`
+	Threshold   float64  `json:"threshold"`
+	Direction   string   `json:"direction"`
+	IsOn        bool     `json:"is_on"`
+	Value       *float64 `json:"value"`
+}
+
+type output struct {
+	IsOn    bool                   `json:"is_on"`
+	Payload map[string]interface{} `json:"payload,omitempty"`
+}
+
+const band = 0.1
+
+var (
+	on     = make(map[[2]int]bool) // (condition, target) is on
+	inBuf  []byte
+	outBuf []byte
+)
+
+func main() {}
+
+//go:wasmexport alloc
+func alloc(size uint32) uint32 {
+	inBuf = make([]byte, size)
+	return ptr(inBuf)
+}
+
+// evaluate reads the input written by the host into the buffer of the last
+// alloc call
+//
+//go:wasmexport evaluate
+func evaluate(_, size uint32) uint64 {
+	var in input
+	if err := json.Unmarshal(inBuf[:size], &in); err != nil || in.Value == nil {
+		return respond(output{IsOn: in.IsOn})
+	}
+	key := [2]int{in.ConditionID, in.TargetID}
+	threshold := in.Threshold
+	margin := threshold * band
+	if in.Direction == "below" {
+		threshold, margin = -threshold, -margin
+		v := -*in.Value
+		in.Value = &v
+	}
+	if on[key] {
+		on[key] = *in.Value > threshold-margin
+	} else {
+		on[key] = *in.Value > threshold
+	}
+	return respond(output{IsOn: on[key], Payload: map[string]interface{}{
+		"plugin": "hysteresis",
+		"band":   fmt.Sprintf("%.0f%%", band*100),
+	}})
+}
+
+func respond(out output) uint64 {
+	outBuf, _ = json.Marshal(out)
+	return uint64(ptr(outBuf))<<32 | uint64(len(outBuf))
+}
+
+func ptr(b []byte) uint32 {
+	if len(b) == 0 {
+		return 0
+	}
+	return uint32(uintptr(unsafe.Pointer(&b[0])))
+}
@@ -2,8 +2,42 @@
 -- ENUM Types
 -- =============
 
-CREATE TYPE target_type AS ENUM ('source_airport', 'destination_airport', 'flight');
+-- anything alerts are raised on, one of target_types.name (e.g. 'flight',
+-- 'destination_airport', 'airline'); a domain rather than an enum, so that a
+-- new target type is a row in target_types
+CREATE DOMAIN target_type AS TEXT;
 CREATE TYPE flight_status AS ENUM ('scheduled', 'departed', 'arrived', 'cancelled', 'delayed');
+-- 'above': alert is on when the measured value exceeds the threshold (wind, delay)
+-- 'below': alert is on when the measured value drops under the threshold (fog, fuel)
+CREATE TYPE threshold_direction AS ENUM ('above', 'below');
+-- how a condition decides is_on:
+--   'threshold':  the evaluator compares its measurement with conditions.threshold
+--   'zscore':     the measurement's z-score against the per-target baseline is
+--                 compared with conditions.threshold (e.g. 2.5)
+--   'percentile': the measurement's percentile under the per-target baseline is
+--                 compared with conditions.threshold (e.g. 99)
+-- Baseline conditions store the score (not the measurement) as alerts.value,
+-- so per-user and shadow thresholds are scores as well. Thresholds are
+-- DOUBLE PRECISION for the sake of fractional scores.
+CREATE TYPE condition_kind AS ENUM ('threshold', 'zscore', 'percentile');
+-- how the active tier of a tier group moved for a target
+CREATE TYPE tier_transition AS ENUM ('raised', 'escalated', 'de-escalated', 'cleared');
+-- how a target's membership in a subscription changed, see subscription_target_events
+CREATE TYPE subscription_target_event AS ENUM ('entered', 'left');
+-- what a push to a user subscription carries, see pushes:
+--   'alerts':             alerts changed since the last push (get_alerts_json)
+--   'snapshot':           every alert on, for a new subscriber (get_alerts_json with snapshot)
+--   'condition_enabled':  alerts of a condition the user turned on (get_condition_change_json)
+--   'condition_disabled': the same alerts turned off, as the user turned the condition off
+CREATE TYPE push_event AS ENUM ('alerts', 'snapshot', 'condition_enabled', 'condition_disabled');
+-- why an alert that stayed on was delivered again, see condition_templates.change_*
+CREATE TYPE alert_change_reason AS ENUM ('severity', 'value', 'payload');
+-- which alerts an inhibition rule suppresses relative to its source alert's target
+CREATE TYPE inhibition_scope AS ENUM ('same_target', 'inbound_flights', 'outbound_flights');
+-- lifecycle of an incident, see incidents
+CREATE TYPE incident_status AS ENUM ('open', 'acknowledged', 'resolved');
+-- what get_alerts_json delivers to a user subscription: every alert, or incidents
+CREATE TYPE delivery_mode AS ENUM ('alerts', 'incidents');
 
 -- =============
 -- Base Tables
@@ -51,6 +85,14 @@ CREATE TABLE planes (
                         icao VARCHAR(10)
 );
 
+-- Individual airframes by registration (tail number), not part of OpenFlights
+CREATE TABLE aircraft (
+                        id SERIAL PRIMARY KEY,
+                        registration TEXT NOT NULL UNIQUE,
+                        plane_id INT NULL REFERENCES planes(id),
+                        airline_id INT NULL REFERENCES airlines(id)
+);
+
 CREATE TABLE routes (
                         id SERIAL PRIMARY KEY,
                         airline TEXT,
@@ -73,9 +115,44 @@ CREATE TABLE flights (
                          destination_airport_id INTEGER NOT NULL,
                          departure_time TIMESTAMPTZ NOT NULL,
                          arrival_time TIMESTAMPTZ NOT NULL,
-                         status flight_status NOT NULL
+                         status flight_status NOT NULL,
+                         aircraft_id INTEGER NULL REFERENCES aircraft(id) -- when the airframe is known
+);
+-- flights to and from an airport, see inhibition_rules
+CREATE INDEX idx_flights_destination_airport ON flights (destination_airport_id);
+CREATE INDEX idx_flights_source_airport ON flights (source_airport_id);
+
+-- =============
+-- Target Registry
+-- =============
+
+-- Every kind of target alerts can be raised on. A target is (target_id,
+-- target_type) where target_id is an id of source_table. Several types can
+-- share an entity, e.g. an airport as source and as destination airport:
+-- relations between targets (inhibition, suppression windows, incidents)
+-- compare entities. Subscription views list their targets in view_column,
+-- see subscription_view_targets. Adding a target type is adding a row.
+CREATE TABLE target_types (
+                        name TEXT PRIMARY KEY,
+                        entity TEXT NOT NULL,
+                        source_table TEXT NOT NULL,
+                        -- names a target: format(label_format, <label_columns of its source_table row>)
+                        label_format TEXT NOT NULL DEFAULT '%s',
+                        label_columns TEXT[] NOT NULL CHECK (cardinality(label_columns) > 0),
+                        view_column TEXT NOT NULL UNIQUE,
+                        description TEXT
 );
 
+INSERT INTO target_types (name, entity, source_table, label_format, label_columns, view_column, description) VALUES
+    ('flight',              'flight',       'flights',        '%s',                    '{flight_number}',                      'flight_id',              'A scheduled flight'),
+    ('source_airport',      'airport',      'airports',       '%s',                    '{name}',                               'source_airport_id',      'Airport a flight departs from'),
+    ('destination_airport', 'airport',      'airports',       '%s',                    '{name}',                               'destination_airport_id', 'Airport a flight arrives at'),
+    ('airline',             'airline',      'airlines',       '%s',                    '{name}',                               'airline_id',             'Operating airline'),
+    ('plane',               'plane',        'planes',         '%s',                    '{name}',                               'plane_id',               'Aircraft type, e.g. Boeing 737-800'),
+    ('route',               'route',        'routes',         '%s-%s',                 '{source_airport,destination_airport}', 'route_id',               'Airline route between two airports'),
+    ('registration',        'registration', 'aircraft',       '%s',                    '{registration}',                       'aircraft_id',            'Individual aircraft by registration'),
+    ('connection',          'connection',   'itinerary_legs', 'leg %s of itinerary %s', '{position,itinerary_id}',             'connection_id',          'Connection from an itinerary leg to the next one');
+
 -- =============
 -- Condition Framework
 -- =============
@@ -84,33 +161,302 @@ CREATE TABLE condition_templates (
                                      id SERIAL PRIMARY KEY,
                                      name TEXT NOT NULL UNIQUE,
                                      description TEXT NOT NULL,
-                                     target_type target_type NOT NULL
+                                     target_type target_type NOT NULL REFERENCES target_types(name),
+                                     direction threshold_direction NOT NULL DEFAULT 'above',
+                                     -- baseline conditions: number of recent measurements the rolling
+                                     -- mean/variance spans, and measurements needed before firing
+                                     baseline_window INT NOT NULL DEFAULT 100,
+                                     baseline_min_samples INT NOT NULL DEFAULT 20,
+                                     -- alerts that are on are turned off by the Go ingestion pipeline when
+                                     -- no update was received for this long (payload reason 'stale'),
+                                     -- NULL = alerts never go stale
+                                     stale_after INTERVAL NULL CHECK (stale_after > interval '0'),
+                                     -- significant changes of an alert that stays on, each updates the
+                                     -- stored alert and notifies its subscribers (NULL = not tracked):
+                                     --   change_bands: ascending severity band limits of the value, e.g.
+                                     --                 fog {50,100,150}; moving to another band is a change
+                                     --   change_delta: the value moved at least this much since it was
+                                     --                 last delivered, smaller jitter is ignored
+                                     --   change_keys:  any change of these payload (JSON) keys
+                                     change_bands DOUBLE PRECISION[] NULL,
+                                     change_delta DOUBLE PRECISION NULL CHECK (change_delta > 0),
+                                     change_keys TEXT[] NULL
+);
+
+-- Conditions sharing a tier group are tiers of one measurement (e.g. wind
+-- 30kt/50kt): only the highest severity tier that is on is delivered.
+CREATE TABLE condition_tier_groups (
+                            id SERIAL PRIMARY KEY,
+                            name TEXT NOT NULL UNIQUE,
+                            description TEXT
 );
 
 CREATE TABLE conditions (
                             id SERIAL PRIMARY KEY,
                             template_id INT NOT NULL REFERENCES condition_templates(id),
-                            threshold INT NOT NULL,
-                            severity INT NOT NULL
+                            threshold DOUBLE PRECISION NOT NULL,
+                            severity INT NOT NULL,
+                            tier_group_id INT NULL REFERENCES condition_tier_groups(id),
+                            kind condition_kind NOT NULL DEFAULT 'threshold',
+                            -- expression over payload, value, is_on and target attributes deciding
+                            -- is_on at ingestion, e.g. 'payload.precip_mm > 10 && payload.temp_c < 2'.
+                            -- Set it through alert_rules.SetConditionRule, which reports syntax errors
+                            rule TEXT NULL
 );
 
 CREATE INDEX idx_conditions_template_id ON conditions(template_id);
 
+-- Alertmanager-style inhibition: while an alert of the source condition is on
+-- for a target, alerts of the target condition are suppressed on
+--   same_target      - the same target (same entity, e.g. an airport as source and destination)
+--   inbound_flights  - flights whose destination is the source's airport
+--   outbound_flights - flights whose source is the source's airport
+-- e.g. arrival delays while the runway is blocked. Inhibited alerts are still
+-- merged and logged, with alerts.inhibited_by pointing at the source alert.
+CREATE TABLE inhibition_rules (
+                            id SERIAL PRIMARY KEY,
+                            source_condition_id INT NOT NULL REFERENCES conditions(id),
+                            target_condition_id INT NOT NULL REFERENCES conditions(id),
+                            scope inhibition_scope NOT NULL DEFAULT 'same_target',
+                            description TEXT,
+                            is_active BOOL NOT NULL DEFAULT true,
+                            UNIQUE (source_condition_id, target_condition_id, scope),
+                            CHECK (source_condition_id <> target_condition_id)
+);
+CREATE INDEX idx_inhibition_rules_target ON inhibition_rules (target_condition_id) WHERE is_active;
+
+-- Scheduled maintenance, e.g. planned runway works or a known closure: alerts
+-- of the target (of one condition, or of all when condition_id is NULL) are
+-- suppressed from starts_at until ends_at. Targets of the same entity match,
+-- e.g. an airport as source and destination. Managed through window_alerts / cmd/suppression_window;
+-- apply_suppression_windows delivers what is still on when a window ends.
+CREATE TABLE suppression_windows (
+                            id SERIAL PRIMARY KEY,
+                            target_id INT NOT NULL,
+                            target_type target_type NOT NULL REFERENCES target_types(name),
+                            condition_id INT NULL REFERENCES conditions(id),
+                            starts_at TIMESTAMPTZ NOT NULL,
+                            ends_at TIMESTAMPTZ NOT NULL,
+                            reason TEXT NOT NULL,
+                            created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+                            CHECK (ends_at > starts_at)
+);
+CREATE INDEX idx_suppression_windows_target ON suppression_windows (target_id, ends_at);
+CREATE INDEX idx_suppression_windows_period ON suppression_windows (ends_at, starts_at);
+
+-- WebAssembly evaluators shipped by partner teams, one per template, run by
+-- the Go ingestion pipeline on every row of the template's conditions before
+-- it is staged (see plugin_alerts). Each plugin is limited to timeout_ms of
+-- CPU per row and memory_pages (64 KiB) of memory
+CREATE TABLE condition_plugins (
+                            id SERIAL PRIMARY KEY,
+                            template_id INT NOT NULL UNIQUE REFERENCES condition_templates(id),
+                            name TEXT NOT NULL,
+                            wasm BYTEA NOT NULL,
+                            fuel BIGINT NOT NULL DEFAULT 100000 CHECK (fuel > 0), -- function calls per evaluation
+                            timeout_ms INT NOT NULL DEFAULT 10 CHECK (timeout_ms > 0), -- wall-clock backstop
+                            memory_pages INT NOT NULL DEFAULT 512 CHECK (memory_pages BETWEEN 1 AND 65536),
+                            is_active BOOL NOT NULL DEFAULT true,
+                            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Rolling (exponentially weighted) mean and variance of the measurements
+-- reported for a template on a target, maintained by the Go ingestion
+-- pipeline for 'zscore' and 'percentile' conditions
+CREATE TABLE baseline_stats (
+                            template_id INT NOT NULL REFERENCES condition_templates(id),
+                            target_id INT NOT NULL,
+                            samples BIGINT NOT NULL,
+                            mean DOUBLE PRECISION NOT NULL,
+                            variance DOUBLE PRECISION NOT NULL,
+                            measured_at TIMESTAMPTZ NULL, -- latest measurement folded in, older ones are not
+                            updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+                            PRIMARY KEY (template_id, target_id)
+);
+
+-- ================================================================
+-- Function: threshold_crossed / effective_is_on
+-- ------------------------------------------------
+-- Purpose:
+--   Evaluates a raw measured value against a threshold, honoring the
+--   template direction. `effective_is_on` is the per-user view of an
+--   alert: when the user overrides the threshold and the alert carries
+--   a raw value, the value is re-evaluated against the override;
+--   otherwise the evaluator's global `is_on` is used as-is.
+--
+-- Notes:
+--   - Both are IMMUTABLE SQL functions so the planner inlines them
+--     into the fan-out and `user_subscription_alerts` queries.
+-- ================================================================
+CREATE OR REPLACE FUNCTION threshold_crossed(dir threshold_direction, val DOUBLE PRECISION, threshold DOUBLE PRECISION)
+    RETURNS BOOL
+    LANGUAGE sql IMMUTABLE AS $$
+SELECT CASE WHEN dir = 'below' THEN val < threshold ELSE val > threshold END
+$$;
+
+CREATE OR REPLACE FUNCTION effective_is_on(is_on BOOL, dir threshold_direction, val DOUBLE PRECISION, user_threshold DOUBLE PRECISION)
+    RETURNS BOOL
+    LANGUAGE sql IMMUTABLE AS $$
+SELECT CASE
+           WHEN user_threshold IS NULL OR val IS NULL THEN is_on
+           ELSE threshold_crossed(dir, val, user_threshold)
+           END
+$$;
+
+-- ================================================================
+-- Function: significant_change
+-- ------------------------------------------------
+-- Purpose:
+--   Classifies an update of an alert that stays on by the significant
+--   change rules of its template (condition_templates.change_*):
+--     'severity' - the value moved to another severity band
+--     'value'    - the value moved at least change_delta from the
+--                  delivered one
+--     'payload'  - one of change_keys differs between the payloads
+--   Returns NULL for jitter that should not be delivered.
+--
+-- Notes:
+--   - Payloads are compared as JSON only when change_keys is set.
+--   - A payload that is not JSON is compared as text, so it never fails
+--     the merge: any change of it is significant.
+-- ================================================================
+CREATE OR REPLACE FUNCTION significant_change(bands DOUBLE PRECISION[], delta DOUBLE PRECISION, keys TEXT[],
+                                              old_value DOUBLE PRECISION, val DOUBLE PRECISION,
+                                              old_payload TEXT, payload TEXT)
+    RETURNS alert_change_reason
+    LANGUAGE sql STABLE AS $$ -- pg_input_is_valid is STABLE
+SELECT CASE
+           WHEN bands IS NOT NULL AND width_bucket(val, bands) IS DISTINCT FROM width_bucket(old_value, bands)
+               THEN 'severity'
+           WHEN abs(val - old_value) >= delta
+               THEN 'value'
+           WHEN keys IS NOT NULL AND old_payload IS DISTINCT FROM payload AND CASE
+               -- CASE, unlike AND, guarantees the casts only see JSON
+               WHEN pg_input_is_valid(old_payload, 'jsonb') AND pg_input_is_valid(payload, 'jsonb') THEN EXISTS (
+                   SELECT 1 FROM unnest(keys) AS k
+                   WHERE (old_payload::jsonb -> k) IS DISTINCT FROM (payload::jsonb -> k))
+               ELSE true
+               END
+               THEN 'payload'
+           END::alert_change_reason
+$$;
+
 -- =============
 -- Alerts
 -- =============
 
+-- Related alerts grouped into one entity, so a storm at a hub is one incident
+-- instead of a dozen alerts. An alert going on joins an incident of its
+-- target, or for flights of their destination or source airport, that is open,
+-- acknowledged or was resolved shortly before (and is reopened); otherwise it
+-- opens one. process_alert_staging resolves an incident when none of its
+-- alerts is on, and bumps updated_at on every change its subscribers are told
+-- about (opened, escalated, acknowledged, resolved, reopened).
+CREATE TABLE incidents (
+                        id SERIAL PRIMARY KEY,
+                        target_id INT NOT NULL, -- airport or flight the incident is about
+                        target_type target_type NOT NULL,
+                        status incident_status NOT NULL DEFAULT 'open',
+                        severity INT NOT NULL, -- highest severity of its alerts that were on
+                        opened_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+                        acknowledged_at TIMESTAMPTZ NULL,
+                        acknowledged_by TEXT NULL,
+                        resolved_at TIMESTAMPTZ NULL,
+                        updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX idx_incidents_target ON incidents (target_id, status);
+CREATE INDEX idx_incidents_updated_at ON incidents (updated_at);
+CREATE INDEX idx_incidents_unresolved ON incidents (id) WHERE status <> 'resolved'; -- snapshots
+
 CREATE TABLE alerts (
                         id SERIAL PRIMARY KEY,
                         condition_id INT NOT NULL REFERENCES conditions(id),
                         target_id INT NOT NULL,
-                        target_type target_type NOT NULL,
+                        target_type target_type NOT NULL REFERENCES target_types (name),
                         is_on BOOL NOT NULL,
+                        value DOUBLE PRECISION NULL, -- raw measured value, re-evaluated against per-user thresholds
     received_at TIMESTAMPTZ NOT NULL,
     payload text NOT NULL,
                         updated_at TIMESTAMPTZ NOT NULL default now(),
+                        superseded_by INT NULL REFERENCES conditions(id), -- higher tier currently on for the same target
+                        tier_transition tier_transition NULL, -- set on the alert that became (or stopped being) the active tier, cleared on its next change
+                        change_reason alert_change_reason NULL, -- set when the last update was a significant change, not a flip
+                        inhibited_by INT NULL, -- source alert of an inhibition rule that is on, see inhibition_rules
+                        suppression_window_id INT NULL, -- suppression window in force, see suppression_windows
+                        incident_id INT NULL REFERENCES incidents(id), -- incident the alert joined when it last went on
+                        -- suppressed alerts keep their evaluated is_on but are not delivered
+                        suppressed BOOL GENERATED ALWAYS AS (superseded_by IS NOT NULL OR inhibited_by IS NOT NULL
+                            OR suppression_window_id IS NOT NULL) STORED,
                         UNIQUE (condition_id, target_id)
 );
+CREATE INDEX idx_alerts_suppression_window ON alerts (suppression_window_id) WHERE suppression_window_id IS NOT NULL;
+CREATE INDEX idx_alerts_incident ON alerts (incident_id) WHERE incident_id IS NOT NULL;
+-- no foreign key: archiving a source alert re-resolves its symptoms instead
+CREATE INDEX idx_alerts_inhibited_by ON alerts (inhibited_by) WHERE inhibited_by IS NOT NULL;
+
+-- Current active tier per tier group and target, NULL condition_id when no tier is on
+CREATE TABLE alert_tiers (
+                        tier_group_id INT NOT NULL REFERENCES condition_tier_groups(id),
+                        target_id INT NOT NULL,
+                        target_type target_type NOT NULL,
+                        condition_id INT NULL REFERENCES conditions(id),
+                        changed_at TIMESTAMPTZ NOT NULL,
+                        PRIMARY KEY (tier_group_id, target_id, target_type)
+);
+
+-- Append-only log of tier moves, one row per raise/escalation/de-escalation/clear
+CREATE TABLE alert_tier_transitions (
+                        id BIGSERIAL PRIMARY KEY,
+                        tier_group_id INT NOT NULL REFERENCES condition_tier_groups(id),
+                        target_id INT NOT NULL,
+                        target_type target_type NOT NULL,
+                        from_condition_id INT NULL REFERENCES conditions(id),
+                        to_condition_id INT NULL REFERENCES conditions(id),
+                        transition tier_transition NOT NULL,
+                        created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX idx_alert_tier_transitions_target ON alert_tier_transitions (target_id, created_at);
+
+-- =============
+-- Shadow Evaluation
+-- =============
+
+-- Candidate threshold for a live condition, evaluated against the same
+-- ingested values as the live one but never delivered to users
+CREATE TABLE shadow_conditions (
+                        id SERIAL PRIMARY KEY,
+                        condition_id INT NOT NULL REFERENCES conditions(id), -- live condition the candidate would replace
+                        threshold DOUBLE PRECISION NOT NULL,
+                        description TEXT,
+                        is_active BOOL NOT NULL DEFAULT true,
+                        created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE shadow_alerts (
+                        shadow_condition_id INT NOT NULL REFERENCES shadow_conditions(id),
+                        target_id INT NOT NULL,
+                        target_type target_type NOT NULL,
+                        is_on BOOL NOT NULL,
+                        value DOUBLE PRECISION NOT NULL,
+                        received_at TIMESTAMPTZ NOT NULL,
+                        updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+                        PRIMARY KEY (shadow_condition_id, target_id)
+);
+
+-- Flips of a shadow condition and, to compare them with, of the live
+-- condition it shadows while the shadow is active
+CREATE TABLE shadow_alert_transitions (
+                        id BIGSERIAL PRIMARY KEY,
+                        shadow_condition_id INT NOT NULL REFERENCES shadow_conditions(id),
+                        live BOOL NOT NULL DEFAULT false, -- a flip of the live condition
+                        target_id INT NOT NULL,
+                        target_type target_type NOT NULL,
+                        old_is_on BOOL NULL, -- NULL on the first evaluation of the target
+                        is_on BOOL NOT NULL,
+                        value DOUBLE PRECISION NULL, -- NULL for live flips reported without a value
+                        recorded_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX idx_shadow_alert_transitions_condition ON shadow_alert_transitions (shadow_condition_id, recorded_at);
 CREATE TABLESPACE ramdisk LOCATION '/ramdisk';
 
 CREATE UNLOGGED TABLE alerts_staging (
@@ -118,23 +464,57 @@ CREATE UNLOGGED TABLE alerts_staging (
                                 target_id INT,
                                 is_on BOOLEAN NOT NULL,
                                 payload TEXT,
-                                received_at TIMESTAMPTZ NOT NULL
+                                received_at TIMESTAMPTZ NOT NULL,
+                                value DOUBLE PRECISION
 ) TABLESPACE ramdisk;
 
 CREATE TABLE users(
                      id SERIAL PRIMARY KEY,
                      name TEXT NOT NULL,
+                     token TEXT NOT NULL UNIQUE DEFAULT gen_random_uuid()::text, -- API bearer token
                      created_at TIMESTAMPTZ DEFAULT now()
 );
 
+-- A traveller's connecting flights, in order of position. A leg followed by
+-- another is a connection: its id is the target id of the 'connection'
+-- target, see connection_risks.
+CREATE TABLE itineraries (
+                             id SERIAL PRIMARY KEY,
+                             created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE itinerary_legs (
+                                id SERIAL PRIMARY KEY,
+                                itinerary_id INT NOT NULL REFERENCES itineraries (id) ON DELETE CASCADE,
+                                position INT NOT NULL CHECK (position > 0),
+                                flight_id INT NOT NULL,
+                                UNIQUE (itinerary_id, position)
+);
+
+-- Minimum connection time at a transfer airport; airports without a row use
+-- the default passed to connection_risks
+CREATE TABLE minimum_connection_times (
+                                          airport_id INT PRIMARY KEY REFERENCES airports (id),
+                                          minutes INT NOT NULL CHECK (minutes > 0)
+);
 
 CREATE TABLE subscriptions (
-                               id INT PRIMARY KEY,
+                               -- seeded subscriptions reuse airport ids, see subscription_alerts.Save
+                               id INT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
                                name TEXT NOT NULL,
-                               view_name TEXT NOT NULL,
+                               view_name TEXT NULL, -- legacy hand-written view listing the targets, see subscription_view_targets
+                               spec JSONB NULL, -- declarative definition, see subscription_spec_targets
+                               -- a traveller's subscription to one flight or an itinerary, deleted
+                               -- expires_after its (last) arrival_time, see expire_flight_subscriptions
+                               flight_id INT NULL,
+                               itinerary_id INT NULL REFERENCES itineraries (id),
+                               expires_after INTERVAL NULL,
     start_update TIMESTAMPTZ,
-    finish_update TIMESTAMPTZ
+    finish_update TIMESTAMPTZ,
+    CHECK (spec IS NOT NULL OR view_name IS NOT NULL OR flight_id IS NOT NULL OR itinerary_id IS NOT NULL),
+    CHECK ((flight_id IS NULL AND itinerary_id IS NULL) = (expires_after IS NULL))
 );
+CREATE INDEX idx_subscriptions_flight ON subscriptions (flight_id) WHERE flight_id IS NOT NULL;
 
 create table user_subscriptions
 (
@@ -143,7 +523,9 @@ create table user_subscriptions
     subscription_id INT NOT NULL REFERENCES subscriptions (id),
     unique (user_id, subscription_id),
     pushed_at     TIMESTAMPTZ NULL, -- when the subscription's alerts were pushed to the user
-    alerts_triggered_at TIMESTAMPTZ NULL -- when the subscription's alerts were triggered
+    alerts_triggered_at TIMESTAMPTZ NULL, -- when the subscription's alerts were triggered
+    delivery delivery_mode NOT NULL DEFAULT 'alerts', -- 'incidents' pushes incident updates instead of alerts
+    min_severity INT NOT NULL DEFAULT 0 -- alerts of conditions with a lower severity are left out
 );
 
 create table user_subscription_conditions
@@ -153,9 +535,67 @@ create table user_subscription_conditions
     condition_id        INT NOT NULL references conditions (id),
     unique (user_subscription_id, condition_id),
     is_on              BOOL NOT NULL,
+    threshold          DOUBLE PRECISION NULL, -- per-user override of conditions.threshold, NULL = use the global one
+    rule               TEXT NULL, -- expression the alert must also match to be on for this user, see alert_rules
     last_changed_at TIMESTAMPTZ
 );
 
+-- Named groups of conditions, e.g. 'weather', a user subscription can turn
+-- on in bulk, see subscription_alerts.EnablePacks
+CREATE TABLE condition_packs (
+    id SERIAL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    description TEXT NOT NULL
+);
+
+CREATE TABLE condition_pack_members (
+    pack_id INT NOT NULL REFERENCES condition_packs (id) ON DELETE CASCADE,
+    condition_id INT NOT NULL REFERENCES conditions (id) ON DELETE CASCADE,
+    PRIMARY KEY (pack_id, condition_id)
+);
+CREATE INDEX idx_condition_pack_members_condition ON condition_pack_members (condition_id);
+
+-- Targets a user subscription does not want alerts of for now, e.g. one
+-- flight of a busy hub until tomorrow. A mute is in force until it ends
+-- (ended_at, set when unmuted or by release_target_mutes once `until`
+-- passes); user_subscription_alerts leaves out the alerts it covers. Ended
+-- mutes are kept until their alerts were delivered, see get_alerts_json.
+CREATE TABLE target_mutes (
+    id SERIAL PRIMARY KEY,
+    user_subscription_id INT NOT NULL REFERENCES user_subscriptions (id) ON DELETE CASCADE,
+    target_id INT NOT NULL,
+    target_type target_type NOT NULL REFERENCES target_types (name),
+    until TIMESTAMPTZ NULL, -- NULL mutes until unmuted
+    reason TEXT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ended_at TIMESTAMPTZ NULL
+);
+CREATE UNIQUE INDEX idx_target_mutes_in_force ON target_mutes (user_subscription_id, target_id, target_type)
+    WHERE ended_at IS NULL;
+CREATE INDEX idx_target_mutes_until ON target_mutes (until) WHERE ended_at IS NULL AND until IS NOT NULL;
+
+-- Every push delivered to a user subscription, as sent (after user rules).
+-- The id is the push sequence the client sees, so it can detect a gap and
+-- replay the pushes it missed.
+CREATE TABLE pushes (
+    id BIGSERIAL PRIMARY KEY,
+    user_subscription_id INT NOT NULL REFERENCES user_subscriptions (id) ON DELETE CASCADE,
+    event push_event NOT NULL,
+    condition_id INT NULL, -- for condition_enabled / condition_disabled
+    payload JSONB NOT NULL,
+    pushed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    error TEXT NULL -- why delivery failed, NULL when it was handed over
+);
+CREATE INDEX idx_pushes_user_subscription ON pushes (user_subscription_id, id);
+CREATE INDEX idx_pushes_pushed_at ON pushes (pushed_at);
+
+-- user rules, reloaded by the delivery worker on every flush
+CREATE INDEX idx_usc_rule ON user_subscription_conditions (id) WHERE rule IS NOT NULL;
+
+-- override thresholds per condition, range-probed by process_alert_staging
+CREATE INDEX idx_usc_threshold_override ON user_subscription_conditions (condition_id, threshold)
+    WHERE threshold IS NOT NULL;
+
 -- ================================================================
 -- Function: notify_subscription_condition_change
 -- ------------------------------------------------
@@ -195,7 +635,8 @@ BEGIN
     payload := json_build_object(
             'id', NEW.id,
             'is_on', NEW.is_on,
-            'user_subscription_id', NEW.user_subscription_id
+            'user_subscription_id', NEW.user_subscription_id,
+            'condition_id', NEW.condition_id
     );
 
     -- Notify the backend listener via PostgreSQL pub/sub
@@ -213,6 +654,121 @@ CREATE TRIGGER trg_notify_subscription_condition_change
     WHEN (OLD.is_on IS DISTINCT FROM NEW.is_on)
 EXECUTE FUNCTION notify_subscription_condition_change();
 
+-- ================================================================
+-- Triggers: trg_snapshot_user_subscriptions,
+--           trg_snapshot_user_subscription_conditions
+-- ------------------------------------------------
+-- Purpose:
+--   A new subscriber, or a subscriber enabling a new condition, gets the
+--   alerts that are already on instead of waiting for the next flip.
+--
+-- Behavior:
+--   - Statement-level, so bulk inserts notify once per statement
+--   - Notifies 'user_subscription_snapshots' with the new user
+--     subscriptions, or with the new conditions that are on
+--     (user_subscription_condition_ids), at most 500 ids per payload to
+--     stay under the NOTIFY size limit
+--   - The listener pushes get_alerts_json(id, snapshot => true) to a new
+--     subscription, and only the alerts of a new condition
+--     (get_condition_change_json) to an existing one
+--   - Conditions of a user subscription created in the same transaction
+--     are left to its snapshot
+-- ================================================================
+CREATE OR REPLACE FUNCTION notify_subscription_snapshot()
+    RETURNS TRIGGER AS $$
+DECLARE
+    ids INT[];
+    key TEXT;
+BEGIN
+    IF TG_TABLE_NAME = 'user_subscriptions' THEN
+        key := 'user_subscription_ids';
+        SELECT array_agg(id) INTO ids FROM inserted;
+    ELSE
+        key := 'user_subscription_condition_ids';
+        SELECT array_agg(i.id) INTO ids
+        FROM inserted i
+                 JOIN user_subscriptions us ON us.id = i.user_subscription_id
+        WHERE i.is_on AND us.xmin <> pg_current_xact_id()::xid;
+    END IF;
+
+    FOR i IN 1 .. COALESCE(array_length(ids, 1), 0) BY 500 LOOP
+        PERFORM pg_notify('user_subscription_snapshots', json_build_object(key, ids[i:i + 499])::text);
+    END LOOP;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trg_snapshot_user_subscriptions
+    AFTER INSERT ON user_subscriptions
+    REFERENCING NEW TABLE AS inserted
+    FOR EACH STATEMENT
+EXECUTE FUNCTION notify_subscription_snapshot();
+
+CREATE TRIGGER trg_snapshot_user_subscription_conditions
+    AFTER INSERT ON user_subscription_conditions
+    REFERENCING NEW TABLE AS inserted
+    FOR EACH STATEMENT
+EXECUTE FUNCTION notify_subscription_snapshot();
+
+-- ================================================================
+-- Trigger: trg_notify_target_unmute
+-- ------------------------------------------------
+-- Purpose:
+--   A user subscription whose mutes ended gets the alerts of those
+--   targets it missed: get_alerts_json delivers the ones that are on or
+--   changed while muted.
+--
+-- Behavior:
+--   - Statement-level, so release_target_mutes notifies once
+--   - Notifies 'user_subscription_alerts', like process_alert_staging
+-- ================================================================
+CREATE OR REPLACE FUNCTION notify_target_unmute()
+    RETURNS TRIGGER AS $$
+DECLARE
+    ids INT[];
+BEGIN
+    SELECT array_agg(DISTINCT n.user_subscription_id) INTO ids
+    FROM new_mutes n
+             JOIN old_mutes o ON o.id = n.id
+    WHERE o.ended_at IS NULL AND n.ended_at IS NOT NULL;
+
+    FOR i IN 1 .. COALESCE(array_length(ids, 1), 0) BY 500 LOOP
+        PERFORM pg_notify('user_subscription_alerts',
+                          json_build_object('user_subscription_ids', ids[i:i + 499])::text);
+    END LOOP;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trg_notify_target_unmute
+    AFTER UPDATE ON target_mutes
+    REFERENCING OLD TABLE AS old_mutes NEW TABLE AS new_mutes
+    FOR EACH STATEMENT
+EXECUTE FUNCTION notify_target_unmute();
+
+-- ================================================================
+-- Trigger: trg_snapshot_min_severity
+-- ------------------------------------------------
+-- Purpose:
+--   A user subscription whose min_severity changed may see alerts it did
+--   not before: it gets a snapshot, like a new subscriber (see
+--   trg_snapshot_user_subscriptions).
+-- ================================================================
+CREATE OR REPLACE FUNCTION notify_subscription_preferences()
+    RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('user_subscription_snapshots',
+                      json_build_object('user_subscription_ids', ARRAY[NEW.id])::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trg_snapshot_min_severity
+    AFTER UPDATE OF min_severity ON user_subscriptions
+    FOR EACH ROW
+    WHEN (OLD.min_severity IS DISTINCT FROM NEW.min_severity)
+EXECUTE FUNCTION notify_subscription_preferences();
+
 -- =============
 -- Views
 -- =============
@@ -286,6 +842,99 @@ BEGIN
 END;
 $$ LANGUAGE plpgsql;
 
+-- ================================================================
+-- Function: inhibiting_alert
+-- ------------------------------------------------
+-- Purpose:
+--   Returns the source alert that inhibits an alert of the given
+--   condition and target under an active inhibition rule, NULL when
+--   none is on. With several, the oldest source alert wins.
+--
+-- Notes:
+--   - Source alerts are matched by their evaluated is_on, so an alert
+--     that is itself suppressed still inhibits its symptoms.
+--   - Related targets are looked up through `flights`, so every rule
+--     costs one indexed lookup per alert.
+-- ================================================================
+CREATE OR REPLACE FUNCTION inhibiting_alert(p_condition_id INT, p_target_id INT, p_target_type target_type)
+    RETURNS INT
+    LANGUAGE sql STABLE AS $$
+SELECT s.id
+FROM inhibition_rules r
+         CROSS JOIN LATERAL (
+    SELECT CASE r.scope
+               WHEN 'same_target' THEN p_target_id
+               WHEN 'inbound_flights' THEN (SELECT f.destination_airport_id FROM flights f
+                                            WHERE f.id = p_target_id AND p_target_type = 'flight')
+               WHEN 'outbound_flights' THEN (SELECT f.source_airport_id FROM flights f
+                                             WHERE f.id = p_target_id AND p_target_type = 'flight')
+               END AS target_id
+    ) src
+         JOIN alerts s ON s.condition_id = r.source_condition_id AND s.target_id = src.target_id AND s.is_on
+         JOIN target_types st ON st.name = s.target_type
+         JOIN target_types pt ON pt.name = p_target_type
+WHERE r.target_condition_id = p_condition_id AND r.is_active
+  AND st.entity = CASE r.scope WHEN 'same_target' THEN pt.entity ELSE 'airport' END
+ORDER BY s.id
+LIMIT 1
+$$;
+
+-- ================================================================
+-- Function: active_suppression_window
+-- ------------------------------------------------
+-- Purpose:
+--   Returns the suppression window in force at `p_at` for an alert of
+--   the given condition and target, NULL when there is none. Of
+--   overlapping windows the one ending last wins, so an alert is not
+--   released and suppressed again in between.
+-- ================================================================
+CREATE OR REPLACE FUNCTION active_suppression_window(p_condition_id INT, p_target_id INT, p_target_type target_type,
+                                                     p_at TIMESTAMPTZ)
+    RETURNS INT
+    LANGUAGE sql STABLE AS $$
+SELECT w.id
+FROM suppression_windows w
+         JOIN target_types wt ON wt.name = w.target_type
+         JOIN target_types pt ON pt.name = p_target_type AND pt.entity = wt.entity
+WHERE w.target_id = p_target_id
+  AND w.ends_at > p_at AND w.starts_at <= p_at
+  AND (w.condition_id IS NULL OR w.condition_id = p_condition_id)
+ORDER BY w.ends_at DESC, w.id
+LIMIT 1
+$$;
+
+-- ================================================================
+-- Function: find_incident
+-- ------------------------------------------------
+-- Purpose:
+--   Returns the incident an alert of the given target going on joins:
+--   one of the target itself, or for a flight of its destination or
+--   source airport, in this order, that is not resolved or was resolved
+--   less than `p_reopen` ago. NULL when a new incident must be opened.
+-- ================================================================
+CREATE OR REPLACE FUNCTION find_incident(p_target_id INT, p_target_type target_type, p_reopen INTERVAL)
+    RETURNS INT
+    LANGUAGE sql STABLE AS $$
+SELECT i.id
+FROM (
+    SELECT p_target_id AS target_id, p_target_type AS target_type, 1 AS rank
+    UNION ALL
+    SELECT f.destination_airport_id, 'destination_airport', 2
+    FROM flights f
+    WHERE f.id = p_target_id AND p_target_type = 'flight'
+    UNION ALL
+    SELECT f.source_airport_id, 'source_airport', 3
+    FROM flights f
+    WHERE f.id = p_target_id AND p_target_type = 'flight'
+) t
+         JOIN target_types tt ON tt.name = t.target_type
+         JOIN incidents i ON i.target_id = t.target_id
+         JOIN target_types it ON it.name = i.target_type AND it.entity = tt.entity
+WHERE i.status <> 'resolved' OR i.resolved_at > now() - p_reopen
+ORDER BY t.rank, i.status = 'resolved', i.updated_at DESC, i.id DESC
+LIMIT 1
+$$;
+
 -- ================================================================
 -- Procedure: process_alert_staging
 -- ------------------------------------------------
@@ -296,14 +945,37 @@ $$ LANGUAGE plpgsql;
 --
 -- Responsibilities:
 --   - Deduplicates staged updates per (condition_id, target_id)
---   - Conditionally updates `alerts` only if `is_on` changed
+--   - Conditionally updates `alerts` only if `is_on` changed, if the
+--     raw value crossed a per-user threshold override, or if an alert
+--     that stays on changed significantly (see significant_change); the
+--     payload is stored with every update
 --   - Resolves target_type via `condition_templates`
---   - Identifies and notifies affected user subscriptions
+--   - Resolves tier groups: only the highest severity tier that is on
+--     stays delivered, lower tiers are marked `superseded_by` it, and
+--     every move of the active tier is logged as a tier transition
+--   - Applies inhibition rules: alerts of a rule's target condition are
+--     `inhibited_by` the rule's source alert while it is on (see
+--     inhibiting_alert)
+--   - Suppresses changed alerts of targets under a suppression window
+--     (see suppression_windows; window boundaries are applied by
+--     apply_suppression_windows)
+--   - Groups alerts going on into incidents (see incidents), escalates,
+--     reopens and resolves the incidents the batch touched
+--   - Logs every state change to `alert_transitions`, tagged with the batch
+--   - Evaluates active shadow conditions on the same staged values into
+--     `shadow_alerts` / `shadow_alert_transitions`, without notifying
+--   - Identifies and notifies affected user subscriptions, evaluating
+--     each subscriber against its own threshold; subscriptions delivered
+--     incidents are notified of incident updates only
 --   - Cleans up staging area after processing
 --
 -- Performance Features:
 --   - Operates entirely in-memory using CTEs
 --   - Uses `ON CONFLICT ... DO UPDATE` with conditional write
+--   - Probes only the override thresholds between the old and the new
+--     value of a condition, an index range scan of
+--     `idx_usc_threshold_override`, not every subscriber
+--   - Tier resolution only visits tier groups touched by this batch
 --   - Notifies backend once with list of affected subscriptions
 --   - Staging buffer can be backed by a RAM-disk for speed
 --
@@ -321,14 +993,43 @@ $$ LANGUAGE plpgsql;
 --
 -- Side Effects:
 --   - Truncates `alerts_staging`
+--   - Updates `alert_tiers` and appends to `alert_tier_transitions`
+--   - Appends to `alert_transitions` and the shadow tables
 --   - Updates `alerts_triggered_at` in `user_subscriptions`
+--   - Leaves the merged changes (old and new state) in the
+--     session-local `alert_changes` table until commit
 -- ================================================================
 CREATE OR REPLACE PROCEDURE process_alert_staging()
     LANGUAGE plpgsql
 AS $$
 DECLARE
     sub_ids INT[];  -- List of affected user_subscription IDs
+    batch BIGINT := nextval('alert_batch_seq'); -- identifies this merge in alert_transitions
+    incident_reopen_window CONSTANT INTERVAL := '30 minutes'; -- a resolved incident is reopened within it
+    flights_pass BOOL;
 BEGIN
+    -- Session-local record of what this merge changed, with the state
+    -- before the change, so subscribers can be evaluated on both sides.
+    -- Each step records the old state of an alert before it first touches it.
+    CREATE TEMP TABLE IF NOT EXISTS alert_changes (
+        alert_id       INT PRIMARY KEY,
+        condition_id   INT NOT NULL,
+        target_id      INT NOT NULL,
+        target_type    target_type NOT NULL,
+        old_is_on      BOOL,             -- NULL for a newly created alert
+        old_value      DOUBLE PRECISION,
+        old_suppressed BOOL NOT NULL,
+        is_on          BOOL NOT NULL,
+        value          DOUBLE PRECISION,
+        suppressed     BOOL NOT NULL,
+        change_reason  alert_change_reason -- significant change of an alert that stayed on
+    ) ON COMMIT DELETE ROWS;
+    TRUNCATE alert_changes;
+
+    -- Incidents touched by this merge
+    CREATE TEMP TABLE IF NOT EXISTS incident_changes (incident_id INT PRIMARY KEY) ON COMMIT DELETE ROWS;
+    TRUNCATE incident_changes;
+
     -- Step 1: Deduplicate incoming alert updates
     -- Keep only the most recent (latest received_at) update
     -- for each (condition_id, target_id) combination
@@ -338,51 +1039,416 @@ BEGIN
         ORDER BY condition_id, target_id, received_at DESC
     ),
 
-         -- Step 2: UPSERT into main alerts table
-         -- Only perform update if the 'is_on' state has changed
-         -- to avoid unnecessary writes and reduce database churn
+         -- Step 2: Attach the current state of each alert
+         staged AS (
+             SELECT
+                 s.condition_id,
+                 s.target_id,
+                 ct.target_type,
+                 ct.direction,
+                 s.is_on,
+                 s.value,
+                 s.payload,
+                 s.received_at,
+                 a.id IS NULL AS is_new,
+                 a.is_on AS old_is_on,
+                 a.value AS old_value,
+                 COALESCE(a.suppressed, false) AS old_suppressed,
+                 CASE WHEN a.is_on AND s.is_on THEN
+                     significant_change(ct.change_bands, ct.change_delta, ct.change_keys,
+                                        a.value, s.value, a.payload, s.payload)
+                 END AS change_reason
+             FROM deduped s
+                      JOIN conditions c ON c.id = s.condition_id
+                      JOIN condition_templates ct ON ct.id = c.template_id
+                      LEFT JOIN alerts a ON a.condition_id = s.condition_id AND a.target_id = s.target_id
+         ),
+
+         -- Step 3: Keep only real changes: new alerts, `is_on` flips, significant
+         -- changes of alerts that stay on, and raw values crossing a threshold
+         -- some user has overridden
+         changed AS (
+             SELECT *
+             FROM staged s
+             WHERE s.is_new
+                OR s.old_is_on IS DISTINCT FROM s.is_on
+                OR s.change_reason IS NOT NULL
+                -- a value appearing or going away changes every override
+                OR ((s.old_value IS NULL) <> (s.value IS NULL)
+                    AND EXISTS (SELECT 1 FROM user_subscription_conditions o
+                                WHERE o.condition_id = s.condition_id AND o.threshold IS NOT NULL))
+                -- otherwise only an override between the old and the new value
+                OR EXISTS (
+                     SELECT 1
+                     FROM user_subscription_conditions o
+                     WHERE o.condition_id = s.condition_id
+                       AND o.threshold BETWEEN least(s.old_value, s.value) AND greatest(s.old_value, s.value)
+                       AND threshold_crossed(s.direction, s.old_value, o.threshold)
+                           IS DISTINCT FROM threshold_crossed(s.direction, s.value, o.threshold)
+                 )
+         ),
+
+         -- Step 4: UPSERT into main alerts table
          upserted AS (
-             INSERT INTO alerts (condition_id, target_id, target_type, is_on, payload, received_at, updated_at)
-                 SELECT
-                     s.condition_id,
-                     s.target_id,
-                     ct.target_type,
-                     s.is_on,
-                     s.payload,
-                     s.received_at,
-                     now()
-                 FROM deduped s
-                          JOIN conditions c ON c.id = s.condition_id
-                          JOIN condition_templates ct ON ct.id = c.template_id
+             INSERT INTO alerts (condition_id, target_id, target_type, is_on, value, payload, received_at, updated_at, change_reason)
+                 SELECT condition_id, target_id, target_type, is_on, value, payload, received_at, now(), change_reason
+                 FROM changed
                  ON CONFLICT (condition_id, target_id) DO UPDATE
                      SET
                          is_on = EXCLUDED.is_on,
-                         updated_at = now(),
+                         value = EXCLUDED.value,
+                         payload = EXCLUDED.payload, -- e.g. why it turned off ('stale')
+                         change_reason = EXCLUDED.change_reason,
+                         tier_transition = NULL, -- until step 5 sets it again
+                         -- a raw value crossing only an override changes the
+                         -- alert for those subscribers, see user_alert_changes
+                         updated_at = CASE WHEN alerts.is_on IS DISTINCT FROM EXCLUDED.is_on
+                                                OR EXCLUDED.change_reason IS NOT NULL
+                                           THEN now() ELSE alerts.updated_at END,
                          received_at = EXCLUDED.received_at
-                     WHERE alerts.is_on IS DISTINCT FROM EXCLUDED.is_on
-                 RETURNING alerts.id, alerts.condition_id, alerts.target_id, alerts.target_type
+                 RETURNING alerts.id, alerts.condition_id, alerts.target_id
+         )
+    INSERT INTO alert_changes (alert_id, condition_id, target_id, target_type,
+                               old_is_on, old_value, old_suppressed, is_on, value, suppressed, change_reason)
+    SELECT u.id, c.condition_id, c.target_id, c.target_type,
+           c.old_is_on, c.old_value, c.old_suppressed, c.is_on, c.value, c.old_suppressed, c.change_reason
+    FROM upserted u
+             JOIN changed c ON c.condition_id = u.condition_id AND c.target_id = u.target_id;
+
+    -- Step 5: Find the active tier of every tier group touched by this batch,
+    -- log the moves and flag the alert that became (or stopped being) active
+    WITH touched AS (
+        SELECT DISTINCT c.tier_group_id, ac.target_id, ac.target_type
+        FROM alert_changes ac
+                 JOIN conditions c ON c.id = ac.condition_id
+        WHERE c.tier_group_id IS NOT NULL
+    ),
+         tops AS (
+             SELECT t.tier_group_id, t.target_id, t.target_type, top.condition_id, top.severity
+             FROM touched t
+                      LEFT JOIN LATERAL (
+                 SELECT a.condition_id, c.severity
+                 FROM alerts a
+                          JOIN conditions c ON c.id = a.condition_id
+                 WHERE c.tier_group_id = t.tier_group_id AND a.target_id = t.target_id
+                   AND a.target_type = t.target_type AND a.is_on
+                 ORDER BY c.severity DESC, c.id DESC
+                 LIMIT 1
+                 ) top ON true
+         ),
+         moved AS (
+             SELECT tp.tier_group_id, tp.target_id, tp.target_type, tp.condition_id,
+                    at.condition_id AS from_condition_id,
+                    CASE
+                        WHEN at.condition_id IS NULL THEN 'raised'
+                        WHEN tp.condition_id IS NULL THEN 'cleared'
+                        WHEN tp.severity > fc.severity THEN 'escalated'
+                        ELSE 'de-escalated'
+                        END::tier_transition AS transition
+             FROM tops tp
+                      LEFT JOIN alert_tiers at ON at.tier_group_id = tp.tier_group_id AND at.target_id = tp.target_id
+                                                   AND at.target_type = tp.target_type
+                      LEFT JOIN conditions fc ON fc.id = at.condition_id
+             WHERE at.condition_id IS DISTINCT FROM tp.condition_id
+         ),
+         saved AS (
+             INSERT INTO alert_tiers (tier_group_id, target_id, target_type, condition_id, changed_at)
+                 SELECT tier_group_id, target_id, target_type, condition_id, now()
+                 FROM moved
+                 ON CONFLICT (tier_group_id, target_id, target_type) DO UPDATE
+                     SET condition_id = EXCLUDED.condition_id,
+                         changed_at = EXCLUDED.changed_at
+         ),
+         logged AS (
+             INSERT INTO alert_tier_transitions (tier_group_id, target_id, target_type, from_condition_id, to_condition_id, transition)
+                 SELECT tier_group_id, target_id, target_type, from_condition_id, condition_id, transition
+                 FROM moved
+         )
+    UPDATE alerts a
+    SET tier_transition = m.transition,
+        updated_at = now()
+    FROM moved m
+    WHERE a.target_id = m.target_id AND a.target_type = m.target_type
+      AND a.condition_id = COALESCE(m.condition_id, m.from_condition_id);
+
+    -- Step 6: Mark lower tiers as superseded by the active one (and release
+    -- them when it goes off), recording their state before the change first
+    INSERT INTO alert_changes (alert_id, condition_id, target_id, target_type,
+                               old_is_on, old_value, old_suppressed, is_on, value, suppressed)
+    SELECT a.id, a.condition_id, a.target_id, a.target_type,
+           a.is_on, a.value, a.suppressed, a.is_on, a.value, a.suppressed
+    FROM alerts a
+             JOIN conditions c ON c.id = a.condition_id
+             JOIN alert_tiers t ON t.tier_group_id = c.tier_group_id AND t.target_id = a.target_id
+                                   AND t.target_type = a.target_type
+    WHERE (c.tier_group_id, a.target_id, a.target_type) IN (
+        SELECT c2.tier_group_id, ac.target_id, ac.target_type
+        FROM alert_changes ac
+                 JOIN conditions c2 ON c2.id = ac.condition_id
+        WHERE c2.tier_group_id IS NOT NULL
+    )
+      AND a.superseded_by IS DISTINCT FROM NULLIF(t.condition_id, a.condition_id)
+    ON CONFLICT (alert_id) DO NOTHING;
+
+    UPDATE alerts a
+    SET superseded_by = NULLIF(t.condition_id, a.condition_id),
+        tier_transition = CASE WHEN a.updated_at = now() THEN a.tier_transition END, -- set by this merge
+        updated_at = now()
+    FROM alert_changes ac, conditions c, alert_tiers t
+    WHERE ac.alert_id = a.id AND c.id = a.condition_id
+      AND t.tier_group_id = c.tier_group_id AND t.target_id = a.target_id AND t.target_type = a.target_type
+      AND a.superseded_by IS DISTINCT FROM NULLIF(t.condition_id, a.condition_id);
+
+    -- Step 7: Inhibit (or release) the target alerts of inhibition rules that
+    -- changed themselves or whose source alert flipped, recording their state
+    -- before the change first
+    WITH flipped_sources AS (
+        SELECT r.scope, r.target_condition_id, ac.target_id, ac.target_type
+        FROM alert_changes ac
+                 JOIN inhibition_rules r ON r.source_condition_id = ac.condition_id AND r.is_active
+        WHERE ac.old_is_on IS DISTINCT FROM ac.is_on
+    ),
+         candidates AS (
+             SELECT ac.alert_id
+             FROM alert_changes ac
+             WHERE ac.condition_id IN (SELECT target_condition_id FROM inhibition_rules WHERE is_active)
+             UNION
+             SELECT t.id
+             FROM flipped_sources fs
+                      JOIN alerts t ON t.condition_id = fs.target_condition_id AND t.target_id = fs.target_id
+             WHERE fs.scope = 'same_target'
+             UNION
+             SELECT t.id
+             FROM flipped_sources fs
+                      JOIN target_types ft ON ft.name = fs.target_type AND ft.entity = 'airport'
+                      JOIN flights f ON f.destination_airport_id = fs.target_id
+                      JOIN alerts t ON t.condition_id = fs.target_condition_id AND t.target_id = f.id
+             WHERE fs.scope = 'inbound_flights'
+             UNION
+             SELECT t.id
+             FROM flipped_sources fs
+                      JOIN target_types ft ON ft.name = fs.target_type AND ft.entity = 'airport'
+                      JOIN flights f ON f.source_airport_id = fs.target_id
+                      JOIN alerts t ON t.condition_id = fs.target_condition_id AND t.target_id = f.id
+             WHERE fs.scope = 'outbound_flights'
+         ),
+         resolved AS (
+             SELECT *
+             FROM (
+                 SELECT a.id, a.condition_id, a.target_id, a.target_type, a.is_on, a.value, a.suppressed,
+                        a.inhibited_by AS old_inhibited_by,
+                        inhibiting_alert(a.condition_id, a.target_id, a.target_type) AS inhibited_by
+                 FROM candidates c
+                          JOIN alerts a ON a.id = c.alert_id
+             ) r
+             WHERE r.old_inhibited_by IS DISTINCT FROM r.inhibited_by
+         ),
+         recorded AS (
+             INSERT INTO alert_changes (alert_id, condition_id, target_id, target_type,
+                                        old_is_on, old_value, old_suppressed, is_on, value, suppressed)
+                 SELECT id, condition_id, target_id, target_type, is_on, value, suppressed, is_on, value, suppressed
+                 FROM resolved
+                 ON CONFLICT (alert_id) DO NOTHING
+         )
+    UPDATE alerts a
+    SET inhibited_by = r.inhibited_by,
+        tier_transition = CASE WHEN a.updated_at = now() THEN a.tier_transition END, -- set by this merge
+        updated_at = now()
+    FROM resolved r
+    WHERE a.id = r.id;
+
+    -- Step 8: Suppress changed alerts of targets under a suppression window
+    UPDATE alerts a
+    SET suppression_window_id = w.window_id,
+        tier_transition = CASE WHEN a.updated_at = now() THEN a.tier_transition END, -- set by this merge
+        updated_at = now()
+    FROM (
+        SELECT ac.alert_id,
+               active_suppression_window(ac.condition_id, ac.target_id, ac.target_type, now()) AS window_id
+        FROM alert_changes ac
+    ) w
+    WHERE a.id = w.alert_id AND a.suppression_window_id IS DISTINCT FROM w.window_id;
+
+    -- Step 9: Refresh the new side of every recorded change
+    UPDATE alert_changes ac
+    SET is_on = a.is_on,
+        value = a.value,
+        suppressed = a.suppressed
+    FROM alerts a
+    WHERE a.id = ac.alert_id;
+
+    -- Step 10: Group alerts that went on into incidents. Airport alerts go
+    -- first, so flight alerts find the incidents their airports opened in
+    -- this batch; the rest of a batch opens one incident per target
+    FOREACH flights_pass IN ARRAY ARRAY[false, true] LOOP
+        WITH joining AS (
+            SELECT ac.alert_id, ac.condition_id, ac.target_id, ac.target_type, tt.entity,
+                   find_incident(ac.target_id, ac.target_type, incident_reopen_window) AS incident_id
+            FROM alert_changes ac
+                     JOIN target_types tt ON tt.name = ac.target_type
+                     JOIN alerts a ON a.id = ac.alert_id
+                     LEFT JOIN incidents i ON i.id = a.incident_id
+            WHERE ac.is_on AND NOT ac.suppressed
+              AND (ac.target_type = 'flight') = flights_pass
+              AND (a.incident_id IS NULL OR i.status = 'resolved')
+        ),
+             opened AS (
+                 INSERT INTO incidents (target_id, target_type, severity)
+                     SELECT j.target_id, min(j.target_type), max(c.severity)
+                     FROM joining j
+                              JOIN conditions c ON c.id = j.condition_id
+                     WHERE j.incident_id IS NULL
+                     GROUP BY j.target_id, j.entity
+                     RETURNING id, target_id, target_type
+             ),
+             assigned AS (
+                 SELECT j.alert_id, COALESCE(j.incident_id, o.id) AS incident_id
+                 FROM joining j
+                          LEFT JOIN (opened o JOIN target_types ot ON ot.name = o.target_type)
+                                    ON j.incident_id IS NULL AND o.target_id = j.target_id AND ot.entity = j.entity
+             ),
+             linked AS (
+                 UPDATE alerts a
+                     SET incident_id = s.incident_id
+                     FROM assigned s
+                     WHERE a.id = s.alert_id
+             )
+        INSERT INTO incident_changes (incident_id)
+        SELECT DISTINCT incident_id FROM assigned
+        ON CONFLICT DO NOTHING;
+    END LOOP;
+
+    -- Step 11: Bring the incidents touched by this batch up to date: escalate
+    -- to the highest severity on, reopen, resolve when no alert is on.
+    -- updated_at marks the incidents their subscribers are told about
+    INSERT INTO incident_changes (incident_id)
+    SELECT DISTINCT a.incident_id
+    FROM alert_changes ac
+             JOIN alerts a ON a.id = ac.alert_id
+    WHERE a.incident_id IS NOT NULL
+    ON CONFLICT DO NOTHING;
+
+    WITH state AS (
+        SELECT i.id,
+               CASE
+                   WHEN max(c.severity) FILTER (WHERE a.is_on AND NOT a.suppressed) IS NULL THEN 'resolved'
+                   WHEN i.status = 'resolved' THEN 'open'
+                   ELSE i.status
+                   END::incident_status AS status,
+               GREATEST(i.severity, max(c.severity) FILTER (WHERE a.is_on AND NOT a.suppressed)) AS severity
+        FROM incident_changes ic
+                 JOIN incidents i ON i.id = ic.incident_id
+                 LEFT JOIN alerts a ON a.incident_id = i.id
+                 LEFT JOIN conditions c ON c.id = a.condition_id
+        GROUP BY i.id
+    )
+    UPDATE incidents i
+    SET status = s.status,
+        severity = s.severity,
+        resolved_at = CASE WHEN s.status = 'resolved' THEN COALESCE(i.resolved_at, now()) END,
+        acknowledged_at = CASE WHEN i.status = 'resolved' AND s.status = 'open' THEN NULL ELSE i.acknowledged_at END,
+        acknowledged_by = CASE WHEN i.status = 'resolved' AND s.status = 'open' THEN NULL ELSE i.acknowledged_by END,
+        updated_at = now()
+    FROM state s
+    WHERE i.id = s.id AND (i.status <> s.status OR i.severity <> s.severity);
+
+    -- Step 12: Log the state changes of this batch
+    INSERT INTO alert_transitions (batch_id, alert_id, condition_id, target_id, target_type, old_is_on, is_on,
+                                   old_suppressed, suppressed, inhibited_by, value, payload, received_at)
+    SELECT batch, ac.alert_id, ac.condition_id, ac.target_id, ac.target_type, ac.old_is_on, ac.is_on,
+           ac.old_suppressed, ac.suppressed, a.inhibited_by, ac.value, a.payload, a.received_at
+    FROM alert_changes ac
+             JOIN alerts a ON a.id = ac.alert_id
+    WHERE ac.old_is_on IS DISTINCT FROM ac.is_on
+       OR ac.old_suppressed IS DISTINCT FROM ac.suppressed;
+
+    -- Step 13: Evaluate shadow conditions against the same staged values.
+    -- Shadow results are only recorded, nobody is notified
+    WITH shadowed AS (
+        SELECT DISTINCT ON (s.condition_id, s.target_id) s.condition_id, s.target_id, s.value, s.received_at
+        FROM alerts_staging s
+        WHERE s.value IS NOT NULL
+          AND s.condition_id IN (SELECT condition_id FROM shadow_conditions WHERE is_active)
+        ORDER BY s.condition_id, s.target_id, s.received_at DESC
+    ),
+         evaluated AS (
+             SELECT sc.id AS shadow_condition_id, s.target_id, ct.target_type, s.value, s.received_at,
+                    threshold_crossed(ct.direction, s.value, sc.threshold) AS is_on,
+                    sa.is_on AS old_is_on
+             FROM shadowed s
+                      JOIN shadow_conditions sc ON sc.condition_id = s.condition_id AND sc.is_active
+                      JOIN conditions c ON c.id = sc.condition_id
+                      JOIN condition_templates ct ON ct.id = c.template_id
+                      LEFT JOIN shadow_alerts sa ON sa.shadow_condition_id = sc.id AND sa.target_id = s.target_id
+         ),
+         upserted AS (
+             INSERT INTO shadow_alerts (shadow_condition_id, target_id, target_type, is_on, value, received_at, updated_at)
+                 SELECT shadow_condition_id, target_id, target_type, is_on, value, received_at, now()
+                 FROM evaluated
+                 WHERE old_is_on IS DISTINCT FROM is_on
+                 ON CONFLICT (shadow_condition_id, target_id) DO UPDATE
+                     SET is_on = EXCLUDED.is_on,
+                         value = EXCLUDED.value,
+                         received_at = EXCLUDED.received_at,
+                         updated_at = now()
          )
+    INSERT INTO shadow_alert_transitions (shadow_condition_id, target_id, target_type, old_is_on, is_on, value)
+    SELECT shadow_condition_id, target_id, target_type, old_is_on, is_on, value
+    FROM evaluated
+    WHERE old_is_on IS DISTINCT FROM is_on;
+
+    -- and the raw flips of the live conditions they shadow, for shadow_report
+    INSERT INTO shadow_alert_transitions (shadow_condition_id, live, target_id, target_type, old_is_on, is_on, value)
+    SELECT sc.id, true, ac.target_id, ac.target_type, ac.old_is_on, ac.is_on, ac.value
+    FROM alert_changes ac
+             JOIN shadow_conditions sc ON sc.condition_id = ac.condition_id AND sc.is_active
+    WHERE ac.old_is_on IS DISTINCT FROM ac.is_on;
 
-    -- Step 3: Identify affected user subscriptions
+    -- Step 14: Identify affected user subscriptions
     -- Only include subscriptions where the user actively listens (is_on = true)
+    -- and whose own view of the alert (threshold, suppression) changed, or
+    -- who see the alert on and it changed significantly. An alert that
+    -- changed for its overriding subscribers only (updated_at not bumped) is
+    -- recorded for them in user_alert_changes. Subscriptions delivered
+    -- incidents are only notified of incident updates
+    WITH affected AS (
+        SELECT usa.user_subscription_id, usa.alert_id, usa.updated_at
+        FROM alert_changes ac
+                 JOIN user_subscription_alerts usa ON usa.alert_id = ac.alert_id
+        WHERE usa.usc_is_on = true AND usa.delivery = 'alerts'
+          AND ((effective_is_on(ac.old_is_on, usa.direction, ac.old_value, usa.user_threshold) AND NOT ac.old_suppressed)
+               IS DISTINCT FROM usa.is_on
+              OR (usa.is_on AND ac.change_reason IS NOT NULL))
+    ),
+         own_changes AS (
+             INSERT INTO user_alert_changes (user_subscription_id, alert_id)
+                 SELECT user_subscription_id, alert_id
+                 FROM affected
+                 WHERE updated_at < now()
+                 ON CONFLICT (user_subscription_id, alert_id) DO UPDATE SET changed_at = now()
+         )
     SELECT ARRAY(
-       SELECT DISTINCT usc.user_subscription_id
-       FROM upserted a, user_subscription_conditions usc, user_subscriptions us, subscription_targets st
-       WHERE a.condition_id = usc.condition_id AND usc.user_subscription_id = us.id
-        AND  us.subscription_id=st.subscription_id AND st.target_id = a.target_id AND st.target_type = a.target_type
-       AND usc.is_on = true
+       SELECT user_subscription_id
+       FROM affected
+       UNION
+       SELECT usa.user_subscription_id
+       FROM incident_changes ic
+                JOIN incidents i ON i.id = ic.incident_id AND i.updated_at = now()
+                JOIN alerts a ON a.incident_id = i.id
+                JOIN user_subscription_alerts usa ON usa.alert_id = a.id
+       WHERE usa.usc_is_on = true AND usa.delivery = 'incidents'
      ) INTO sub_ids;
 
-    -- Step 4: Update alerts_triggered_at to mark activity
+    -- Step 15: Update alerts_triggered_at to mark activity
     UPDATE user_subscriptions us
     SET alerts_triggered_at = now()
     WHERE us.id = ANY(sub_ids);
 
-    -- Step 5: Clean up staging buffer
+    -- Step 16: Clean up staging buffer
     -- Truncate RAM-based alerts_staging to reclaim memory
     TRUNCATE alerts_staging;
 
-    -- Step 6: Send single NOTIFY payload with all affected subscription IDs
+    -- Step 17: Send single NOTIFY payload with all affected subscription IDs
     IF array_length(sub_ids, 1) > 0 THEN
         PERFORM pg_notify(
                 'user_subscription_alerts',
@@ -397,122 +1463,1267 @@ $$;
 CREATE TABLE subscription_targets(
                                      subscription_id INT NOT NULL REFERENCES subscriptions (id),
                                      target_id INT NOT NULL,
-                                     target_type target_type NOT NULL,
+                                     target_type target_type NOT NULL REFERENCES target_types (name),
                                      UNIQUE (subscription_id, target_id, target_type)
 );
 
+-- Targets that dropped out of a subscription (e.g. the flight arrived) when
+-- subscription_targets was recreated. Kept until the target's alerts are
+-- archived, to know whom to send the closing events.
+CREATE TABLE retired_subscription_targets (
+                                     subscription_id INT NOT NULL REFERENCES subscriptions (id) ON DELETE CASCADE,
+                                     target_id INT NOT NULL,
+                                     target_type target_type NOT NULL,
+                                     retired_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+                                     PRIMARY KEY (subscription_id, target_id, target_type)
+);
+CREATE INDEX idx_retired_subscription_targets_target ON retired_subscription_targets (target_id, target_type);
+
+-- Targets whose subscriptions may have changed: the targets a flight led to
+-- before and after it was inserted, updated or deleted, filled by
+-- trg_queue_flight_change and drained by refresh_subscription_targets
+CREATE TABLE subscription_target_queue (
+                                     target_id INT NOT NULL,
+                                     target_type target_type NOT NULL,
+                                     queued_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+                                     PRIMARY KEY (target_id, target_type)
+);
+
+-- Targets entering or leaving a subscription, in the order they happened
+CREATE TABLE subscription_target_events (
+                                     id BIGSERIAL PRIMARY KEY,
+                                     subscription_id INT NOT NULL REFERENCES subscriptions (id) ON DELETE CASCADE,
+                                     target_id INT NOT NULL,
+                                     target_type target_type NOT NULL,
+                                     event subscription_target_event NOT NULL,
+                                     recorded_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX idx_subscription_target_events_subscription ON subscription_target_events (subscription_id, id);
+CREATE INDEX idx_subscription_target_events_recorded ON subscription_target_events (recorded_at); -- retention
+
+-- Alerts of targets no longer referenced by any subscription, moved out of
+-- `alerts` by archive_untracked_alerts
+CREATE TABLE alerts_archive (
+                        id INT PRIMARY KEY,
+                        condition_id INT NOT NULL,
+                        target_id INT NOT NULL,
+                        target_type target_type NOT NULL,
+                        is_on BOOL NOT NULL,
+                        value DOUBLE PRECISION NULL,
+                        received_at TIMESTAMPTZ NOT NULL,
+                        payload TEXT NOT NULL,
+                        updated_at TIMESTAMPTZ NOT NULL,
+                        superseded_by INT NULL,
+                        inhibited_by INT NULL,
+                        suppression_window_id INT NULL,
+                        incident_id INT NULL,
+                        archived_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX idx_alerts_archive_target ON alerts_archive (target_id, target_type);
+
+-- Closing events of archived alerts, one per user subscription that last saw
+-- the alert on; get_alerts_json delivers and deletes them
+CREATE TABLE alert_closures (
+                        user_subscription_id INT NOT NULL REFERENCES user_subscriptions (id) ON DELETE CASCADE,
+                        alert_id INT NOT NULL,
+                        condition_id INT NOT NULL,
+                        target_id INT NOT NULL,
+                        target_type target_type NOT NULL,
+                        payload TEXT NOT NULL, -- last payload of the alert
+                        closed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+                        PRIMARY KEY (user_subscription_id, alert_id)
+);
+
+-- Alerts that changed for one subscriber only: the raw value crossed its
+-- threshold override while the alert, as everyone else sees it, did not
+-- change (updated_at is left alone so they are not pushed it again).
+-- get_alerts_json delivers and deletes them.
+CREATE TABLE user_alert_changes (
+                        user_subscription_id INT NOT NULL REFERENCES user_subscriptions (id) ON DELETE CASCADE,
+                        alert_id INT NOT NULL REFERENCES alerts (id) ON DELETE CASCADE,
+                        changed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+                        PRIMARY KEY (user_subscription_id, alert_id)
+);
+CREATE INDEX idx_user_alert_changes_alert ON user_alert_changes (alert_id);
+
 -- =============================================================================
--- Procedure: recreate_subscription_targets
+-- Function: subscription_view_targets(p_view TEXT)
 -- -----------------------------------------------------------------------------
 -- Purpose:
---   Rebuilds the `subscription_targets` table by resolving and extracting
---   all monitored targets (flights, source airports, destination airports)
---   from dynamic subscription views.
---
--- Description:
---   - Each user subscription in the `subscriptions` table is associated with
---     a view that determines which targets it monitors.
---   - This procedure dynamically queries each view and inserts all distinct
---     `flight_id`, `source_airport_id`, and `destination_airport_id` values
---     into `subscription_targets` with the appropriate `target_type`.
---   - The result is a flattened and query-efficient mapping of
---     (subscription_id, target_id, target_type) used for alert resolution.
---
--- When to Use:
---   This procedure **must be called** whenever:
---     1. A user subscription is added, updated, or removed.
---     2. The contents of any subscription view change (e.g., due to flight updates).
---
--- Guarantees:
---   - `subscription_targets` reflects the latest state of all active subscriptions.
---   - Enables efficient joins and filtering during alert fan-out.
+--   Generic subscription-to-target resolution: the distinct targets a
+--   subscription view lists, one column per registered target type
+--   (target_types.view_column, e.g. `flight_id`, `airline_id`). Columns the
+--   view does not have are skipped and NULLs ignored.
 --
--- Target Types Inserted:
---   - 'flight'
---   - 'source_airport'
---   - 'destination_airport'
+--   p_related_to, {view_column: [ids]}, limits the result to the given
+--   targets, so the view is filtered on those columns instead of read in
+--   full.
 --
--- Implementation Notes:
---   - Uses dynamic SQL to iterate over `subscriptions.view_name`.
---   - Performs a full `TRUNCATE` before re-inserting target mappings.
---   - Optimized for batch regeneration, not partial updates.
+-- Example Usage:
+--   SELECT * FROM subscription_view_targets('subscription_3797');
+--   SELECT * FROM subscription_view_targets('subscription_3797', '{"flight_id": [1234]}');
 -- =============================================================================
-CREATE OR REPLACE PROCEDURE recreate_subscription_targets()
-    LANGUAGE plpgsql
-AS $$
+CREATE OR REPLACE FUNCTION subscription_view_targets(p_view TEXT, p_related_to JSONB DEFAULT NULL)
+    RETURNS TABLE (target_id INT, target_type target_type)
+    LANGUAGE plpgsql STABLE AS $$
 DECLARE
-    rec RECORD;
     dyn_sql TEXT;
 BEGIN
-    -- Step 1: Clear existing data
-    TRUNCATE subscription_targets;
+    SELECT string_agg(format('SELECT DISTINCT %I::int, %L::target_type FROM %I WHERE %I IS NOT NULL',
+                             tt.view_column, tt.name, p_view, tt.view_column) ||
+                      CASE WHEN p_related_to IS NOT NULL THEN
+                               format(' AND %I IN (SELECT jsonb_array_elements_text($1 -> %L)::int)',
+                                      tt.view_column, tt.view_column)
+                           ELSE '' END, ' UNION ALL ')
+    INTO dyn_sql
+    FROM target_types tt
+             JOIN pg_attribute att ON att.attrelid = to_regclass(format('%I', p_view))
+        AND att.attname = tt.view_column AND att.attnum > 0 AND NOT att.attisdropped
+    WHERE p_related_to IS NULL OR p_related_to ? tt.view_column;
 
-    -- Step 2: Iterate over each subscription
-    FOR rec IN SELECT id, view_name FROM subscriptions LOOP
-            -- Step 3: Construct dynamic SQL for each subscription view
-            dyn_sql := format($fmt$
-            INSERT INTO subscription_targets(subscription_id, target_id, target_type)
-            SELECT DISTINCT %s, flight_id, 'flight'::target_type FROM %I
-            WHERE flight_id IS NOT NULL
-            UNION ALL
-            SELECT DISTINCT %s, source_airport_id, 'source_airport'::target_type FROM %I
-            WHERE source_airport_id IS NOT NULL
-            UNION ALL
-            SELECT DISTINCT %s, destination_airport_id, 'destination_airport'::target_type FROM %I
-            WHERE destination_airport_id IS NOT NULL;
-        $fmt$, rec.id, rec.view_name, rec.id, rec.view_name, rec.id, rec.view_name);
-            -- Step 4: insert targets from current subscription into subscription_targets
-            EXECUTE dyn_sql;
-        END LOOP;
+    IF dyn_sql IS NOT NULL THEN
+        RETURN QUERY EXECUTE dyn_sql USING p_related_to;
+    END IF;
 END;
 $$;
 
-CREATE OR REPLACE VIEW user_subscription_alerts AS
-SELECT
-    a.id AS alert_id,
-    a.condition_id,
-    a.target_id,
-    a.is_on,
-    a.payload,
-    a.updated_at,
-    us.id AS user_subscription_id,
-    usc.id AS user_subscription_condition_id,
-    a.target_type,
-    us.pushed_at,
-    usc.is_on usc_is_on
-FROM alerts a, user_subscription_conditions usc, user_subscriptions us, subscription_targets st
-WHERE a.condition_id = usc.condition_id AND usc.user_subscription_id = us.id -- 1 alert 1 user_subscription : 1 user_subscription_conditions
- AND us.subscription_id = st.subscription_id AND st.target_id = a.target_id AND st.target_type = a.target_type
-;
+-- =============================================================================
+-- Function: great_circle_km(lat1, lon1, lat2, lon2)
+-- -----------------------------------------------------------------------------
+-- Purpose:
+--   Great-circle distance in km between two points in degrees (haversine,
+--   mean earth radius), without PostGIS. Mirrors subscription_alerts.GreatCircleKm.
+-- =============================================================================
+CREATE OR REPLACE FUNCTION great_circle_km(lat1 DOUBLE PRECISION, lon1 DOUBLE PRECISION,
+                                           lat2 DOUBLE PRECISION, lon2 DOUBLE PRECISION)
+    RETURNS DOUBLE PRECISION
+    LANGUAGE sql IMMUTABLE AS $$
+SELECT 2 * 6371.0088 * asin(least(1, sqrt(
+        power(sin(radians(lat2 - lat1) / 2), 2) +
+        cos(radians(lat1)) * cos(radians(lat2)) * power(sin(radians(lon2 - lon1) / 2), 2))));
+$$;
 
 -- =============================================================================
--- Function: get_alerts_json(user_sub_id INT)
+-- Function: point_in_polygon(lat, lon, polygon JSONB)
 -- -----------------------------------------------------------------------------
 -- Purpose:
---   Fetches all **active and updated** alerts for a given user subscription
---   and returns them as a JSON array. Only includes alerts that:
---     - Belong to the specified user subscription
---     - Have `usc_is_on = true` (i.e., condition is enabled)
---     - Have `updated_at` newer than `pushed_at` (not yet delivered)
---
--- Behavior:
---   - Returns alerts as an array of JSON objects, each containing:
---       - alert_id
---       - condition_id
---       - target_id
+--   Whether a point lies inside a polygon given as a JSON array of
+--   [lat, lon] vertices (ray casting on degrees, so regions must not cross
+--   the antimeridian). Mirrors subscription_alerts.Area.Contains.
+-- =============================================================================
+CREATE OR REPLACE FUNCTION point_in_polygon(lat DOUBLE PRECISION, lon DOUBLE PRECISION, polygon JSONB)
+    RETURNS BOOLEAN
+    LANGUAGE plpgsql IMMUTABLE AS $$
+DECLARE
+    n INT := jsonb_array_length(polygon);
+    j INT := n - 1;
+    inside BOOLEAN := false;
+    lat_i DOUBLE PRECISION;
+    lon_i DOUBLE PRECISION;
+    lat_j DOUBLE PRECISION;
+    lon_j DOUBLE PRECISION;
+BEGIN
+    FOR i IN 0 .. n - 1 LOOP
+        lat_i := (polygon -> i ->> 0)::float8;
+        lon_i := (polygon -> i ->> 1)::float8;
+        lat_j := (polygon -> j ->> 0)::float8;
+        lon_j := (polygon -> j ->> 1)::float8;
+        IF (lat_i > lat) <> (lat_j > lat)
+            AND lon < (lon_j - lon_i) * (lat - lat_i) / (lat_j - lat_i) + lon_i THEN
+            inside := NOT inside;
+        END IF;
+        j := i;
+    END LOOP;
+    RETURN inside;
+END;
+$$;
+
+-- =============================================================================
+-- Function: in_area(lat, lon, area JSONB)
+-- -----------------------------------------------------------------------------
+-- Purpose:
+--   Whether a point lies in a subscription spec area: within `radius_km` of
+--   `lat`/`lon`, or inside `polygon`.
+-- =============================================================================
+CREATE OR REPLACE FUNCTION in_area(lat DOUBLE PRECISION, lon DOUBLE PRECISION, area JSONB)
+    RETURNS BOOLEAN
+    LANGUAGE sql IMMUTABLE AS $$
+SELECT CASE
+           WHEN area ? 'polygon' THEN point_in_polygon(lat, lon, area -> 'polygon')
+           ELSE great_circle_km(lat, lon, (area ->> 'lat')::float8, (area ->> 'lon')::float8)
+               <= (area ->> 'radius_km')::float8
+           END;
+$$;
+
+-- =============================================================================
+-- Function: subscription_spec_flights(p_spec JSONB)
+-- -----------------------------------------------------------------------------
+-- Purpose:
+--   The flights a declarative subscription spec selects, with one column
+--   per target type they lead to (named after target_types.view_column).
+--
+-- Spec:
+--   Every key is optional; filters are ANDed, the values of one filter ORed:
+--     airports              IATA or ICAO codes, either end of the flight
+--     source_airports       IATA or ICAO codes of the departure airport
+--     destination_airports  IATA or ICAO codes of the arrival airport
+--     airlines              IATA or ICAO codes of the operating airline
+--     countries             country of either airport, e.g. 'United States'
+--     routes                'JFK-LAX' style IATA pairs
+--     flight_numbers        e.g. 'AA100'
+--     statuses              flight_status values, default the active ones
+--     areas                 geo-fences, see in_area: {lat, lon, radius_km} or
+--                           {polygon: [[lat, lon], ...]}, with `end` 'source'
+--                           or 'destination' to fence one end only
+--   Only flights that have not arrived yet are selected, so the targets
+--   follow flight updates on every recreate_subscription_targets.
+--
+-- Notes:
+--   - Static SQL: the spec is data, never spliced into a query
+--   - Codes are resolved to ids first so the flights indexes are used;
+--     a filter none of whose codes exist selects nothing
+--   - p_related_to, {view_column: [ids]}, limits the result to flights
+--     leading to one of the given targets, which is all
+--     refresh_subscription_targets needs to decide whether those targets
+--     are still in the subscription
+-- =============================================================================
+CREATE OR REPLACE FUNCTION subscription_spec_flights(p_spec JSONB, p_related_to JSONB DEFAULT NULL)
+    RETURNS TABLE (flight_id INT, source_airport_id INT, destination_airport_id INT, airline_id INT,
+                   route_id INT, aircraft_id INT, plane_id INT)
+    LANGUAGE sql STABLE AS $$
+WITH lists AS (
+    SELECT (SELECT array_agg(x) FROM jsonb_array_elements_text(p_spec -> 'airports') x)             AS airports,
+           (SELECT array_agg(x) FROM jsonb_array_elements_text(p_spec -> 'source_airports') x)      AS source_airports,
+           (SELECT array_agg(x) FROM jsonb_array_elements_text(p_spec -> 'destination_airports') x) AS destination_airports,
+           (SELECT array_agg(x) FROM jsonb_array_elements_text(p_spec -> 'airlines') x)             AS airlines,
+           (SELECT array_agg(x) FROM jsonb_array_elements_text(p_spec -> 'countries') x)            AS countries,
+           (SELECT array_agg(x) FROM jsonb_array_elements_text(p_spec -> 'routes') x)               AS routes,
+           (SELECT array_agg(x) FROM jsonb_array_elements_text(p_spec -> 'flight_numbers') x)       AS flight_numbers,
+           COALESCE((SELECT array_agg(x::flight_status) FROM jsonb_array_elements_text(p_spec -> 'statuses') x),
+                    ARRAY['scheduled', 'departed', 'delayed']::flight_status[])                      AS statuses
+),
+     ids AS (
+         SELECT CASE WHEN l.airports IS NOT NULL THEN COALESCE(
+                    (SELECT array_agg(a.id) FROM airports a WHERE a.iata = ANY(l.airports) OR a.icao = ANY(l.airports)), '{}') END AS airports,
+                CASE WHEN l.source_airports IS NOT NULL THEN COALESCE(
+                    (SELECT array_agg(a.id) FROM airports a WHERE a.iata = ANY(l.source_airports) OR a.icao = ANY(l.source_airports)), '{}') END AS source_airports,
+                CASE WHEN l.destination_airports IS NOT NULL THEN COALESCE(
+                    (SELECT array_agg(a.id) FROM airports a WHERE a.iata = ANY(l.destination_airports) OR a.icao = ANY(l.destination_airports)), '{}') END AS destination_airports,
+                CASE WHEN l.airlines IS NOT NULL THEN COALESCE(
+                    (SELECT array_agg(al.id) FROM airlines al WHERE al.iata = ANY(l.airlines) OR al.icao = ANY(l.airlines)), '{}') END AS airlines,
+                CASE WHEN l.countries IS NOT NULL THEN COALESCE(
+                    (SELECT array_agg(a.id) FROM airports a WHERE a.country = ANY(l.countries)), '{}') END AS countries,
+                CASE WHEN jsonb_array_length(COALESCE(p_spec -> 'areas', '[]')) > 0 THEN COALESCE(
+                    (SELECT array_agg(DISTINCT a.id) FROM airports a, jsonb_array_elements(p_spec -> 'areas') ar
+                     WHERE COALESCE(ar ->> 'end', 'either') IN ('either', 'source')
+                       AND in_area(a.latitude, a.longitude, ar)), '{}') END AS area_sources,
+                CASE WHEN jsonb_array_length(COALESCE(p_spec -> 'areas', '[]')) > 0 THEN COALESCE(
+                    (SELECT array_agg(DISTINCT a.id) FROM airports a, jsonb_array_elements(p_spec -> 'areas') ar
+                     WHERE COALESCE(ar ->> 'end', 'either') IN ('either', 'destination')
+                       AND in_area(a.latitude, a.longitude, ar)), '{}') END AS area_destinations,
+                l.routes, l.flight_numbers, l.statuses
+         FROM lists l
+     )
+SELECT f.id, f.source_airport_id, f.destination_airport_id, f.airline_id, f.route_id, f.aircraft_id, ac.plane_id
+FROM ids
+         JOIN flights f ON f.status = ANY(ids.statuses) AND f.arrival_time > now()
+         LEFT JOIN aircraft ac ON ac.id = f.aircraft_id
+WHERE (ids.airports IS NULL OR f.source_airport_id = ANY(ids.airports) OR f.destination_airport_id = ANY(ids.airports))
+  AND (ids.source_airports IS NULL OR f.source_airport_id = ANY(ids.source_airports))
+  AND (ids.destination_airports IS NULL OR f.destination_airport_id = ANY(ids.destination_airports))
+  AND (ids.airlines IS NULL OR f.airline_id = ANY(ids.airlines))
+  AND (ids.countries IS NULL OR f.source_airport_id = ANY(ids.countries) OR f.destination_airport_id = ANY(ids.countries))
+  AND (ids.flight_numbers IS NULL OR f.flight_number = ANY(ids.flight_numbers))
+  AND (ids.area_sources IS NULL
+    OR f.source_airport_id = ANY(ids.area_sources) OR f.destination_airport_id = ANY(ids.area_destinations))
+  AND (ids.routes IS NULL OR (f.source_airport_id, f.destination_airport_id) IN (
+    SELECT src.id, dst.id
+    FROM unnest(ids.routes) r
+             JOIN airports src ON src.iata = split_part(r, '-', 1)
+             JOIN airports dst ON dst.iata = split_part(r, '-', 2)))
+  AND (p_related_to IS NULL OR EXISTS (
+    SELECT 1
+    FROM jsonb_each(jsonb_build_object('flight_id', f.id, 'source_airport_id', f.source_airport_id,
+                                       'destination_airport_id', f.destination_airport_id, 'airline_id', f.airline_id,
+                                       'route_id', f.route_id, 'aircraft_id', f.aircraft_id, 'plane_id', ac.plane_id)) c
+    WHERE p_related_to -> c.key @> jsonb_build_array(c.value)));
+$$;
+
+-- =============================================================================
+-- Function: subscription_spec_targets(p_spec JSONB)
+-- -----------------------------------------------------------------------------
+-- Purpose:
+--   The distinct targets of a declarative subscription spec: for every
+--   target type listed in spec.targets (default flight, source_airport and
+--   destination_airport), the matching column of subscription_spec_flights.
+--   Types the flights do not lead to (e.g. connection) resolve to nothing.
+--
+--   p_related_to is passed to subscription_spec_flights.
+--
+-- Example Usage:
+--   SELECT * FROM subscription_spec_targets('{"destination_airports": ["JFK"], "targets": ["flight", "airline"]}');
+-- =============================================================================
+CREATE OR REPLACE FUNCTION subscription_spec_targets(p_spec JSONB, p_related_to JSONB DEFAULT NULL)
+    RETURNS TABLE (target_id INT, target_type target_type)
+    LANGUAGE sql STABLE AS $$
+SELECT DISTINCT (r.flight ->> tt.view_column)::int, tt.name::target_type
+FROM (SELECT to_jsonb(f) AS flight FROM subscription_spec_flights(p_spec, p_related_to) f) r
+         JOIN target_types tt ON tt.name = ANY(COALESCE(
+        (SELECT array_agg(x) FROM jsonb_array_elements_text(p_spec -> 'targets') x),
+        ARRAY['flight', 'source_airport', 'destination_airport']))
+WHERE r.flight ->> tt.view_column IS NOT NULL;
+$$;
+
+-- =============================================================================
+-- Function: resolve_subscription_targets(p_subscription_id INT)
+-- -----------------------------------------------------------------------------
+-- Purpose:
+--   The targets of a subscription: from its spec when it has one, the
+--   flight and both of its airports for a traveller's flight subscription,
+--   those of every leg plus the connections between them for an itinerary,
+--   from its legacy view otherwise. p_related_to, {view_column: [ids]},
+--   narrows a spec or a view to the given targets; flight and itinerary
+--   subscriptions are small and always resolved in full. They keep their flights
+--   after they land, until expire_flight_subscriptions drops them.
+--
+-- Example Usage:
+--   SELECT * FROM resolve_subscription_targets(3797);
+-- =============================================================================
+CREATE OR REPLACE FUNCTION resolve_subscription_targets(p_subscription_id INT, p_related_to JSONB DEFAULT NULL)
+    RETURNS TABLE (target_id INT, target_type target_type)
+    LANGUAGE plpgsql STABLE AS $$
+DECLARE
+    sub subscriptions%ROWTYPE;
+BEGIN
+    SELECT * INTO sub FROM subscriptions WHERE id = p_subscription_id;
+    IF sub.spec IS NOT NULL THEN
+        RETURN QUERY SELECT * FROM subscription_spec_targets(sub.spec, p_related_to);
+    ELSIF sub.flight_id IS NOT NULL THEN
+        RETURN QUERY
+            SELECT t.target_id, t.target_type
+            FROM flights f
+                     CROSS JOIN LATERAL (VALUES (f.id, 'flight'::target_type),
+                                                (f.source_airport_id, 'source_airport'::target_type),
+                                                (f.destination_airport_id, 'destination_airport'::target_type))
+                AS t(target_id, target_type)
+            WHERE f.id = sub.flight_id;
+    ELSIF sub.itinerary_id IS NOT NULL THEN
+        RETURN QUERY
+            SELECT t.target_id, t.target_type
+            FROM itinerary_legs l
+                     JOIN flights f ON f.id = l.flight_id
+                     CROSS JOIN LATERAL (VALUES (f.id, 'flight'::target_type),
+                                                (f.source_airport_id, 'source_airport'::target_type),
+                                                (f.destination_airport_id, 'destination_airport'::target_type))
+                AS t(target_id, target_type)
+            WHERE l.itinerary_id = sub.itinerary_id
+            UNION
+            SELECT l.id, 'connection'::target_type
+            FROM itinerary_legs l
+            WHERE l.itinerary_id = sub.itinerary_id
+              AND EXISTS (SELECT 1 FROM itinerary_legs n
+                          WHERE n.itinerary_id = l.itinerary_id AND n.position = l.position + 1);
+    ELSIF sub.view_name IS NOT NULL THEN
+        RETURN QUERY SELECT * FROM subscription_view_targets(sub.view_name, p_related_to);
+    END IF;
+END;
+$$;
+
+-- =============================================================================
+-- Procedure: recreate_subscription_targets
+-- -----------------------------------------------------------------------------
+-- Purpose:
+--   Rebuilds the `subscription_targets` table by resolving and extracting
+--   all monitored targets (flights, airports, airlines, ...) from
+--   subscription specs or, for legacy subscriptions, their views.
+--
+-- Description:
+--   - Each subscription in the `subscriptions` table has a declarative spec
+--     or a view that determines which targets it monitors.
+--   - This procedure resolves each with resolve_subscription_targets and
+--     inserts the distinct targets (`flight_id`, `destination_airport_id`,
+--     `airline_id`, see target_types.view_column) into `subscription_targets`.
+--   - The result is a flattened and query-efficient mapping of
+--     (subscription_id, target_id, target_type) used for alert resolution.
+--
+-- When to Use:
+--   This procedure **must be called** whenever:
+--     1. A user subscription is added, updated, or removed.
+--     2. The flights a subscription selects change (e.g., due to flight updates).
+--
+-- Guarantees:
+--   - `subscription_targets` reflects the latest state of all active subscriptions.
+--   - Enables efficient joins and filtering during alert fan-out.
+--   - Targets that dropped out of a subscription are recorded in
+--     `retired_subscription_targets` (see archive_untracked_alerts);
+--     targets that came back are removed from it.
+--   - Targets entering or leaving a subscription are logged in
+--     `subscription_target_events`, like refresh_subscription_targets does,
+--     except on the first build: every target would enter.
+--
+-- Target Types Inserted:
+--   - the spec's `targets`, or every type in `target_types` whose
+--     view_column a legacy view has
+--
+-- Implementation Notes:
+--   - Specs compile to static SQL; only legacy `subscriptions.view_name`
+--     still goes through dynamic SQL.
+--   - Resolves every target into a temp table and applies only the
+--     difference, so fan-out and delivery reading `subscription_targets`
+--     are never blocked (a TRUNCATE would lock them out for the rebuild).
+--   - Optimized for batch regeneration; refresh_subscription_targets keeps
+--     the table current between rebuilds.
+-- =============================================================================
+CREATE OR REPLACE PROCEDURE recreate_subscription_targets()
+    LANGUAGE plpgsql
+AS $$
+DECLARE
+    rec RECORD;
+    first_build BOOL := NOT EXISTS (SELECT 1 FROM subscription_targets);
+BEGIN
+    -- Step 1: Resolve into temp tables of this session
+    CREATE TEMP TABLE IF NOT EXISTS next_subscription_targets
+        (LIKE subscription_targets) ON COMMIT DELETE ROWS;
+    CREATE TEMP TABLE IF NOT EXISTS changed_subscription_targets
+        (LIKE subscription_targets, entered BOOL NOT NULL) ON COMMIT DELETE ROWS;
+    TRUNCATE next_subscription_targets, changed_subscription_targets;
+    -- queued flight changes are covered by the rebuild
+    DELETE FROM subscription_target_queue;
+
+    -- Step 2: Iterate over each subscription
+    FOR rec IN SELECT id FROM subscriptions LOOP
+            -- Step 3: Resolve the targets of the spec, or of the legacy view
+            INSERT INTO next_subscription_targets(subscription_id, target_id, target_type)
+            SELECT DISTINCT rec.id, t.target_id, t.target_type
+            FROM resolve_subscription_targets(rec.id) t;
+        END LOOP;
+    ANALYZE next_subscription_targets; -- temp tables are not analyzed automatically
+
+    -- Step 4: Apply the difference, locking only the rows that change
+    WITH removed AS (
+        DELETE FROM subscription_targets st
+        WHERE NOT EXISTS (
+            SELECT 1 FROM next_subscription_targets n
+            WHERE n.subscription_id = st.subscription_id AND n.target_id = st.target_id AND n.target_type = st.target_type)
+        RETURNING st.subscription_id, st.target_id, st.target_type
+    ),
+    added AS (
+        INSERT INTO subscription_targets (subscription_id, target_id, target_type)
+        SELECT n.subscription_id, n.target_id, n.target_type
+        FROM next_subscription_targets n
+        WHERE NOT EXISTS (
+            SELECT 1 FROM subscription_targets st
+            WHERE st.subscription_id = n.subscription_id AND st.target_id = n.target_id AND st.target_type = n.target_type)
+        RETURNING subscription_id, target_id, target_type
+    )
+    INSERT INTO changed_subscription_targets (subscription_id, target_id, target_type, entered)
+    SELECT subscription_id, target_id, target_type, false FROM removed
+    UNION ALL
+    SELECT subscription_id, target_id, target_type, true FROM added;
+
+    -- Step 5: Retire targets that dropped out, keeping the first retirement time
+    INSERT INTO retired_subscription_targets (subscription_id, target_id, target_type)
+    SELECT c.subscription_id, c.target_id, c.target_type
+    FROM changed_subscription_targets c
+    WHERE NOT c.entered
+    ON CONFLICT DO NOTHING;
+
+    DELETE FROM retired_subscription_targets r
+        USING subscription_targets st
+    WHERE st.subscription_id = r.subscription_id AND st.target_id = r.target_id AND st.target_type = r.target_type;
+
+    -- Step 6: Log targets that entered or left a subscription
+    IF NOT first_build THEN
+        INSERT INTO subscription_target_events (subscription_id, target_id, target_type, event)
+        SELECT c.subscription_id, c.target_id, c.target_type,
+               CASE WHEN c.entered THEN 'entered' ELSE 'left' END::subscription_target_event
+        FROM changed_subscription_targets c;
+    END IF;
+END;
+$$;
+
+-- =============================================================================
+-- Function: flight_row_targets(f flights)
+-- -----------------------------------------------------------------------------
+-- Purpose:
+--   Every target a flight row leads to, one per registered target type
+--   with a column in subscription_spec_flights (the flight itself, its
+--   airports, airline, route, aircraft and aircraft type). Takes the row,
+--   so the targets of a deleted or updated flight's OLD row can be found.
+-- =============================================================================
+CREATE OR REPLACE FUNCTION flight_row_targets(f flights)
+    RETURNS TABLE (target_id INT, target_type target_type)
+    LANGUAGE sql STABLE AS $$
+SELECT (r.flight ->> tt.view_column)::int, tt.name::target_type
+FROM (SELECT to_jsonb(f) || jsonb_build_object('flight_id', f.id, 'plane_id',
+                                               (SELECT ac.plane_id FROM aircraft ac WHERE ac.id = f.aircraft_id)) AS flight) r
+         JOIN target_types tt ON r.flight ->> tt.view_column IS NOT NULL;
+$$;
+
+-- ================================================================
+-- Trigger: trg_queue_flight_change
+-- ------------------------------------------------
+-- Purpose:
+--   Queues the targets of flights whose subscriptions may have changed for
+--   refresh_subscription_targets: new and deleted flights, and updates of
+--   anything subscription specs filter on. Both the OLD and NEW targets
+--   are queued, so the airport a flight no longer goes to, or the flight
+--   that was deleted, leaves the subscriptions it was in. Flights leaving
+--   active_flights only because they landed are found by the refresh itself.
+-- ================================================================
+CREATE OR REPLACE FUNCTION queue_flight_change()
+    RETURNS TRIGGER AS $$
+BEGIN
+    INSERT INTO subscription_target_queue (target_id, target_type)
+    SELECT t.target_id, t.target_type FROM flight_row_targets(OLD) t WHERE TG_OP <> 'INSERT'
+    UNION
+    SELECT t.target_id, t.target_type FROM flight_row_targets(NEW) t WHERE TG_OP <> 'DELETE'
+    ON CONFLICT (target_id, target_type) DO NOTHING;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trg_queue_flight_change
+    AFTER INSERT OR DELETE OR UPDATE OF status, arrival_time, source_airport_id, destination_airport_id,
+        airline_id, route_id, flight_number, aircraft_id
+    ON flights
+    FOR EACH ROW
+EXECUTE FUNCTION queue_flight_change();
+
+-- =============================================================================
+-- Procedure: refresh_subscription_targets
+-- -----------------------------------------------------------------------------
+-- Purpose:
+--   Incremental maintenance of `subscription_targets` between full
+--   rebuilds: only the (subscription, target) rows of targets whose flights
+--   changed are recomputed, so flights becoming active are tracked within
+--   seconds and flights leaving active_flights are dropped.
+--
+-- Behavior:
+--   - Candidates are the targets drained from `subscription_target_queue`
+--     and every target (see flight_row_targets) of tracked flights that
+--     landed (arrival_time passed, so they left active_flights), except
+--     where a flight or itinerary subscription tracks them until it expires
+--   - Each subscription re-resolves only the flights, or legacy view rows,
+--     leading to a candidate (resolve_subscription_targets with p_related_to)
+--   - Candidates a subscription now resolves to are inserted, the others
+--     deleted; each is logged in `subscription_target_events` as 'entered'
+--     or 'left' and `retired_subscription_targets` is kept in step
+--
+-- Example Usage:
+--   CALL refresh_subscription_targets();
+--
+-- Notes:
+--   - The Go ingestion pipeline runs it every few seconds between merges;
+--     recreate_subscription_targets still runs hourly and reconciles what
+--     the queue can not see, e.g. flights removed by TRUNCATE.
+-- =============================================================================
+CREATE OR REPLACE PROCEDURE refresh_subscription_targets()
+    LANGUAGE plpgsql
+AS $$
+DECLARE
+    related JSONB;
+    rec RECORD;
+BEGIN
+    -- Step 1: Claim queued targets and those of tracked flights that landed
+    CREATE TEMP TABLE IF NOT EXISTS target_candidates (
+        target_id INT NOT NULL,
+        target_type target_type NOT NULL,
+        PRIMARY KEY (target_id, target_type)
+    ) ON COMMIT DELETE ROWS;
+    TRUNCATE target_candidates;
+    WITH claimed AS (
+        DELETE FROM subscription_target_queue RETURNING target_id, target_type
+    )
+    INSERT INTO target_candidates (target_id, target_type)
+    SELECT target_id, target_type FROM claimed
+    UNION
+    SELECT t.target_id, t.target_type
+    FROM subscription_targets st
+             JOIN flights f ON f.id = st.target_id
+             JOIN subscriptions s ON s.id = st.subscription_id
+             CROSS JOIN LATERAL flight_row_targets(f) t
+    WHERE st.target_type = 'flight' AND f.arrival_time <= now()
+      AND s.flight_id IS NULL AND s.itinerary_id IS NULL;
+
+    IF NOT FOUND THEN
+        RETURN;
+    END IF;
+
+    -- Step 2: The candidates by view column, see subscription_spec_flights
+    SELECT jsonb_object_agg(x.view_column, x.ids) INTO related
+    FROM (SELECT tt.view_column, jsonb_agg(c.target_id) AS ids
+          FROM target_candidates c
+                   JOIN target_types tt ON tt.name = c.target_type
+          GROUP BY tt.view_column) x;
+
+    -- Step 3: Recompute the membership of the candidates in every subscription
+    CREATE TEMP TABLE IF NOT EXISTS target_membership
+        (LIKE subscription_targets) ON COMMIT DELETE ROWS;
+    TRUNCATE target_membership;
+    FOR rec IN SELECT id FROM subscriptions LOOP
+            INSERT INTO target_membership (subscription_id, target_id, target_type)
+            SELECT rec.id, t.target_id, t.target_type
+            FROM resolve_subscription_targets(rec.id, related) t
+                     JOIN target_candidates c ON c.target_id = t.target_id AND c.target_type = t.target_type;
+        END LOOP;
+
+    -- Step 4: Apply the difference and log it
+    WITH entered AS (
+        INSERT INTO subscription_targets (subscription_id, target_id, target_type)
+        SELECT DISTINCT m.subscription_id, m.target_id, m.target_type FROM target_membership m
+        ON CONFLICT (subscription_id, target_id, target_type) DO NOTHING
+        RETURNING subscription_id, target_id, target_type
+    ),
+         dropped AS (
+             DELETE FROM subscription_targets st
+                 USING target_candidates c
+                 WHERE st.target_id = c.target_id AND st.target_type = c.target_type
+                     AND NOT EXISTS (
+                         SELECT 1 FROM target_membership m
+                         WHERE m.subscription_id = st.subscription_id AND m.target_id = st.target_id
+                           AND m.target_type = st.target_type)
+                 RETURNING st.subscription_id, st.target_id, st.target_type
+         ),
+         logged AS (
+             INSERT INTO subscription_target_events (subscription_id, target_id, target_type, event)
+             SELECT subscription_id, target_id, target_type, 'entered'::subscription_target_event FROM entered
+             UNION ALL
+             SELECT subscription_id, target_id, target_type, 'left' FROM dropped
+             RETURNING subscription_id, target_id, target_type, event
+         ),
+         retired AS (
+             INSERT INTO retired_subscription_targets (subscription_id, target_id, target_type)
+             SELECT subscription_id, target_id, target_type FROM logged WHERE event = 'left'
+             ON CONFLICT DO NOTHING
+         )
+    DELETE FROM retired_subscription_targets r
+        USING logged l
+    WHERE l.event = 'entered' AND r.subscription_id = l.subscription_id
+      AND r.target_id = l.target_id AND r.target_type = l.target_type;
+END;
+$$;
+
+-- =============================================================================
+-- Procedure: sync_subscription_targets(p_subscription_id INT)
+-- -----------------------------------------------------------------------------
+-- Purpose:
+--   Resolves one subscription in full right after it was created or its
+--   spec changed, so it does not wait for the next
+--   recreate_subscription_targets.
+--
+-- Behavior:
+--   - Inserts the targets it resolves to and deletes the others, logging
+--     them in `subscription_target_events` and keeping
+--     `retired_subscription_targets` in step like refresh_subscription_targets
+--
+-- Example Usage:
+--   CALL sync_subscription_targets(3797);
+-- =============================================================================
+CREATE OR REPLACE PROCEDURE sync_subscription_targets(p_subscription_id INT)
+    LANGUAGE plpgsql
+AS $$
+BEGIN
+    CREATE TEMP TABLE IF NOT EXISTS target_membership
+        (LIKE subscription_targets) ON COMMIT DELETE ROWS;
+    TRUNCATE target_membership;
+    INSERT INTO target_membership (subscription_id, target_id, target_type)
+    SELECT DISTINCT p_subscription_id, t.target_id, t.target_type
+    FROM resolve_subscription_targets(p_subscription_id) t;
+
+    WITH entered AS (
+        INSERT INTO subscription_targets (subscription_id, target_id, target_type)
+        SELECT m.subscription_id, m.target_id, m.target_type FROM target_membership m
+        ON CONFLICT (subscription_id, target_id, target_type) DO NOTHING
+        RETURNING subscription_id, target_id, target_type
+    ),
+         dropped AS (
+             DELETE FROM subscription_targets st
+                 WHERE st.subscription_id = p_subscription_id
+                     AND NOT EXISTS (
+                         SELECT 1 FROM target_membership m
+                         WHERE m.target_id = st.target_id AND m.target_type = st.target_type)
+                 RETURNING st.subscription_id, st.target_id, st.target_type
+         ),
+         logged AS (
+             INSERT INTO subscription_target_events (subscription_id, target_id, target_type, event)
+             SELECT subscription_id, target_id, target_type, 'entered'::subscription_target_event FROM entered
+             UNION ALL
+             SELECT subscription_id, target_id, target_type, 'left' FROM dropped
+             RETURNING subscription_id, target_id, target_type, event
+         ),
+         retired AS (
+             INSERT INTO retired_subscription_targets (subscription_id, target_id, target_type)
+             SELECT subscription_id, target_id, target_type FROM logged WHERE event = 'left'
+             ON CONFLICT DO NOTHING
+         )
+    DELETE FROM retired_subscription_targets r
+        USING logged l
+    WHERE l.event = 'entered' AND r.subscription_id = l.subscription_id
+      AND r.target_id = l.target_id AND r.target_type = l.target_type;
+END;
+$$;
+
+-- =============================================================================
+-- Function: expire_flight_subscriptions()
+-- -----------------------------------------------------------------------------
+-- Purpose:
+--   Deletes the flight and itinerary subscriptions of travellers whose
+--   (last) flight arrived more than their expires_after ago (or no longer
+--   exists), together with their user subscriptions, conditions, targets
+--   and itineraries. Pushes and closing events
+--   of the user subscriptions go with them (ON DELETE CASCADE); the alerts
+--   of targets nobody tracks any more are archived by
+--   archive_untracked_alerts as usual.
+--
+-- Returns:
+--   The number of subscriptions deleted.
+--
+-- Example Usage:
+--   SELECT expire_flight_subscriptions();
+-- =============================================================================
+CREATE OR REPLACE FUNCTION expire_flight_subscriptions()
+    RETURNS INT
+    LANGUAGE plpgsql AS $$
+DECLARE
+    expired INT[];
+    expired_itineraries INT[];
+BEGIN
+    SELECT array_agg(s.id), array_agg(s.itinerary_id) FILTER (WHERE s.itinerary_id IS NOT NULL)
+    INTO expired, expired_itineraries
+    FROM subscriptions s
+             CROSS JOIN LATERAL (
+        -- two index lookups: the pinned flight, or the legs of the itinerary
+        SELECT max(a.arrival_time) AS arrival_time
+        FROM (SELECT f.arrival_time FROM flights f WHERE f.id = s.flight_id
+              UNION ALL
+              SELECT f.arrival_time
+              FROM itinerary_legs l JOIN flights f ON f.id = l.flight_id
+              WHERE l.itinerary_id = s.itinerary_id) a) latest
+    WHERE s.expires_after IS NOT NULL
+      AND (latest.arrival_time IS NULL OR latest.arrival_time + s.expires_after <= now());
+
+    IF expired IS NULL THEN
+        RETURN 0;
+    END IF;
+
+    DELETE FROM user_subscription_conditions usc
+        USING user_subscriptions us
+    WHERE usc.user_subscription_id = us.id AND us.subscription_id = ANY(expired);
+    DELETE FROM user_subscriptions WHERE subscription_id = ANY(expired);
+    DELETE FROM subscription_targets WHERE subscription_id = ANY(expired);
+    DELETE FROM subscriptions WHERE id = ANY(expired);
+    DELETE FROM itineraries WHERE id = ANY(expired_itineraries);
+    RETURN cardinality(expired);
+END;
+$$;
+
+-- The latest value of a measurement of a target, from the alerts of any
+-- condition of the template, see connection_risks
+CREATE OR REPLACE FUNCTION latest_measurement(p_template TEXT, p_target_type target_type, p_target_id INT)
+    RETURNS DOUBLE PRECISION
+    LANGUAGE sql STABLE AS $$
+SELECT a.value
+FROM alerts a
+         JOIN conditions c ON c.id = a.condition_id
+         JOIN condition_templates ct ON ct.id = c.template_id
+WHERE ct.name = p_template AND a.target_id = p_target_id AND a.target_type = p_target_type
+  AND a.value IS NOT NULL
+ORDER BY a.received_at DESC
+LIMIT 1;
+$$;
+
+-- =============================================================================
+-- Function: connection_risks(p_delayed_minutes, p_minimum_minutes)
+-- -----------------------------------------------------------------------------
+-- Purpose:
+--   The connection_at_risk measurement of every tracked connection (an
+--   itinerary leg followed by another): how many minutes of the minimum
+--   connection time at the transfer airport the estimated delay of the
+--   inbound leg eats into, negative while the connection still has slack.
+--   One row per connection_at_risk condition, ready to be staged.
+--
+-- Behavior:
+--   - The estimated delay of the inbound leg is the largest of
+--       * the latest departure_delay measurement at its source airport,
+--         until it departed
+--       * the latest arrival_delay measurement at the transfer airport
+--       * p_delayed_minutes while its status is 'delayed'
+--     and 0 once it arrived (arrival_time is then the actual one)
+--   - The minimum connection time comes from minimum_connection_times,
+--     p_minimum_minutes for airports without one
+--   - Measurements are taken from alerts whether they are on or off: a
+--     10 minute delay under the 15 minute threshold still shortens a
+--     connection
+--
+-- Example Usage:
+--   SELECT * FROM connection_risks(30, 60);
+--
+-- Notes:
+--   - The Go ingestion pipeline stages these rows periodically, so the
+--     alert is merged, inhibited, suppressed and fanned out like any other.
+-- =============================================================================
+CREATE OR REPLACE FUNCTION connection_risks(p_delayed_minutes DOUBLE PRECISION DEFAULT 30,
+                                            p_minimum_minutes INT DEFAULT 60)
+    RETURNS TABLE (condition_id INT, connection_id INT, is_on BOOL, value DOUBLE PRECISION, payload TEXT)
+    LANGUAGE sql STABLE AS $$
+WITH connections AS (
+    SELECT l.id,
+           fi.flight_number AS inbound,
+           fo.flight_number AS outbound,
+           fi.destination_airport_id AS airport_id,
+           COALESCE(m.minutes, p_minimum_minutes)::float8 AS minimum_minutes,
+           (EXTRACT(EPOCH FROM fo.departure_time - fi.arrival_time) / 60)::float8 AS scheduled_minutes,
+           CASE WHEN fi.status = 'arrived' THEN 0 ELSE GREATEST(
+                   CASE WHEN fi.status IN ('scheduled', 'delayed')
+                            THEN latest_measurement('departure_delay', 'source_airport', fi.source_airport_id) END,
+                   latest_measurement('arrival_delay', 'destination_airport', fi.destination_airport_id),
+                   CASE WHEN fi.status = 'delayed' THEN p_delayed_minutes END,
+                   0) END AS estimated_delay
+    FROM itinerary_legs l
+             JOIN itinerary_legs n ON n.itinerary_id = l.itinerary_id AND n.position = l.position + 1
+             JOIN flights fi ON fi.id = l.flight_id
+             JOIN flights fo ON fo.id = n.flight_id
+             LEFT JOIN minimum_connection_times m ON m.airport_id = fi.destination_airport_id
+    WHERE EXISTS (SELECT 1 FROM subscription_targets st
+                  WHERE st.target_id = l.id AND st.target_type = 'connection')
+)
+SELECT c.id,
+       x.id,
+       threshold_crossed(ct.direction, x.risk, c.threshold),
+       x.risk,
+       json_build_object(
+               'inbound', x.inbound,
+               'outbound', x.outbound,
+               'airport_id', x.airport_id,
+               'estimated_delay_minutes', x.estimated_delay,
+               'connection_minutes', x.scheduled_minutes - x.estimated_delay,
+               'minimum_connection_minutes', x.minimum_minutes
+       )::text
+FROM (SELECT cn.*, cn.minimum_minutes - (cn.scheduled_minutes - cn.estimated_delay) AS risk
+      FROM connections cn) x
+         CROSS JOIN conditions c
+         JOIN condition_templates ct ON ct.id = c.template_id
+WHERE ct.name = 'connection_at_risk';
+$$;
+
+-- =============================================================================
+-- Procedure: archive_untracked_alerts(grace INTERVAL)
+-- -----------------------------------------------------------------------------
+-- Purpose:
+--   Lifecycle job keeping the `alerts` working set small: moves alerts of
+--   targets no longer referenced by any subscription (e.g. arrived or
+--   cancelled flights) to `alerts_archive`.
+--
+-- Behavior:
+--   - A target is archived once it is in no `subscription_targets` and
+--     dropped out of its last subscription more than `grace` ago, so a
+--     target that comes back shortly keeps its alerts
+--   - Every user subscription that last saw an archived alert on (listens
+--     to its condition, per-user threshold, not suppressed) gets a closing
+--     event in `alert_closures`, delivered by get_alerts_json as
+--     `is_on: false, closed: true`
+--   - Alerts inhibited by an archived alert are inhibited again by another
+--     source alert or released (see inhibiting_alert), logged to
+--     `alert_transitions` as one batch
+--   - Notifies those subscriptions, and the ones whose view of a released
+--     alert changed, on 'user_subscription_alerts', like
+--     process_alert_staging
+--   - Forgets retired targets that are archived or tracked again, and
+--     tier state of archived targets; resolves incidents left without an
+--     alert that is on and notifies their incident-mode subscribers
+--
+-- Example Usage:
+--   CALL recreate_subscription_targets();
+--   CALL archive_untracked_alerts();
+--
+-- Notes:
+--   - Run after refresh_subscription_targets (or a full
+--     recreate_subscription_targets); the Go ingestion pipeline archives
+--     every 5 minutes between merges and rebuilds in full hourly.
+-- =============================================================================
+CREATE OR REPLACE PROCEDURE archive_untracked_alerts(grace INTERVAL DEFAULT '10 minutes')
+    LANGUAGE plpgsql
+AS $$
+DECLARE
+    sub_ids INT[];
+    batch BIGINT;
+BEGIN
+    CREATE TEMP TABLE IF NOT EXISTS untracked_alerts (alert_id INT PRIMARY KEY) ON COMMIT DELETE ROWS;
+    TRUNCATE untracked_alerts;
+    CREATE TEMP TABLE IF NOT EXISTS uninhibited_alerts (
+        alert_id       INT PRIMARY KEY,
+        old_suppressed BOOL NOT NULL
+    ) ON COMMIT DELETE ROWS;
+    TRUNCATE uninhibited_alerts;
+
+    -- Step 1: Alerts of targets no subscription references any more
+    INSERT INTO untracked_alerts
+    SELECT a.id
+    FROM alerts a
+    WHERE NOT EXISTS (
+        SELECT 1 FROM subscription_targets st
+        WHERE st.target_id = a.target_id AND st.target_type = a.target_type)
+      AND NOT EXISTS (
+        SELECT 1 FROM retired_subscription_targets r
+        WHERE r.target_id = a.target_id AND r.target_type = a.target_type AND r.retired_at > now() - grace);
+
+    -- Step 2: Close them for the subscribers that last saw them on
+    WITH closed AS (
+        INSERT INTO alert_closures (user_subscription_id, alert_id, condition_id, target_id, target_type, payload)
+            SELECT us.id, a.id, a.condition_id, a.target_id, a.target_type, a.payload
+            FROM untracked_alerts u
+                     JOIN alerts a ON a.id = u.alert_id
+                     JOIN conditions c ON c.id = a.condition_id
+                     JOIN condition_templates ct ON ct.id = c.template_id
+                     JOIN retired_subscription_targets r ON r.target_id = a.target_id AND r.target_type = a.target_type
+                     JOIN user_subscriptions us ON us.subscription_id = r.subscription_id
+                     JOIN user_subscription_conditions usc
+                          ON usc.user_subscription_id = us.id AND usc.condition_id = a.condition_id AND usc.is_on
+            WHERE effective_is_on(a.is_on, ct.direction, a.value, usc.threshold) AND NOT a.suppressed
+              AND NOT EXISTS (SELECT 1 FROM target_mutes m
+                              WHERE m.user_subscription_id = us.id AND m.target_id = a.target_id
+                                AND m.target_type = a.target_type AND m.ended_at IS NULL
+                                AND (m.until IS NULL OR m.until > now()))
+              AND c.severity >= us.min_severity
+            ON CONFLICT (user_subscription_id, alert_id) DO NOTHING
+            RETURNING user_subscription_id
+    )
+    SELECT ARRAY(SELECT DISTINCT user_subscription_id FROM closed) INTO sub_ids;
+
+    -- Step 3: Record the alerts they inhibit, before they go away
+    INSERT INTO uninhibited_alerts (alert_id, old_suppressed)
+    SELECT a.id, a.suppressed
+    FROM untracked_alerts u
+             JOIN alerts a ON a.inhibited_by = u.alert_id
+    WHERE NOT EXISTS (SELECT 1 FROM untracked_alerts x WHERE x.alert_id = a.id);
+
+    -- Step 4: Move them to the archive
+    WITH moved AS (
+        DELETE FROM alerts a
+            USING untracked_alerts u
+        WHERE a.id = u.alert_id
+        RETURNING a.id, a.condition_id, a.target_id, a.target_type, a.is_on, a.value,
+                  a.received_at, a.payload, a.updated_at, a.superseded_by, a.inhibited_by, a.suppression_window_id,
+                  a.incident_id
+    )
+    INSERT INTO alerts_archive (id, condition_id, target_id, target_type, is_on, value,
+                                received_at, payload, updated_at, superseded_by, inhibited_by, suppression_window_id,
+                                incident_id)
+    SELECT * FROM moved
+    ON CONFLICT (id) DO NOTHING;
+
+    -- Step 5: Re-resolve the alerts they inhibited, log the suppression
+    -- changes and add the subscriptions whose view of an alert changed
+    IF EXISTS (SELECT 1 FROM uninhibited_alerts) THEN
+        UPDATE alerts a
+        SET inhibited_by = inhibiting_alert(a.condition_id, a.target_id, a.target_type),
+            tier_transition = NULL,
+            updated_at = now()
+        FROM uninhibited_alerts ua
+        WHERE a.id = ua.alert_id;
+
+        batch := nextval('alert_batch_seq');
+        INSERT INTO alert_transitions (batch_id, alert_id, condition_id, target_id, target_type, old_is_on, is_on,
+                                       old_suppressed, suppressed, inhibited_by, value, payload, received_at)
+        SELECT batch, a.id, a.condition_id, a.target_id, a.target_type, a.is_on, a.is_on,
+               ua.old_suppressed, a.suppressed, a.inhibited_by, a.value, a.payload, a.received_at
+        FROM uninhibited_alerts ua
+                 JOIN alerts a ON a.id = ua.alert_id
+        WHERE ua.old_suppressed IS DISTINCT FROM a.suppressed;
+
+        SELECT ARRAY(
+           SELECT unnest(sub_ids)
+           UNION
+           SELECT usa.user_subscription_id
+           FROM uninhibited_alerts ua
+                    JOIN alerts a ON a.id = ua.alert_id
+                    JOIN user_subscription_alerts usa ON usa.alert_id = ua.alert_id
+           WHERE usa.usc_is_on = true
+             AND (effective_is_on(a.is_on, usa.direction, a.value, usa.user_threshold) AND NOT ua.old_suppressed)
+                 IS DISTINCT FROM usa.is_on
+         ) INTO sub_ids;
+    END IF;
+
+    -- Step 6: Forget what is no longer needed
+    DELETE FROM retired_subscription_targets r
+    WHERE NOT EXISTS (SELECT 1 FROM alerts a WHERE a.target_id = r.target_id AND a.target_type = r.target_type);
+
+    DELETE FROM alert_tiers t
+    WHERE NOT EXISTS (
+        SELECT 1 FROM alerts a
+                 JOIN conditions c ON c.id = a.condition_id
+        WHERE c.tier_group_id = t.tier_group_id AND a.target_id = t.target_id AND a.target_type = t.target_type);
+
+    -- subscriptions delivered incidents are told about the resolved ones,
+    -- like process_alert_staging; those that saw an archived alert of them
+    -- on have its closing event already
+    WITH resolved AS (
+        UPDATE incidents i
+            SET status = 'resolved',
+                resolved_at = now(),
+                updated_at = now()
+            WHERE i.status <> 'resolved'
+              AND NOT EXISTS (SELECT 1 FROM alerts a WHERE a.incident_id = i.id AND a.is_on AND NOT a.suppressed)
+            RETURNING i.id
+    )
+    SELECT ARRAY(
+       SELECT unnest(sub_ids)
+       UNION
+       SELECT usa.user_subscription_id
+       FROM resolved r
+                JOIN alerts a ON a.incident_id = r.id
+                JOIN user_subscription_alerts usa ON usa.alert_id = a.id
+       WHERE usa.usc_is_on = true AND usa.delivery = 'incidents'
+     ) INTO sub_ids;
+
+    -- Step 7: Notify the subscriptions with closing events, released alerts
+    -- or resolved incidents
+    UPDATE user_subscriptions us
+    SET alerts_triggered_at = now()
+    WHERE us.id = ANY(sub_ids);
+
+    IF array_length(sub_ids, 1) > 0 THEN
+        PERFORM pg_notify(
+                'user_subscription_alerts',
+                json_build_object(
+                        'user_subscription_ids', sub_ids
+                )::text
+                );
+    END IF;
+END;
+$$;
+
+-- =============================================================================
+-- Procedure: apply_suppression_windows()
+-- -----------------------------------------------------------------------------
+-- Purpose:
+--   Applies the boundaries of suppression windows to alerts that do not
+--   change themselves: suppresses the alerts of windows that started and
+--   releases those of windows that ended (or were moved or deleted).
+--
+-- Behavior:
+--   - Sets or clears `alerts.suppression_window_id`, bumping updated_at
+--   - Logs suppression changes to `alert_transitions` as one batch
+--   - Notifies the subscriptions whose view of an alert changed on
+--     'user_subscription_alerts', like process_alert_staging, so alerts
+--     still on when a window ends are delivered
+--
+-- Example Usage:
+--   CALL apply_suppression_windows();
+--
+-- Notes:
+--   - The Go ingestion pipeline calls it periodically between merges.
+-- =============================================================================
+CREATE OR REPLACE PROCEDURE apply_suppression_windows()
+    LANGUAGE plpgsql
+AS $$
+DECLARE
+    sub_ids INT[];
+    batch BIGINT;
+BEGIN
+    CREATE TEMP TABLE IF NOT EXISTS window_changes (
+        alert_id       INT PRIMARY KEY,
+        old_suppressed BOOL NOT NULL,
+        window_id      INT
+    ) ON COMMIT DELETE ROWS;
+    TRUNCATE window_changes;
+
+    -- Step 1: Alerts of targets under a window in force, and alerts held by one
+    WITH candidates AS (
+        SELECT a.id
+        FROM suppression_windows w
+                 JOIN conditions c ON w.condition_id IS NULL OR c.id = w.condition_id
+                 JOIN alerts a ON a.condition_id = c.id AND a.target_id = w.target_id
+        WHERE w.ends_at > now() AND w.starts_at <= now()
+        UNION
+        SELECT a.id
+        FROM alerts a
+        WHERE a.suppression_window_id IS NOT NULL
+    )
+    INSERT INTO window_changes (alert_id, old_suppressed, window_id)
+    SELECT r.id, r.suppressed, r.window_id
+    FROM (
+        SELECT a.id, a.suppressed, a.suppression_window_id,
+               active_suppression_window(a.condition_id, a.target_id, a.target_type, now()) AS window_id
+        FROM candidates c
+                 JOIN alerts a ON a.id = c.id
+    ) r
+    WHERE r.suppression_window_id IS DISTINCT FROM r.window_id;
+
+    IF NOT EXISTS (SELECT 1 FROM window_changes) THEN
+        RETURN;
+    END IF;
+
+    -- Step 2: Apply them
+    UPDATE alerts a
+    SET suppression_window_id = wc.window_id,
+        tier_transition = NULL,
+        updated_at = now()
+    FROM window_changes wc
+    WHERE a.id = wc.alert_id;
+
+    -- Step 3: Log the suppression changes
+    batch := nextval('alert_batch_seq');
+    INSERT INTO alert_transitions (batch_id, alert_id, condition_id, target_id, target_type, old_is_on, is_on,
+                                   old_suppressed, suppressed, inhibited_by, value, payload, received_at)
+    SELECT batch, a.id, a.condition_id, a.target_id, a.target_type, a.is_on, a.is_on,
+           wc.old_suppressed, a.suppressed, a.inhibited_by, a.value, a.payload, a.received_at
+    FROM window_changes wc
+             JOIN alerts a ON a.id = wc.alert_id
+    WHERE wc.old_suppressed IS DISTINCT FROM a.suppressed;
+
+    -- Step 4: Notify the subscriptions whose view of an alert changed
+    SELECT ARRAY(
+       SELECT DISTINCT usa.user_subscription_id
+       FROM window_changes wc
+                JOIN alerts a ON a.id = wc.alert_id
+                JOIN user_subscription_alerts usa ON usa.alert_id = wc.alert_id
+       WHERE usa.usc_is_on = true
+         AND (effective_is_on(a.is_on, usa.direction, a.value, usa.user_threshold) AND NOT wc.old_suppressed)
+             IS DISTINCT FROM usa.is_on
+     ) INTO sub_ids;
+
+    UPDATE user_subscriptions us
+    SET alerts_triggered_at = now()
+    WHERE us.id = ANY(sub_ids);
+
+    IF array_length(sub_ids, 1) > 0 THEN
+        PERFORM pg_notify(
+                'user_subscription_alerts',
+                json_build_object(
+                        'user_subscription_ids', sub_ids
+                )::text
+                );
+    END IF;
+END;
+$$;
+
+-- =============================================================================
+-- Procedure: release_target_mutes()
+-- -----------------------------------------------------------------------------
+-- Purpose:
+--   Ends the target mutes whose `until` passed, so their alerts are
+--   delivered again (see trg_notify_target_unmute), and forgets ended mutes
+--   whose alerts were delivered since.
+--
+-- Example Usage:
+--   CALL release_target_mutes();
+--
+-- Notes:
+--   - The Go ingestion pipeline calls it periodically, with
+--     apply_suppression_windows.
+-- =============================================================================
+CREATE OR REPLACE PROCEDURE release_target_mutes()
+    LANGUAGE plpgsql
+AS $$
+BEGIN
+    UPDATE target_mutes
+    SET ended_at = now() -- not until: pushes since then still left the alerts out
+    WHERE ended_at IS NULL AND until <= now();
+
+    DELETE FROM target_mutes m
+        USING user_subscriptions us
+    WHERE us.id = m.user_subscription_id AND m.ended_at <= us.pushed_at;
+END;
+$$;
+
+-- `is_on` is the alert as seen by this user: re-evaluated against the user's
+-- threshold override when one is set (see effective_is_on), and off while
+-- the alert is suppressed (superseded by a higher tier, inhibited or under a
+-- suppression window). Alerts of targets the user subscription muted are
+-- left out while the mute is in force (see target_mutes), and so are those
+-- of conditions under its min_severity.
+CREATE OR REPLACE VIEW user_subscription_alerts AS
+SELECT
+    a.id AS alert_id,
+    a.condition_id,
+    a.target_id,
+    effective_is_on(a.is_on, ct.direction, a.value, usc.threshold) AND NOT a.suppressed AS is_on,
+    a.payload,
+    a.updated_at,
+    us.id AS user_subscription_id,
+    usc.id AS user_subscription_condition_id,
+    a.target_type,
+    us.pushed_at,
+    usc.is_on usc_is_on,
+    a.value,
+    COALESCE(usc.threshold, c.threshold) AS threshold,
+    usc.threshold AS user_threshold,
+    ct.direction,
+    a.superseded_by,
+    a.tier_transition,
+    a.change_reason,
+    a.inhibited_by,
+    a.suppression_window_id,
+    us.delivery
+FROM alerts a, conditions c, condition_templates ct, user_subscription_conditions usc, user_subscriptions us, subscription_targets st
+WHERE a.condition_id = usc.condition_id AND usc.user_subscription_id = us.id -- 1 alert 1 user_subscription : 1 user_subscription_conditions
+ AND us.subscription_id = st.subscription_id AND st.target_id = a.target_id AND st.target_type = a.target_type
+ AND c.id = a.condition_id AND ct.id = c.template_id
+ AND NOT EXISTS (SELECT 1 FROM target_mutes m
+                 WHERE m.user_subscription_id = us.id AND m.target_id = a.target_id
+                   AND m.target_type = a.target_type AND m.ended_at IS NULL
+                   AND (m.until IS NULL OR m.until > now()))
+ AND c.severity >= us.min_severity
+;
+
+-- =============================================================================
+-- Function: get_alerts_json(user_sub_id INT)
+-- -----------------------------------------------------------------------------
+-- Purpose:
+--   Fetches all **active and updated** alerts for a given user subscription
+--   and returns them as a JSON array. Only includes alerts that:
+--     - Belong to the specified user subscription
+--     - Have `usc_is_on = true` (i.e., condition is enabled)
+--     - Have `updated_at` newer than `pushed_at` (not yet delivered), or
+--       changed for this subscriber only (see user_alert_changes)
+--
+-- Behavior:
+--   - Returns alerts as an array of JSON objects, each containing:
+--       - alert_id
+--       - condition_id
+--       - target_id
 --       - target_type
---       - is_on
+--       - is_on (evaluated against the user's threshold override, if any)
+--       - value (raw measured value, when the evaluator reports one)
+--       - threshold (the threshold this user is evaluated against)
+--       - superseded_by (condition of the higher tier that is on instead)
+--       - inhibited_by (source alert of an inhibition rule, see
+--         inhibition_rules)
+--       - suppression_window_id (maintenance window the alert is
+--         suppressed by, see suppression_windows)
+--       - tier_transition (raised/escalated/de-escalated/cleared, when
+--         this alert became or stopped being the active tier)
+--       - change_reason (severity/value/payload, when the alert stayed
+--         on and was delivered again for a significant change)
 --       - payload (raw JSON from alert evaluator)
 --       - updated_at (last time alert was modified)
+--       - user_subscription_condition_id (lets the delivery worker apply
+--         the user's rule, see user_subscription_conditions.rule)
+--   - Also returns, once, the closing events of alerts archived since the
+--     last call (see archive_untracked_alerts): alert_id, condition_id,
+--     target_id, target_type, is_on = false, closed = true, the last
+--     payload and updated_at (when it was closed)
 --   - If no alerts qualify, returns an empty array: `[]`
 --   - Updates the `pushed_at` field in `user_subscriptions` to `now()`
 --     to mark alerts as delivered.
+--   - Subscriptions with `delivery = 'incidents'` get get_incidents_json
+--     instead.
+--   - With `snapshot`, every alert currently on for the user is returned as
+--     well, not only those updated since the last push: the initial state
+--     of a new subscriber or condition, after which pushes are incremental
+--     again (see trg_snapshot_user_subscriptions).
+--   - Alerts of muted targets are left out (see target_mutes); once a mute
+--     ended, the target's alerts that are on or changed while it was muted
+--     are returned with the next push.
 --
 -- Return Type:
 --   JSON array of alert objects
 --
 -- Example Usage:
 --   SELECT get_alerts_json(42);
+--   SELECT get_alerts_json(42, snapshot => true);
 --
 -- Use Case:
 --   - Called by backend systems or notification workers to fetch
@@ -523,24 +2734,70 @@ WHERE a.condition_id = usc.condition_id AND usc.user_subscription_id = us.id --
 --     and push alerts, as it advances the `pushed_at` timestamp.
 --   - Ensures idempotent client behavior by skipping already pushed alerts.
 -- =============================================================================
-CREATE OR REPLACE FUNCTION get_alerts_json(user_sub_id INT)
+CREATE OR REPLACE FUNCTION get_alerts_json(user_sub_id INT, snapshot BOOLEAN DEFAULT false)
     RETURNS JSON AS $$
 DECLARE
     alerts JSON;
 BEGIN
-    SELECT json_agg(json_build_object(
+    IF (SELECT delivery FROM user_subscriptions WHERE id = user_sub_id) = 'incidents' THEN
+        RETURN get_incidents_json(user_sub_id, snapshot);
+    END IF;
+
+    -- closing events and changes of the subscriber's own thresholds are
+    -- delivered once
+    WITH closed AS (
+        DELETE FROM alert_closures cl
+        WHERE cl.user_subscription_id = user_sub_id
+        RETURNING cl.*
+    ),
+         own AS (
+             DELETE FROM user_alert_changes uc
+             WHERE uc.user_subscription_id = user_sub_id
+             RETURNING uc.alert_id
+         )
+    SELECT json_agg(q.alert)
+    INTO alerts
+    FROM (
+        SELECT json_build_object(
             'alert_id', alert_id,
             'condition_id', condition_id,
             'target_id', target_id,
             'target_type', target_type,
             'is_on', is_on,
+            'value', value,
+            'threshold', threshold,
+            'superseded_by', superseded_by,
+            'inhibited_by', inhibited_by,
+            'suppression_window_id', suppression_window_id,
+            'tier_transition', tier_transition,
+            'change_reason', change_reason,
             'payload', payload,
-            'updated_at', updated_at
-                    ))
-    INTO alerts
-    FROM user_subscription_alerts
-    WHERE user_subscription_id = user_sub_id
-      and usc_is_on = true AND updated_at > COALESCE(pushed_at, '2000-01-01');
+            'updated_at', updated_at,
+            'user_subscription_condition_id', user_subscription_condition_id
+                    ) AS alert
+        FROM user_subscription_alerts usa
+        WHERE user_subscription_id = user_sub_id
+          and usc_is_on = true
+          AND (updated_at > COALESCE(pushed_at, '2000-01-01') OR (snapshot AND is_on)
+              OR alert_id IN (SELECT own.alert_id FROM own)
+              OR EXISTS (SELECT 1 FROM target_mutes m
+                         WHERE m.user_subscription_id = user_sub_id AND m.target_id = usa.target_id
+                           AND m.target_type = usa.target_type
+                           AND m.ended_at > COALESCE(usa.pushed_at, '2000-01-01')
+                           AND (usa.is_on OR usa.updated_at > m.created_at)))
+        UNION ALL
+        SELECT json_build_object(
+            'alert_id', cl.alert_id,
+            'condition_id', cl.condition_id,
+            'target_id', cl.target_id,
+            'target_type', cl.target_type,
+            'is_on', false,
+            'closed', true,
+            'payload', cl.payload,
+            'updated_at', cl.closed_at
+                    )
+        FROM closed cl
+    ) q;
 
     IF alerts IS NULL THEN
         RETURN '[]'::json;
@@ -554,3 +2811,467 @@ BEGIN
     RETURN alerts;
 END;
 $$ LANGUAGE plpgsql;
+
+-- =============================================================================
+-- Function: get_condition_change_json(p_usc_id INT)
+-- -----------------------------------------------------------------------------
+-- Purpose:
+--   The push for a user turning a condition on or off (see
+--   trg_notify_subscription_condition_change): the condition's alerts that
+--   are on for the user, with `is_on` set to whether the condition is now
+--   enabled, shaped like get_alerts_json objects.
+--
+-- Behavior:
+--   - Also returns the changes of the user's other conditions not pushed
+--     yet, then advances `pushed_at` like get_alerts_json, so the next
+--     regular push neither repeats nor loses anything
+--   - Returns NULL when the user subscription condition does not exist
+--
+-- Example Usage:
+--   SELECT get_condition_change_json(8);
+-- =============================================================================
+CREATE OR REPLACE FUNCTION get_condition_change_json(p_usc_id INT)
+    RETURNS JSON AS $$
+DECLARE
+    usc user_subscription_conditions%ROWTYPE;
+    alerts JSON;
+BEGIN
+    SELECT * INTO usc FROM user_subscription_conditions WHERE id = p_usc_id;
+    IF NOT FOUND THEN
+        RETURN NULL;
+    END IF;
+
+    SELECT json_agg(q.alert)
+    INTO alerts
+    FROM (
+        SELECT json_build_object(
+            'alert_id', alert_id,
+            'condition_id', condition_id,
+            'target_id', target_id,
+            'target_type', target_type,
+            'is_on', CASE WHEN user_subscription_condition_id = p_usc_id THEN usc.is_on ELSE is_on END,
+            'value', value,
+            'threshold', threshold,
+            'superseded_by', superseded_by,
+            'inhibited_by', inhibited_by,
+            'suppression_window_id', suppression_window_id,
+            'tier_transition', tier_transition,
+            'change_reason', change_reason,
+            'payload', payload,
+            'updated_at', updated_at,
+            'user_subscription_condition_id', user_subscription_condition_id
+                    ) AS alert
+        FROM user_subscription_alerts
+        WHERE user_subscription_id = usc.user_subscription_id
+          AND CASE WHEN user_subscription_condition_id = p_usc_id
+                       THEN is_on
+                   ELSE usc_is_on AND updated_at > COALESCE(pushed_at, '2000-01-01') END
+    ) q;
+
+    UPDATE user_subscriptions
+    SET pushed_at = now()
+    WHERE id = usc.user_subscription_id;
+
+    RETURN COALESCE(alerts, '[]'::json);
+END;
+$$ LANGUAGE plpgsql;
+
+-- =============================================================================
+-- Function: get_incidents_json(user_sub_id INT)
+-- -----------------------------------------------------------------------------
+-- Purpose:
+--   get_alerts_json for subscriptions with `delivery = 'incidents'`: one
+--   object per incident updated since the last push (see incidents) instead
+--   of one per alert.
+--
+-- Behavior:
+--   - Returns incident_id, status, severity, target_id, target_type,
+--     opened_at, acknowledged_at, acknowledged_by, resolved_at, updated_at
+--     and `alerts`: the incident's alerts the user listens to, shaped like
+--     get_alerts_json objects (is_on as seen by this user)
+--   - Incidents without an alert the user listens to are skipped
+--   - Closing events of archived alerts are delivered in the `alerts` of
+--     their incident (`is_on: false, closed: true`), e.g. of the incident
+--     archive_untracked_alerts resolved; the others are dropped
+--   - With `snapshot`, every incident that is not resolved is returned as
+--     well, like get_alerts_json
+--   - Advances `pushed_at` like get_alerts_json
+-- =============================================================================
+CREATE OR REPLACE FUNCTION get_incidents_json(user_sub_id INT, snapshot BOOLEAN DEFAULT false)
+    RETURNS JSON AS $$
+DECLARE
+    result JSON;
+BEGIN
+    WITH closed AS (
+        DELETE FROM alert_closures cl
+        WHERE cl.user_subscription_id = user_sub_id
+        RETURNING cl.*
+    )
+    SELECT json_agg(json_build_object(
+        'incident_id', i.id,
+        'status', i.status,
+        'severity', i.severity,
+        'target_id', i.target_id,
+        'target_type', i.target_type,
+        'opened_at', i.opened_at,
+        'acknowledged_at', i.acknowledged_at,
+        'acknowledged_by', i.acknowledged_by,
+        'resolved_at', i.resolved_at,
+        'updated_at', i.updated_at,
+        'alerts', m.alerts
+                    ) ORDER BY i.id)
+    INTO result
+    FROM user_subscriptions us
+             -- one index lookup each, an OR of them would scan every incident
+             JOIN LATERAL (
+        SELECT * FROM incidents WHERE updated_at > COALESCE(us.pushed_at, '2000-01-01')
+        UNION
+        SELECT * FROM incidents WHERE snapshot AND status <> 'resolved'
+        ) i ON true
+             JOIN LATERAL (
+        SELECT json_agg(x.alert ORDER BY x.alert_id) AS alerts
+        FROM (
+            SELECT usa.alert_id, json_build_object(
+                'alert_id', usa.alert_id,
+                'condition_id', usa.condition_id,
+                'target_id', usa.target_id,
+                'target_type', usa.target_type,
+                'is_on', usa.is_on,
+                'value', usa.value,
+                'threshold', usa.threshold,
+                'payload', usa.payload,
+                'updated_at', usa.updated_at,
+                'user_subscription_condition_id', usa.user_subscription_condition_id
+                            ) AS alert
+            FROM alerts a
+                     JOIN user_subscription_alerts usa ON usa.alert_id = a.id
+            WHERE a.incident_id = i.id AND usa.user_subscription_id = us.id AND usa.usc_is_on
+            UNION ALL
+            SELECT cl.alert_id, json_build_object(
+                'alert_id', cl.alert_id,
+                'condition_id', cl.condition_id,
+                'target_id', cl.target_id,
+                'target_type', cl.target_type,
+                'is_on', false,
+                'closed', true,
+                'payload', cl.payload,
+                'updated_at', cl.closed_at
+                            )
+            FROM closed cl
+                     JOIN alerts_archive ar ON ar.id = cl.alert_id
+            WHERE ar.incident_id = i.id
+        ) x
+        ) m ON m.alerts IS NOT NULL
+    WHERE us.id = user_sub_id;
+
+    IF result IS NULL THEN
+        RETURN '[]'::json;
+    END IF;
+
+    UPDATE user_subscriptions
+    SET pushed_at = now()
+    WHERE id = user_sub_id;
+
+    RETURN result;
+END;
+$$ LANGUAGE plpgsql;
+
+-- =============================================================================
+-- Procedure: set_incident_status(p_incident_id INT, p_status incident_status, p_by TEXT)
+-- -----------------------------------------------------------------------------
+-- Purpose:
+--   Moves an incident through its lifecycle by hand: acknowledge it (by
+--   `p_by`), resolve it, or reopen it.
+--
+-- Behavior:
+--   - Does nothing when the incident already has `p_status`, and raises
+--     no_data_found when there is no such incident
+--   - Reopening clears the acknowledgement; a resolved incident is reopened
+--     by process_alert_staging as soon as one of its alerts changes while on
+--   - Notifies the subscriptions delivered the incident on
+--     'user_subscription_alerts'
+--
+-- Example Usage:
+--   CALL set_incident_status(17, 'acknowledged', 'ops desk');
+-- =============================================================================
+CREATE OR REPLACE PROCEDURE set_incident_status(p_incident_id INT, p_status incident_status, p_by TEXT DEFAULT NULL)
+    LANGUAGE plpgsql
+AS $$
+DECLARE
+    sub_ids INT[];
+BEGIN
+    UPDATE incidents
+    SET status = p_status,
+        acknowledged_at = CASE p_status WHEN 'acknowledged' THEN now() WHEN 'open' THEN NULL ELSE acknowledged_at END,
+        acknowledged_by = CASE p_status WHEN 'acknowledged' THEN p_by WHEN 'open' THEN NULL ELSE acknowledged_by END,
+        resolved_at = CASE WHEN p_status = 'resolved' THEN now() END,
+        updated_at = now()
+    WHERE id = p_incident_id AND status <> p_status;
+    IF NOT FOUND THEN
+        IF NOT EXISTS (SELECT 1 FROM incidents WHERE id = p_incident_id) THEN
+            RAISE EXCEPTION 'no incident %', p_incident_id USING ERRCODE = 'no_data_found';
+        END IF;
+        RETURN;
+    END IF;
+
+    SELECT ARRAY(
+       SELECT DISTINCT usa.user_subscription_id
+       FROM alerts a
+                JOIN user_subscription_alerts usa ON usa.alert_id = a.id
+       WHERE a.incident_id = p_incident_id AND usa.usc_is_on AND usa.delivery = 'incidents'
+     ) INTO sub_ids;
+
+    UPDATE user_subscriptions us
+    SET alerts_triggered_at = now()
+    WHERE us.id = ANY(sub_ids);
+
+    IF array_length(sub_ids, 1) > 0 THEN
+        PERFORM pg_notify(
+                'user_subscription_alerts',
+                json_build_object(
+                        'user_subscription_ids', sub_ids
+                )::text
+                );
+    END IF;
+END;
+$$;
+
+-- =============================================================================
+-- Function: shadow_report(shadow_id INT, period_from TIMESTAMPTZ, period_to TIMESTAMPTZ)
+-- -----------------------------------------------------------------------------
+-- Purpose:
+--   Compares a shadow condition with the live condition it shadows over the
+--   given period. Returns one 'live' and one 'shadow' row with:
+--     - threshold          (live threshold vs candidate threshold)
+--     - transitions        (on/off flips, a first evaluation counts only if on)
+--     - turned_on          (flips to on)
+--     - targets            (distinct targets that flipped)
+--     - user_subscriptions (distinct subscriptions that would have been
+--                           pushed: subscribed to the target and listening
+--                           to the live condition)
+--
+-- Example Usage:
+--   SELECT * FROM shadow_report(1, now() - interval '1 day', now());
+--
+-- Notes:
+--   - Live flips are the raw evaluator flips of the live condition while
+--     the shadow was active (see shadow_alert_transitions.live); tier
+--     suppression and per-user overrides are not taken into account.
+--   - Subscribers are resolved through the current `subscription_targets`.
+-- =============================================================================
+CREATE OR REPLACE FUNCTION shadow_report(shadow_id INT, period_from TIMESTAMPTZ, period_to TIMESTAMPTZ)
+    RETURNS TABLE (
+                      source             TEXT,
+                      threshold          DOUBLE PRECISION,
+                      transitions        BIGINT,
+                      turned_on          BIGINT,
+                      targets            BIGINT,
+                      user_subscriptions BIGINT
+                  ) AS $$
+BEGIN
+    RETURN QUERY
+        WITH sc AS (
+            SELECT s.id, s.condition_id, s.threshold AS shadow_threshold, c.threshold AS live_threshold
+            FROM shadow_conditions s
+                     JOIN conditions c ON c.id = s.condition_id
+            WHERE s.id = shadow_id
+        ),
+             flips AS (
+                 SELECT CASE WHEN t.live THEN 'live' ELSE 'shadow' END AS source, t.target_id, t.target_type, t.is_on
+                 FROM shadow_alert_transitions t, sc
+                 WHERE t.shadow_condition_id = sc.id
+                   AND t.recorded_at >= period_from AND t.recorded_at < period_to
+                   AND COALESCE(t.old_is_on, false) IS DISTINCT FROM t.is_on
+             ),
+             totals AS (
+                 SELECT f.source, count(*) AS transitions, count(*) FILTER (WHERE f.is_on) AS turned_on,
+                        count(DISTINCT (f.target_id, f.target_type)) AS targets
+                 FROM flips f
+                 GROUP BY f.source
+             ),
+             reached AS (
+                 SELECT f.source, count(DISTINCT us.id) AS user_subscriptions
+                 FROM (SELECT DISTINCT fl.source, fl.target_id, fl.target_type FROM flips fl) f
+                          JOIN subscription_targets st ON st.target_id = f.target_id AND st.target_type = f.target_type
+                          JOIN user_subscriptions us ON us.subscription_id = st.subscription_id
+                          JOIN user_subscription_conditions usc ON usc.user_subscription_id = us.id AND usc.is_on
+                          JOIN sc ON sc.condition_id = usc.condition_id
+                 GROUP BY f.source
+             )
+        SELECT src.source,
+               CASE WHEN src.source = 'live' THEN sc.live_threshold ELSE sc.shadow_threshold END,
+               COALESCE(t.transitions, 0),
+               COALESCE(t.turned_on, 0),
+               COALESCE(t.targets, 0),
+               COALESCE(r.user_subscriptions, 0)
+        FROM sc
+                 CROSS JOIN (VALUES ('live'), ('shadow')) AS src(source)
+                 LEFT JOIN totals t ON t.source = src.source
+                 LEFT JOIN reached r ON r.source = src.source;
+END;
+$$ LANGUAGE plpgsql;
+
+-- =============
+-- Alert History
+-- =============
+
+-- Every run of process_alert_staging is a batch, see alert_transitions.batch_id
+CREATE SEQUENCE alert_batch_seq;
+
+-- Append-only log of alert state changes written by process_alert_staging:
+-- raw `is_on` flips as reported by evaluators and suppression changes.
+-- Partitioned by day on recorded_at, so old history is dropped a partition at
+-- a time (see maintain_alert_transitions) and the merge only appends to the
+-- current partition. No foreign key to alerts: history outlives its alerts.
+CREATE TABLE alert_transitions (
+                        id BIGSERIAL,
+                        batch_id BIGINT NOT NULL, -- process_alert_staging run that made the change
+                        alert_id INT NOT NULL,
+                        condition_id INT NOT NULL,
+                        target_id INT NOT NULL,
+                        target_type target_type NOT NULL,
+                        old_is_on BOOL NULL, -- NULL when the alert was created by this change
+                        is_on BOOL NOT NULL,
+                        old_suppressed BOOL NOT NULL,
+                        suppressed BOOL NOT NULL,
+                        inhibited_by INT NULL, -- source alert inhibiting this one after the change
+                        value DOUBLE PRECISION NULL,
+                        payload TEXT NOT NULL,
+                        received_at TIMESTAMPTZ NOT NULL,
+                        recorded_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+                        PRIMARY KEY (id, recorded_at)
+) PARTITION BY RANGE (recorded_at);
+-- catches rows when partitions were not created ahead in time
+CREATE TABLE alert_transitions_default PARTITION OF alert_transitions DEFAULT;
+CREATE INDEX idx_alert_transitions_condition ON alert_transitions (condition_id, recorded_at);
+CREATE INDEX idx_alert_transitions_target ON alert_transitions (target_id, target_type, recorded_at);
+CREATE INDEX idx_alert_transitions_alert ON alert_transitions (alert_id, recorded_at);
+
+-- =============================================================================
+-- Procedure: maintain_alert_transitions(days_ahead INT, retention_days INT)
+-- -----------------------------------------------------------------------------
+-- Purpose:
+--   Keeps the daily partitions of `alert_transitions`:
+--     - creates the partitions of today and the next `days_ahead` days, so
+--       process_alert_staging always appends to a small, current partition
+--     - drops partitions older than `retention_days`
+--
+-- Behavior:
+--   - Partitions are named alert_transitions_YYYYMMDD
+--   - Rows that landed in alert_transitions_default (maintenance did not run
+--     in time) are moved into the partition created for their day
+--   - Dropping a partition is instant, unlike deleting old rows
+--
+-- Example Usage:
+--   CALL maintain_alert_transitions();        -- 2 days ahead, keep 30 days
+--   CALL maintain_alert_transitions(7, 90);
+--
+-- Notes:
+--   - Run at least daily; the Go ingestion pipeline runs it hourly.
+-- =============================================================================
+CREATE OR REPLACE PROCEDURE maintain_alert_transitions(days_ahead INT DEFAULT 2, retention_days INT DEFAULT 30)
+    LANGUAGE plpgsql
+AS $$
+DECLARE
+    day DATE;
+    part_name TEXT;
+BEGIN
+    FOR day IN SELECT generate_series(current_date, current_date + days_ahead, interval '1 day')::date LOOP
+        part_name := 'alert_transitions_' || to_char(day, 'YYYYMMDD');
+        CONTINUE WHEN to_regclass(part_name) IS NOT NULL;
+
+        EXECUTE format('CREATE TABLE %I (LIKE alert_transitions INCLUDING DEFAULTS)', part_name);
+        EXECUTE format('WITH moved AS (
+                            DELETE FROM alert_transitions_default
+                            WHERE recorded_at >= %L AND recorded_at < %L
+                            RETURNING *)
+                        INSERT INTO %I SELECT * FROM moved', day, day + 1, part_name);
+        EXECUTE format('ALTER TABLE alert_transitions ATTACH PARTITION %I FOR VALUES FROM (%L) TO (%L)',
+                       part_name, day, day + 1);
+    END LOOP;
+
+    FOR part_name IN
+        SELECT c.relname
+        FROM pg_inherits i
+                 JOIN pg_class c ON c.oid = i.inhrelid
+        WHERE i.inhparent = 'alert_transitions'::regclass
+          AND c.relname ~ '^alert_transitions_[0-9]{8}$'
+          AND to_date(right(c.relname, 8), 'YYYYMMDD') < current_date - retention_days
+    LOOP
+        EXECUTE format('DROP TABLE %I', part_name);
+    END LOOP;
+
+    DELETE FROM alert_transitions_default WHERE recorded_at < current_date - retention_days;
+END;
+$$;
+
+CALL maintain_alert_transitions();
+
+-- =============================================================================
+-- Function: alerts_as_of(p_target_id INT, p_target_type target_type, p_at TIMESTAMPTZ)
+-- -----------------------------------------------------------------------------
+-- Purpose:
+--   Time travel: the state of every alert of a target as it was at `p_at`,
+--   e.g. all alerts at airport X as of yesterday 14:00.
+--
+-- Behavior:
+--   - Returns the last transition of each alert recorded at or before `p_at`
+--   - `p_target_type` NULL matches every type, so an airport's alerts as
+--     source and as destination airport are returned together
+--   - is_on and suppressed are exact; value and payload are those of the
+--     last transition (value changes that did not flip is_on are not logged)
+--   - Alerts whose last transition before `p_at` is older than the retention
+--     of `alert_transitions` are missing
+--
+-- Example Usage:
+--   SELECT * FROM alerts_as_of(3797, NULL, now() - interval '1 day');
+--   SELECT * FROM alerts_as_of(1234, 'flight', '2025-05-01 14:00Z') WHERE is_on;
+-- =============================================================================
+CREATE OR REPLACE FUNCTION alerts_as_of(p_target_id INT, p_target_type target_type, p_at TIMESTAMPTZ)
+    RETURNS TABLE (
+        alert_id INT,
+        condition_id INT,
+        target_id INT,
+        target_type target_type,
+        is_on BOOL,
+        suppressed BOOL,
+        inhibited_by INT,
+        value DOUBLE PRECISION,
+        payload TEXT,
+        received_at TIMESTAMPTZ,
+        changed_at TIMESTAMPTZ,
+        batch_id BIGINT
+    ) AS $$
+    SELECT DISTINCT ON (t.alert_id)
+           t.alert_id, t.condition_id, t.target_id, t.target_type, t.is_on, t.suppressed, t.inhibited_by,
+           t.value, t.payload, t.received_at, t.recorded_at, t.batch_id
+    FROM alert_transitions t
+    WHERE t.target_id = p_target_id
+      AND (p_target_type IS NULL OR t.target_type = p_target_type)
+      AND t.recorded_at <= p_at
+    ORDER BY t.alert_id, t.recorded_at DESC, t.id DESC;
+$$ LANGUAGE sql STABLE;
+
+-- =============================================================================
+-- Function: target_transitions(p_target_id INT, p_target_type target_type,
+--                              p_from TIMESTAMPTZ, p_to TIMESTAMPTZ)
+-- -----------------------------------------------------------------------------
+-- Purpose:
+--   The transitions of a target over a period in the order they were
+--   merged, e.g. everything that happened to flight Y.
+--
+-- Example Usage:
+--   SELECT * FROM target_transitions(1234, 'flight');
+--   SELECT * FROM target_transitions(3797, NULL, now() - interval '6 hours', now());
+-- =============================================================================
+CREATE OR REPLACE FUNCTION target_transitions(p_target_id INT, p_target_type target_type,
+                                              p_from TIMESTAMPTZ DEFAULT '-infinity',
+                                              p_to TIMESTAMPTZ DEFAULT 'infinity')
+    RETURNS SETOF alert_transitions AS $$
+    SELECT *
+    FROM alert_transitions t
+    WHERE t.target_id = p_target_id
+      AND (p_target_type IS NULL OR t.target_type = p_target_type)
+      AND t.recorded_at >= p_from AND t.recorded_at < p_to
+    ORDER BY t.recorded_at, t.id;
+$$ LANGUAGE sql STABLE;
@@ -25,7 +25,28 @@ INSERT INTO condition_templates (name, description, target_type) VALUES
 ('heavy_rain',     'Heavy rain at source airport reducing visibility',       'source_airport'),
 ('thunderstorm',   'Thunderstorm activity near source airport',             'source_airport'),
 ('snowfall',       'Snowfall causing operational delays at source airport', 'source_airport'),
-('crosswind_alert','Crosswind exceeding safe takeoff limits at source airport', 'source_airport');
+('crosswind_alert','Crosswind exceeding safe takeoff limits at source airport', 'source_airport'),
+
+-- Airline (any registered target type, see target_types)
+('crew_shortage',  'Crew shortage across the airline network',             'airline'),
+
+-- Itinerary connection, derived by the pipeline, see connection_risks
+('connection_at_risk', 'Inbound delay eats into the minimum connection time', 'connection');
+
+-- Conditions that fire when the measured value drops under the threshold
+UPDATE condition_templates SET direction = 'below'
+WHERE name IN ('low_altitude', 'low_fuel', 'fog', 'low_visibility');
+
+-- Flight telemetry is reported continuously, an alert without updates for
+-- 5 minutes means its producer is gone
+UPDATE condition_templates SET stale_after = interval '5 minutes'
+WHERE name IN ('low_altitude', 'high_speed', 'low_fuel');
+
+-- Deliver fog again when visibility drops into a worse band, and wind when it
+-- picks up (or eases) by 10 knots, while the alert stays on
+UPDATE condition_templates SET change_bands = '{50, 100, 150}' WHERE name = 'fog';
+UPDATE condition_templates SET change_delta = 10 WHERE name = 'wind';
+UPDATE condition_templates SET change_keys = '{runway}' WHERE name = 'runway_blocked';
 
 -- ==========================
 -- Insert normalized conditions
@@ -54,6 +75,108 @@ FROM (VALUES
           -- flight
           ('low_altitude',  -3000,  3),   -- altitude delta in feet (negative = below expected)
           ('high_speed',     500,   2),   -- knots
-          ('low_fuel',       -20,   3)    -- % below minimum
+          ('low_fuel',       -20,   3),   -- % below minimum
+
+          -- airline
+          ('crew_shortage',    10,   2),   -- % of rostered crew missing
+
+          -- connection
+          ('connection_at_risk', 0,  3)    -- minutes of the minimum connection time lost
      ) AS vals(name, threshold, severity)
-         JOIN condition_templates ct ON ct.name = vals.name;
\ No newline at end of file
+         JOIN condition_templates ct ON ct.name = vals.name;
+
+-- ==========================
+-- Minimum connection times
+-- ==========================
+
+-- Large hubs need longer than the default to change terminals
+INSERT INTO minimum_connection_times (airport_id, minutes)
+SELECT a.id, v.minutes
+FROM (VALUES ('ATL', 55), ('JFK', 75), ('LHR', 90), ('FRA', 45), ('DXB', 75)) AS v(iata, minutes)
+         JOIN airports a ON a.iata = v.iata;
+
+-- ==========================
+-- Tiered conditions
+-- ==========================
+
+-- Gale tier on top of the 30kt wind condition: a 55kt wind delivers only
+-- the 50kt alert, and moving between the two is a tier transition
+INSERT INTO condition_tier_groups (name, description) VALUES
+    ('wind', 'Strong wind and gale at destination airport');
+
+INSERT INTO conditions (template_id, threshold, severity)
+SELECT ct.id, 50, 3
+FROM condition_templates ct
+WHERE ct.name = 'wind';
+
+UPDATE conditions c
+SET tier_group_id = g.id
+FROM condition_templates ct, condition_tier_groups g
+WHERE ct.id = c.template_id AND ct.name = 'wind' AND g.name = 'wind';
+
+-- ==========================
+-- Baseline conditions
+-- ==========================
+
+-- Arrival delay that is unusual for the airport: 2.5 standard deviations
+-- above its rolling baseline, whatever its routine delay is
+INSERT INTO conditions (template_id, threshold, severity, kind)
+SELECT ct.id, 2.5, 2, 'zscore'
+FROM condition_templates ct
+WHERE ct.name = 'arrival_delay';
+
+-- ==========================
+-- Inhibition rules
+-- ==========================
+
+-- A blocked runway explains the arrival delays at the same airport, for the
+-- fixed and the baseline delay conditions alike
+INSERT INTO inhibition_rules (source_condition_id, target_condition_id, scope, description)
+SELECT src.id, tgt.id, 'same_target', 'Arrival delays follow a blocked runway'
+FROM conditions src
+         JOIN condition_templates sct ON sct.id = src.template_id AND sct.name = 'runway_blocked'
+         CROSS JOIN conditions tgt
+         JOIN condition_templates tct ON tct.id = tgt.template_id AND tct.name = 'arrival_delay';
+
+-- Inbound flights holding or going around for the runway fly low
+INSERT INTO inhibition_rules (source_condition_id, target_condition_id, scope, description)
+SELECT src.id, tgt.id, 'inbound_flights', 'Inbound flights hold while the runway is blocked'
+FROM conditions src
+         JOIN condition_templates sct ON sct.id = src.template_id AND sct.name = 'runway_blocked'
+         CROSS JOIN conditions tgt
+         JOIN condition_templates tct ON tct.id = tgt.template_id AND tct.name = 'low_altitude';
+
+-- ==========================
+-- Shadow conditions
+-- ==========================
+
+-- Candidate 25kt threshold for the 30kt wind condition, see `make shadow-report`
+INSERT INTO shadow_conditions (condition_id, threshold, description)
+SELECT c.id, 25, 'Dispatchers asked for 25kt wind alerts'
+FROM conditions c
+         JOIN condition_templates ct ON ct.id = c.template_id
+WHERE ct.name = 'wind' AND c.threshold = 30;
+
+-- ==========================
+-- Condition packs
+-- ==========================
+
+INSERT INTO condition_packs (name, description) VALUES
+('weather', 'Weather at the airports of the flight'),
+('ops',     'Delays, crews and connections'),
+('safety',  'Flight safety and conditions unsafe for takeoff or landing');
+
+-- Every condition of a template, tiers and baselines included, joins its packs
+INSERT INTO condition_pack_members (pack_id, condition_id)
+SELECT p.id, c.id
+FROM (VALUES ('weather', 'fog'), ('weather', 'wind'), ('weather', 'temperature'),
+             ('weather', 'deicing_needed'), ('weather', 'low_visibility'), ('weather', 'strong_headwind'),
+             ('weather', 'heavy_rain'), ('weather', 'thunderstorm'), ('weather', 'snowfall'),
+             ('weather', 'crosswind_alert'),
+             ('ops', 'runway_blocked'), ('ops', 'arrival_delay'), ('ops', 'departure_delay'),
+             ('ops', 'crew_shortage'), ('ops', 'connection_at_risk'),
+             ('safety', 'low_altitude'), ('safety', 'high_speed'), ('safety', 'low_fuel'),
+             ('safety', 'runway_blocked'), ('safety', 'crosswind_alert')) m(pack, template)
+         JOIN condition_packs p ON p.name = m.pack
+         JOIN condition_templates ct ON ct.name = m.template
+         JOIN conditions c ON c.template_id = ct.id;
@@ -0,0 +1,232 @@
+package preview_alerts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/okharch/yal/model"
+	"github.com/okharch/yal/subscription_alerts"
+	"github.com/okharch/yal/target_alerts"
+)
+
+// ErrInvalid is returned for a request that can not be previewed.
+var ErrInvalid = errors.New("invalid preview request")
+
+// ConditionFilter is a condition the previewed subscription would listen to,
+// optionally with the user's own threshold.
+type ConditionFilter struct {
+	ID        int
+	Threshold *float64
+}
+
+// Request describes a subscription that does not exist yet: a declarative
+// spec (like subscriptions.spec), a legacy subscription view or an explicit
+// target set, and the conditions it would enable.
+type Request struct {
+	Spec       *subscription_alerts.Spec
+	ViewName   string
+	Targets    []model.Target
+	Conditions []ConditionFilter
+	From       time.Time
+	To         time.Time
+	Samples    int // number of sample payloads to return
+}
+
+// Burst is a peak of activity starting at At.
+type Burst struct {
+	At    time.Time
+	Count int
+}
+
+// Result is the estimated delivery the subscription would have received.
+type Result struct {
+	From          time.Time
+	To            time.Time
+	Targets       int
+	Notifications int     // pushes, one per merged batch that changed something for the subscription
+	AlertChanges  int     // alert objects delivered across all pushes
+	PerDay        float64 // notifications per day
+	PeakPush      Burst   // most alert changes delivered in a single push
+	PeakHour      Burst   // most notifications within one clock hour
+	ByCondition   map[int]int
+	Samples       []json.RawMessage
+	Caveats       []string // why the estimate may be off, to show with it
+}
+
+// Caveats of a preview.
+const (
+	caveatThresholds = "custom thresholds are only evaluated when the live condition flipped: " +
+		"crossings of a custom threshold in between are missed"
+	caveatTargets = "spec and view targets are resolved against today's flights"
+)
+
+// Preview replays alert_transitions over the requested period through the
+// matching logic of user_subscription_alerts (per-user threshold, suppression)
+// and estimates what the subscription would have been pushed.
+//
+// It is an estimate, see Result.Caveats: history records flips of the live
+// condition, not every measurement, so a custom threshold is only evaluated
+// at those flips, and spec and view targets are resolved against today's
+// flights.
+func Preview(ctx context.Context, db *pgxpool.Pool, req Request) (*Result, error) {
+	if len(req.Conditions) == 0 {
+		return nil, fmt.Errorf("%w: at least one condition is required", ErrInvalid)
+	}
+	if !req.From.Before(req.To) {
+		return nil, fmt.Errorf("%w: empty period %s .. %s", ErrInvalid, req.From, req.To)
+	}
+
+	targets := req.Targets
+	if req.Spec != nil {
+		if err := req.Spec.Validate(ctx, db); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalid, err)
+		}
+		specTargets, err := req.Spec.Resolve(ctx, db)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, specTargets...)
+	}
+	if req.ViewName != "" {
+		viewTargets, err := fetchViewTargets(ctx, db, req.ViewName)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, viewTargets...)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("%w: subscription resolves to no targets", ErrInvalid)
+	}
+
+	targetIDs := make([]int, 0, len(targets))
+	targetTypes := make([]string, 0, len(targets))
+	for _, t := range targets {
+		targetIDs = append(targetIDs, t.ID)
+		targetTypes = append(targetTypes, t.Type)
+	}
+	conditionIDs := make([]int, 0, len(req.Conditions))
+	thresholds := make([]*float64, 0, len(req.Conditions))
+	for _, c := range req.Conditions {
+		conditionIDs = append(conditionIDs, c.ID)
+		thresholds = append(thresholds, c.Threshold)
+	}
+
+	// Changes of the alert as this user would see it: the delivered state is
+	// evaluated exactly like user_subscription_alerts.is_on, and only flips
+	// of that state are pushed
+	rows, err := db.Query(ctx, `
+		WITH targets AS (
+			SELECT DISTINCT t.target_id, t.target_type::target_type AS target_type
+			FROM unnest($1::int[], $2::text[]) AS t(target_id, target_type)
+		),
+		conds AS (
+			SELECT * FROM unnest($3::int[], $4::float8[]) AS c(condition_id, user_threshold)
+		),
+		matched AS (
+			SELECT t.id, t.alert_id, t.condition_id, t.target_id, t.target_type, t.value, t.payload, t.recorded_at,
+			       COALESCE(k.user_threshold, c.threshold) AS threshold,
+			       effective_is_on(t.is_on, ct.direction, t.value, k.user_threshold) AND NOT t.suppressed AS is_on,
+			       t.old_is_on AND NOT t.old_suppressed AS old_is_on
+			FROM alert_transitions t
+			JOIN targets tg ON tg.target_id = t.target_id AND tg.target_type = t.target_type
+			JOIN conds k ON k.condition_id = t.condition_id
+			JOIN conditions c ON c.id = t.condition_id
+			JOIN condition_templates ct ON ct.id = c.template_id
+			WHERE t.recorded_at >= $5 AND t.recorded_at < $6
+		),
+		replayed AS (
+			SELECT m.*,
+			       COALESCE(lag(m.is_on) OVER (PARTITION BY m.alert_id ORDER BY m.recorded_at, m.id), m.old_is_on) AS prev_is_on
+			FROM matched m
+		)
+		SELECT condition_id, recorded_at,
+		       json_build_object(
+		           'alert_id', alert_id,
+		           'condition_id', condition_id,
+		           'target_id', target_id,
+		           'target_type', target_type,
+		           'is_on', is_on,
+		           'value', value,
+		           'threshold', threshold,
+		           'payload', payload,
+		           'updated_at', recorded_at
+		       )::text
+		FROM replayed
+		WHERE prev_is_on IS DISTINCT FROM is_on
+		ORDER BY recorded_at`,
+		targetIDs, targetTypes, conditionIDs, thresholds, req.From, req.To)
+	if err != nil {
+		return nil, fmt.Errorf("failed to replay alert history: %w", err)
+	}
+	defer rows.Close()
+
+	result := &Result{
+		From:        req.From,
+		To:          req.To,
+		Targets:     len(targets),
+		ByCondition: make(map[int]int),
+	}
+	for _, c := range req.Conditions {
+		if c.Threshold != nil {
+			result.Caveats = append(result.Caveats, caveatThresholds)
+			break
+		}
+	}
+	if req.Spec != nil || req.ViewName != "" {
+		result.Caveats = append(result.Caveats, caveatTargets)
+	}
+	pushes := make(map[time.Time]int) // alerts per merged batch (recorded_at is the batch time)
+	hourly := make(map[time.Time]int) // pushes per clock hour
+	for rows.Next() {
+		var conditionID int
+		var recordedAt time.Time
+		var payload string
+		if err := rows.Scan(&conditionID, &recordedAt, &payload); err != nil {
+			return nil, err
+		}
+		result.AlertChanges++
+		result.ByCondition[conditionID]++
+		if pushes[recordedAt] == 0 {
+			hourly[recordedAt.Truncate(time.Hour)]++
+		}
+		pushes[recordedAt]++
+		if len(result.Samples) < req.Samples {
+			result.Samples = append(result.Samples, json.RawMessage(payload))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result.Notifications = len(pushes)
+	result.PerDay = float64(result.Notifications) / req.To.Sub(req.From).Hours() * 24
+	for at, n := range pushes {
+		if n > result.PeakPush.Count || n == result.PeakPush.Count && at.Before(result.PeakPush.At) {
+			result.PeakPush = Burst{At: at, Count: n}
+		}
+	}
+	for at, n := range hourly {
+		if n > result.PeakHour.Count || n == result.PeakHour.Count && at.Before(result.PeakHour.At) {
+			result.PeakHour = Burst{At: at, Count: n}
+		}
+	}
+	return result, nil
+}
+
+// fetchViewTargets resolves a subscription view the same way
+// recreate_subscription_targets does.
+func fetchViewTargets(ctx context.Context, db *pgxpool.Pool, viewName string) ([]model.Target, error) {
+	var exists bool
+	if err := db.QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL`, viewName).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to look up view %s: %w", viewName, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("%w: view %s does not exist", ErrInvalid, viewName)
+	}
+
+	return target_alerts.ViewTargets(ctx, db, viewName)
+}
@@ -2,10 +2,16 @@ package process_alerts
 
 import (
 	"fmt"
+
+	"github.com/okharch/yal/alert_rules"
 )
 
 var ShowDebug bool
 
-func LogPushSubscription(UserSubId int, jsonPayload string) {
-	fmt.Printf("PUSH user_sub %d\npayload=%s\n", UserSubId, jsonPayload) // ,
+// SubscriptionRules, when set, are applied to alerts before they are pushed,
+// see user_subscription_conditions.rule
+var SubscriptionRules *alert_rules.SubscriptionRules
+
+func LogPush(p Push) {
+	fmt.Printf("PUSH user_sub %d #%d %s\npayload=%s\n", p.UserSubscriptionID, p.ID, p.Event, p.Payload)
 }
@@ -0,0 +1,144 @@
+package process_alerts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Push events, see push_event.
+const (
+	EventAlerts            = "alerts"
+	EventSnapshot          = "snapshot"
+	EventConditionEnabled  = "condition_enabled"
+	EventConditionDisabled = "condition_disabled"
+)
+
+// ReplayWindow is how long pushes are kept for PushesSince. A client that
+// was away longer can not catch up and must Resync.
+var ReplayWindow = 24 * time.Hour
+
+// ErrResyncNeeded is returned by PushesSince when the pushes it would replay
+// are older than ReplayWindow and were pruned.
+var ErrResyncNeeded = errors.New("pushes were pruned, resync")
+
+// Push is one message to a user subscription, recorded in pushes. The
+// client applies pushes in ID order; a gap means it missed one and should
+// replay them with PushesSince (or ask for a snapshot with Resync).
+type Push struct {
+	ID                 int64           `json:"push_id"`
+	Event              string          `json:"event"`
+	UserSubscriptionID int             `json:"user_subscription_id"`
+	ConditionID        *int            `json:"condition_id,omitempty"`
+	Payload            json.RawMessage `json:"payload"` // alerts, or incidents for delivery = 'incidents'
+	PushedAt           time.Time       `json:"pushed_at"`
+}
+
+// Deliver hands a recorded push to the user's transport. The default only
+// prints it with ShowDebug; a real transport (websocket, mobile push, ...)
+// replaces it.
+var Deliver = func(ctx context.Context, p Push) error {
+	if ShowDebug {
+		LogPush(p)
+	}
+	return nil
+}
+
+// deliver is the single delivery pipeline of every push: it applies the
+// user's rules, records the push and hands it to Deliver. Regular pushes
+// left with nothing to say are dropped.
+func deliver(ctx context.Context, db *pgxpool.Pool, p Push) error {
+	payload := string(p.Payload)
+	if SubscriptionRules != nil {
+		var err error
+		if payload, err = SubscriptionRules.Apply(payload); err != nil {
+			return err
+		}
+	}
+	if p.Event == EventAlerts && payload == "[]" {
+		return nil
+	}
+	p.Payload = json.RawMessage(payload)
+
+	err := db.QueryRow(ctx, `
+		INSERT INTO pushes (user_subscription_id, event, condition_id, payload)
+		VALUES ($1, $2, $3, $4::jsonb)
+		RETURNING id, pushed_at`, p.UserSubscriptionID, p.Event, p.ConditionID, payload).Scan(&p.ID, &p.PushedAt)
+	if err != nil {
+		return fmt.Errorf("failed to record push to user subscription %d: %w", p.UserSubscriptionID, err)
+	}
+	if err := Deliver(ctx, p); err != nil {
+		if _, uerr := db.Exec(ctx, `UPDATE pushes SET error = $2 WHERE id = $1`, p.ID, err.Error()); uerr != nil {
+			log.Printf("failed to record delivery error of push %d: %v", p.ID, uerr)
+		}
+		return fmt.Errorf("failed to deliver push %d: %w", p.ID, err)
+	}
+	return nil
+}
+
+// PushesSince returns up to limit pushes of a user subscription after push
+// afterID, oldest first, for a client to catch up on the ones it missed.
+// It returns ErrResyncNeeded when push afterID itself was pruned.
+func PushesSince(ctx context.Context, db *pgxpool.Pool, userSubscriptionID int, afterID int64, limit int) ([]Push, error) {
+	if afterID > 0 {
+		var kept bool
+		err := db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM pushes WHERE id = $1 AND user_subscription_id = $2)`,
+			afterID, userSubscriptionID).Scan(&kept)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pushes of user subscription %d: %w", userSubscriptionID, err)
+		}
+		if !kept {
+			return nil, ErrResyncNeeded
+		}
+	}
+	rows, err := db.Query(ctx, `
+		SELECT id, event, user_subscription_id, condition_id, payload, pushed_at
+		FROM pushes
+		WHERE user_subscription_id = $1 AND id > $2
+		ORDER BY id
+		LIMIT $3`, userSubscriptionID, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pushes of user subscription %d: %w", userSubscriptionID, err)
+	}
+	defer rows.Close()
+	var pushes []Push
+	for rows.Next() {
+		var p Push
+		var payload []byte
+		if err := rows.Scan(&p.ID, &p.Event, &p.UserSubscriptionID, &p.ConditionID, &payload, &p.PushedAt); err != nil {
+			return nil, err
+		}
+		p.Payload = payload
+		pushes = append(pushes, p)
+	}
+	return pushes, rows.Err()
+}
+
+// Resync pushes a snapshot of the user subscription, for a client whose
+// state can no longer be reconciled from PushesSince.
+func Resync(ctx context.Context, db *pgxpool.Pool, userSubscriptionID int) error {
+	return pushSnapshot(ctx, db, userSubscriptionID)
+}
+
+// PrunePushes deletes the pushes older than ReplayWindow every hour until
+// ctx is done.
+func PrunePushes(ctx context.Context, db *pgxpool.Pool) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if _, err := db.Exec(ctx, `DELETE FROM pushes WHERE pushed_at < now() - make_interval(secs => $1)`,
+			ReplayWindow.Seconds()); err != nil {
+			log.Printf("failed to prune pushes: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -14,6 +14,7 @@ type ConditionChangePayload struct {
 	Id                 int  `json:"id"`
 	IsOn               bool `json:"is_on"`
 	UserSubscriptionId int  `json:"user_subscription_id"`
+	ConditionId        int  `json:"condition_id"`
 }
 
 // ListenForConditionChanges listens on PostgreSQL pub/sub channel
@@ -58,46 +59,38 @@ func ListenForConditionChanges(ctx context.Context, dbConnStr string, db *pgxpoo
 			handleConditionChange(ctx, db, payload)
 		}
 	}
-
-	return nil
 }
 
-// handleConditionChange fetches alerts from the view and sends them directly as raw JSON.
+// handleConditionChange pushes the alerts of the toggled condition (and
+// any pending changes) as a condition_enabled or condition_disabled event,
+// see get_condition_change_json.
 func handleConditionChange(ctx context.Context, db *pgxpool.Pool, payload ConditionChangePayload) {
-
-	var alertsJSON []byte
-	query := `
-			SELECT json_agg(json_build_object(
-				'alert_id', alert_id,
-				'condition_id', condition_id,
-				'target_id', target_id,
-				'target_type', target_type,
-				'payload', payload,
-				'updated_at', updated_at,
-				'is_on', %s
-			))
-			FROM user_subscription_alerts
-			WHERE user_subscription_condition_id = $1 AND is_on = true`
-
-	if payload.IsOn {
-		// Normal: show active alerts as-is
-		query = fmt.Sprintf(query, "true")
-	} else {
-		// Inverted: send is_on=false for active alerts as this condition is now inactive
-		query = fmt.Sprintf(query, "false")
-	}
-
-	err := db.QueryRow(ctx, query, payload.Id).Scan(&alertsJSON)
-	if err != nil {
-		log.Printf("failed to fetch alerts for user_subscription_id=%d: %v", payload.Id, err)
+	var alertsJSON *string
+	if err := db.QueryRow(ctx, `SELECT get_condition_change_json($1)`, payload.Id).Scan(&alertsJSON); err != nil {
+		log.Printf("failed to fetch alerts for user_subscription_condition_id=%d: %v", payload.Id, err)
 		return
 	}
-
 	if alertsJSON == nil {
-		log.Printf("No alerts to push for user_subscription_id=%d (is_on=%v)", payload.Id, payload.IsOn)
+		// the condition was deleted since
 		return
 	}
-	if ShowDebug {
-		LogPushSubscription(payload.UserSubscriptionId, string(alertsJSON))
+
+	if SubscriptionRules != nil {
+		if err := SubscriptionRules.Refresh(ctx, db); err != nil {
+			log.Printf("failed to refresh subscription rules: %v", err)
+		}
+	}
+	event := EventConditionDisabled
+	if payload.IsOn {
+		event = EventConditionEnabled
+	}
+	push := Push{
+		Event:              event,
+		UserSubscriptionID: payload.UserSubscriptionId,
+		ConditionID:        &payload.ConditionId,
+		Payload:            json.RawMessage(*alertsJSON),
+	}
+	if err := deliver(ctx, db, push); err != nil {
+		log.Printf("failed to push condition change to subscription %d: %v", payload.UserSubscriptionId, err)
 	}
 }
@@ -0,0 +1,115 @@
+package process_alerts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ListenForSnapshots listens on 'user_subscription_snapshots' and pushes new
+// subscribers every alert that is already on, and subscribers that added a
+// condition the alerts of that condition, see
+// trg_snapshot_user_subscriptions. Later changes arrive through
+// ListenForSubscriptionUpdates as usual.
+func ListenForSnapshots(ctx context.Context, dbConnStr string, db *pgxpool.Pool) error {
+	conn, err := pgx.Connect(ctx, dbConnStr)
+	if err != nil {
+		return fmt.Errorf("failed to connect for LISTEN: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	_, err = conn.Exec(ctx, "LISTEN user_subscription_snapshots")
+	if err != nil {
+		return fmt.Errorf("failed to LISTEN on user_subscription_snapshots: %w", err)
+	}
+
+	log.Println("Listening for user_subscription_snapshots notifications...")
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Println("Stopping snapshot listener...")
+				return nil
+			}
+			log.Printf("error receiving notification: %v", err)
+			continue
+		}
+
+		var payload snapshotPayload
+		if err := json.Unmarshal([]byte(notification.Payload), &payload); err != nil {
+			log.Printf("failed to parse payload(%s): %v", notification.Payload, err)
+			continue
+		}
+		pushSnapshots(ctx, db, payload.UserSubscriptionIDs)
+		pushNewConditions(ctx, db, payload.UserSubscriptionConditionIDs)
+	}
+}
+
+// snapshotPayload names either new user subscriptions or new conditions of
+// existing ones.
+type snapshotPayload struct {
+	NotificationPayload
+	UserSubscriptionConditionIDs []int `json:"user_subscription_condition_ids"`
+}
+
+// pushNewConditions pushes the alerts of each condition added to a user
+// subscription as a condition_enabled event, like turning it on.
+func pushNewConditions(ctx context.Context, db *pgxpool.Pool, ids []int) {
+	if len(ids) == 0 {
+		return
+	}
+	rows, err := db.Query(ctx, `
+		SELECT id, user_subscription_id, condition_id
+		FROM user_subscription_conditions
+		WHERE id = ANY($1) AND is_on`, ids)
+	if err != nil {
+		log.Printf("failed to load new subscription conditions: %v", err)
+		return
+	}
+	changes, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (ConditionChangePayload, error) {
+		c := ConditionChangePayload{IsOn: true}
+		err := row.Scan(&c.Id, &c.UserSubscriptionId, &c.ConditionId)
+		return c, err
+	})
+	if err != nil {
+		log.Printf("failed to load new subscription conditions: %v", err)
+		return
+	}
+	for _, c := range changes {
+		handleConditionChange(ctx, db, c)
+	}
+}
+
+// pushSnapshots pushes the snapshot of every subscription.
+func pushSnapshots(ctx context.Context, db *pgxpool.Pool, subscriptionIDs []int) {
+	if SubscriptionRules != nil {
+		if err := SubscriptionRules.Refresh(ctx, db); err != nil {
+			log.Printf("failed to refresh subscription rules: %v", err)
+		}
+	}
+	var wg sync.WaitGroup
+	for _, id := range subscriptionIDs {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			if err := pushSnapshot(ctx, db, id); err != nil {
+				log.Printf("failed to push snapshot to subscription %d: %v", id, err)
+			}
+		}(id)
+	}
+	wg.Wait()
+}
+
+func pushSnapshot(ctx context.Context, db *pgxpool.Pool, id int) error {
+	var snapshot string
+	if err := db.QueryRow(ctx, `SELECT get_alerts_json($1, snapshot => true)`, id).Scan(&snapshot); err != nil {
+		return err
+	}
+	return deliver(ctx, db, Push{Event: EventSnapshot, UserSubscriptionID: id, Payload: json.RawMessage(snapshot)})
+}
@@ -0,0 +1,153 @@
+package process_alerts
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/okharch/yal/testdb"
+)
+
+// A new user subscription is pushed the alerts that are already on, once for
+// it and its conditions, and a condition added to it later pushes only that
+// condition's alerts. The inserts commit, as the triggers notify on commit;
+// the user and its subscription are deleted when the test ends.
+func TestSnapshotPushes(t *testing.T) {
+	db := testdb.Connect(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// a subscription with alerts of two conditions on
+	var subscriptionID, first, second int
+	err := db.QueryRow(ctx, `
+		SELECT st.subscription_id, min(a.condition_id), max(a.condition_id)
+		FROM alerts a
+		JOIN subscription_targets st ON st.target_id = a.target_id AND st.target_type = a.target_type
+		WHERE a.is_on AND NOT a.suppressed
+		GROUP BY st.subscription_id
+		HAVING count(DISTINCT a.condition_id) > 1
+		ORDER BY st.subscription_id LIMIT 1`).Scan(&subscriptionID, &first, &second)
+	if err != nil {
+		t.Skipf("no subscription with alerts of two conditions on: %v", err)
+	}
+
+	conn, err := pgx.Connect(ctx, testdb.ConnStr(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(context.Background())
+	if _, err := conn.Exec(ctx, "LISTEN user_subscription_snapshots"); err != nil {
+		t.Fatal(err)
+	}
+	next := func() snapshotPayload {
+		t.Helper()
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			t.Fatalf("no snapshot notification: %v", err)
+		}
+		var payload snapshotPayload
+		if err := json.Unmarshal([]byte(notification.Payload), &payload); err != nil {
+			t.Fatal(err)
+		}
+		return payload
+	}
+
+	var mu sync.Mutex
+	var pushes []Push
+	deliverBefore := Deliver
+	t.Cleanup(func() { Deliver = deliverBefore })
+	Deliver = func(ctx context.Context, p Push) error {
+		mu.Lock()
+		defer mu.Unlock()
+		pushes = append(pushes, p)
+		return nil
+	}
+	pushed := func(event string, conditionID int) {
+		t.Helper()
+		if len(pushes) != 1 || pushes[0].Event != event {
+			t.Fatalf("got pushes %+v, want one %s push", pushes, event)
+		}
+		if event == EventConditionEnabled && (pushes[0].ConditionID == nil || *pushes[0].ConditionID != conditionID) {
+			t.Errorf("%s push names condition %v, want %d", event, pushes[0].ConditionID, conditionID)
+		}
+		var alerts []struct {
+			ConditionID int  `json:"condition_id"`
+			IsOn        bool `json:"is_on"`
+		}
+		if err := json.Unmarshal(pushes[0].Payload, &alerts); err != nil {
+			t.Fatal(err)
+		}
+		on := 0
+		for _, a := range alerts {
+			if a.ConditionID != conditionID {
+				t.Errorf("%s push carries an alert of condition %d, want only %d", event, a.ConditionID, conditionID)
+			}
+			if a.IsOn {
+				on++
+			}
+		}
+		if on == 0 {
+			t.Errorf("%s push %s has no alert of condition %d on", event, pushes[0].Payload, conditionID)
+		}
+		pushes = nil
+	}
+
+	var userID, userSubscriptionID int
+	if err := db.QueryRow(ctx, `INSERT INTO users (name) VALUES ('snapshot test') RETURNING id`).Scan(&userID); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx := context.Background()
+		for _, q := range []string{
+			`DELETE FROM user_subscription_conditions WHERE user_subscription_id IN
+				(SELECT id FROM user_subscriptions WHERE user_id = $1)`,
+			`DELETE FROM user_subscriptions WHERE user_id = $1`,
+			`DELETE FROM users WHERE id = $1`,
+		} {
+			if _, err := db.Exec(ctx, q, userID); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	err = pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		if err := tx.QueryRow(ctx, `
+			INSERT INTO user_subscriptions (user_id, subscription_id) VALUES ($1, $2) RETURNING id`,
+			userID, subscriptionID).Scan(&userSubscriptionID); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `
+			INSERT INTO user_subscription_conditions (user_subscription_id, condition_id, is_on) VALUES ($1, $2, true)`,
+			userSubscriptionID, first)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// its condition is left to the snapshot, the next notification is the
+	// condition added below
+	payload := next()
+	if !slices.Equal(payload.UserSubscriptionIDs, []int{userSubscriptionID}) || len(payload.UserSubscriptionConditionIDs) > 0 {
+		t.Fatalf("got notification %+v, want user subscription %d", payload, userSubscriptionID)
+	}
+	pushSnapshots(ctx, db, payload.UserSubscriptionIDs)
+	pushed(EventSnapshot, first)
+
+	var conditionID int
+	err = db.QueryRow(ctx, `
+		INSERT INTO user_subscription_conditions (user_subscription_id, condition_id, is_on) VALUES ($1, $2, true)
+		RETURNING id`, userSubscriptionID, second).Scan(&conditionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload = next()
+	if !slices.Equal(payload.UserSubscriptionConditionIDs, []int{conditionID}) || len(payload.UserSubscriptionIDs) > 0 {
+		t.Fatalf("got notification %+v, want user subscription condition %d", payload, conditionID)
+	}
+	pushNewConditions(ctx, db, payload.UserSubscriptionConditionIDs)
+	pushed(EventConditionEnabled, second)
+}
@@ -116,17 +116,22 @@ func ListenForSubscriptionUpdates(ctx context.Context, dbConnStr string, db *pgx
 		lastFlush = time.Now()
 		go func() {
 			started := time.Now()
+			if SubscriptionRules != nil {
+				if err := SubscriptionRules.Refresh(ctx, db); err != nil {
+					log.Printf("failed to refresh subscription rules: %v", err)
+				}
+			}
 			var wg sync.WaitGroup
 			for _, id := range subscriptionIDs {
 				wg.Add(1)
 				go func(id int) {
 					defer wg.Done()
-					json, err := fetchAlertsJSON(ctx, db, id)
-					if ShowDebug {
-						LogPushSubscription(id, json)
+					alerts, err := fetchAlertsJSON(ctx, db, id)
+					if err == nil {
+						err = deliver(ctx, db, Push{Event: EventAlerts, UserSubscriptionID: id, Payload: json.RawMessage(alerts)})
 					}
 					if err != nil {
-						log.Printf("failed to fetch alerts JSON for subscription %d: %v", id, err)
+						log.Printf("failed to push alerts to subscription %d: %v", id, err)
 						return
 					}
 				}(id)
@@ -0,0 +1,59 @@
+package subscription_alerts
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/okharch/yal/model"
+)
+
+// Entered and Left are the values of subscription_target_event.
+const (
+	Entered = "entered"
+	Left    = "left"
+)
+
+// TargetEvent is a target entering or leaving a subscription, see
+// subscription_target_events.
+type TargetEvent struct {
+	ID             int64
+	SubscriptionID int
+	Target         model.Target
+	Event          string // Entered or Left
+	RecordedAt     time.Time
+}
+
+// LastTargetEventID returns the id of the latest target event, 0 if none,
+// to read only the events that follow.
+func LastTargetEventID(ctx context.Context, db *pgxpool.Pool) (int64, error) {
+	var id int64
+	if err := db.QueryRow(ctx, `SELECT COALESCE(max(id), 0) FROM subscription_target_events`).Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to read target events: %w", err)
+	}
+	return id, nil
+}
+
+// TargetEvents returns up to limit target events after afterID, oldest first.
+func TargetEvents(ctx context.Context, db *pgxpool.Pool, afterID int64, limit int) ([]TargetEvent, error) {
+	rows, err := db.Query(ctx, `
+		SELECT id, subscription_id, target_id, target_type, event, recorded_at
+		FROM subscription_target_events
+		WHERE id > $1
+		ORDER BY id
+		LIMIT $2`, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read target events: %w", err)
+	}
+	defer rows.Close()
+	var events []TargetEvent
+	for rows.Next() {
+		var e TargetEvent
+		if err := rows.Scan(&e.ID, &e.SubscriptionID, &e.Target.ID, &e.Target.Type, &e.Event, &e.RecordedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,198 @@
+package subscription_alerts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DefaultFlightExpiry is how long after its arrival_time a traveller's flight
+// subscription is kept when no expiry is given.
+var DefaultFlightExpiry = 6 * time.Hour
+
+// ErrNoFlight is returned when no upcoming flight has the flight number.
+var ErrNoFlight = errors.New("no such flight")
+
+// ErrFollowing is returned with the existing subscription when the user
+// already follows the flight.
+var ErrFollowing = errors.New("already following the flight")
+
+// FlightSubscription is a traveller following one flight: a subscription
+// pinned to the flight (subscriptions.flight_id) that resolves to the flight
+// and both of its airports, with the user subscribed to every condition. It
+// is deleted ExpiresAfter the flight's arrival, see expire_flight_subscriptions.
+type FlightSubscription struct {
+	ID                 int // subscriptions.id
+	UserSubscriptionID int
+	UserID             int
+	FlightID           int
+	FlightNumber       string
+	DepartureTime      time.Time
+	ArrivalTime        time.Time
+	ExpiresAfter       time.Duration
+}
+
+// ExpiresAt is when the subscription is deleted, moving with the arrival time.
+func (f FlightSubscription) ExpiresAt() time.Time {
+	return f.ArrivalTime.Add(f.ExpiresAfter)
+}
+
+// SubscribeToFlight subscribes a user to the flight with flightNumber that
+// departs on the day of departsOn (UTC), or to its next flight that has not
+// arrived yet when departsOn is zero. expiresAfter <= 0 means
+// DefaultFlightExpiry. Targets are resolved and the user is pushed a snapshot
+// of the alerts already on. A user follows a flight once: following it again
+// returns the existing subscription with ErrFollowing.
+func SubscribeToFlight(ctx context.Context, db *pgxpool.Pool, userID int, flightNumber string, departsOn time.Time,
+	expiresAfter time.Duration) (FlightSubscription, error) {
+	if expiresAfter <= 0 {
+		expiresAfter = DefaultFlightExpiry
+	}
+	fs := FlightSubscription{UserID: userID, FlightNumber: strings.TrimSpace(flightNumber), ExpiresAfter: expiresAfter}
+	if fs.FlightNumber == "" {
+		return fs, errors.New("flight number is required")
+	}
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return fs, err
+	}
+	defer tx.Rollback(ctx)
+	f, err := findFlight(ctx, tx, fs.FlightNumber, departsOn, time.Time{})
+	if err != nil {
+		return fs, err
+	}
+	fs.FlightID, fs.DepartureTime, fs.ArrivalTime = f.id, f.departureTime, f.arrivalTime
+	// serializes the user's follows, so the same flight is not followed twice
+	if _, err := tx.Exec(ctx, `SELECT FROM users WHERE id = $1 FOR NO KEY UPDATE`, userID); err != nil {
+		return fs, fmt.Errorf("failed to lock user %d: %w", userID, err)
+	}
+	var secs float64
+	err = tx.QueryRow(ctx, `
+		SELECT s.id, us.id, EXTRACT(EPOCH FROM s.expires_after)::float8
+		FROM subscriptions s JOIN user_subscriptions us ON us.subscription_id = s.id
+		WHERE us.user_id = $1 AND s.flight_id = $2`, userID, fs.FlightID).Scan(&fs.ID, &fs.UserSubscriptionID, &secs)
+	if err == nil {
+		fs.ExpiresAfter = time.Duration(secs * float64(time.Second))
+		return fs, ErrFollowing
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return fs, fmt.Errorf("failed to look up the user's subscription to flight %d: %w", fs.FlightID, err)
+	}
+	name := fmt.Sprintf("%s %s", fs.FlightNumber, fs.DepartureTime.UTC().Format(time.DateOnly))
+	fs.ID, fs.UserSubscriptionID, err = subscribeTraveller(ctx, tx, userID, name, insertFlightSubscription, fs.FlightID, expiresAfter)
+	if err != nil {
+		return fs, err
+	}
+	return fs, tx.Commit(ctx)
+}
+
+// Inserts of a subscription pinned to a flight or an itinerary, see
+// subscribeTraveller.
+const (
+	insertFlightSubscription = `
+		INSERT INTO subscriptions (name, flight_id, expires_after) VALUES ($1, $2, make_interval(secs => $3))
+		RETURNING id`
+	insertItinerarySubscription = `
+		INSERT INTO subscriptions (name, itinerary_id, expires_after) VALUES ($1, $2, make_interval(secs => $3))
+		RETURNING id`
+)
+
+// subscribeTraveller creates a subscription pinned to pinID with insert
+// (insertFlightSubscription or insertItinerarySubscription), resolves its
+// targets and subscribes the user to every condition, which pushes a snapshot.
+func subscribeTraveller(ctx context.Context, tx pgx.Tx, userID int, name, insert string, pinID int,
+	expiresAfter time.Duration) (id, userSubscriptionID int, err error) {
+	err = tx.QueryRow(ctx, insert, name, pinID, expiresAfter.Seconds()).Scan(&id)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create subscription %q: %w", name, err)
+	}
+	if err := syncTargets(ctx, tx, id); err != nil {
+		return 0, 0, err
+	}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO user_subscriptions (user_id, subscription_id) VALUES ($1, $2)
+		RETURNING id`, userID, id).Scan(&userSubscriptionID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to subscribe user %d: %w", userID, err)
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO user_subscription_conditions (user_subscription_id, condition_id, is_on, last_changed_at)
+		SELECT $1, id, true, now() FROM conditions`, userSubscriptionID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to subscribe user %d to conditions: %w", userID, err)
+	}
+	return id, userSubscriptionID, nil
+}
+
+// FlightSubscriptions returns the flight subscriptions of a user by departure.
+func FlightSubscriptions(ctx context.Context, db *pgxpool.Pool, userID int) ([]FlightSubscription, error) {
+	rows, err := db.Query(ctx, `
+		SELECT s.id, us.id, us.user_id, f.id, f.flight_number, f.departure_time, f.arrival_time,
+		       EXTRACT(EPOCH FROM s.expires_after)::float8
+		FROM subscriptions s
+		         JOIN user_subscriptions us ON us.subscription_id = s.id
+		         JOIN flights f ON f.id = s.flight_id
+		WHERE us.user_id = $1
+		ORDER BY f.departure_time, s.id`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load flight subscriptions: %w", err)
+	}
+	defer rows.Close()
+	var subs []FlightSubscription
+	for rows.Next() {
+		var fs FlightSubscription
+		var secs float64
+		if err := rows.Scan(&fs.ID, &fs.UserSubscriptionID, &fs.UserID, &fs.FlightID, &fs.FlightNumber,
+			&fs.DepartureTime, &fs.ArrivalTime, &secs); err != nil {
+			return nil, err
+		}
+		fs.ExpiresAfter = time.Duration(secs * float64(time.Second))
+		subs = append(subs, fs)
+	}
+	return subs, rows.Err()
+}
+
+type flight struct {
+	id                   int
+	number               string
+	sourceAirportID      int
+	destinationAirportID int
+	departureTime        time.Time
+	arrivalTime          time.Time
+}
+
+// findFlight finds the flight with number that departs on the day of
+// departsOn (UTC); when departsOn is zero, its first flight departing after
+// notBefore, or its next flight that has not arrived yet.
+func findFlight(ctx context.Context, tx pgx.Tx, number string, departsOn, notBefore time.Time) (flight, error) {
+	f := flight{number: number}
+	var from, to *time.Time
+	switch {
+	case !departsOn.IsZero():
+		day := departsOn.UTC().Truncate(24 * time.Hour)
+		next := day.Add(24 * time.Hour)
+		from, to = &day, &next
+	case !notBefore.IsZero():
+		from = &notBefore
+	}
+	err := tx.QueryRow(ctx, `
+		SELECT id, source_airport_id, destination_airport_id, departure_time, arrival_time FROM flights
+		WHERE flight_number = $1
+		  AND CASE WHEN $2::timestamptz IS NULL THEN arrival_time > now()
+		           ELSE departure_time >= $2 AND ($3::timestamptz IS NULL OR departure_time < $3) END
+		ORDER BY departure_time
+		LIMIT 1`, number, from, to).Scan(&f.id, &f.sourceAirportID, &f.destinationAirportID,
+		&f.departureTime, &f.arrivalTime)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return f, fmt.Errorf("%w %s", ErrNoFlight, number)
+	}
+	if err != nil {
+		return f, fmt.Errorf("failed to find flight %s: %w", number, err)
+	}
+	return f, nil
+}
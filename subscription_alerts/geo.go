@@ -0,0 +1,133 @@
+package subscription_alerts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// earthRadiusKm is the mean earth radius, as in great_circle_km.
+const earthRadiusKm = 6371.0088
+
+// Point is a position in degrees.
+type Point struct {
+	Lat float64
+	Lon float64
+}
+
+// GreatCircleKm is the haversine distance between two points in km, the same
+// formula as great_circle_km so Go and SQL agree on what is inside a radius.
+func GreatCircleKm(a, b Point) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (b.Lon - a.Lon) * math.Pi / 180
+	h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dLon/2), 2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// Area is a geo-fence of a spec: a radius around Lat/Lon, or a polygon of
+// [lat, lon] vertices. End limits it to where flights depart ("source") or
+// arrive ("destination"); by default either end counts.
+type Area struct {
+	Lat      float64     `json:"lat" yaml:"lat"`
+	Lon      float64     `json:"lon" yaml:"lon"`
+	RadiusKm float64     `json:"radius_km,omitempty" yaml:"radius_km,omitempty"`
+	Polygon  [][]float64 `json:"polygon,omitempty" yaml:"polygon,omitempty"`
+	End      string      `json:"end,omitempty" yaml:"end,omitempty"`
+}
+
+// Check validates the area without the database.
+func (a Area) Check() error {
+	switch a.End {
+	case "", "either", "source", "destination":
+	default:
+		return fmt.Errorf("end must be source, destination or either, not %q", a.End)
+	}
+	if len(a.Polygon) > 0 {
+		if a.RadiusKm != 0 {
+			return errors.New("set either radius_km or polygon")
+		}
+		if len(a.Polygon) < 3 {
+			return errors.New("polygon needs at least 3 vertices")
+		}
+		for _, v := range a.Polygon {
+			if len(v) != 2 || !validPoint(Point{Lat: v[0], Lon: v[1]}) {
+				return fmt.Errorf("polygon vertex %v is not [lat, lon]", v)
+			}
+		}
+		return nil
+	}
+	if a.RadiusKm <= 0 {
+		return errors.New("radius_km must be positive")
+	}
+	if !validPoint(Point{Lat: a.Lat, Lon: a.Lon}) {
+		return fmt.Errorf("%v, %v is not a position", a.Lat, a.Lon)
+	}
+	return nil
+}
+
+func validPoint(p Point) bool {
+	return p.Lat >= -90 && p.Lat <= 90 && p.Lon >= -180 && p.Lon <= 180
+}
+
+// Contains reports whether p is inside the area, like in_area. Polygons use
+// ray casting on degrees, so they must not cross the antimeridian.
+func (a Area) Contains(p Point) bool {
+	if len(a.Polygon) == 0 {
+		return GreatCircleKm(Point{Lat: a.Lat, Lon: a.Lon}, p) <= a.RadiusKm
+	}
+	inside := false
+	for i, j := 0, len(a.Polygon)-1; i < len(a.Polygon); j, i = i, i+1 {
+		vi, vj := a.Polygon[i], a.Polygon[j]
+		if (vi[0] > p.Lat) != (vj[0] > p.Lat) &&
+			p.Lon < (vj[1]-vi[1])*(p.Lat-vi[0])/(vj[0]-vi[0])+vi[1] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// Airport is an airport with known coordinates.
+type Airport struct {
+	ID   int
+	Code string // IATA, or ICAO when there is none
+	Name string
+	Point
+}
+
+// AirportsWithin returns the airports inside any of the areas.
+func AirportsWithin(ctx context.Context, db *pgxpool.Pool, areas []Area) ([]Airport, error) {
+	var within []Airport
+	err := scanAirports(ctx, db, func(a Airport) {
+		for _, area := range areas {
+			if area.Contains(a.Point) {
+				within = append(within, a)
+				return
+			}
+		}
+	})
+	return within, err
+}
+
+// scanAirports calls fn with every airport that has coordinates.
+func scanAirports(ctx context.Context, db *pgxpool.Pool, fn func(Airport)) error {
+	rows, err := db.Query(ctx, `
+		SELECT id, COALESCE(NULLIF(iata, ''), icao, ''), COALESCE(name, ''), latitude, longitude
+		FROM airports
+		WHERE latitude IS NOT NULL AND longitude IS NOT NULL`)
+	if err != nil {
+		return fmt.Errorf("failed to load airports: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a Airport
+		if err := rows.Scan(&a.ID, &a.Code, &a.Name, &a.Lat, &a.Lon); err != nil {
+			return err
+		}
+		fn(a)
+	}
+	return rows.Err()
+}
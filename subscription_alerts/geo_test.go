@@ -0,0 +1,140 @@
+package subscription_alerts
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/okharch/yal/testdb"
+)
+
+var (
+	jfk = Point{Lat: 40.6398, Lon: -73.7789}
+	lga = Point{Lat: 40.7769, Lon: -73.8740}
+	lax = Point{Lat: 33.9425, Lon: -118.408}
+	lhr = Point{Lat: 51.4706, Lon: -0.461941}
+)
+
+// manhattan is a square around JFK and LaGuardia, notch a concave polygon
+// whose notch cuts LaGuardia out.
+var (
+	manhattan = Area{Polygon: [][]float64{{40.5, -74.1}, {40.9, -74.1}, {40.9, -73.6}, {40.5, -73.6}}}
+	notch     = Area{Polygon: [][]float64{{40.5, -74.1}, {40.9, -74.1}, {40.7, -73.85}, {40.9, -73.6}, {40.5, -73.6}}}
+)
+
+func TestGreatCircleKm(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Point
+		want float64
+	}{
+		{"same point", jfk, jfk, 0},
+		{"JFK-LGA", jfk, lga, 17.22},
+		{"JFK-LAX", jfk, lax, 3974.20},
+		{"LHR-JFK", lhr, jfk, 5539.65},
+		{"antipodes", Point{}, Point{Lon: 180}, math.Pi * earthRadiusKm},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := GreatCircleKm(tt.a, tt.b)
+			if math.Abs(got-tt.want) > 0.01 {
+				t.Errorf("got %.2f km, want %.2f", got, tt.want)
+			}
+			if back := GreatCircleKm(tt.b, tt.a); math.Abs(back-got) > 1e-9 {
+				t.Errorf("not symmetric: %v and %v", got, back)
+			}
+		})
+	}
+}
+
+func TestAreaContains(t *testing.T) {
+	tests := []struct {
+		name string
+		area Area
+		p    Point
+		want bool
+	}{
+		{"in radius", Area{Lat: jfk.Lat, Lon: jfk.Lon, RadiusKm: 20}, lga, true},
+		{"out of radius", Area{Lat: jfk.Lat, Lon: jfk.Lon, RadiusKm: 15}, lga, false},
+		{"center", Area{Lat: lax.Lat, Lon: lax.Lon, RadiusKm: 1}, lax, true},
+		{"in polygon", manhattan, jfk, true},
+		{"out of polygon", manhattan, lax, false},
+		{"in concave polygon", notch, jfk, true},
+		{"in notch", notch, lga, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.area.Contains(tt.p); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAirportsWithin(t *testing.T) {
+	db := testdb.Connect(t)
+	within, err := AirportsWithin(context.Background(), db, []Area{
+		{Lat: jfk.Lat, Lon: jfk.Lon, RadiusKm: 20},
+		{Lat: lax.Lat, Lon: lax.Lon, RadiusKm: 5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var codes []string
+	for _, a := range within {
+		codes = append(codes, a.Code)
+	}
+	for _, code := range []string{"JFK", "LGA", "LAX"} {
+		if !slices.Contains(codes, code) {
+			t.Errorf("%s is not within, got %v", code, codes)
+		}
+	}
+	if slices.Contains(codes, "EWR") || slices.Contains(codes, "LHR") {
+		t.Errorf("got airports outside the areas: %v", codes)
+	}
+	if len(codes) != len(slices.Compact(slices.Sorted(slices.Values(codes)))) {
+		t.Errorf("got an airport twice: %v", codes)
+	}
+}
+
+// Go and SQL must agree on what is inside an area, or previews and resolved
+// subscriptions differ.
+func TestGeoMatchesSQL(t *testing.T) {
+	db := testdb.Connect(t)
+	ctx := context.Background()
+	points := []Point{jfk, lga, lax, lhr, {}, {Lat: -33.9461, Lon: 151.1772}}
+	for _, a := range points {
+		for _, b := range points {
+			var km float64
+			if err := db.QueryRow(ctx, `SELECT great_circle_km($1, $2, $3, $4)`, a.Lat, a.Lon, b.Lat, b.Lon).Scan(&km); err != nil {
+				t.Fatal(err)
+			}
+			if got := GreatCircleKm(a, b); math.Abs(got-km) > 1e-6 {
+				t.Errorf("%v-%v: Go %v km, SQL %v km", a, b, got, km)
+			}
+		}
+	}
+	areas := []Area{
+		{Lat: jfk.Lat, Lon: jfk.Lon, RadiusKm: 20},
+		{Lat: jfk.Lat, Lon: jfk.Lon, RadiusKm: 15},
+		manhattan,
+		notch,
+	}
+	for i, area := range areas {
+		data, err := json.Marshal(area)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range points {
+			var inside bool
+			if err := db.QueryRow(ctx, `SELECT in_area($1, $2, $3::jsonb)`, p.Lat, p.Lon, string(data)).Scan(&inside); err != nil {
+				t.Fatal(err)
+			}
+			if got := area.Contains(p); got != inside {
+				t.Errorf("areas[%d] %v: Go %v, SQL %v", i, p, got, inside)
+			}
+		}
+	}
+}
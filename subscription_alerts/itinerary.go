@@ -0,0 +1,166 @@
+package subscription_alerts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrInvalidItinerary is returned for legs that do not connect.
+var ErrInvalidItinerary = errors.New("invalid itinerary")
+
+// Leg is a flight of an itinerary as a traveller names it: its flight number
+// and, optionally, the day it departs.
+type Leg struct {
+	FlightNumber string
+	DepartsOn    time.Time // zero: its first flight after the previous leg arrives
+}
+
+// ItineraryLeg is a leg resolved to its flight. A leg followed by another is
+// a connection, the target of connection_at_risk alerts.
+type ItineraryLeg struct {
+	ID            int // itinerary_legs.id, the target id of its connection
+	Position      int
+	FlightID      int
+	FlightNumber  string
+	DepartureTime time.Time
+	ArrivalTime   time.Time
+}
+
+// Itinerary is a traveller following connecting flights: a subscription
+// pinned to the itinerary (subscriptions.itinerary_id) that resolves to
+// every leg's flight and airports plus the connections between the legs,
+// deleted ExpiresAfter the last leg's arrival like a FlightSubscription.
+type Itinerary struct {
+	ID                 int // itineraries.id
+	SubscriptionID     int
+	UserSubscriptionID int
+	UserID             int
+	Legs               []ItineraryLeg
+	ExpiresAfter       time.Duration
+}
+
+// ExpiresAt is when the subscription is deleted, moving with the last arrival.
+func (it Itinerary) ExpiresAt() time.Time {
+	if len(it.Legs) == 0 {
+		return time.Time{}
+	}
+	return it.Legs[len(it.Legs)-1].ArrivalTime.Add(it.ExpiresAfter)
+}
+
+// SubscribeToItinerary subscribes a user to connecting flights. Every leg
+// must depart from the airport the previous one arrives at, after it
+// arrives. expiresAfter <= 0 means DefaultFlightExpiry.
+func SubscribeToItinerary(ctx context.Context, db *pgxpool.Pool, userID int, legs []Leg,
+	expiresAfter time.Duration) (Itinerary, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return Itinerary{UserID: userID}, err
+	}
+	defer tx.Rollback(ctx)
+	it, err := subscribeToItinerary(ctx, tx, userID, legs, expiresAfter)
+	if err != nil {
+		return it, err
+	}
+	return it, tx.Commit(ctx)
+}
+
+// subscribeToItinerary is SubscribeToItinerary in tx, which the caller commits.
+func subscribeToItinerary(ctx context.Context, tx pgx.Tx, userID int, legs []Leg,
+	expiresAfter time.Duration) (Itinerary, error) {
+	if expiresAfter <= 0 {
+		expiresAfter = DefaultFlightExpiry
+	}
+	it := Itinerary{UserID: userID, ExpiresAfter: expiresAfter}
+	if len(legs) < 2 {
+		return it, fmt.Errorf("%w: it needs at least 2 legs", ErrInvalidItinerary)
+	}
+	var flights []flight
+	for i, leg := range legs {
+		number := strings.TrimSpace(leg.FlightNumber)
+		if number == "" {
+			return it, fmt.Errorf("%w: legs[%d]: flight number is required", ErrInvalidItinerary, i)
+		}
+		var notBefore time.Time
+		if i > 0 {
+			notBefore = flights[i-1].arrivalTime
+		}
+		f, err := findFlight(ctx, tx, number, leg.DepartsOn, notBefore)
+		if err != nil {
+			return it, fmt.Errorf("legs[%d]: %w", i, err)
+		}
+		if i > 0 {
+			prev := flights[i-1]
+			if f.sourceAirportID != prev.destinationAirportID {
+				return it, fmt.Errorf("%w: legs[%d]: %s does not depart where %s arrives",
+					ErrInvalidItinerary, i, f.number, prev.number)
+			}
+			if !f.departureTime.After(prev.arrivalTime) {
+				return it, fmt.Errorf("%w: legs[%d]: %s departs before %s arrives",
+					ErrInvalidItinerary, i, f.number, prev.number)
+			}
+		}
+		flights = append(flights, f)
+	}
+
+	if err := tx.QueryRow(ctx, `INSERT INTO itineraries DEFAULT VALUES RETURNING id`).Scan(&it.ID); err != nil {
+		return it, fmt.Errorf("failed to create itinerary: %w", err)
+	}
+	numbers := make([]string, len(flights))
+	for i, f := range flights {
+		leg := ItineraryLeg{Position: i + 1, FlightID: f.id, FlightNumber: f.number,
+			DepartureTime: f.departureTime, ArrivalTime: f.arrivalTime}
+		err := tx.QueryRow(ctx, `
+			INSERT INTO itinerary_legs (itinerary_id, position, flight_id) VALUES ($1, $2, $3)
+			RETURNING id`, it.ID, leg.Position, leg.FlightID).Scan(&leg.ID)
+		if err != nil {
+			return it, fmt.Errorf("failed to add leg %d: %w", leg.Position, err)
+		}
+		it.Legs = append(it.Legs, leg)
+		numbers[i] = f.number
+	}
+	name := fmt.Sprintf("%s %s", strings.Join(numbers, "/"), flights[0].departureTime.UTC().Format(time.DateOnly))
+	var err error
+	it.SubscriptionID, it.UserSubscriptionID, err = subscribeTraveller(ctx, tx, userID, name, insertItinerarySubscription, it.ID, expiresAfter)
+	return it, err
+}
+
+// Itineraries returns the itineraries of a user by first departure.
+func Itineraries(ctx context.Context, db *pgxpool.Pool, userID int) ([]Itinerary, error) {
+	rows, err := db.Query(ctx, `
+		SELECT s.itinerary_id, s.id, us.id, us.user_id, EXTRACT(EPOCH FROM s.expires_after)::float8,
+		       l.id, l.position, f.id, f.flight_number, f.departure_time, f.arrival_time
+		FROM subscriptions s
+		         JOIN user_subscriptions us ON us.subscription_id = s.id
+		         JOIN itinerary_legs l ON l.itinerary_id = s.itinerary_id
+		         JOIN flights f ON f.id = l.flight_id
+		WHERE us.user_id = $1
+		ORDER BY min(f.departure_time) OVER (PARTITION BY s.id), s.id, l.position`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load itineraries: %w", err)
+	}
+	defer rows.Close()
+	var itineraries []Itinerary
+	for rows.Next() {
+		var it Itinerary
+		var leg ItineraryLeg
+		var secs float64
+		if err := rows.Scan(&it.ID, &it.SubscriptionID, &it.UserSubscriptionID, &it.UserID, &secs,
+			&leg.ID, &leg.Position, &leg.FlightID, &leg.FlightNumber, &leg.DepartureTime, &leg.ArrivalTime); err != nil {
+			return nil, err
+		}
+		if n := len(itineraries); n > 0 && itineraries[n-1].SubscriptionID == it.SubscriptionID {
+			itineraries[n-1].Legs = append(itineraries[n-1].Legs, leg)
+			continue
+		}
+		it.ExpiresAfter = time.Duration(secs * float64(time.Second))
+		it.Legs = []ItineraryLeg{leg}
+		itineraries = append(itineraries, it)
+	}
+	return itineraries, rows.Err()
+}
@@ -0,0 +1,235 @@
+package subscription_alerts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/okharch/yal/testdb"
+)
+
+// itineraryFlights adds a user and the flights of the itinerary tests:
+// ITT1 arrives in 3 hours where ITT2 departs 2 hours later, ITT3 departs
+// from another airport and ITT4 from the same one before ITT1 arrives.
+func itineraryFlights(ctx context.Context, t *testing.T, tx pgx.Tx) (userID int, departures map[string]time.Time) {
+	t.Helper()
+	var inbound, outbound, elsewhere int
+	err := tx.QueryRow(ctx, `
+		SELECT r1.id, r2.id,
+		       (SELECT r3.id FROM routes r3 JOIN airlines al3 ON al3.id = r3.airline_id
+		        WHERE r3.source_airport_id <> r1.destination_airport_id ORDER BY r3.id LIMIT 1)
+		FROM routes r1
+		JOIN routes r2 ON r2.source_airport_id = r1.destination_airport_id
+		JOIN airlines al1 ON al1.id = r1.airline_id
+		JOIN airlines al2 ON al2.id = r2.airline_id
+		WHERE r1.source_airport_id <> r1.destination_airport_id AND r2.destination_airport_id <> r2.source_airport_id
+		ORDER BY r1.id, r2.id LIMIT 1`).Scan(&inbound, &outbound, &elsewhere)
+	if err != nil {
+		t.Fatalf("no connecting routes: %v", err)
+	}
+	if err := tx.QueryRow(ctx, `INSERT INTO users (name) VALUES ('itinerary test') RETURNING id`).Scan(&userID); err != nil {
+		t.Fatal(err)
+	}
+	departures = map[string]time.Time{}
+	for _, f := range []struct {
+		number          string
+		routeID         int
+		departs, arrive string
+	}{
+		{"ITT1", inbound, "1 hour", "3 hours"},
+		{"ITT2", outbound, "5 hours", "7 hours"},
+		{"ITT3", elsewhere, "5 hours", "7 hours"},
+		{"ITT4", outbound, "2 hours", "4 hours"},
+	} {
+		var departure time.Time
+		err := tx.QueryRow(ctx, `
+			INSERT INTO flights (route_id, airline_id, flight_number, source_airport_id, destination_airport_id,
+			                     departure_time, arrival_time, status)
+			SELECT r.id, r.airline_id, $1, r.source_airport_id, r.destination_airport_id,
+			       now() + $3::interval, now() + $4::interval, 'scheduled'
+			FROM routes r WHERE r.id = $2
+			RETURNING departure_time`, f.number, f.routeID, f.departs, f.arrive).Scan(&departure)
+		if err != nil {
+			t.Fatal(err)
+		}
+		departures[f.number] = departure
+	}
+	return userID, departures
+}
+
+func TestSubscribeToItinerary(t *testing.T) {
+	db := testdb.Connect(t)
+	testdb.Tx(t, db, func(ctx context.Context, tx pgx.Tx) {
+		userID, departures := itineraryFlights(ctx, t, tx)
+		tests := []struct {
+			name    string
+			legs    []Leg
+			wantErr error
+		}{
+			{"one leg", []Leg{{FlightNumber: "ITT1"}}, ErrInvalidItinerary},
+			{"wrong transfer airport", []Leg{{FlightNumber: "ITT1"}, {FlightNumber: "ITT3"}}, ErrInvalidItinerary},
+			{"departs before arrival", []Leg{{FlightNumber: "ITT1"}, {FlightNumber: "ITT4", DepartsOn: departures["ITT4"]}}, ErrInvalidItinerary},
+			{"unknown flight", []Leg{{FlightNumber: "ITT1"}, {FlightNumber: "ITT0"}}, ErrNoFlight},
+			{"connecting", []Leg{{FlightNumber: "ITT1"}, {FlightNumber: "ITT2"}}, nil},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				it, err := subscribeToItinerary(ctx, tx, userID, tt.legs, 0)
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				if err != nil {
+					return
+				}
+				if len(it.Legs) != 2 || it.Legs[0].FlightNumber != "ITT1" || it.Legs[1].FlightNumber != "ITT2" {
+					t.Fatalf("got legs %+v, want ITT1 and ITT2", it.Legs)
+				}
+				var tracked bool
+				err = tx.QueryRow(ctx, `
+					SELECT EXISTS (SELECT 1 FROM subscription_targets
+					               WHERE subscription_id = $1 AND target_id = $2 AND target_type = 'connection')`,
+					it.SubscriptionID, it.Legs[0].ID).Scan(&tracked)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !tracked {
+					t.Error("the connection of the itinerary is not a target of its subscription")
+				}
+			})
+		}
+	})
+}
+
+// The estimated delay of the inbound leg: the status of the flight, the
+// delays measured at its airports, and none once it arrived.
+func TestConnectionRisks(t *testing.T) {
+	db := testdb.Connect(t)
+	testdb.Tx(t, db, func(ctx context.Context, tx pgx.Tx) {
+		userID, _ := itineraryFlights(ctx, t, tx)
+		it, err := subscribeToItinerary(ctx, tx, userID, []Leg{{FlightNumber: "ITT1"}, {FlightNumber: "ITT2"}}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inbound := it.Legs[0]
+		measure := func(template, targetType string, value float64) {
+			t.Helper()
+			_, err := tx.Exec(ctx, `
+				INSERT INTO alerts_staging (condition_id, target_id, is_on, payload, received_at, value)
+				SELECT c.id, CASE $2::target_type WHEN 'source_airport' THEN f.source_airport_id
+				                                  ELSE f.destination_airport_id END,
+				       threshold_crossed(ct.direction, $3, c.threshold), '{}', clock_timestamp(), $3
+				FROM conditions c
+				JOIN condition_templates ct ON ct.id = c.template_id AND ct.name = $1 AND ct.target_type = $2::target_type
+				JOIN flights f ON f.id = $4
+				WHERE c.kind = 'threshold'`, template, targetType, value, inbound.FlightID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tx.Exec(ctx, `CALL process_alert_staging()`); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tests := []struct {
+			name                     string
+			status                   string
+			departureDelay, arrDelay float64
+			wantDelay                float64
+		}{
+			{"on time", "scheduled", 0, 0, 0},
+			{"departure delay measured", "scheduled", 40, 0, 40},
+			{"delayed", "delayed", 0, 0, 30},
+			{"arrival delay measured", "departed", 40, 100, 100},
+			{"inbound arrived", "arrived", 0, 100, 0},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if _, err := tx.Exec(ctx, `UPDATE flights SET status = $2 WHERE id = $1`, inbound.FlightID, tt.status); err != nil {
+					t.Fatal(err)
+				}
+				measure("departure_delay", "source_airport", tt.departureDelay)
+				measure("arrival_delay", "destination_airport", tt.arrDelay)
+
+				var isOn bool
+				var value float64
+				var payload string
+				err := tx.QueryRow(ctx, `SELECT is_on, value, payload FROM connection_risks() WHERE connection_id = $1`,
+					inbound.ID).Scan(&isOn, &value, &payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var risk struct {
+					EstimatedDelay float64 `json:"estimated_delay_minutes"`
+					Connection     float64 `json:"connection_minutes"`
+					Minimum        float64 `json:"minimum_connection_minutes"`
+				}
+				if err := json.Unmarshal([]byte(payload), &risk); err != nil {
+					t.Fatal(err)
+				}
+				if risk.EstimatedDelay != tt.wantDelay {
+					t.Errorf("estimated delay %v minutes, want %v", risk.EstimatedDelay, tt.wantDelay)
+				}
+				if math.Abs(risk.Connection-(120-tt.wantDelay)) > 0.01 {
+					t.Errorf("connection %v minutes, want %v", risk.Connection, 120-tt.wantDelay)
+				}
+				if math.Abs(value-(risk.Minimum-risk.Connection)) > 0.01 || isOn != (value > 0) {
+					t.Errorf("got risk %v on %v with %v of %v minutes", value, isOn, risk.Connection, risk.Minimum)
+				}
+			})
+		}
+	})
+}
+
+// An itinerary whose last leg arrived longer than expires_after ago is
+// deleted with its legs, subscription and targets.
+func TestExpireItinerary(t *testing.T) {
+	db := testdb.Connect(t)
+	testdb.Tx(t, db, func(ctx context.Context, tx pgx.Tx) {
+		userID, _ := itineraryFlights(ctx, t, tx)
+		it, err := subscribeToItinerary(ctx, tx, userID, []Leg{{FlightNumber: "ITT1"}, {FlightNumber: "ITT2"}}, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expired int
+		if err := tx.QueryRow(ctx, `SELECT expire_flight_subscriptions()`).Scan(&expired); err != nil {
+			t.Fatal(err)
+		}
+		var left bool
+		if err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM itineraries WHERE id = $1)`, it.ID).Scan(&left); err != nil {
+			t.Fatal(err)
+		}
+		if !left {
+			t.Fatal("itinerary that has not arrived expired")
+		}
+
+		if _, err := tx.Exec(ctx, `
+			UPDATE flights SET departure_time = departure_time - interval '10 hours',
+			                   arrival_time = arrival_time - interval '10 hours', status = 'arrived'
+			WHERE flight_number IN ('ITT1', 'ITT2')`); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.QueryRow(ctx, `SELECT expire_flight_subscriptions()`).Scan(&expired); err != nil {
+			t.Fatal(err)
+		}
+		if expired < 1 {
+			t.Errorf("expired %d subscriptions, want the itinerary's", expired)
+		}
+		var itineraries, legs, subscriptions, targets int
+		err = tx.QueryRow(ctx, `
+			SELECT (SELECT count(*) FROM itineraries WHERE id = $1),
+			       (SELECT count(*) FROM itinerary_legs WHERE itinerary_id = $1),
+			       (SELECT count(*) FROM subscriptions WHERE id = $2),
+			       (SELECT count(*) FROM subscription_targets WHERE subscription_id = $2)`,
+			it.ID, it.SubscriptionID).Scan(&itineraries, &legs, &subscriptions, &targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if itineraries+legs+subscriptions+targets > 0 {
+			t.Errorf("left %d itineraries, %d legs, %d subscriptions and %d targets", itineraries, legs, subscriptions, targets)
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package subscription_alerts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrUnknownPack is returned by EnablePacks for a pack that does not exist.
+var ErrUnknownPack = errors.New("unknown condition pack")
+
+// Pack is a named group of conditions, e.g. "weather", a user subscription
+// can turn on in bulk, see condition_packs.
+type Pack struct {
+	ID           int
+	Name         string
+	Description  string
+	ConditionIDs []int
+}
+
+// Packs returns every condition pack by name.
+func Packs(ctx context.Context, db *pgxpool.Pool) ([]Pack, error) {
+	rows, err := db.Query(ctx, `
+		SELECT p.id, p.name, p.description,
+		       COALESCE(array_agg(m.condition_id ORDER BY m.condition_id)
+		                FILTER (WHERE m.condition_id IS NOT NULL), '{}')
+		FROM condition_packs p
+		         LEFT JOIN condition_pack_members m ON m.pack_id = p.id
+		GROUP BY p.id
+		ORDER BY p.name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list condition packs: %w", err)
+	}
+	defer rows.Close()
+	var packs []Pack
+	for rows.Next() {
+		var p Pack
+		if err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.ConditionIDs); err != nil {
+			return nil, err
+		}
+		packs = append(packs, p)
+	}
+	return packs, rows.Err()
+}
+
+// Preferences narrow down the alerts a user subscription is delivered on top
+// of its conditions: those of conditions under MinSeverity are left out.
+type Preferences struct {
+	MinSeverity int
+}
+
+// LoadPreferences returns the preferences of a user subscription, or
+// pgx.ErrNoRows when it does not exist.
+func LoadPreferences(ctx context.Context, db *pgxpool.Pool, userSubscriptionID int) (Preferences, error) {
+	var p Preferences
+	err := db.QueryRow(ctx, `SELECT min_severity FROM user_subscriptions WHERE id = $1`, userSubscriptionID).
+		Scan(&p.MinSeverity)
+	if err != nil {
+		return Preferences{}, fmt.Errorf("failed to load preferences of user subscription %d: %w",
+			userSubscriptionID, err)
+	}
+	return p, nil
+}
+
+// SetMinSeverity leaves out the alerts of conditions with a lower severity;
+// 0 delivers them all. A change pushes the user subscription a snapshot,
+// see trg_snapshot_min_severity.
+func SetMinSeverity(ctx context.Context, db *pgxpool.Pool, userSubscriptionID, minSeverity int) error {
+	if minSeverity < 0 {
+		return errors.New("min severity must not be negative")
+	}
+	tag, err := db.Exec(ctx, `UPDATE user_subscriptions SET min_severity = $2 WHERE id = $1`,
+		userSubscriptionID, minSeverity)
+	if err != nil {
+		return fmt.Errorf("failed to set min severity: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// EnablePacks turns on every condition of the packs for a user
+// subscription, leaving its other conditions as they are. Every condition
+// turned on pushes its alerts, see trg_notify_subscription_condition_change;
+// one the user subscription did not have yet pushes a snapshot.
+func EnablePacks(ctx context.Context, db *pgxpool.Pool, userSubscriptionID int, names []string) error {
+	if names == nil {
+		names = []string{}
+	}
+	var unknown []string
+	err := db.QueryRow(ctx, `
+		SELECT COALESCE(array_agg(n.name), '{}') FROM unnest($1::text[]) n(name)
+		WHERE NOT EXISTS (SELECT 1 FROM condition_packs p WHERE p.name = n.name)`, names).Scan(&unknown)
+	if err != nil {
+		return fmt.Errorf("failed to check condition packs: %w", err)
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("%w: %v", ErrUnknownPack, unknown)
+	}
+	// only the conditions that are off, so the triggers fire for a change
+	_, err = db.Exec(ctx, `
+		INSERT INTO user_subscription_conditions AS usc (user_subscription_id, condition_id, is_on, last_changed_at)
+		SELECT DISTINCT $1::int, m.condition_id, true, now()
+		FROM condition_pack_members m JOIN condition_packs p ON p.id = m.pack_id
+		WHERE p.name = ANY($2)
+		ON CONFLICT (user_subscription_id, condition_id) DO UPDATE
+		SET is_on = true, last_changed_at = EXCLUDED.last_changed_at
+		WHERE NOT usc.is_on`, userSubscriptionID, names)
+	if err != nil {
+		return fmt.Errorf("failed to enable condition packs: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package subscription_alerts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/okharch/yal/model"
+	"gopkg.in/yaml.v3"
+)
+
+// Spec is a declarative subscription: the flights it follows and the target
+// types it raises alerts on, stored as subscriptions.spec and resolved by
+// subscription_spec_targets. Filters are ANDed, the values of one filter ORed.
+type Spec struct {
+	Airports            []string `json:"airports,omitempty" yaml:"airports,omitempty"` // IATA or ICAO, either end
+	SourceAirports      []string `json:"source_airports,omitempty" yaml:"source_airports,omitempty"`
+	DestinationAirports []string `json:"destination_airports,omitempty" yaml:"destination_airports,omitempty"`
+	Airlines            []string `json:"airlines,omitempty" yaml:"airlines,omitempty"`   // IATA or ICAO
+	Countries           []string `json:"countries,omitempty" yaml:"countries,omitempty"` // of either airport
+	Routes              []string `json:"routes,omitempty" yaml:"routes,omitempty"`       // e.g. "JFK-LAX"
+	FlightNumbers       []string `json:"flight_numbers,omitempty" yaml:"flight_numbers,omitempty"`
+	Statuses            []string `json:"statuses,omitempty" yaml:"statuses,omitempty"` // flight_status, default the active ones
+	Areas               []Area   `json:"areas,omitempty" yaml:"areas,omitempty"`       // geo-fences, a flight matches any of them
+	Targets             []string `json:"targets,omitempty" yaml:"targets,omitempty"`   // target_type, see DefaultTargets
+}
+
+// ErrInvalidSpec is returned by Create for a spec that does not validate.
+var ErrInvalidSpec = errors.New("invalid spec")
+
+// DefaultTargets are the target types of a spec that lists none.
+var DefaultTargets = []string{"flight", "source_airport", "destination_airport"}
+
+// flightStatuses are the values of flight_status.
+var flightStatuses = []string{"scheduled", "departed", "arrived", "cancelled", "delayed"}
+
+// flightColumns are the columns of subscription_spec_flights; a target type
+// can only be resolved from a spec if its view_column is one of them.
+var flightColumns = []string{"flight_id", "source_airport_id", "destination_airport_id", "airline_id",
+	"route_id", "aircraft_id", "plane_id"}
+
+// Parse reads a spec from YAML or JSON (which is valid YAML), rejecting
+// unknown keys so a typo does not silently widen the subscription.
+func Parse(data []byte) (*Spec, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var s Spec
+	if err := dec.Decode(&s); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("empty subscription spec")
+		}
+		return nil, fmt.Errorf("invalid subscription spec: %w", err)
+	}
+	if err := s.Check(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Check validates the spec without the database: at least one flight
+// filter, no blank values, well-formed routes and areas and known statuses.
+func (s *Spec) Check() error {
+	filters := map[string][]string{
+		"airports":             s.Airports,
+		"source_airports":      s.SourceAirports,
+		"destination_airports": s.DestinationAirports,
+		"airlines":             s.Airlines,
+		"countries":            s.Countries,
+		"routes":               s.Routes,
+		"flight_numbers":       s.FlightNumbers,
+	}
+	empty := len(s.Areas) == 0
+	for key, values := range filters {
+		if len(values) > 0 {
+			empty = false
+		}
+		for _, v := range values {
+			if strings.TrimSpace(v) == "" {
+				return fmt.Errorf("%s: blank value", key)
+			}
+		}
+	}
+	if empty {
+		return errors.New("subscription spec selects every flight, add at least one filter")
+	}
+	for _, r := range s.Routes {
+		src, dst, ok := strings.Cut(r, "-")
+		if !ok || len(src) != 3 || len(dst) != 3 {
+			return fmt.Errorf("routes: %q is not an IATA pair like JFK-LAX", r)
+		}
+	}
+	for i, area := range s.Areas {
+		if err := area.Check(); err != nil {
+			return fmt.Errorf("areas[%d]: %w", i, err)
+		}
+	}
+	for _, st := range s.Statuses {
+		if !slices.Contains(flightStatuses, st) {
+			return fmt.Errorf("statuses: unknown flight status %q", st)
+		}
+	}
+	return nil
+}
+
+// Validate checks the spec against the database: every airport and airline
+// code exists, every area has an airport and every target type is registered
+// and derivable from flights.
+func (s *Spec) Validate(ctx context.Context, db *pgxpool.Pool) error {
+	if err := s.Check(); err != nil {
+		return err
+	}
+	airports := slices.Concat(s.Airports, s.SourceAirports, s.DestinationAirports)
+	if err := checkCodes(ctx, db, "airports", airports); err != nil {
+		return err
+	}
+	if err := checkCodes(ctx, db, "airlines", s.Airlines); err != nil {
+		return err
+	}
+	for _, country := range s.Countries {
+		var found bool
+		if err := db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM airports WHERE country = $1)`, country).Scan(&found); err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("countries: no airport in %q", country)
+		}
+	}
+	if len(s.Areas) > 0 {
+		found := make([]bool, len(s.Areas))
+		err := scanAirports(ctx, db, func(a Airport) {
+			for i, area := range s.Areas {
+				found[i] = found[i] || area.Contains(a.Point)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		for i, ok := range found {
+			if !ok {
+				return fmt.Errorf("areas[%d]: no airport inside", i)
+			}
+		}
+	}
+	for _, name := range s.targets() {
+		var viewColumn string
+		err := db.QueryRow(ctx, `SELECT view_column FROM target_types WHERE name = $1`, name).Scan(&viewColumn)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("targets: unknown target type %q", name)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to check target type %q: %w", name, err)
+		}
+		if !slices.Contains(flightColumns, viewColumn) {
+			return fmt.Errorf("targets: %s can not be derived from flights", name)
+		}
+	}
+	return nil
+}
+
+// checkCodes reports the codes that are neither an IATA nor an ICAO code of
+// a row of table.
+func checkCodes(ctx context.Context, db *pgxpool.Pool, table string, codes []string) error {
+	if len(codes) == 0 {
+		return nil
+	}
+	var missing []string
+	err := db.QueryRow(ctx, fmt.Sprintf(`
+		SELECT COALESCE(array_agg(c), '{}')
+		FROM unnest($1::text[]) c
+		WHERE NOT EXISTS (SELECT 1 FROM %s t WHERE t.iata = c OR t.icao = c)`, table), codes).Scan(&missing)
+	if err != nil {
+		return fmt.Errorf("failed to check %s: %w", table, err)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s: unknown codes %s", table, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (s *Spec) targets() []string {
+	if len(s.Targets) == 0 {
+		return DefaultTargets
+	}
+	return s.Targets
+}
+
+// Resolve resolves the spec to its current targets, see subscription_spec_targets.
+func (s *Spec) Resolve(ctx context.Context, db *pgxpool.Pool) ([]model.Target, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(ctx, `SELECT target_id, target_type FROM subscription_spec_targets($1::jsonb)`, string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve subscription spec: %w", err)
+	}
+	defer rows.Close()
+	var targets []model.Target
+	for rows.Next() {
+		var t model.Target
+		if err := rows.Scan(&t.ID, &t.Type); err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, rows.Err()
+}
+
+// Save validates the spec and stores it as subscription id, replacing the
+// legacy view of an existing subscription, and resolves its targets right
+// away, see sync_subscription_targets.
+func Save(ctx context.Context, db *pgxpool.Pool, id int, name string, s *Spec) error {
+	if err := s.Validate(ctx, db); err != nil {
+		return err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, `
+		INSERT INTO subscriptions (id, name, spec) VALUES ($1, $2, $3::jsonb)
+		ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, spec = EXCLUDED.spec, view_name = NULL`,
+		id, name, string(data))
+	if err != nil {
+		return fmt.Errorf("failed to save subscription %d: %w", id, err)
+	}
+	// keep the ids Create picks above the ones given here
+	_, err = tx.Exec(ctx, `
+		SELECT setval(pg_get_serial_sequence('subscriptions', 'id'), $1)
+		WHERE $1 >= (SELECT last_value FROM subscriptions_id_seq)`, id)
+	if err != nil {
+		return fmt.Errorf("failed to advance subscription ids past %d: %w", id, err)
+	}
+	if err := syncTargets(ctx, tx, id); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Create validates the spec and stores it as a new subscription, resolving
+// its targets right away like Save.
+func Create(ctx context.Context, db *pgxpool.Pool, name string, s *Spec) (int, error) {
+	if err := s.Validate(ctx, db); err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrInvalidSpec, err)
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+	var id int
+	err = tx.QueryRow(ctx, `
+		INSERT INTO subscriptions (name, spec) VALUES ($1, $2::jsonb)
+		RETURNING id`, name, string(data)).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create subscription: %w", err)
+	}
+	if err := syncTargets(ctx, tx, id); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit(ctx)
+}
+
+func syncTargets(ctx context.Context, tx pgx.Tx, id int) error {
+	if _, err := tx.Exec(ctx, `CALL sync_subscription_targets($1)`, id); err != nil {
+		return fmt.Errorf("failed to resolve targets of subscription %d: %w", id, err)
+	}
+	return nil
+}
+
+// Load returns the spec of subscription id, nil for a legacy view or flight
+// subscription.
+func Load(ctx context.Context, db *pgxpool.Pool, id int) (*Spec, error) {
+	var data []byte
+	if err := db.QueryRow(ctx, `SELECT spec FROM subscriptions WHERE id = $1`, id).Scan(&data); err != nil {
+		return nil, fmt.Errorf("failed to load subscription %d: %w", id, err)
+	}
+	if data == nil {
+		return nil, nil
+	}
+	var s Spec
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("subscription %d: %w", id, err)
+	}
+	return &s, nil
+}
@@ -0,0 +1,125 @@
+package subscription_alerts
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/okharch/yal/testdb"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		err  string
+	}{
+		{"yaml", "destination_airports: [JFK]\ntargets: [flight, airline]\n", ""},
+		{"json", `{"routes": ["JFK-LAX"], "statuses": ["delayed"]}`, ""},
+		{"area", `{"areas": [{"lat": 40.6, "lon": -73.8, "radius_km": 50, "end": "source"}]}`, ""},
+		{"empty", "", "empty subscription spec"},
+		{"unknown key", "destination_airport: [JFK]\n", "field destination_airport not found"},
+		{"no filter", "targets: [flight]\n", "selects every flight"},
+		{"blank value", `{"airlines": [" "]}`, "airlines: blank value"},
+		{"bad route", `{"routes": ["JFK:LAX"]}`, `"JFK:LAX" is not an IATA pair`},
+		{"unknown status", `{"flight_numbers": ["AA100"], "statuses": ["boarding"]}`, `unknown flight status "boarding"`},
+		{"bad area", `{"areas": [{"lat": 40.6, "lon": -73.8}]}`, "areas[0]: radius_km must be positive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.spec))
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("Parse: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// A failing query is reported as such, not as an unknown target type.
+func TestValidateQueryError(t *testing.T) {
+	db, err := pgxpool.New(context.Background(), "postgresql://postgres@127.0.0.1:1/postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s := &Spec{FlightNumbers: []string{"AA100"}}
+	err = s.Validate(ctx, db)
+	if err == nil || !strings.Contains(err.Error(), "failed to check target type") {
+		t.Errorf("got error %v, want the query error", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	db := testdb.Connect(t)
+	tests := []struct {
+		name string
+		spec Spec
+		err  string
+	}{
+		{"valid", Spec{DestinationAirports: []string{"JFK"}, Targets: []string{"flight", "airline"}}, ""},
+		{"unknown airport", Spec{Airports: []string{"JFK", "QQQ"}}, "airports: unknown codes QQQ"},
+		{"unknown country", Spec{Countries: []string{"Atlantis"}}, `countries: no airport in "Atlantis"`},
+		{"unknown target", Spec{FlightNumbers: []string{"AA100"}, Targets: []string{"gate"}}, `unknown target type "gate"`},
+		{"not from flights", Spec{FlightNumbers: []string{"AA100"}, Targets: []string{"connection"}}, "connection can not be derived from flights"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.spec.Validate(context.Background(), db)
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("Validate: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSpecFlightsRoutes(t *testing.T) {
+	db := testdb.Connect(t)
+	testdb.Tx(t, db, func(ctx context.Context, tx pgx.Tx) {
+		var flightID int
+		var src, dst string
+		err := tx.QueryRow(ctx, `
+			INSERT INTO flights (route_id, airline_id, flight_number, source_airport_id, destination_airport_id,
+			                     departure_time, arrival_time, status)
+			SELECT r.id, r.airline_id, 'TEST1', r.source_airport_id, r.destination_airport_id,
+			       now() + interval '1 hour', now() + interval '3 hours', 'scheduled'
+			FROM routes r
+			JOIN airports src ON src.id = r.source_airport_id AND src.iata <> ''
+			JOIN airports dst ON dst.id = r.destination_airport_id AND dst.iata <> ''
+			JOIN airlines al ON al.id = r.airline_id
+			WHERE src.id <> dst.id
+			ORDER BY r.id LIMIT 1
+			RETURNING id, (SELECT iata FROM airports WHERE id = source_airport_id),
+			          (SELECT iata FROM airports WHERE id = destination_airport_id)`).Scan(&flightID, &src, &dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for route, want := range map[string]bool{src + "-" + dst: true, dst + "-" + src: false} {
+			var found bool
+			err := tx.QueryRow(ctx, `
+				SELECT EXISTS (SELECT 1 FROM subscription_spec_flights(jsonb_build_object('routes', jsonb_build_array($1::text)))
+				               WHERE flight_id = $2)`, route, flightID).Scan(&found)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != want {
+				t.Errorf("route %s: got flight %v, want %v", route, found, want)
+			}
+		}
+	})
+}
@@ -0,0 +1,28 @@
+package target_alerts
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/okharch/yal/model"
+)
+
+// ViewTargets resolves a subscription view to its distinct targets the same
+// way recreate_subscription_targets does, see subscription_view_targets.
+func ViewTargets(ctx context.Context, db *pgxpool.Pool, viewName string) ([]model.Target, error) {
+	rows, err := db.Query(ctx, `SELECT target_id, target_type FROM subscription_view_targets($1)`, viewName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch targets of %s: %w", viewName, err)
+	}
+	defer rows.Close()
+	var targets []model.Target
+	for rows.Next() {
+		var t model.Target
+		if err := rows.Scan(&t.ID, &t.Type); err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, rows.Err()
+}
@@ -0,0 +1,52 @@
+// Package testdb connects tests and benchmarks to a local database built by
+// make rebuild. They are skipped unless YAL_TEST_DB is set, e.g.
+//
+//	YAL_TEST_DB=postgresql://postgres@localhost:5433/postgres?sslmode=disable go test ./...
+package testdb
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Env names the connection string of the test database.
+const Env = "YAL_TEST_DB"
+
+// ConnStr returns the connection string of the test database, skipping tb
+// when there is none.
+func ConnStr(tb testing.TB) string {
+	tb.Helper()
+	connStr := os.Getenv(Env)
+	if connStr == "" {
+		tb.Skipf("%s is not set", Env)
+	}
+	return connStr
+}
+
+// Connect opens a pool to the test database, closed when tb ends.
+func Connect(tb testing.TB) *pgxpool.Pool {
+	tb.Helper()
+	db, err := pgxpool.New(context.Background(), ConnStr(tb))
+	if err != nil {
+		tb.Fatalf("failed to connect to %s: %v", Env, err)
+	}
+	tb.Cleanup(db.Close)
+	return db
+}
+
+// Tx runs fn in a transaction that is rolled back, so tests leave the
+// database as they found it.
+func Tx(tb testing.TB, db *pgxpool.Pool, fn func(ctx context.Context, tx pgx.Tx)) {
+	tb.Helper()
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		tb.Fatalf("failed to begin: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	fn(ctx, tx)
+}
@@ -0,0 +1,94 @@
+package window_alerts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/okharch/yal/model"
+)
+
+// Window is a scheduled suppression of a target's alerts, e.g. planned
+// runway works, see suppression_windows. Airports match as source and
+// destination airport.
+type Window struct {
+	ID          int
+	Target      model.Target
+	ConditionID *int // nil suppresses every condition of the target
+	StartsAt    time.Time
+	EndsAt      time.Time
+	Reason      string
+}
+
+// Active reports whether the window is in force at t.
+func (w Window) Active(t time.Time) bool {
+	return !t.Before(w.StartsAt) && t.Before(w.EndsAt)
+}
+
+// Add schedules a window and returns its id. Running ingestion pipelines
+// apply it within seconds of StartsAt.
+func Add(ctx context.Context, db *pgxpool.Pool, w Window) (int, error) {
+	switch {
+	case w.Target.ID == 0 || w.Target.Type == "":
+		return 0, errors.New("window needs a target")
+	case !w.EndsAt.After(w.StartsAt):
+		return 0, errors.New("window must end after it starts")
+	case w.Reason == "":
+		return 0, errors.New("window needs a reason")
+	}
+	var id int
+	err := db.QueryRow(ctx, `
+		INSERT INTO suppression_windows (target_id, target_type, condition_id, starts_at, ends_at, reason)
+		VALUES ($1, $2::target_type, $3, $4, $5, $6)
+		RETURNING id`,
+		w.Target.ID, w.Target.Type, w.ConditionID, w.StartsAt, w.EndsAt, w.Reason).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to add suppression window: %w", err)
+	}
+	return id, nil
+}
+
+// List returns the windows that have not ended by now, or all of them.
+func List(ctx context.Context, db *pgxpool.Pool, all bool) ([]Window, error) {
+	rows, err := db.Query(ctx, `
+		SELECT id, target_id, target_type::text, condition_id, starts_at, ends_at, reason
+		FROM suppression_windows
+		WHERE $1 OR ends_at > now()
+		ORDER BY starts_at, id`, all)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list suppression windows: %w", err)
+	}
+	defer rows.Close()
+	var windows []Window
+	for rows.Next() {
+		var w Window
+		if err := rows.Scan(&w.ID, &w.Target.ID, &w.Target.Type, &w.ConditionID, &w.StartsAt, &w.EndsAt, &w.Reason); err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, rows.Err()
+}
+
+// End ends a window now, e.g. when works finish early; a window that has not
+// started yet is cancelled. Alerts still on are delivered when running
+// ingestion pipelines release them.
+func End(ctx context.Context, db *pgxpool.Pool, id int) error {
+	tag, err := db.Exec(ctx, `DELETE FROM suppression_windows WHERE id = $1 AND starts_at > now()`, id)
+	if err != nil {
+		return fmt.Errorf("failed to cancel suppression window: %w", err)
+	}
+	if tag.RowsAffected() > 0 {
+		return nil
+	}
+	tag, err = db.Exec(ctx, `UPDATE suppression_windows SET ends_at = now() WHERE id = $1 AND ends_at > now()`, id)
+	if err != nil {
+		return fmt.Errorf("failed to end suppression window: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("no suppression window %d in force or scheduled", id)
+	}
+	return nil
+}
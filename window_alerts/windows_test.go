@@ -0,0 +1,63 @@
+package window_alerts
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/okharch/yal/model"
+	"github.com/okharch/yal/testdb"
+)
+
+// End ends a window in force now, cancels a scheduled one and refuses one
+// that already ended. The windows are on an airport id past the last
+// airport, so a running pipeline suppresses nothing; they are deleted when
+// the test ends.
+func TestEnd(t *testing.T) {
+	db := testdb.Connect(t)
+	ctx := context.Background()
+	var target model.Target
+	if err := db.QueryRow(ctx, `SELECT max(id) + 1, 'destination_airport' FROM airports`).Scan(&target.ID, &target.Type); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := db.Exec(context.Background(), `DELETE FROM suppression_windows WHERE target_id = $1`, target.ID); err != nil {
+			t.Error(err)
+		}
+	})
+
+	now := time.Now()
+	tests := []struct {
+		name             string
+		starts, ends     time.Duration
+		wantErr, wantRow bool
+	}{
+		{"in force", -time.Hour, time.Hour, false, true},
+		{"scheduled", time.Hour, 2 * time.Hour, false, false},
+		{"ended", -2 * time.Hour, -time.Hour, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := Add(ctx, db, Window{Target: target, StartsAt: now.Add(tt.starts), EndsAt: now.Add(tt.ends), Reason: "test " + tt.name})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := End(ctx, db, id); (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			var endsAt *time.Time
+			if err := db.QueryRow(ctx, `SELECT (SELECT ends_at FROM suppression_windows WHERE id = $1)`, id).Scan(&endsAt); err != nil {
+				t.Fatal(err)
+			}
+			if (endsAt != nil) != tt.wantRow {
+				t.Fatalf("window kept %v, want %v", endsAt != nil, tt.wantRow)
+			}
+			if endsAt != nil && endsAt.After(time.Now()) {
+				t.Errorf("window ends at %s, want ended", endsAt)
+			}
+		})
+	}
+	if err := End(ctx, db, -1); err == nil {
+		t.Error("ending an unknown window succeeded")
+	}
+}